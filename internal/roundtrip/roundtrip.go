@@ -0,0 +1,208 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+// Package roundtrip helps test that SDK resources survive conversion to the node agent protobuf and back.
+// Fill generates random resources and Diff compares them the way the protobuf sees them: proto3 has no field
+// presence, so a nil pointer, slice or map is equal to a zero or empty one.
+package roundtrip
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const (
+	maxDepth   = 24
+	maxLength  = 3
+	nilPercent = 25
+	letters    = "abcdefghijklmnopqrstuvwxyz0123456789"
+)
+
+// Fill sets every exported field reachable from v, which must be a pointer, to a random value
+func Fill(v interface{}, r *rand.Rand) {
+	fill(reflect.ValueOf(v).Elem(), r, false, 0)
+}
+
+// FillSparse is like Fill but leaves some pointers nil, to exercise the nil handling of conversions
+func FillSparse(v interface{}, r *rand.Rand) {
+	fill(reflect.ValueOf(v).Elem(), r, true, 0)
+}
+
+func fill(v reflect.Value, r *rand.Rand, sparse bool, depth int) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if depth > maxDepth || (sparse && r.Intn(100) < nilPercent) {
+			return
+		}
+		p := reflect.New(v.Type().Elem())
+		fill(p.Elem(), r, sparse, depth+1)
+		v.Set(p)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if isSkipped(v.Type().Field(i)) {
+				continue
+			}
+			fill(v.Field(i), r, sparse, depth+1)
+		}
+	case reflect.Slice:
+		if depth > maxDepth {
+			return
+		}
+		n := 1 + r.Intn(maxLength)
+		s := reflect.MakeSlice(v.Type(), n, n)
+		for i := 0; i < n; i++ {
+			fill(s.Index(i), r, false, depth+1)
+		}
+		v.Set(s)
+	case reflect.Map:
+		if depth > maxDepth {
+			return
+		}
+		m := reflect.MakeMap(v.Type())
+		for i := 1 + r.Intn(maxLength); i > 0; i-- {
+			key, value := reflect.New(v.Type().Key()).Elem(), reflect.New(v.Type().Elem()).Elem()
+			fill(key, r, false, depth+1)
+			fill(value, r, false, depth+1)
+			if value.Kind() == reflect.Ptr && value.IsNil() {
+				// Conversions may not expect nil map values, e.g. tags
+				continue
+			}
+			m.SetMapIndex(key, value)
+		}
+		v.Set(m)
+	case reflect.String:
+		b := make([]byte, 1+r.Intn(8))
+		for i := range b {
+			b[i] = letters[r.Intn(len(letters))]
+		}
+		v.SetString(string(b))
+	case reflect.Bool:
+		v.SetBool(r.Intn(2) == 1)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(int64(r.Intn(100)))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(uint64(r.Intn(100)))
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(float64(r.Intn(10000)) / 100)
+	}
+}
+
+// Diff returns the paths at which got differs from want, or nil if they are equal
+func Diff(want, got interface{}) []string {
+	diffs := []string{}
+	diff("", reflect.ValueOf(want), reflect.ValueOf(got), &diffs)
+	if len(diffs) == 0 {
+		return nil
+	}
+	return diffs
+}
+
+func diff(path string, a, b reflect.Value, diffs *[]string) {
+	if isEmpty(a) && isEmpty(b) {
+		return
+	}
+	if !a.IsValid() || !b.IsValid() {
+		*diffs = append(*diffs, fmt.Sprintf("%s: want %s, got %s", path, describe(a), describe(b)))
+		return
+	}
+
+	switch a.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		diff(path, indirect(a), indirect(b), diffs)
+	case reflect.Struct:
+		if !hasExportedFields(a.Type()) {
+			if !reflect.DeepEqual(a.Interface(), b.Interface()) {
+				*diffs = append(*diffs, fmt.Sprintf("%s: want %v, got %v", path, a.Interface(), b.Interface()))
+			}
+			return
+		}
+		for i := 0; i < a.NumField(); i++ {
+			field := a.Type().Field(i)
+			if isSkipped(field) {
+				continue
+			}
+			diff(path+"."+field.Name, a.Field(i), b.Field(i), diffs)
+		}
+	case reflect.Slice:
+		if a.Len() != b.Len() {
+			*diffs = append(*diffs, fmt.Sprintf("%s: want %d elements, got %d", path, a.Len(), b.Len()))
+			return
+		}
+		for i := 0; i < a.Len(); i++ {
+			diff(fmt.Sprintf("%s[%d]", path, i), a.Index(i), b.Index(i), diffs)
+		}
+	case reflect.Map:
+		keys := map[string]reflect.Value{}
+		for _, key := range append(a.MapKeys(), b.MapKeys()...) {
+			keys[fmt.Sprint(key.Interface())] = key
+		}
+		names := make([]string, 0, len(keys))
+		for name := range keys {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			diff(fmt.Sprintf("%s[%s]", path, name), a.MapIndex(keys[name]), b.MapIndex(keys[name]), diffs)
+		}
+	default:
+		if !reflect.DeepEqual(a.Interface(), b.Interface()) {
+			*diffs = append(*diffs, fmt.Sprintf("%s: want %v, got %v", path, a.Interface(), b.Interface()))
+		}
+	}
+}
+
+// isEmpty reports whether v carries no information once converted to protobuf
+func isEmpty(v reflect.Value) bool {
+	if !v.IsValid() {
+		return true
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil() || isEmpty(v.Elem())
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	case reflect.Struct:
+		if !hasExportedFields(v.Type()) {
+			return v.IsZero()
+		}
+		for i := 0; i < v.NumField(); i++ {
+			if !isSkipped(v.Type().Field(i)) && !isEmpty(v.Field(i)) {
+				return false
+			}
+		}
+		return true
+	default:
+		return v.IsZero()
+	}
+}
+
+func indirect(v reflect.Value) reflect.Value {
+	if v.IsNil() {
+		return reflect.Zero(v.Type().Elem())
+	}
+	return v.Elem()
+}
+
+func describe(v reflect.Value) string {
+	if !v.IsValid() {
+		return "nothing"
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// isSkipped leaves out unexported fields and the bookkeeping fields of generated protobuf structs
+func isSkipped(field reflect.StructField) bool {
+	return field.PkgPath != "" || strings.HasPrefix(field.Name, "XXX_")
+}
+
+func hasExportedFields(t reflect.Type) bool {
+	for i := 0; i < t.NumField(); i++ {
+		if !isSkipped(t.Field(i)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+// Package redact hides credentials before SDK types are logged or dumped.
+//
+// A struct field is hidden when it is tagged `sensitive:"true"`:
+//
+//	AdminPassword *string `json:"adminPassword,omitempty" sensitive:"true"`
+//
+// Set strings are replaced by Redacted, maps keep their keys with every value replaced, and any other kind is cleared.
+// Unset fields stay unset, so a dump still shows which credentials were given.
+package redact
+
+import (
+	"reflect"
+
+	"github.com/microsoft/moc/pkg/marshal"
+)
+
+const (
+	// Redacted replaces the value of a sensitive field
+	Redacted = "REDACTED"
+	// tagName is the struct tag that marks a sensitive field
+	tagName = "sensitive"
+)
+
+// Value returns a deep copy of data with every sensitive field hidden. data itself is not changed.
+func Value(data interface{}) interface{} {
+	if data == nil {
+		return nil
+	}
+	return redact(reflect.ValueOf(data)).Interface()
+}
+
+// ToString is marshal.ToString for a copy of data with every sensitive field hidden
+func ToString(data interface{}) string {
+	return marshal.ToString(Value(data))
+}
+
+// ToJSON is marshal.ToJSON for a copy of data with every sensitive field hidden
+func ToJSON(data interface{}) (string, error) {
+	return marshal.ToJSON(Value(data))
+}
+
+func redact(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.New(v.Type().Elem())
+		out.Elem().Set(redact(v.Elem()))
+		return out
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.New(v.Type()).Elem()
+		out.Set(redact(v.Elem()))
+		return out
+	case reflect.Struct:
+		out := reflect.New(v.Type()).Elem()
+		out.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			if field.Tag.Get(tagName) == "true" {
+				out.Field(i).Set(hide(v.Field(i)))
+			} else {
+				out.Field(i).Set(redact(v.Field(i)))
+			}
+		}
+		return out
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			out.Index(i).Set(redact(v.Index(i)))
+		}
+		return out
+	case reflect.Array:
+		out := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.Len(); i++ {
+			out.Index(i).Set(redact(v.Index(i)))
+		}
+		return out
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			out.SetMapIndex(iter.Key(), redact(iter.Value()))
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+// hide returns the value a sensitive field is replaced with
+func hide(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.String:
+		if v.Len() == 0 {
+			return v
+		}
+		return reflect.ValueOf(Redacted).Convert(v.Type())
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		if v.Type().Elem().Kind() == reflect.String {
+			out := reflect.New(v.Type().Elem())
+			out.Elem().Set(hide(v.Elem()))
+			return out
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			out.SetMapIndex(iter.Key(), hide(iter.Value()))
+		}
+		return out
+	}
+	return reflect.Zero(v.Type())
+}
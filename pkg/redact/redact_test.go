@@ -0,0 +1,73 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package redact
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/microsoft/wssd-sdk-for-go/services/compute"
+	"github.com/microsoft/wssd-sdk-for-go/services/security"
+)
+
+func Test_Value(t *testing.T) {
+	vm := &compute.VirtualMachine{
+		Name: proto.String("vm1"),
+		VirtualMachineProperties: &compute.VirtualMachineProperties{
+			OsProfile: &compute.OSProfile{
+				AdminUsername: proto.String("admin"),
+				AdminPassword: proto.String("p@ssw0rd"),
+				// An unattend file holds the password too
+				CustomData: proto.String("<Password><Value>p@ssw0rd</Value><PlainText>true</PlainText></Password>"),
+			},
+		},
+	}
+
+	redacted := Value(vm).(*compute.VirtualMachine)
+	assert.Equal(t, Redacted, *redacted.OsProfile.AdminPassword)
+	assert.Equal(t, Redacted, *redacted.OsProfile.CustomData)
+	assert.Equal(t, "admin", *redacted.OsProfile.AdminUsername)
+	assert.Equal(t, "vm1", *redacted.Name)
+	// The original is not changed
+	assert.Equal(t, "p@ssw0rd", *vm.OsProfile.AdminPassword)
+
+	assert.NotContains(t, ToString([]compute.VirtualMachine{*vm}), "p@ssw0rd")
+	json, err := ToJSON(vm)
+	assert.Nil(t, err)
+	assert.NotContains(t, json, "p@ssw0rd")
+}
+
+func Test_ValueUnsetAndMaps(t *testing.T) {
+	request := compute.VirtualMachineRunCommandRequest{RunAsUser: proto.String("user")}
+	assert.Nil(t, Value(request).(compute.VirtualMachineRunCommandRequest).RunAsPassword)
+
+	keyvault := &security.KeyVaultProperties{SecretMap: map[string]*string{"a": proto.String("secret"), "b": nil}}
+	redacted := Value(keyvault).(*security.KeyVaultProperties)
+	assert.Equal(t, Redacted, *redacted.SecretMap["a"])
+	assert.Nil(t, redacted.SecretMap["b"])
+	assert.Equal(t, "secret", *keyvault.SecretMap["a"])
+
+	assert.Nil(t, Value(nil))
+}
+
+func Test_ValueIdentity(t *testing.T) {
+	identity := security.Identity{
+		Name:        proto.String("vm1-identity"),
+		Certificate: proto.String("MIIBcert"),
+		Token:       proto.String("eyJtoken"),
+	}
+	s := ToString(&identity)
+	assert.Contains(t, s, "vm1-identity")
+	assert.NotContains(t, s, "MIIBcert")
+	assert.NotContains(t, s, "eyJtoken")
+
+	redacted := Value(identity).(security.Identity)
+	assert.Equal(t, Redacted, *redacted.Certificate)
+	assert.Equal(t, Redacted, *redacted.Token)
+
+	request := Value(&security.CertificateRequest{OldCertificate: proto.String("MIIBold")}).(*security.CertificateRequest)
+	assert.Equal(t, Redacted, *request.OldCertificate)
+}
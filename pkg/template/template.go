@@ -0,0 +1,526 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+// Package template loads virtual machine, virtual network interface and virtual hard disk specs from YAML or JSON files.
+//
+// A template looks like:
+//
+//	parameters:
+//	  name:
+//	    type: string
+//	  cpu:
+//	    type: int
+//	    default: 2
+//	defaults:
+//	  VirtualMachine:
+//	    properties:
+//	      guestAgentProfile:
+//	        enabled: true
+//	resources:
+//	  - kind: VirtualMachine
+//	    spec:
+//	      name: ${name}
+//	      properties:
+//	        hardwareProfile:
+//	          vmSize: Custom
+//	          customsize:
+//	            cpucount: ${cpu}
+//
+// Specs use the JSON field names of the SDK types. A scalar that is exactly "${param}" takes the type of the parameter,
+// anywhere else "${param}" is replaced by its text; "$${" escapes a literal "${".
+// Defaults are merged into every resource of the kind, with the values of the resource taking precedence.
+package template
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/microsoft/moc/pkg/errors"
+	"gopkg.in/yaml.v3"
+
+	"github.com/microsoft/wssd-sdk-for-go/services/compute"
+	"github.com/microsoft/wssd-sdk-for-go/services/network"
+	"github.com/microsoft/wssd-sdk-for-go/services/storage"
+)
+
+// Resource kinds supported in templates
+const (
+	KindVirtualMachine          = "VirtualMachine"
+	KindVirtualNetworkInterface = "VirtualNetworkInterface"
+	KindVirtualHardDisk         = "VirtualHardDisk"
+)
+
+var kindTypes = map[string]reflect.Type{
+	KindVirtualMachine:          reflect.TypeOf(compute.VirtualMachine{}),
+	KindVirtualNetworkInterface: reflect.TypeOf(network.VirtualNetworkInterface{}),
+	KindVirtualHardDisk:         reflect.TypeOf(storage.VirtualHardDisk{}),
+}
+
+// Resources are the objects rendered from a template, in the order they appear in it
+type Resources struct {
+	VirtualMachines          []*compute.VirtualMachine
+	VirtualNetworkInterfaces []*network.VirtualNetworkInterface
+	VirtualHardDisks         []*storage.VirtualHardDisk
+}
+
+// LoadFile renders the template in path
+func LoadFile(path string, parameters map[string]interface{}) (*Resources, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Load(data, parameters)
+}
+
+// Load renders a YAML or JSON template with the given parameter values.
+// All problems found are returned together, each prefixed with its line in the template.
+func Load(data []byte, parameters map[string]interface{}) (*Resources, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, errors.Wrapf(errors.InvalidInput, "Unable to parse template: %v", err)
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 {
+		return nil, errors.Wrapf(errors.InvalidInput, "Template is empty")
+	}
+
+	l := &loader{}
+	resources := l.load(doc.Content[0], parameters)
+	if len(l.errs) > 0 {
+		return nil, errors.Wrapf(errors.InvalidInput, "Invalid template: %s", strings.Join(l.errs, "; "))
+	}
+	return resources, nil
+}
+
+type loader struct {
+	errs   []string
+	params map[string]interface{}
+}
+
+func (l *loader) errorf(node *yaml.Node, format string, args ...interface{}) {
+	l.errs = append(l.errs, fmt.Sprintf("line %d: %s", node.Line, fmt.Sprintf(format, args...)))
+}
+
+// mapping returns the key and value nodes of a mapping in order
+func mapping(node *yaml.Node) [][2]*yaml.Node {
+	pairs := [][2]*yaml.Node{}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		pairs = append(pairs, [2]*yaml.Node{node.Content[i], node.Content[i+1]})
+	}
+	return pairs
+}
+
+func (l *loader) load(root *yaml.Node, parameters map[string]interface{}) *Resources {
+	resources := &Resources{}
+	if root.Kind != yaml.MappingNode {
+		l.errorf(root, "template must be a mapping with parameters, defaults and resources")
+		return resources
+	}
+
+	var paramsNode, defaultsNode, resourcesNode *yaml.Node
+	for _, pair := range mapping(root) {
+		switch pair[0].Value {
+		case "parameters":
+			paramsNode = pair[1]
+		case "defaults":
+			defaultsNode = pair[1]
+		case "resources":
+			resourcesNode = pair[1]
+		default:
+			l.errorf(pair[0], "unknown section %q", pair[0].Value)
+		}
+	}
+
+	l.params = l.getParameters(paramsNode, parameters)
+	if len(l.errs) > 0 {
+		// References to missing parameters would only repeat the same problems
+		return resources
+	}
+
+	defaults := map[string]*yaml.Node{}
+	if defaultsNode != nil {
+		if defaultsNode.Kind != yaml.MappingNode {
+			l.errorf(defaultsNode, "defaults must be a mapping of kind to spec")
+		} else {
+			for _, pair := range mapping(defaultsNode) {
+				if _, found := kindTypes[pair[0].Value]; !found {
+					l.errorf(pair[0], "unknown kind %q", pair[0].Value)
+					continue
+				}
+				l.substitute(pair[1])
+				defaults[pair[0].Value] = pair[1]
+			}
+		}
+	}
+
+	if resourcesNode == nil {
+		l.errorf(root, "resources are missing")
+		return resources
+	}
+	if resourcesNode.Kind != yaml.SequenceNode {
+		l.errorf(resourcesNode, "resources must be a list")
+		return resources
+	}
+	for _, resourceNode := range resourcesNode.Content {
+		l.loadResource(resourceNode, defaults, resources)
+	}
+	return resources
+}
+
+func (l *loader) loadResource(node *yaml.Node, defaults map[string]*yaml.Node, resources *Resources) {
+	if node.Kind != yaml.MappingNode {
+		l.errorf(node, "resource must be a mapping with kind and spec")
+		return
+	}
+	var kindNode, specNode *yaml.Node
+	for _, pair := range mapping(node) {
+		switch pair[0].Value {
+		case "kind":
+			kindNode = pair[1]
+		case "spec":
+			specNode = pair[1]
+		default:
+			l.errorf(pair[0], "unknown resource field %q", pair[0].Value)
+		}
+	}
+	if kindNode == nil || specNode == nil {
+		l.errorf(node, "resource must have a kind and a spec")
+		return
+	}
+	t, found := kindTypes[kindNode.Value]
+	if !found {
+		l.errorf(kindNode, "unknown kind %q", kindNode.Value)
+		return
+	}
+
+	l.substitute(specNode)
+	if def, found := defaults[kindNode.Value]; found {
+		mergeDefaults(specNode, def)
+	}
+
+	errCount := len(l.errs)
+	value := l.convert(specNode, t)
+	if len(l.errs) > errCount {
+		return
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		l.errorf(specNode, "%v", err)
+		return
+	}
+
+	switch kindNode.Value {
+	case KindVirtualMachine:
+		vm := &compute.VirtualMachine{}
+		if l.unmarshal(specNode, data, vm) {
+			for _, verr := range compute.Validate(vm) {
+				l.errorf(specNode, "%s", verr.Error())
+			}
+			resources.VirtualMachines = append(resources.VirtualMachines, vm)
+		}
+	case KindVirtualNetworkInterface:
+		vnic := &network.VirtualNetworkInterface{}
+		if l.unmarshal(specNode, data, vnic) {
+			l.requireName(specNode, vnic.Name)
+			resources.VirtualNetworkInterfaces = append(resources.VirtualNetworkInterfaces, vnic)
+		}
+	case KindVirtualHardDisk:
+		vhd := &storage.VirtualHardDisk{}
+		if l.unmarshal(specNode, data, vhd) {
+			l.requireName(specNode, vhd.Name)
+			resources.VirtualHardDisks = append(resources.VirtualHardDisks, vhd)
+		}
+	}
+}
+
+func (l *loader) unmarshal(node *yaml.Node, data []byte, out interface{}) bool {
+	if err := json.Unmarshal(data, out); err != nil {
+		l.errorf(node, "%v", err)
+		return false
+	}
+	return true
+}
+
+func (l *loader) requireName(node *yaml.Node, name *string) {
+	if name == nil || len(strings.TrimSpace(*name)) == 0 {
+		l.errorf(node, "name: is required")
+	}
+}
+
+// getParameters resolves the declared parameters against the supplied values and defaults
+func (l *loader) getParameters(node *yaml.Node, supplied map[string]interface{}) map[string]interface{} {
+	values := map[string]interface{}{}
+	declared := map[string]bool{}
+	if node != nil && node.Kind != yaml.MappingNode {
+		l.errorf(node, "parameters must be a mapping of name to declaration")
+		node = nil
+	}
+	if node != nil {
+		for _, pair := range mapping(node) {
+			name := pair[0].Value
+			declared[name] = true
+			paramType, defaultNode := "string", (*yaml.Node)(nil)
+			if pair[1].Kind == yaml.MappingNode {
+				for _, field := range mapping(pair[1]) {
+					switch field[0].Value {
+					case "type":
+						paramType = field[1].Value
+					case "default":
+						defaultNode = field[1]
+					case "description":
+					default:
+						l.errorf(field[0], "unknown parameter field %q", field[0].Value)
+					}
+				}
+			} else if pair[1].Tag != "!!null" {
+				l.errorf(pair[1], "parameter %q must be a mapping with type and default", name)
+				continue
+			}
+
+			var value interface{}
+			if v, found := supplied[name]; found {
+				value = v
+			} else if defaultNode != nil {
+				value = defaultNode.Value
+			} else {
+				l.errorf(pair[0], "parameter %q has no value and no default", name)
+				continue
+			}
+			typed, err := getParameterValue(paramType, value)
+			if err != nil {
+				l.errorf(pair[0], "parameter %q: %v", name, err)
+				continue
+			}
+			values[name] = typed
+		}
+	}
+	for name := range supplied {
+		if !declared[name] {
+			l.errs = append(l.errs, fmt.Sprintf("parameter %q is not declared", name))
+		}
+	}
+	return values
+}
+
+func getParameterValue(paramType string, value interface{}) (interface{}, error) {
+	text := fmt.Sprint(value)
+	switch paramType {
+	case "string":
+		return text, nil
+	case "int":
+		return strconv.ParseInt(text, 10, 64)
+	case "bool":
+		return strconv.ParseBool(text)
+	}
+	return nil, fmt.Errorf("unknown type %q, expected string, int or bool", paramType)
+}
+
+var parameterReference = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+var exactParameterReference = regexp.MustCompile(`^\$\{([A-Za-z_][A-Za-z0-9_]*)\}$`)
+
+// substitute replaces parameter references in every scalar under node
+func (l *loader) substitute(node *yaml.Node) {
+	if node.Kind == yaml.ScalarNode {
+		if match := exactParameterReference.FindStringSubmatch(node.Value); match != nil {
+			value, found := l.params[match[1]]
+			if !found {
+				l.errorf(node, "unknown parameter %q", match[1])
+				return
+			}
+			node.Value = fmt.Sprint(value)
+			switch value.(type) {
+			case int64:
+				node.Tag = "!!int"
+			case bool:
+				node.Tag = "!!bool"
+			default:
+				node.Tag = "!!str"
+			}
+			return
+		}
+		node.Value = parameterReference.ReplaceAllStringFunc(node.Value, func(ref string) string {
+			if ref == "$${" {
+				return "${"
+			}
+			name := ref[2 : len(ref)-1]
+			value, found := l.params[name]
+			if !found {
+				l.errorf(node, "unknown parameter %q", name)
+				return ref
+			}
+			return fmt.Sprint(value)
+		})
+		return
+	}
+	for _, child := range node.Content {
+		l.substitute(child)
+	}
+}
+
+// mergeDefaults copies the fields of def that spec does not set into spec
+func mergeDefaults(spec, def *yaml.Node) {
+	if spec.Kind != yaml.MappingNode || def.Kind != yaml.MappingNode {
+		return
+	}
+	existing := map[string]*yaml.Node{}
+	for _, pair := range mapping(spec) {
+		existing[strings.ToLower(pair[0].Value)] = pair[1]
+	}
+	for _, pair := range mapping(def) {
+		if value, found := existing[strings.ToLower(pair[0].Value)]; found {
+			mergeDefaults(value, pair[1])
+			continue
+		}
+		spec.Content = append(spec.Content, pair[0], pair[1])
+	}
+}
+
+type jsonField struct {
+	name string
+	t    reflect.Type
+}
+
+// getJSONFields returns the fields of a struct keyed by lower case JSON name, flattening untagged embedded structs like encoding/json
+func getJSONFields(t reflect.Type) map[string]jsonField {
+	fields := map[string]jsonField{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() && !f.Anonymous {
+			continue
+		}
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				for key, field := range getJSONFields(ft) {
+					if _, found := fields[key]; !found {
+						fields[key] = field
+					}
+				}
+				continue
+			}
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[strings.ToLower(name)] = jsonField{name: name, t: f.Type}
+	}
+	return fields
+}
+
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+// convert checks node against t and returns the equivalent value for encoding/json
+func (l *loader) convert(node *yaml.Node, t reflect.Type) interface{} {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if node.Kind == yaml.ScalarNode && node.Tag == "!!null" {
+		return nil
+	}
+	if t.Kind() == reflect.Ptr {
+		return l.convert(node, t.Elem())
+	}
+	if reflect.PointerTo(t).Implements(textUnmarshalerType) {
+		if node.Kind != yaml.ScalarNode {
+			l.errorf(node, "expected a string for %s", t)
+			return nil
+		}
+		return node.Value
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			l.errorf(node, "expected a mapping for %s", t.Name())
+			return nil
+		}
+		fields := getJSONFields(t)
+		out := map[string]interface{}{}
+		for _, pair := range mapping(node) {
+			field, found := fields[strings.ToLower(pair[0].Value)]
+			if !found {
+				l.errorf(pair[0], "unknown field %q in %s", pair[0].Value, t.Name())
+				continue
+			}
+			out[field.name] = l.convert(pair[1], field.t)
+		}
+		return out
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			l.errorf(node, "expected a mapping")
+			return nil
+		}
+		out := map[string]interface{}{}
+		for _, pair := range mapping(node) {
+			out[pair[0].Value] = l.convert(pair[1], t.Elem())
+		}
+		return out
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 && node.Kind == yaml.ScalarNode {
+			return node.Value
+		}
+		if node.Kind != yaml.SequenceNode {
+			l.errorf(node, "expected a list")
+			return nil
+		}
+		out := []interface{}{}
+		for _, item := range node.Content {
+			out = append(out, l.convert(item, t.Elem()))
+		}
+		return out
+	case reflect.Interface:
+		var out interface{}
+		if err := node.Decode(&out); err != nil {
+			l.errorf(node, "%v", err)
+		}
+		return out
+	}
+
+	if node.Kind != yaml.ScalarNode {
+		l.errorf(node, "expected a %s value", t.Kind())
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return node.Value
+	case reflect.Bool:
+		v, err := strconv.ParseBool(node.Value)
+		if err != nil {
+			l.errorf(node, "expected a boolean, got %q", node.Value)
+		}
+		return v
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v, err := strconv.ParseInt(node.Value, 0, t.Bits())
+		if err != nil {
+			l.errorf(node, "expected a %d-bit integer, got %q", t.Bits(), node.Value)
+		}
+		return v
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v, err := strconv.ParseUint(node.Value, 0, t.Bits())
+		if err != nil {
+			l.errorf(node, "expected a %d-bit unsigned integer, got %q", t.Bits(), node.Value)
+		}
+		return v
+	case reflect.Float32, reflect.Float64:
+		v, err := strconv.ParseFloat(node.Value, t.Bits())
+		if err != nil {
+			l.errorf(node, "expected a number, got %q", node.Value)
+		}
+		return v
+	}
+	l.errorf(node, "unsupported field type %s", t)
+	return nil
+}
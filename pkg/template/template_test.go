@@ -0,0 +1,116 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package template
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/microsoft/wssd-sdk-for-go/services/compute"
+)
+
+const testTemplate = `
+parameters:
+  name:
+    type: string
+  cpu:
+    type: int
+    default: 2
+  tpm:
+    type: bool
+    default: false
+defaults:
+  VirtualMachine:
+    properties:
+      guestAgentProfile:
+        enabled: true
+      hardwareProfile:
+        vmSize: Standard_A2_v2
+resources:
+  - kind: VirtualHardDisk
+    spec:
+      name: ${name}-os
+      virtualharddiskproperties:
+        diskSizeBytes: 10737418240
+  - kind: VirtualNetworkInterface
+    spec:
+      name: ${name}-nic
+  - kind: VirtualMachine
+    spec:
+      name: ${name}
+      tags:
+        note: "$${literal}"
+      properties:
+        hardwareProfile:
+          vmSize: Custom
+          customsize:
+            cpucount: ${cpu}
+            memorymb: 4096
+        securityProfile:
+          enableTPM: ${tpm}
+        storageProfile:
+          osDisk:
+            vhd: ${name}-os
+`
+
+func Test_Load(t *testing.T) {
+	resources, err := Load([]byte(testTemplate), map[string]interface{}{"name": "web", "cpu": 4})
+	assert.NoError(t, err)
+	assert.Len(t, resources.VirtualHardDisks, 1)
+	assert.Equal(t, "web-os", *resources.VirtualHardDisks[0].Name)
+	assert.Equal(t, "web-nic", *resources.VirtualNetworkInterfaces[0].Name)
+
+	vm := resources.VirtualMachines[0]
+	assert.Equal(t, "web", *vm.Name)
+	assert.Equal(t, "${literal}", *vm.Tags["note"])
+	assert.Equal(t, compute.VirtualMachineSizeTypesCustom, vm.HardwareProfile.VMSize)
+	assert.Equal(t, int32(4), *vm.HardwareProfile.CustomSize.CpuCount)
+	assert.False(t, *vm.SecurityProfile.EnableTPM)
+	assert.True(t, *vm.GuestAgentProfile.Enabled)
+	assert.Equal(t, "web-os", *vm.StorageProfile.OsDisk.VhdName)
+}
+
+func Test_LoadJSON(t *testing.T) {
+	resources, err := Load([]byte(`{"resources": [{"kind": "VirtualMachine", "spec": {"name": "vm1", "properties": {"hardwareProfile": {"vmSize": "Standard_D2s_v3"}}}}]}`), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, compute.VirtualMachineSizeTypesStandardD2sV3, resources.VirtualMachines[0].HardwareProfile.VMSize)
+}
+
+func Test_LoadErrors(t *testing.T) {
+	_, err := Load([]byte(testTemplate), map[string]interface{}{"cpu": "four"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `line 3: parameter "name" has no value and no default`)
+	assert.Contains(t, err.Error(), `line 5: parameter "cpu"`)
+
+	_, err = Load([]byte(`
+resources:
+  - kind: VirtualMachine
+    spec:
+      name: vm1
+      properties:
+        hardwareProfile:
+          vmSize: Custom
+          customsize:
+            cpucount: many
+        bogus: 1
+  - kind: Container
+    spec: {}
+`), nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `line 10: expected a 32-bit integer, got "many"`)
+	assert.Contains(t, err.Error(), `line 11: unknown field "bogus" in VirtualMachineProperties`)
+	assert.Contains(t, err.Error(), `line 12: unknown kind "Container"`)
+
+	_, err = Load([]byte(`
+resources:
+  - kind: VirtualMachine
+    spec:
+      name: vm1
+      properties:
+        hardwareProfile:
+          vmSize: Custom
+`), nil)
+	assert.Contains(t, err.Error(), "line 5: properties.hardwareProfile.customSize: is required for size [Custom]")
+}
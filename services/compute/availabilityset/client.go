@@ -9,6 +9,8 @@ import (
 	"github.com/microsoft/moc/pkg/auth"
 	"github.com/microsoft/wssd-sdk-for-go/services/compute"
 	"github.com/microsoft/wssd-sdk-for-go/services/compute/availabilityset/internal"
+	"github.com/microsoft/wssd-sdk-for-go/services/compute/internal/vmlocation"
+	"github.com/microsoft/wssd-sdk-for-go/services/compute/virtualmachine"
 )
 
 type Service interface {
@@ -22,6 +24,8 @@ type Service interface {
 type AvailabilitySetClient struct {
 	compute.BaseClient
 	internal Service
+	// newNodeClient connects to the node agent of another node, to find the virtual machines it hosts
+	newNodeClient vmlocation.NodeClientFactory
 }
 
 func NewAvailabilitySetClient(cloudFQDN string, authorizer auth.Authorizer) (*AvailabilitySetClient, error) {
@@ -29,8 +33,11 @@ func NewAvailabilitySetClient(cloudFQDN string, authorizer auth.Authorizer) (*Av
 	if err != nil {
 		return nil, err
 	}
+	newNodeClient := func(node string) (vmlocation.VirtualMachineGetter, error) {
+		return virtualmachine.NewVirtualMachineClient(node, authorizer)
+	}
 
-	return &AvailabilitySetClient{internal: c}, nil
+	return &AvailabilitySetClient{internal: c, newNodeClient: newNodeClient}, nil
 }
 
 func (c *AvailabilitySetClient) Get(ctx context.Context, name string) (*[]compute.AvailabilitySet, error) {
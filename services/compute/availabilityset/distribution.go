@@ -0,0 +1,231 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package availabilityset
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/microsoft/moc/pkg/errors"
+
+	"github.com/microsoft/wssd-sdk-for-go/services/compute/internal/vmlocation"
+)
+
+// FaultDomain lists the nodes of a fault domain and the virtual machines of the availability set they host
+type FaultDomain struct {
+	// Index - The fault domain, from 0 to PlatformFaultDomainCount - 1
+	Index int32
+	// Nodes - The nodes in the fault domain
+	Nodes []string
+	// VirtualMachines - The virtual machines of the availability set running in the fault domain
+	VirtualMachines []string
+}
+
+// VirtualMachinePlacement is where a virtual machine of the availability set runs
+type VirtualMachinePlacement struct {
+	// Name - The virtual machine
+	Name string
+	// Node - The node hosting the virtual machine
+	Node string
+	// FaultDomain - The fault domain of Node
+	FaultDomain int32
+}
+
+// Distribution is how the virtual machines of an availability set are spread over fault domains
+type Distribution struct {
+	// PlatformFaultDomainCount - The fault domains the availability set asks for
+	PlatformFaultDomainCount int32
+	// FaultDomains - The fault domains, by index
+	FaultDomains []FaultDomain
+	// VirtualMachines - The virtual machines found on a node, by name
+	VirtualMachines []VirtualMachinePlacement
+	// Unplaced - The virtual machines of the availability set no node hosts
+	Unplaced []string
+	// Warnings - Imbalances and other problems with the spread
+	Warnings []string
+}
+
+// Migration moves a virtual machine to another node to restore the spread of its availability set
+type Migration struct {
+	// VirtualMachine - The virtual machine to move
+	VirtualMachine string
+	// FromNode - The node hosting it now
+	FromNode string
+	// ToNode - The node to move it to
+	ToNode string
+	// FromFaultDomain - The fault domain of FromNode
+	FromFaultDomain int32
+	// ToFaultDomain - The fault domain of ToNode
+	ToFaultDomain int32
+}
+
+// GetDistribution returns the fault domain and node of each virtual machine of the availability set name.
+// The node agents do not report fault domains, so faultDomains gives the fault domain of each node to look on, from 0
+// to PlatformFaultDomainCount - 1. A virtual machine runs on the node whose agent does not report it as a placeholder.
+func (c *AvailabilitySetClient) GetDistribution(ctx context.Context, name string, faultDomains map[string]int32) (*Distribution, error) {
+	if len(faultDomains) == 0 {
+		return nil, errors.Wrapf(errors.InvalidInput, "Missing the fault domain of the nodes: the node agents do not report them")
+	}
+	avsets, err := c.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if avsets == nil || len(*avsets) == 0 {
+		return nil, errors.Wrapf(errors.NotFound, "Unable to find Availability Set [%s]", name)
+	}
+	avset := (*avsets)[0]
+	nodes := []string{}
+	for node := range faultDomains {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+
+	d := &Distribution{}
+	if avset.AvailabilitySetProperties != nil && avset.PlatformFaultDomainCount != nil {
+		d.PlatformFaultDomainCount = *avset.PlatformFaultDomainCount
+	}
+	if d.PlatformFaultDomainCount <= 0 {
+		return nil, errors.Wrapf(errors.InvalidConfiguration, "Availability Set [%s] has no fault domain count", name)
+	}
+	for i := int32(0); i < d.PlatformFaultDomainCount; i++ {
+		d.FaultDomains = append(d.FaultDomains, FaultDomain{Index: i, Nodes: []string{}, VirtualMachines: []string{}})
+	}
+	for _, node := range nodes {
+		index := faultDomains[node]
+		if index < 0 || index >= d.PlatformFaultDomainCount {
+			return nil, errors.Wrapf(errors.InvalidInput, "Fault domain %d of node [%s] is not between 0 and %d", index, node, d.PlatformFaultDomainCount-1)
+		}
+		fd := &d.FaultDomains[index]
+		fd.Nodes = append(fd.Nodes, node)
+	}
+	for _, fd := range d.FaultDomains {
+		if len(fd.Nodes) == 0 {
+			d.Warnings = append(d.Warnings, fmt.Sprintf("Fault domain %d has no nodes", fd.Index))
+		}
+	}
+
+	names := []string{}
+	if avset.AvailabilitySetProperties != nil {
+		for _, vm := range avset.VirtualMachines {
+			if vm != nil && vm.Name != nil {
+				names = append(names, *vm.Name)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	hosts, err := vmlocation.Locate(ctx, c.newNodeClient, nodes, names)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, vmName := range names {
+		found := hosts[vmName]
+		if len(found) == 0 {
+			d.Unplaced = append(d.Unplaced, vmName)
+			d.Warnings = append(d.Warnings, fmt.Sprintf("Virtual Machine [%s] is not running on any node", vmName))
+			continue
+		}
+		if len(found) > 1 {
+			d.Warnings = append(d.Warnings, fmt.Sprintf("Virtual Machine [%s] is reported by nodes %v, using [%s]", vmName, found, found[0]))
+		}
+		placement := VirtualMachinePlacement{Name: vmName, Node: found[0], FaultDomain: faultDomains[found[0]]}
+		d.VirtualMachines = append(d.VirtualMachines, placement)
+		fd := &d.FaultDomains[placement.FaultDomain]
+		fd.VirtualMachines = append(fd.VirtualMachines, vmName)
+	}
+
+	if most, least, ok := getLoadExtremes(d.FaultDomains); ok && len(d.FaultDomains[most].VirtualMachines)-len(d.FaultDomains[least].VirtualMachines) > 1 {
+		d.Warnings = append(d.Warnings, fmt.Sprintf("Fault domain %d has %d virtual machines, fault domain %d has %d",
+			most, len(d.FaultDomains[most].VirtualMachines), least, len(d.FaultDomains[least].VirtualMachines)))
+	}
+	return d, nil
+}
+
+// PlanRebalance proposes migrations that leave at most one more virtual machine in any fault domain than in any other.
+// Each migration moves a virtual machine from the busiest node of the fullest fault domain to the least busy node of the
+// emptiest one. Fault domains without nodes are ignored. The migrations are not performed.
+func PlanRebalance(d *Distribution) []Migration {
+	migrations := []Migration{}
+	if d == nil {
+		return migrations
+	}
+	faultDomains := make([]FaultDomain, len(d.FaultDomains))
+	nodeVMs := map[string][]string{}
+	for i, fd := range d.FaultDomains {
+		faultDomains[i] = FaultDomain{Index: fd.Index, Nodes: fd.Nodes, VirtualMachines: append([]string{}, fd.VirtualMachines...)}
+		for _, node := range fd.Nodes {
+			nodeVMs[node] = []string{}
+		}
+	}
+	for _, placement := range d.VirtualMachines {
+		nodeVMs[placement.Node] = append(nodeVMs[placement.Node], placement.Name)
+	}
+
+	for range d.VirtualMachines {
+		most, least, ok := getLoadExtremes(faultDomains)
+		if !ok || len(faultDomains[most].VirtualMachines)-len(faultDomains[least].VirtualMachines) <= 1 {
+			break
+		}
+		from := getNodeByLoad(faultDomains[most].Nodes, nodeVMs, true)
+		to := getNodeByLoad(faultDomains[least].Nodes, nodeVMs, false)
+		vms := nodeVMs[from]
+		vm := vms[len(vms)-1]
+		nodeVMs[from] = vms[:len(vms)-1]
+		nodeVMs[to] = append(nodeVMs[to], vm)
+		faultDomains[most].VirtualMachines = removeString(faultDomains[most].VirtualMachines, vm)
+		faultDomains[least].VirtualMachines = append(faultDomains[least].VirtualMachines, vm)
+		migrations = append(migrations, Migration{
+			VirtualMachine:  vm,
+			FromNode:        from,
+			ToNode:          to,
+			FromFaultDomain: faultDomains[most].Index,
+			ToFaultDomain:   faultDomains[least].Index,
+		})
+	}
+	return migrations
+}
+
+// getLoadExtremes returns the fault domains with nodes holding the most and the fewest virtual machines.
+// Ties go to the lowest index.
+func getLoadExtremes(faultDomains []FaultDomain) (int, int, bool) {
+	most, least := -1, -1
+	for i, fd := range faultDomains {
+		if len(fd.Nodes) == 0 {
+			continue
+		}
+		if most < 0 || len(fd.VirtualMachines) > len(faultDomains[most].VirtualMachines) {
+			most = i
+		}
+		if least < 0 || len(fd.VirtualMachines) < len(faultDomains[least].VirtualMachines) {
+			least = i
+		}
+	}
+	return most, least, most >= 0
+}
+
+// getNodeByLoad returns the node with the most virtual machines, or the fewest. Ties go to the node that sorts first.
+func getNodeByLoad(nodes []string, nodeVMs map[string][]string, busiest bool) string {
+	selected := ""
+	for _, node := range nodes {
+		if selected == "" {
+			selected = node
+			continue
+		}
+		if busiest && len(nodeVMs[node]) > len(nodeVMs[selected]) || !busiest && len(nodeVMs[node]) < len(nodeVMs[selected]) {
+			selected = node
+		}
+	}
+	return selected
+}
+
+func removeString(values []string, value string) []string {
+	for i, v := range values {
+		if v == value {
+			return append(values[:i], values[i+1:]...)
+		}
+	}
+	return values
+}
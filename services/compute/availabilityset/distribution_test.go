@@ -0,0 +1,127 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package availabilityset
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/microsoft/moc/pkg/errors"
+
+	"github.com/microsoft/wssd-sdk-for-go/services/compute"
+	"github.com/microsoft/wssd-sdk-for-go/services/compute/internal/vmlocation"
+)
+
+type fakeService struct {
+	avsets map[string]*compute.AvailabilitySet
+}
+
+func (s *fakeService) Get(ctx context.Context, name string) (*[]compute.AvailabilitySet, error) {
+	avset, ok := s.avsets[name]
+	if !ok {
+		return nil, errors.Wrapf(errors.NotFound, "%s", name)
+	}
+	return &[]compute.AvailabilitySet{*avset}, nil
+}
+
+func (s *fakeService) CreateOrUpdate(ctx context.Context, name string, avset *compute.AvailabilitySet) (*compute.AvailabilitySet, error) {
+	s.avsets[name] = avset
+	return avset, nil
+}
+
+func (s *fakeService) Delete(ctx context.Context, name string) error {
+	delete(s.avsets, name)
+	return nil
+}
+
+func (s *fakeService) AddVmToAvailabilitySet(ctx context.Context, avset, vm string) error {
+	return nil
+}
+
+func (s *fakeService) RemoveVmFromAvailabilitySet(ctx context.Context, avset, vm string) error {
+	return nil
+}
+
+func newTestClient(faultDomainCount int32, vms []string, placement map[string][]string) *AvailabilitySetClient {
+	members := []*compute.SubResource{}
+	for i := range vms {
+		members = append(members, &compute.SubResource{Name: &vms[i]})
+	}
+	name := "avset"
+	service := &fakeService{avsets: map[string]*compute.AvailabilitySet{
+		name: {
+			Name: &name,
+			AvailabilitySetProperties: &compute.AvailabilitySetProperties{
+				PlatformFaultDomainCount: &faultDomainCount,
+				VirtualMachines:          members,
+			},
+		},
+	}}
+	return &AvailabilitySetClient{
+		internal:      service,
+		newNodeClient: vmlocation.NewFakeNodeClientFactory(placement),
+	}
+}
+
+func Test_GetDistribution(t *testing.T) {
+	client := newTestClient(2, []string{"vm1", "vm2", "vm3", "vm4"}, map[string][]string{
+		"node0": {"vm1", "vm2", "vm3"},
+		"node1": {},
+	})
+	d, err := client.GetDistribution(context.Background(), "avset", map[string]int32{"node1": 1, "node0": 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(d.FaultDomains[0], FaultDomain{Index: 0, Nodes: []string{"node0"}, VirtualMachines: []string{"vm1", "vm2", "vm3"}}) {
+		t.Errorf("Unexpected fault domain 0: %+v", d.FaultDomains[0])
+	}
+	if len(d.FaultDomains[1].VirtualMachines) != 0 {
+		t.Errorf("Unexpected fault domain 1: %+v", d.FaultDomains[1])
+	}
+	if !reflect.DeepEqual(d.Unplaced, []string{"vm4"}) {
+		t.Errorf("Expected vm4 to be unplaced, got %v", d.Unplaced)
+	}
+	// One warning for vm4, one for the imbalance
+	if len(d.Warnings) != 2 {
+		t.Errorf("Expected 2 warnings, got %v", d.Warnings)
+	}
+
+	migrations := PlanRebalance(d)
+	if len(migrations) != 1 {
+		t.Fatalf("Expected 1 migration, got %+v", migrations)
+	}
+	if migrations[0].FromNode != "node0" || migrations[0].ToNode != "node1" || migrations[0].ToFaultDomain != 1 {
+		t.Errorf("Unexpected migration %+v", migrations[0])
+	}
+}
+
+func Test_GetDistributionBalanced(t *testing.T) {
+	client := newTestClient(3, []string{"vm1", "vm2", "vm3"}, map[string][]string{
+		"node0": {"vm1"},
+		"node1": {"vm2"},
+	})
+	d, err := client.GetDistribution(context.Background(), "avset", map[string]int32{"node0": 0, "node1": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// vm3 is unplaced and fault domain 2 has no nodes, but the nodes are balanced
+	if len(d.Warnings) != 2 {
+		t.Errorf("Expected 2 warnings, got %v", d.Warnings)
+	}
+	if migrations := PlanRebalance(d); len(migrations) != 0 {
+		t.Errorf("Expected no migration, got %+v", migrations)
+	}
+
+	if _, err := client.GetDistribution(context.Background(), "missing", map[string]int32{"node0": 0}); !errors.IsNotFound(err) {
+		t.Errorf("Expected NotFound, got %v", err)
+	}
+	// The fault domains of the nodes are not guessed
+	if _, err := client.GetDistribution(context.Background(), "avset", nil); !errors.IsInvalidInput(err) {
+		t.Errorf("Expected InvalidInput, got %v", err)
+	}
+	if _, err := client.GetDistribution(context.Background(), "avset", map[string]int32{"node0": 3}); !errors.IsInvalidInput(err) {
+		t.Errorf("Expected InvalidInput, got %v", err)
+	}
+}
@@ -4,6 +4,8 @@
 package compute
 
 import (
+	"time"
+
 	"github.com/microsoft/moc/rpc/common"
 	"github.com/microsoft/wssd-sdk-for-go/services/network"
 )
@@ -158,7 +160,7 @@ type DataDisk struct {
 }
 
 type StorageProfile struct {
-	// ImageReference - Specifies information about the image to use. You can specify information about platform images, marketplace images, or virtual machine images. This element is required when you want to use a platform image, marketplace image, or virtual machine image, but is not used in other creation operations.
+	// ImageReference - Specifies information about the image to use. You can specify information about platform images, marketplace images, or virtual machine images. This element is required when you want to use a platform image, marketplace image, or virtual machine image, but is not used in other creation operations. Not sent to the node agent, which references disks by VhdName only.
 	ImageReference *ImageReference `json:"imageReference,omitempty"`
 	// OSDisk
 	OsDisk *OSDisk `json:"osDisk,omitempty"`
@@ -169,7 +171,7 @@ type StorageProfile struct {
 }
 
 type SSHPublicKey struct {
-	// Path - Specifies the full path on the created VM where ssh public key is stored. If the file already exists, the specified key is appended to the file. Example: /home/user/.ssh/authorized_keys
+	// Path - Specifies the full path on the created VM where ssh public key is stored. If the file already exists, the specified key is appended to the file. Example: /home/user/.ssh/authorized_keys. Not sent to the node agent, which picks the path itself.
 	Path *string `json:"path,omitempty"`
 	// KeyData - SSH public key certificate used to authenticate with the VM through ssh. The key needs to be at least 2048-bit and in ssh-rsa format. <br><br> For creating ssh keys, see [Create SSH keys on Linux and Mac for Li      nux VMs in Azure](https://docs.microsoft.com/azure/virtual-machines/virtual-machines-linux-mac-create-ssh-keys?toc=%2fazure%2fvirtual-machines%2flinux%2ftoc.json).
 	KeyData *string `json:"keyData,omitempty"`
@@ -239,9 +241,12 @@ type OSProfile struct {
 	// AdminUsername
 	AdminUsername *string `json:"adminUsername,omitempty"`
 	// AdminPassword
-	AdminPassword *string `json:"adminPassword,omitempty"`
+	AdminPassword *string `json:"adminPassword,omitempty" sensitive:"true"`
+	// AdminPasswordReference - Read AdminPassword from a keyvault secret instead of giving it inline. Resolved by the client; not sent to the node agent.
+	AdminPasswordReference *SecretReference `json:"adminPasswordReference,omitempty"`
 	// CustomData Specifies a base-64 encoded string of custom data. The base-64 encoded string is decoded to a binary array that is saved as a file on the Virtual Machine. The maximum length of the binary array is 65535 bytes. <br><br> For using cloud-init for your VM, see [Using cloud-init to customize a Linux VM during creation](https://docs.microsoft.com/azure/virtual-machines/virtual-machines-linux-using-cloud-init?toc=%2fazure%2fvirtual-machines%2flinux%2ftoc.json)
-	CustomData *string `json:"customData,omitempty"`
+	// It is sensitive: it may carry secrets, such as the AdminPassword an unattend file built by customdata.UnattendBuilder holds.
+	CustomData *string `json:"customData,omitempty" sensitive:"true"`
 	// WindowsConfiguration
 	WindowsConfiguration *WindowsConfiguration `json:"windowsConfiguration,omitempty"`
 	// LinuxConfiguration
@@ -253,7 +258,7 @@ type OSProfile struct {
 }
 
 type NetworkInterfaceReference struct {
-	// VirtualNetworkReference
+	// VirtualNetworkReference - Not sent to the node agent; the virtual network is a property of the network interface
 	VirtualNetworkReference *string `json:"virtualNetworkReference,omitempty"`
 	// VirtualNetworkInterfaceReference
 	VirtualNetworkInterfaceReference *string `json:"virtualNetworkInterfaceReference,omitempty"`
@@ -288,6 +293,80 @@ type GuestAgentInstanceView struct {
 	Statuses []*InstanceViewStatus `json:"statuses,omitempty"`
 }
 
+// GuestNetworkInterface describes a network adapter as reported by the guest operating system
+type GuestNetworkInterface struct {
+	// Name - READ-ONLY; The adapter name inside the guest.
+	Name *string `json:"name,omitempty"`
+	// MacAddress - READ-ONLY; The MAC address of the adapter.
+	MacAddress *string `json:"macAddress,omitempty"`
+	// IPAddresses - READ-ONLY; The IPv4 and IPv6 addresses assigned to the adapter.
+	IPAddresses *[]string `json:"ipAddresses,omitempty"`
+}
+
+// GuestInfo is the inventory reported by the guest operating system through the guest agent. It is not read from the
+// Hyper-V KVP exchange.
+type GuestInfo struct {
+	// Hostname - READ-ONLY; The host name of the guest.
+	Hostname *string `json:"hostname,omitempty"`
+	// OsName - READ-ONLY; The name of the guest operating system.
+	OsName *string `json:"osName,omitempty"`
+	// OsVersion - READ-ONLY; The version of the guest operating system.
+	OsVersion *string `json:"osVersion,omitempty"`
+	// NetworkInterfaces - READ-ONLY; The network adapters of the guest.
+	NetworkInterfaces *[]GuestNetworkInterface `json:"networkInterfaces,omitempty"`
+	// AgentVersion - READ-ONLY; The Guest Agent full version.
+	AgentVersion *string `json:"agentVersion,omitempty"`
+	// LastHeartbeat - READ-ONLY; The time of the latest status reported by the guest agent.
+	LastHeartbeat *string `json:"lastHeartbeat,omitempty"`
+	// IntegrationServices - READ-ONLY; Whether the Hyper-V integration service daemons run in the guest, keyed by service name.
+	IntegrationServices map[string]*string `json:"integrationServices,omitempty"`
+}
+
+// VirtualMachineDiskMetrics describes the utilization of a disk as seen by the guest
+type VirtualMachineDiskMetrics struct {
+	// Name - READ-ONLY; The disk device name inside the guest.
+	Name *string `json:"name,omitempty"`
+	// ReadIOPS - READ-ONLY; Read operations per second.
+	ReadIOPS *float64 `json:"readIOPS,omitempty"`
+	// WriteIOPS - READ-ONLY; Write operations per second.
+	WriteIOPS *float64 `json:"writeIOPS,omitempty"`
+	// ReadBytesPerSecond - READ-ONLY; Bytes read per second.
+	ReadBytesPerSecond *float64 `json:"readBytesPerSecond,omitempty"`
+	// WriteBytesPerSecond - READ-ONLY; Bytes written per second.
+	WriteBytesPerSecond *float64 `json:"writeBytesPerSecond,omitempty"`
+}
+
+// VirtualMachineNetworkInterfaceMetrics describes the utilization of a network adapter as seen by the guest
+type VirtualMachineNetworkInterfaceMetrics struct {
+	// Name - READ-ONLY; The adapter name inside the guest.
+	Name *string `json:"name,omitempty"`
+	// BytesReceivedPerSecond - READ-ONLY; Bytes received per second.
+	BytesReceivedPerSecond *float64 `json:"bytesReceivedPerSecond,omitempty"`
+	// BytesSentPerSecond - READ-ONLY; Bytes sent per second.
+	BytesSentPerSecond *float64 `json:"bytesSentPerSecond,omitempty"`
+	// PacketsReceivedPerSecond - READ-ONLY; Packets received per second.
+	PacketsReceivedPerSecond *float64 `json:"packetsReceivedPerSecond,omitempty"`
+	// PacketsSentPerSecond - READ-ONLY; Packets sent per second.
+	PacketsSentPerSecond *float64 `json:"packetsSentPerSecond,omitempty"`
+}
+
+// VirtualMachineMetricsSample is the utilization of a virtual machine over one sampling interval
+type VirtualMachineMetricsSample struct {
+	// Time - READ-ONLY; The guest time at the end of the interval.
+	Time *time.Time `json:"time,omitempty"`
+	// CpuPercent - READ-ONLY; The average processor utilization over the interval, 0 to 100.
+	CpuPercent *float64 `json:"cpuPercent,omitempty"`
+	// AssignedMemoryMB - READ-ONLY; The memory visible to the guest operating system. With dynamic memory this moves between the configured minimum and maximum.
+	AssignedMemoryMB *uint64 `json:"assignedMemoryMB,omitempty"`
+	// GuestUsedMemoryMB - READ-ONLY; The memory the guest operating system reports in use, that is not available to new
+	// allocations. This is not the Hyper-V memory demand.
+	GuestUsedMemoryMB *uint64 `json:"guestUsedMemoryMB,omitempty"`
+	// Disks - READ-ONLY; Per disk counters.
+	Disks *[]VirtualMachineDiskMetrics `json:"disks,omitempty"`
+	// NetworkInterfaces - READ-ONLY; Per adapter counters.
+	NetworkInterfaces *[]VirtualMachineNetworkInterfaceMetrics `json:"networkInterfaces,omitempty"`
+}
+
 type UefiSettings struct {
 	// SecureBootEnabled - Specifies whether secure boot should be enabled on the virtual machine.
 	SecureBootEnabled *bool `json:"secureBootEnabled,omitempty"`
@@ -323,6 +402,9 @@ type VirtualMachineProperties struct {
 	NetworkProfile *NetworkProfile `json:"networkProfile,omitempty"`
 	// GuestAgentProfile - Specifies the guest agent settings for the virtual machine.
 	GuestAgentProfile *GuestAgentProfile `json:"guestAgentProfile,omitempty"`
+	// DiagnosticsProfile - Specifies the boot diagnostic settings state. The node agent does not carry it; it is kept in
+	// reserved tags and nothing captures console output for it.
+	DiagnosticsProfile *DiagnosticsProfile `json:"diagnosticsProfile,omitempty"`
 	// ProvisioningState - READ-ONLY; The provisioning state, which only appears in the response.
 	ProvisioningState *string `json:"provisioningState,omitempty"`
 	// ValidationState - READ-ONLY; The validation status, which only appears in the response.
@@ -358,6 +440,8 @@ type VirtualMachine struct {
 	Type *string `json:"type,omitempty"`
 	// Tags - Custom resource tags
 	Tags map[string]*string `json:"tags"`
+	// Identity - The identity of the virtual machine, if configured.
+	Identity *VirtualMachineIdentity `json:"identity,omitempty"`
 	// Properties
 	*VirtualMachineProperties `json:"properties,omitempty"`
 }
@@ -440,11 +524,12 @@ type VirtualMachineScaleSetVMProfileProperties struct {
 	OsProfile *OSProfile `json:"osProfile,omitempty"`
 	// NetworkProfile
 	NetworkProfile *VirtualMachineScaleSetNetworkProfile `json:"networkProfile,omitempty"`
-	// DiagnosticsProfile - Specifies the boot diagnostic settings state
+	// DiagnosticsProfile - Specifies the boot diagnostic settings state. Kept in the tags of the scale set, as the node agent
+	// does not carry it; nothing captures console output for it.
 	DiagnosticsProfile *DiagnosticsProfile `json:"diagnosticsProfile,omitempty"`
-	// Priority - Specifies the priority for the virtual machines in the scale set. <br><br>Minimum api-version: 2017-10-30-preview. Possible values include: 'Regular', 'Low'
+	// Priority - Specifies the priority for the virtual machines in the scale set. <br><br>Minimum api-version: 2017-10-30-preview. Possible values include: 'Regular', 'Low'. Kept in the tags of the scale set, as the node agent does not carry it.
 	Priority VirtualMachinePriorityTypes `json:"priority,omitempty"`
-	// EvictionPolicy - Specifies the eviction policy for virtual machines in a low priority scale set. <br><br>Minimum api-version: 2017-10-30-preview. Possible values include: 'Deallocate', 'Delete'
+	// EvictionPolicy - Specifies the eviction policy for virtual machines in a low priority scale set. <br><br>Minimum api-version: 2017-10-30-preview. Possible values include: 'Deallocate', 'Delete'. Applied by the client when an instance is evicted, see HandleEviction.
 	EvictionPolicy VirtualMachineEvictionPolicyTypes `json:"evictionPolicy,omitempty"`
 }
 
@@ -480,7 +565,7 @@ const (
 type VirtualMachineScaleSetIdentityUserAssignedIdentitiesValue struct {
 	// PrincipalID - READ-ONLY; The principal id of user assigned identity.
 	PrincipalID *string `json:"principalId,omitempty"`
-	// ClientID - READ-ONLY; The client id of user assigned identity.
+	// ClientID - READ-ONLY; The client id of user assigned identity. Not set: the identity service has no client IDs.
 	ClientID *string `json:"clientId,omitempty"`
 }
 
@@ -494,12 +579,50 @@ type VirtualMachineScaleSetIdentity struct {
 	Type ResourceIdentityType `json:"type,omitempty"`
 	// UserAssignedIdentities - The list of user identities associated with the virtual machine scale set. The user identity dictionary key references will be ARM resource ids in the form: '/subscriptions/{subscriptionId}/resourceGroups/{resourceGroupName}/providers/Microsoft.ManagedIdentity/userAssignedIdentities/{identityName}'.
 	UserAssignedIdentities map[string]*VirtualMachineScaleSetIdentityUserAssignedIdentitiesValue `json:"userAssignedIdentities"`
+	// KeyVaultName - The key vault the token and certificate of each identity are written to, as the secrets named by
+	// IdentityTokenSecretName and IdentityCertificateSecretName, for the instances to read. Nil does not project them.
+	KeyVaultName *string `json:"keyVaultName,omitempty"`
+}
+
+// VirtualMachineIdentity identity for the virtual machine. It is declared the same way as the identity of a scale set.
+type VirtualMachineIdentity = VirtualMachineScaleSetIdentity
+
+// UpgradeMode is how a change to the virtual machine profile of a scale set reaches the existing instances
+type UpgradeMode string
+
+const (
+	// UpgradeModeManual - Existing instances keep their configuration until they are reimaged
+	UpgradeModeManual UpgradeMode = "Manual"
+	// UpgradeModeAutomatic - All existing instances are recreated at once
+	UpgradeModeAutomatic UpgradeMode = "Automatic"
+	// UpgradeModeRolling - Existing instances are recreated in batches, following RollingUpgradePolicy
+	UpgradeModeRolling UpgradeMode = "Rolling"
+)
+
+// RollingUpgradePolicy controls the batches of a rolling upgrade
+type RollingUpgradePolicy struct {
+	// MaxBatchPercent - The largest share of the instances recreated at once, 1 to 100
+	MaxBatchPercent *int32 `json:"maxBatchPercent,omitempty"`
+	// MaxUnhealthyPercent - The largest share of unhealthy instances tolerated before the upgrade stops, 0 to 100
+	MaxUnhealthyPercent *int32 `json:"maxUnhealthyPercent,omitempty"`
+	// PauseBetweenBatches - How long to wait after a healthy batch before the next one
+	PauseBetweenBatches *time.Duration `json:"pauseBetweenBatches,omitempty"`
+}
+
+// UpgradePolicy describes how a scale set upgrades its instances
+type UpgradePolicy struct {
+	// Mode - Possible values include: 'Manual', 'Automatic', 'Rolling'. Empty means Manual.
+	Mode UpgradeMode `json:"mode,omitempty"`
+	// RollingUpgradePolicy - The batches used by a rolling upgrade
+	RollingUpgradePolicy *RollingUpgradePolicy `json:"rollingUpgradePolicy,omitempty"`
 }
 
 // VirtualMachineScaleSetProperties
 type VirtualMachineScaleSetProperties struct {
 	// VirtualMachineProfile
 	VirtualMachineProfile *VirtualMachineScaleSetVMProfile `json:"virtualMachineProfile,omitempty"`
+	// UpgradePolicy - Applied by the client. The node agent has no upgrade policy; it is kept in tags of the scale set.
+	UpgradePolicy *UpgradePolicy `json:"upgradePolicy,omitempty"`
 	// ProvisioningState - READ-ONLY; The provisioning state, which only appears in the response.
 	ProvisioningState *string `json:"provisioningState,omitempty"`
 	// State - State would container PowerState/ProvisioningState-SubState
@@ -546,6 +669,16 @@ const (
 	ExecutionStateSucceeded ExecutionState = "Succeeded"
 	// ExecutionStateUnknown ...
 	ExecutionStateUnknown ExecutionState = "Unknown"
+	// ExecutionStatePending ...
+	ExecutionStatePending ExecutionState = "Pending"
+	// ExecutionStateRebooting ...
+	ExecutionStateRebooting ExecutionState = "Rebooting"
+	// ExecutionStateRunning - SDK only; the command was sent to the agent and has not returned yet.
+	ExecutionStateRunning ExecutionState = "Running"
+	// ExecutionStateCanceled - SDK only; the command was canceled by the caller.
+	ExecutionStateCanceled ExecutionState = "Canceled"
+	// ExecutionStateTimedOut - SDK only; the command did not return within the requested timeout.
+	ExecutionStateTimedOut ExecutionState = "TimedOut"
 )
 
 // VirtualMachineRunCommandScriptSource describes the script sources for run command.
@@ -585,7 +718,17 @@ type VirtualMachineRunCommandRequest struct {
 	// Parameters - The parameters used by the script.
 	Parameters    *[]RunCommandInputParameter `json:"parameters,omitempty"`
 	RunAsUser     *string                     `json:"runasuser,omitempty"`
-	RunAsPassword *string                     `json:"runaspassword,omitempty"`
+	RunAsPassword *string                     `json:"runaspassword,omitempty" sensitive:"true"`
+	// RunAsPasswordReference - Read RunAsPassword from a keyvault secret instead of giving it inline. Resolved by the client; not sent to the node agent.
+	RunAsPasswordReference *SecretReference `json:"runAsPasswordReference,omitempty"`
+}
+
+// SecretReference points at a keyvault secret holding a credential
+type SecretReference struct {
+	// VaultName - The keyvault holding the secret
+	VaultName *string `json:"vaultName,omitempty"`
+	// SecretName - The name of the secret
+	SecretName *string `json:"secretName,omitempty"`
 }
 
 // VirtualMachineRunCommandResponse
@@ -691,8 +834,8 @@ type PlacementGroupUpdate struct {
 // For more information about placement groups, see placement groups overview [https://docs.microsoft.com/azure/virtual-machines/placement-group-overview].
 // For more information on Azure
 // planned maintenance, see Maintenance and updates for Virtual Machines in Azure [https://docs.microsoft.com/azure/virtual-machines/maintenance-and-updates].
-// Currently, a VM can only be added to an
-// placement group at creation time. An existing VM cannot be added to an placement group.
+// An existing VM can be added to or removed from a placement group with AddVmToPlacementGroup and RemoveVmFromPlacementGroup
+// of the placement group client.
 type PlacementGroup struct {
 	// The instance view of a resource.
 	*PlacementGroupProperties `json:"properties,omitempty"`
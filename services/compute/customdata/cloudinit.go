@@ -0,0 +1,283 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+// Package customdata builds the OSProfile.CustomData consumed by the bootstrap engines: cloud-init user data for Linux
+// and unattend.xml answer files for Windows.
+package customdata
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"mime/multipart"
+	"net/textproto"
+
+	"github.com/microsoft/moc/pkg/errors"
+	"github.com/microsoft/moc/rpc/common"
+	"gopkg.in/yaml.v3"
+
+	"github.com/microsoft/wssd-sdk-for-go/services/compute"
+)
+
+const (
+	netplanPath          = "/etc/netplan/90-customdata.yaml"
+	cloudInitNetworkPath = "/etc/cloud/cloud.cfg.d/90-customdata-network.cfg"
+)
+
+// Content types of the parts of a multipart cloud-init user data
+const (
+	CloudConfigContentType = "text/cloud-config"
+	ShellScriptContentType = "text/x-shellscript"
+	BoothookContentType    = "text/cloud-boothook"
+)
+
+// CloudInitUser is a user created by cloud-init
+type CloudInitUser struct {
+	Name              string   `yaml:"name"`
+	Gecos             string   `yaml:"gecos,omitempty"`
+	Groups            []string `yaml:"groups,omitempty,flow"`
+	Sudo              string   `yaml:"sudo,omitempty"`
+	Shell             string   `yaml:"shell,omitempty"`
+	LockPassword      *bool    `yaml:"lock_passwd,omitempty"`
+	SSHAuthorizedKeys []string `yaml:"ssh_authorized_keys,omitempty"`
+}
+
+// CloudInitFile is a file written by cloud-init. Content is written verbatim.
+type CloudInitFile struct {
+	Path        string
+	Content     []byte
+	Permissions string
+	Owner       string
+	Append      bool
+}
+
+// NetworkConfig is a cloud-init network config version 2 (netplan) document
+type NetworkConfig struct {
+	Ethernets map[string]EthernetConfig `yaml:"ethernets,omitempty"`
+}
+
+// EthernetConfig configures one ethernet device of a NetworkConfig
+type EthernetConfig struct {
+	Match       *NetworkMatch      `yaml:"match,omitempty"`
+	SetName     string             `yaml:"set-name,omitempty"`
+	DHCP4       *bool              `yaml:"dhcp4,omitempty"`
+	DHCP6       *bool              `yaml:"dhcp6,omitempty"`
+	Addresses   []string           `yaml:"addresses,omitempty"`
+	Routes      []NetworkRoute     `yaml:"routes,omitempty"`
+	Nameservers *NetworkNameserver `yaml:"nameservers,omitempty"`
+	MTU         int                `yaml:"mtu,omitempty"`
+}
+
+// NetworkMatch selects a device by MAC address or name
+type NetworkMatch struct {
+	MACAddress string `yaml:"macaddress,omitempty"`
+	Name       string `yaml:"name,omitempty"`
+}
+
+// NetworkRoute is a static route
+type NetworkRoute struct {
+	To  string `yaml:"to"`
+	Via string `yaml:"via"`
+}
+
+// NetworkNameserver configures DNS
+type NetworkNameserver struct {
+	Addresses []string `yaml:"addresses,omitempty"`
+	Search    []string `yaml:"search,omitempty"`
+}
+
+type cloudConfigFile struct {
+	Path        string `yaml:"path"`
+	Content     string `yaml:"content"`
+	Encoding    string `yaml:"encoding"`
+	Permissions string `yaml:"permissions,omitempty"`
+	Owner       string `yaml:"owner,omitempty"`
+	Append      bool   `yaml:"append,omitempty"`
+}
+
+type cloudConfig struct {
+	Hostname          string            `yaml:"hostname,omitempty"`
+	Users             []interface{}     `yaml:"users,omitempty"`
+	SSHAuthorizedKeys []string          `yaml:"ssh_authorized_keys,omitempty"`
+	WriteFiles        []cloudConfigFile `yaml:"write_files,omitempty"`
+	RunCmd            [][]string        `yaml:"runcmd,omitempty"`
+}
+
+type mimePart struct {
+	contentType string
+	content     []byte
+}
+
+// CloudInitBuilder builds cloud-init user data
+type CloudInitBuilder struct {
+	dataSource common.CloudInitDataSource
+	config     cloudConfig
+	users      []CloudInitUser
+	network    *NetworkConfig
+	parts      []mimePart
+}
+
+// NewCloudInitBuilder returns a builder for a virtual machine with the given Linux configuration.
+// With the Azure data source the platform provisions the administrator of the OS profile, so the "default" user is kept
+// alongside the users added to the builder; with NoCloud exactly the users added are created.
+func NewCloudInitBuilder(linuxConfiguration *compute.LinuxConfiguration) *CloudInitBuilder {
+	b := &CloudInitBuilder{dataSource: common.CloudInitDataSource_NoCloud}
+	if linuxConfiguration != nil {
+		b.dataSource = linuxConfiguration.CloudInitDataSource
+	}
+	return b
+}
+
+// SetHostname sets the hostname of the guest
+func (b *CloudInitBuilder) SetHostname(hostname string) *CloudInitBuilder {
+	b.config.Hostname = hostname
+	return b
+}
+
+// AddUser adds a user
+func (b *CloudInitBuilder) AddUser(user CloudInitUser) *CloudInitBuilder {
+	b.users = append(b.users, user)
+	return b
+}
+
+// AddSSHAuthorizedKeys authorizes keys for the default user
+func (b *CloudInitBuilder) AddSSHAuthorizedKeys(keys ...string) *CloudInitBuilder {
+	b.config.SSHAuthorizedKeys = append(b.config.SSHAuthorizedKeys, keys...)
+	return b
+}
+
+// AddFile writes a file in the guest
+func (b *CloudInitBuilder) AddFile(file CloudInitFile) *CloudInitBuilder {
+	b.config.WriteFiles = append(b.config.WriteFiles, cloudConfigFile{
+		Path:        file.Path,
+		Content:     base64.StdEncoding.EncodeToString(file.Content),
+		Encoding:    "b64",
+		Permissions: file.Permissions,
+		Owner:       file.Owner,
+		Append:      file.Append,
+	})
+	return b
+}
+
+// AddRunCommand runs a command on first boot. The arguments are passed to the command without a shell.
+func (b *CloudInitBuilder) AddRunCommand(args ...string) *CloudInitBuilder {
+	b.config.RunCmd = append(b.config.RunCmd, args)
+	return b
+}
+
+// SetNetworkConfig applies a network config version 2 in the guest.
+// The node agent generates the network config of the data source, so the config is written as a netplan file, applied on
+// first boot, and registered with cloud-init so it is not replaced on later boots.
+func (b *CloudInitBuilder) SetNetworkConfig(config *NetworkConfig) *CloudInitBuilder {
+	b.network = config
+	return b
+}
+
+// AddPart adds a part to the user data, which is then sent as a multipart MIME document with the cloud-config first
+func (b *CloudInitBuilder) AddPart(contentType string, content []byte) *CloudInitBuilder {
+	b.parts = append(b.parts, mimePart{contentType: contentType, content: content})
+	return b
+}
+
+// Build returns the user data
+func (b *CloudInitBuilder) Build() ([]byte, error) {
+	config := b.config
+	config.WriteFiles = append([]cloudConfigFile{}, b.config.WriteFiles...)
+	config.RunCmd = append([][]string{}, b.config.RunCmd...)
+
+	if len(b.users) > 0 {
+		if b.dataSource == common.CloudInitDataSource_Azure {
+			config.Users = append(config.Users, "default")
+		}
+		for _, user := range b.users {
+			if user.Name == "" {
+				return nil, errors.Wrapf(errors.InvalidInput, "Cloud-init user name is missing")
+			}
+			config.Users = append(config.Users, user)
+		}
+	}
+
+	if b.network != nil {
+		netplan, err := yaml.Marshal(map[string]interface{}{"network": struct {
+			Version        int `yaml:"version"`
+			*NetworkConfig `yaml:",inline"`
+		}{2, b.network}})
+		if err != nil {
+			return nil, errors.Wrapf(errors.InvalidInput, "Unable to encode network config: %v", err)
+		}
+		config.WriteFiles = append(config.WriteFiles,
+			cloudConfigFile{Path: netplanPath, Content: base64.StdEncoding.EncodeToString(netplan), Encoding: "b64", Permissions: "0600"},
+			cloudConfigFile{Path: cloudInitNetworkPath, Content: base64.StdEncoding.EncodeToString(netplan), Encoding: "b64", Permissions: "0644"},
+		)
+		config.RunCmd = append([][]string{{"netplan", "apply"}}, config.RunCmd...)
+	}
+
+	for _, file := range config.WriteFiles {
+		if file.Path == "" {
+			return nil, errors.Wrapf(errors.InvalidInput, "Cloud-init file path is missing")
+		}
+	}
+
+	body, err := yaml.Marshal(config)
+	if err != nil {
+		return nil, errors.Wrapf(errors.InvalidInput, "Unable to encode cloud-config: %v", err)
+	}
+	cloudConfig := append([]byte("#cloud-config\n"), body...)
+	if len(b.parts) == 0 {
+		return cloudConfig, nil
+	}
+	return getMultipartUserData(append([]mimePart{{contentType: CloudConfigContentType, content: cloudConfig}}, b.parts...))
+}
+
+// CustomData returns the user data encoded for OSProfile.CustomData
+func (b *CloudInitBuilder) CustomData() (*string, error) {
+	data, err := b.Build()
+	if err != nil {
+		return nil, err
+	}
+	customData := base64.StdEncoding.EncodeToString(data)
+	return &customData, nil
+}
+
+// Apply sets the custom data and bootstrap engine of the OS profile
+func (b *CloudInitBuilder) Apply(profile *compute.OSProfile) error {
+	if profile == nil {
+		return errors.Wrapf(errors.InvalidInput, "OS profile is nil")
+	}
+	if profile.LinuxConfiguration != nil && profile.LinuxConfiguration.CloudInitDataSource != b.dataSource {
+		return errors.Wrapf(errors.InvalidInput, "The builder targets the %s data source but the OS profile uses %s", b.dataSource, profile.LinuxConfiguration.CloudInitDataSource)
+	}
+	customData, err := b.CustomData()
+	if err != nil {
+		return err
+	}
+	profile.CustomData = customData
+	profile.OsBootstrapEngine = compute.CloudInit
+	return nil
+}
+
+func getMultipartUserData(parts []mimePart) ([]byte, error) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for i, part := range parts {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", fmt.Sprintf("%s; charset=\"utf-8\"", part.contentType))
+		header.Set("Content-Transfer-Encoding", "base64")
+		header.Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"part-%03d\"", i))
+		w, err := writer.CreatePart(header)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = w.Write([]byte(base64.StdEncoding.EncodeToString(part.content))); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "Content-Type: multipart/mixed; boundary=\"%s\"\nMIME-Version: 1.0\n\n", writer.Boundary())
+	out.Write(body.Bytes())
+	return out.Bytes(), nil
+}
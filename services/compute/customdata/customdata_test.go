@@ -0,0 +1,140 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package customdata
+
+import (
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/microsoft/moc/rpc/common"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+
+	"github.com/microsoft/wssd-sdk-for-go/services/compute"
+)
+
+func Test_CloudInitBuilder(t *testing.T) {
+	dhcp := true
+	b := NewCloudInitBuilder(&compute.LinuxConfiguration{CloudInitDataSource: common.CloudInitDataSource_Azure}).
+		SetHostname("vm1").
+		AddUser(CloudInitUser{Name: "ops", Groups: []string{"sudo"}, SSHAuthorizedKeys: []string{"ssh-ed25519 AAAA ops"}}).
+		AddFile(CloudInitFile{Path: "/etc/motd", Content: []byte("hello: world\n")}).
+		AddRunCommand("systemctl", "restart", "sshd").
+		SetNetworkConfig(&NetworkConfig{Ethernets: map[string]EthernetConfig{"eth0": {DHCP4: &dhcp}}})
+
+	data, err := b.Build()
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(string(data), "#cloud-config\n"))
+
+	config := map[string]interface{}{}
+	assert.Nil(t, yaml.Unmarshal(data, &config))
+	assert.Equal(t, "vm1", config["hostname"])
+	users := config["users"].([]interface{})
+	assert.Equal(t, "default", users[0])
+	assert.Equal(t, "ops", users[1].(map[string]interface{})["name"])
+
+	files := config["write_files"].([]interface{})
+	assert.Len(t, files, 3)
+	motd := files[0].(map[string]interface{})
+	content, _ := base64.StdEncoding.DecodeString(motd["content"].(string))
+	assert.Equal(t, "hello: world\n", string(content))
+	netplan := files[1].(map[string]interface{})
+	assert.Equal(t, netplanPath, netplan["path"])
+	content, _ = base64.StdEncoding.DecodeString(netplan["content"].(string))
+	assert.Contains(t, string(content), "version: 2")
+	assert.Contains(t, string(content), "dhcp4: true")
+
+	runcmd := config["runcmd"].([]interface{})
+	assert.Equal(t, []interface{}{"netplan", "apply"}, runcmd[0])
+	assert.Equal(t, []interface{}{"systemctl", "restart", "sshd"}, runcmd[1])
+
+	// NoCloud creates exactly the users listed
+	data, err = NewCloudInitBuilder(nil).AddUser(CloudInitUser{Name: "ops"}).Build()
+	assert.Nil(t, err)
+	assert.NotContains(t, string(data), "default")
+
+	profile := &compute.OSProfile{LinuxConfiguration: &compute.LinuxConfiguration{}}
+	assert.NotNil(t, b.Apply(profile))
+	profile.LinuxConfiguration.CloudInitDataSource = common.CloudInitDataSource_Azure
+	assert.Nil(t, b.Apply(profile))
+	assert.Equal(t, compute.CloudInit, profile.OsBootstrapEngine)
+	decoded, err := base64.StdEncoding.DecodeString(*profile.CustomData)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(string(decoded), "#cloud-config\n"))
+}
+
+func Test_CloudInitBuilderMultipart(t *testing.T) {
+	data, err := NewCloudInitBuilder(nil).
+		AddRunCommand("true").
+		AddPart(ShellScriptContentType, []byte("#!/bin/sh\necho hi\n")).
+		Build()
+	assert.Nil(t, err)
+
+	msg, err := mail.ReadMessage(strings.NewReader(string(data)))
+	assert.Nil(t, err)
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	assert.Nil(t, err)
+	assert.Equal(t, "multipart/mixed", mediaType)
+
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	expected := []struct{ contentType, prefix string }{
+		{CloudConfigContentType, "#cloud-config\n"},
+		{ShellScriptContentType, "#!/bin/sh\n"},
+	}
+	for _, e := range expected {
+		part, err := reader.NextPart()
+		assert.Nil(t, err)
+		assert.True(t, strings.HasPrefix(part.Header.Get("Content-Type"), e.contentType))
+		encoded, _ := io.ReadAll(part)
+		content, err := base64.StdEncoding.DecodeString(string(encoded))
+		assert.Nil(t, err)
+		assert.True(t, strings.HasPrefix(string(content), e.prefix))
+	}
+	_, err = reader.NextPart()
+	assert.Equal(t, io.EOF, err)
+}
+
+func Test_UnattendBuilder(t *testing.T) {
+	port := uint16(3390)
+	profile := &compute.OSProfile{
+		ComputerName:  strPtr("win1"),
+		AdminPassword: strPtr("p<ss>&word"),
+		WindowsConfiguration: &compute.WindowsConfiguration{
+			TimeZone: strPtr("Pacific Standard Time"),
+			RDP:      &compute.RDPConfiguration{Port: &port},
+			WinRM:    &compute.WinRMConfiguration{Listeners: &[]compute.WinRMListener{{Protocol: compute.HTTPS}}},
+		},
+	}
+	data, err := NewUnattendBuilder(profile).Build()
+	assert.Nil(t, err)
+	xmlData := string(data)
+	assert.Contains(t, xmlData, `xmlns="urn:schemas-microsoft-com:unattend"`)
+	assert.Contains(t, xmlData, "<ComputerName>win1</ComputerName>")
+	assert.Contains(t, xmlData, "<TimeZone>Pacific Standard Time</TimeZone>")
+	assert.Contains(t, xmlData, "<fDenyTSConnections>false</fDenyTSConnections>")
+	assert.Contains(t, xmlData, "PortNumber -Value 3390")
+	assert.Contains(t, xmlData, "Enable-PSRemoting")
+	assert.Contains(t, xmlData, "-Transport HTTPS")
+	assert.Contains(t, xmlData, `wcm:action="add"`)
+	assert.Contains(t, xmlData, "<Value>p&lt;ss&gt;&amp;word</Value>")
+
+	_, err = NewUnattendBuilder(nil).SetComputerName("a-very-long-computer-name").Build()
+	assert.NotNil(t, err)
+
+	assert.Nil(t, NewUnattendBuilder(profile).DisableRDP().Apply(profile))
+	assert.Equal(t, compute.WindowsAnswerFiles, profile.OsBootstrapEngine)
+	decoded, err := base64.StdEncoding.DecodeString(*profile.CustomData)
+	assert.Nil(t, err)
+	assert.Contains(t, string(decoded), "<fDenyTSConnections>true</fDenyTSConnections>")
+	assert.NotContains(t, string(decoded), "PortNumber")
+}
+
+func strPtr(s string) *string {
+	return &s
+}
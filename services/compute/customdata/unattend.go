@@ -0,0 +1,259 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package customdata
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+
+	"github.com/microsoft/moc/pkg/errors"
+
+	"github.com/microsoft/wssd-sdk-for-go/services/compute"
+)
+
+const (
+	unattendNamespace    = "urn:schemas-microsoft-com:unattend"
+	unattendWcmNamespace = "http://schemas.microsoft.com/WMIConfig/2002/State"
+	// maxComputerNameLength is the NetBIOS name limit enforced by Windows setup
+	maxComputerNameLength = 15
+	// remoteDesktopFirewallGroup is the language neutral name of the built-in Remote Desktop firewall rules
+	remoteDesktopFirewallGroup = "@FirewallAPI.dll,-28752"
+)
+
+type unattend struct {
+	XMLName  xml.Name           `xml:"unattend"`
+	Xmlns    string             `xml:"xmlns,attr"`
+	XmlnsWcm string             `xml:"xmlns:wcm,attr"`
+	Settings []unattendSettings `xml:"settings"`
+}
+
+type unattendSettings struct {
+	Pass       string              `xml:"pass,attr"`
+	Components []unattendComponent `xml:"component"`
+}
+
+type unattendComponent struct {
+	Name                  string `xml:"name,attr"`
+	ProcessorArchitecture string `xml:"processorArchitecture,attr"`
+	PublicKeyToken        string `xml:"publicKeyToken,attr"`
+	Language              string `xml:"language,attr"`
+	VersionScope          string `xml:"versionScope,attr"`
+
+	ComputerName       string                  `xml:"ComputerName,omitempty"`
+	TimeZone           string                  `xml:"TimeZone,omitempty"`
+	FDenyTSConnections *bool                   `xml:"fDenyTSConnections,omitempty"`
+	RunSynchronous     *unattendRunSynchronous `xml:"RunSynchronous,omitempty"`
+	UserAccounts       *unattendUserAccounts   `xml:"UserAccounts,omitempty"`
+}
+
+type unattendRunSynchronous struct {
+	Commands []unattendCommand `xml:"RunSynchronousCommand"`
+}
+
+type unattendCommand struct {
+	Action      string `xml:"wcm:action,attr"`
+	Order       int    `xml:"Order"`
+	Description string `xml:"Description"`
+	Path        string `xml:"Path"`
+}
+
+type unattendUserAccounts struct {
+	AdministratorPassword unattendPassword `xml:"AdministratorPassword"`
+}
+
+type unattendPassword struct {
+	Value     string `xml:"Value"`
+	PlainText bool   `xml:"PlainText"`
+}
+
+// UnattendBuilder builds a Windows unattend.xml answer file
+type UnattendBuilder struct {
+	computerName   string
+	adminPassword  string
+	timeZone       string
+	rdp            *compute.RDPConfiguration
+	winRMProtocols []compute.ProtocolTypes
+}
+
+// NewUnattendBuilder returns a builder initialized from the computer name, administrator password and Windows
+// configuration of the OS profile, if any
+func NewUnattendBuilder(profile *compute.OSProfile) *UnattendBuilder {
+	b := &UnattendBuilder{}
+	if profile == nil {
+		return b
+	}
+	if profile.ComputerName != nil {
+		b.computerName = *profile.ComputerName
+	}
+	if profile.AdminPassword != nil {
+		b.adminPassword = *profile.AdminPassword
+	}
+	if windows := profile.WindowsConfiguration; windows != nil {
+		if windows.TimeZone != nil {
+			b.timeZone = *windows.TimeZone
+		}
+		b.rdp = windows.RDP
+		if windows.WinRM != nil && windows.WinRM.Listeners != nil {
+			for _, listener := range *windows.WinRM.Listeners {
+				b.winRMProtocols = append(b.winRMProtocols, listener.Protocol)
+			}
+		}
+	}
+	return b
+}
+
+// SetComputerName sets the computer name of the guest
+func (b *UnattendBuilder) SetComputerName(computerName string) *UnattendBuilder {
+	b.computerName = computerName
+	return b
+}
+
+// SetAdminPassword sets the password of the built-in Administrator account
+func (b *UnattendBuilder) SetAdminPassword(password string) *UnattendBuilder {
+	b.adminPassword = password
+	return b
+}
+
+// SetTimeZone sets the time zone of the guest, e.g. "Pacific Standard Time"
+func (b *UnattendBuilder) SetTimeZone(timeZone string) *UnattendBuilder {
+	b.timeZone = timeZone
+	return b
+}
+
+// EnableRDP allows Remote Desktop connections, on a custom port if port is not 0
+func (b *UnattendBuilder) EnableRDP(port uint16) *UnattendBuilder {
+	disable := false
+	b.rdp = &compute.RDPConfiguration{DisableRDP: &disable}
+	if port != 0 {
+		b.rdp.Port = &port
+	}
+	return b
+}
+
+// DisableRDP denies Remote Desktop connections
+func (b *UnattendBuilder) DisableRDP() *UnattendBuilder {
+	disable := true
+	b.rdp = &compute.RDPConfiguration{DisableRDP: &disable}
+	return b
+}
+
+// AddWinRMListener adds a WinRM listener. HTTPS listeners use a self-signed certificate created in the guest.
+func (b *UnattendBuilder) AddWinRMListener(protocol compute.ProtocolTypes) *UnattendBuilder {
+	b.winRMProtocols = append(b.winRMProtocols, protocol)
+	return b
+}
+
+// Build returns the answer file
+func (b *UnattendBuilder) Build() ([]byte, error) {
+	if len(b.computerName) > maxComputerNameLength {
+		return nil, errors.Wrapf(errors.InvalidInput, "Computer name [%s] is longer than %d characters", b.computerName, maxComputerNameLength)
+	}
+
+	specialize := unattendSettings{Pass: "specialize"}
+	shellSetup := newUnattendComponent("Microsoft-Windows-Shell-Setup")
+	shellSetup.ComputerName = b.computerName
+	shellSetup.TimeZone = b.timeZone
+	if shellSetup.ComputerName != "" || shellSetup.TimeZone != "" {
+		specialize.Components = append(specialize.Components, shellSetup)
+	}
+
+	commands := []string{}
+	if b.rdp != nil {
+		deny := b.rdp.DisableRDP != nil && *b.rdp.DisableRDP
+		sessionManager := newUnattendComponent("Microsoft-Windows-TerminalServices-LocalSessionManager")
+		sessionManager.FDenyTSConnections = &deny
+		specialize.Components = append(specialize.Components, sessionManager)
+		if !deny {
+			commands = append(commands, fmt.Sprintf("Enable-NetFirewallRule -Group '%s'", remoteDesktopFirewallGroup))
+			if b.rdp.Port != nil {
+				commands = append(commands,
+					fmt.Sprintf("Set-ItemProperty -Path 'HKLM:\\System\\CurrentControlSet\\Control\\Terminal Server\\WinStations\\RDP-Tcp' -Name PortNumber -Value %d", *b.rdp.Port),
+					fmt.Sprintf("New-NetFirewallRule -DisplayName 'Remote Desktop (TCP-In %d)' -Direction Inbound -Protocol TCP -LocalPort %d -Action Allow", *b.rdp.Port, *b.rdp.Port))
+			}
+		}
+	}
+	if len(b.winRMProtocols) > 0 {
+		commands = append(commands, "Enable-PSRemoting -Force -SkipNetworkProfileCheck")
+		https := false
+		for _, protocol := range b.winRMProtocols {
+			switch protocol {
+			case compute.HTTP:
+			case compute.HTTPS:
+				https = true
+			default:
+				return nil, errors.Wrapf(errors.InvalidInput, "Unsupported WinRM listener protocol [%s]", protocol)
+			}
+		}
+		if https {
+			commands = append(commands,
+				"$c = New-SelfSignedCertificate -DnsName $env:COMPUTERNAME -CertStoreLocation Cert:\\LocalMachine\\My; "+
+					"New-Item -Path WSMan:\\localhost\\Listener -Transport HTTPS -Address * -CertificateThumbPrint $c.Thumbprint -Force",
+				"New-NetFirewallRule -DisplayName 'Windows Remote Management (HTTPS-In)' -Direction Inbound -Protocol TCP -LocalPort 5986 -Action Allow")
+		}
+	}
+	if len(commands) > 0 {
+		deployment := newUnattendComponent("Microsoft-Windows-Deployment")
+		deployment.RunSynchronous = &unattendRunSynchronous{}
+		for i, command := range commands {
+			deployment.RunSynchronous.Commands = append(deployment.RunSynchronous.Commands, unattendCommand{
+				Action:      "add",
+				Order:       i + 1,
+				Description: fmt.Sprintf("customdata-%d", i+1),
+				Path:        fmt.Sprintf("powershell.exe -NoProfile -ExecutionPolicy Bypass -Command \"%s\"", command),
+			})
+		}
+		specialize.Components = append(specialize.Components, deployment)
+	}
+
+	answerFile := unattend{Xmlns: unattendNamespace, XmlnsWcm: unattendWcmNamespace}
+	if len(specialize.Components) > 0 {
+		answerFile.Settings = append(answerFile.Settings, specialize)
+	}
+	if b.adminPassword != "" {
+		oobe := newUnattendComponent("Microsoft-Windows-Shell-Setup")
+		oobe.UserAccounts = &unattendUserAccounts{AdministratorPassword: unattendPassword{Value: b.adminPassword, PlainText: true}}
+		answerFile.Settings = append(answerFile.Settings, unattendSettings{Pass: "oobeSystem", Components: []unattendComponent{oobe}})
+	}
+
+	data, err := xml.MarshalIndent(answerFile, "", "  ")
+	if err != nil {
+		return nil, errors.Wrapf(errors.InvalidInput, "Unable to encode answer file: %v", err)
+	}
+	return append([]byte(xml.Header), data...), nil
+}
+
+// CustomData returns the answer file encoded for OSProfile.CustomData
+func (b *UnattendBuilder) CustomData() (*string, error) {
+	data, err := b.Build()
+	if err != nil {
+		return nil, err
+	}
+	customData := base64.StdEncoding.EncodeToString(data)
+	return &customData, nil
+}
+
+// Apply sets the custom data and bootstrap engine of the OS profile
+func (b *UnattendBuilder) Apply(profile *compute.OSProfile) error {
+	if profile == nil {
+		return errors.Wrapf(errors.InvalidInput, "OS profile is nil")
+	}
+	customData, err := b.CustomData()
+	if err != nil {
+		return err
+	}
+	profile.CustomData = customData
+	profile.OsBootstrapEngine = compute.WindowsAnswerFiles
+	return nil
+}
+
+func newUnattendComponent(name string) unattendComponent {
+	return unattendComponent{
+		Name:                  name,
+		ProcessorArchitecture: "amd64",
+		PublicKeyToken:        "31bf3856ad364e35",
+		Language:              "neutral",
+		VersionScope:          "nonSxS",
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package compute
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/microsoft/moc/pkg/errors"
+)
+
+// The node agent has no diagnostics configuration; the boot diagnostics declaration is kept in tags with these keys.
+// Nothing on the node captures console output for it.
+const (
+	bootDiagnosticsTagPrefix     = "wssdsdk.bootdiagnostics."
+	bootDiagnosticsEnabledTag    = bootDiagnosticsTagPrefix + "enabled"
+	bootDiagnosticsStorageURITag = bootDiagnosticsTagPrefix + "storageuri"
+)
+
+// BootDiagnosticsToTags returns a copy of tags with the boot diagnostics of diagnostics added. Tags starting with
+// wssdsdk.bootdiagnostics. are reserved for the declaration and rejected.
+func BootDiagnosticsToTags(diagnostics *DiagnosticsProfile, tags map[string]*string) (map[string]*string, error) {
+	for key := range tags {
+		if strings.HasPrefix(key, bootDiagnosticsTagPrefix) {
+			return nil, errors.Wrapf(errors.InvalidInput, "Tag [%s] is reserved for boot diagnostics", key)
+		}
+	}
+	if diagnostics == nil || diagnostics.BootDiagnostics == nil {
+		return tags, nil
+	}
+	result := map[string]*string{}
+	for key, value := range tags {
+		result[key] = value
+	}
+	if diagnostics.BootDiagnostics.Enabled != nil {
+		enabled := strconv.FormatBool(*diagnostics.BootDiagnostics.Enabled)
+		result[bootDiagnosticsEnabledTag] = &enabled
+	}
+	if diagnostics.BootDiagnostics.StorageURI != nil {
+		storageURI := *diagnostics.BootDiagnostics.StorageURI
+		result[bootDiagnosticsStorageURITag] = &storageURI
+	}
+	return result, nil
+}
+
+// BootDiagnosticsFromTags returns the boot diagnostics kept in tags, or nil if there are none, and the other tags
+func BootDiagnosticsFromTags(tags map[string]*string) (*DiagnosticsProfile, map[string]*string) {
+	var diagnostics *BootDiagnostics
+	result := map[string]*string{}
+	for key, value := range tags {
+		if !strings.HasPrefix(key, bootDiagnosticsTagPrefix) {
+			result[key] = value
+			continue
+		}
+		if value == nil {
+			continue
+		}
+		if diagnostics == nil {
+			diagnostics = &BootDiagnostics{}
+		}
+		switch key {
+		case bootDiagnosticsEnabledTag:
+			enabled := *value == "true"
+			diagnostics.Enabled = &enabled
+		case bootDiagnosticsStorageURITag:
+			storageURI := *value
+			diagnostics.StorageURI = &storageURI
+		}
+	}
+	if diagnostics == nil {
+		return nil, result
+	}
+	return &DiagnosticsProfile{BootDiagnostics: diagnostics}, result
+}
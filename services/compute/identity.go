@@ -0,0 +1,272 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package compute
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/microsoft/moc/pkg/errors"
+
+	"github.com/microsoft/wssd-sdk-for-go/services/security"
+	"github.com/microsoft/wssd-sdk-for-go/services/security/keyvault"
+)
+
+// The node agent does not carry identities; the declaration is kept in tags with these keys
+const (
+	identityTagPrefix       = "wssdsdk.identity."
+	identityTypeTag         = "wssdsdk.identity.type"
+	identityUserAssignedTag = "wssdsdk.identity.userassigned"
+	identityKeyVaultTag     = "wssdsdk.identity.keyvault"
+)
+
+// IdentityService is the part of the security identity client used to create and read identities
+type IdentityService interface {
+	Get(context.Context, string, string) (*[]security.Identity, error)
+	CreateOrUpdate(context.Context, string, string, *security.Identity) (*security.Identity, error)
+	Delete(context.Context, string, string) error
+}
+
+// SecretSetter is the part of the keyvault secret client used to project identities
+type SecretSetter interface {
+	CreateOrUpdate(context.Context, string, string, *keyvault.Secret) (*keyvault.Secret, error)
+}
+
+// SystemAssignedIdentityName returns the name of the identity created for resourceName
+func SystemAssignedIdentityName(resourceName string) string {
+	return resourceName + "-identity"
+}
+
+// IdentityTokenSecretName returns the name of the secret the token of identityName is projected to
+func IdentityTokenSecretName(identityName string) string {
+	return identityName + "-token"
+}
+
+// IdentityCertificateSecretName returns the name of the secret the certificate of identityName is projected to
+func IdentityCertificateSecretName(identityName string) string {
+	return identityName + "-certificate"
+}
+
+// IdentityToTags returns a copy of tags with the declaration of identity added. Tags starting with wssdsdk.identity. are
+// reserved for the declaration and rejected.
+func IdentityToTags(identity *VirtualMachineScaleSetIdentity, tags map[string]*string) (map[string]*string, error) {
+	for key := range tags {
+		if strings.HasPrefix(key, identityTagPrefix) {
+			return nil, errors.Wrapf(errors.InvalidInput, "Tag [%s] is reserved: the node agent does not carry identities, they are kept in tags", key)
+		}
+	}
+	if identity == nil {
+		return tags, nil
+	}
+	result := map[string]*string{}
+	for key, value := range tags {
+		result[key] = value
+	}
+	if identity.Type != "" {
+		identityType := string(identity.Type)
+		result[identityTypeTag] = &identityType
+	}
+	if len(identity.UserAssignedIdentities) > 0 {
+		userAssigned := strings.Join(getUserAssignedIdentityNames(identity), ",")
+		result[identityUserAssignedTag] = &userAssigned
+	}
+	if identity.KeyVaultName != nil {
+		result[identityKeyVaultTag] = identity.KeyVaultName
+	}
+	return result, nil
+}
+
+// IdentityFromTags returns the identity declared in tags, or nil if there is none, and the other tags
+func IdentityFromTags(tags map[string]*string) (*VirtualMachineScaleSetIdentity, map[string]*string) {
+	var identity *VirtualMachineScaleSetIdentity
+	result := map[string]*string{}
+	for key, value := range tags {
+		if !strings.HasPrefix(key, identityTagPrefix) {
+			result[key] = value
+			continue
+		}
+		if identity == nil {
+			identity = &VirtualMachineScaleSetIdentity{}
+		}
+		if value == nil {
+			continue
+		}
+		switch key {
+		case identityTypeTag:
+			identity.Type = ResourceIdentityType(*value)
+		case identityUserAssignedTag:
+			identity.UserAssignedIdentities = map[string]*VirtualMachineScaleSetIdentityUserAssignedIdentitiesValue{}
+			for _, name := range strings.Split(*value, ",") {
+				identity.UserAssignedIdentities[name] = &VirtualMachineScaleSetIdentityUserAssignedIdentitiesValue{}
+			}
+		case identityKeyVaultTag:
+			keyVaultName := *value
+			identity.KeyVaultName = &keyVaultName
+		}
+	}
+	return identity, result
+}
+
+// EnsureIdentities creates the system assigned identity of resourceName if declared, checks that the user assigned
+// identities exist and, if identity.KeyVaultName is set, projects their tokens and certificates as secrets of that vault
+func EnsureIdentities(ctx context.Context, identities IdentityService, secrets SecretSetter, group, resourceName string, identity *VirtualMachineScaleSetIdentity) error {
+	if identity == nil || identity.Type == "" || identity.Type == ResourceIdentityTypeNone {
+		return nil
+	}
+	systemAssigned, userAssigned, err := getIdentityTypes(identity)
+	if err != nil {
+		return err
+	}
+	if identities == nil {
+		return errors.Wrapf(errors.NotInitialized, "No identity client to bind the identities of [%s]", resourceName)
+	}
+
+	bound := []*security.Identity{}
+	if systemAssigned {
+		name := SystemAssignedIdentityName(resourceName)
+		found, err := getIdentity(ctx, identities, group, name)
+		if errors.IsNotFound(err) {
+			found, err = identities.CreateOrUpdate(ctx, group, name, &security.Identity{Name: &name})
+		}
+		if err != nil {
+			return errors.Wrapf(err, "Unable to create identity [%s]", name)
+		}
+		bound = append(bound, found)
+	}
+	if userAssigned {
+		for _, name := range getUserAssignedIdentityNames(identity) {
+			found, err := getIdentity(ctx, identities, group, name)
+			if err != nil {
+				return errors.Wrapf(err, "Unable to bind identity [%s]", name)
+			}
+			bound = append(bound, found)
+		}
+	}
+
+	if identity.KeyVaultName == nil {
+		return nil
+	}
+	if secrets == nil {
+		return errors.Wrapf(errors.NotInitialized, "No keyvault secret client to project the identities of [%s]", resourceName)
+	}
+	for _, id := range bound {
+		if id.Name == nil {
+			continue
+		}
+		if id.Token != nil {
+			if err := setSecret(ctx, secrets, group, *identity.KeyVaultName, IdentityTokenSecretName(*id.Name), *id.Token); err != nil {
+				return err
+			}
+		}
+		if id.Certificate != nil {
+			if err := setSecret(ctx, secrets, group, *identity.KeyVaultName, IdentityCertificateSecretName(*id.Name), *id.Certificate); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// FillIdentityIDs sets the principal IDs of the system assigned identity of resourceName and of the user assigned
+// identities. Identities that no longer exist are left without IDs. The identity service has no client IDs, so ClientID
+// is left empty.
+func FillIdentityIDs(ctx context.Context, identities IdentityService, group, resourceName string, identity *VirtualMachineScaleSetIdentity) error {
+	if identity == nil || identities == nil || identity.Type == "" || identity.Type == ResourceIdentityTypeNone {
+		return nil
+	}
+	systemAssigned, userAssigned, err := getIdentityTypes(identity)
+	if err != nil {
+		return err
+	}
+	if systemAssigned {
+		found, err := getIdentity(ctx, identities, group, SystemAssignedIdentityName(resourceName))
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		if found != nil {
+			identity.PrincipalID = found.ID
+		}
+	}
+	if userAssigned {
+		for _, name := range getUserAssignedIdentityNames(identity) {
+			found, err := getIdentity(ctx, identities, group, name)
+			if err != nil && !errors.IsNotFound(err) {
+				return err
+			}
+			value := &VirtualMachineScaleSetIdentityUserAssignedIdentitiesValue{}
+			if found != nil {
+				value.PrincipalID = found.ID
+			}
+			identity.UserAssignedIdentities[name] = value
+		}
+	}
+	return nil
+}
+
+// DeleteSystemAssignedIdentity deletes the identity created for resourceName, if it declares one
+func DeleteSystemAssignedIdentity(ctx context.Context, identities IdentityService, group, resourceName string, identity *VirtualMachineScaleSetIdentity) error {
+	if identity == nil || identities == nil {
+		return nil
+	}
+	if identity.Type != ResourceIdentityTypeSystemAssigned && identity.Type != ResourceIdentityTypeSystemAssignedUserAssigned {
+		return nil
+	}
+	err := identities.Delete(ctx, group, SystemAssignedIdentityName(resourceName))
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func getIdentityTypes(identity *VirtualMachineScaleSetIdentity) (bool, bool, error) {
+	switch identity.Type {
+	case ResourceIdentityTypeSystemAssigned:
+		return true, false, nil
+	case ResourceIdentityTypeUserAssigned:
+		if len(identity.UserAssignedIdentities) == 0 {
+			return false, false, errors.Wrapf(errors.InvalidInput, "Identity type [%s] needs user assigned identities", identity.Type)
+		}
+		return false, true, nil
+	case ResourceIdentityTypeSystemAssignedUserAssigned:
+		if len(identity.UserAssignedIdentities) == 0 {
+			return false, false, errors.Wrapf(errors.InvalidInput, "Identity type [%s] needs user assigned identities", identity.Type)
+		}
+		return true, true, nil
+	default:
+		return false, false, errors.Wrapf(errors.InvalidInput, "Unknown identity type [%s]", identity.Type)
+	}
+}
+
+func getUserAssignedIdentityNames(identity *VirtualMachineScaleSetIdentity) []string {
+	names := []string{}
+	for name := range identity.UserAssignedIdentities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func getIdentity(ctx context.Context, identities IdentityService, group, name string) (*security.Identity, error) {
+	found, err := identities.Get(ctx, group, name)
+	if err != nil {
+		return nil, err
+	}
+	if found == nil || len(*found) == 0 {
+		return nil, errors.Wrapf(errors.NotFound, "Unable to find identity [%s]", name)
+	}
+	return &(*found)[0], nil
+}
+
+func setSecret(ctx context.Context, secrets SecretSetter, group, vaultName, name, value string) error {
+	secret := &keyvault.Secret{
+		Name:             &name,
+		Value:            &value,
+		SecretProperties: &keyvault.SecretProperties{VaultName: &vaultName},
+	}
+	if _, err := secrets.CreateOrUpdate(ctx, group, name, secret); err != nil {
+		return errors.Wrapf(err, "Unable to project secret [%s] to keyvault [%s]", name, vaultName)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package compute
+
+import (
+	"context"
+	"testing"
+
+	"github.com/microsoft/moc/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/microsoft/wssd-sdk-for-go/services/security"
+	"github.com/microsoft/wssd-sdk-for-go/services/security/keyvault"
+)
+
+type fakeIdentities map[string]*security.Identity
+
+func (s fakeIdentities) Get(ctx context.Context, group, name string) (*[]security.Identity, error) {
+	if identity, found := s[name]; found {
+		return &[]security.Identity{*identity}, nil
+	}
+	return nil, errors.NotFound
+}
+
+func (s fakeIdentities) CreateOrUpdate(ctx context.Context, group, name string, identity *security.Identity) (*security.Identity, error) {
+	created := *identity
+	created.ID = proto.String("id-" + name)
+	created.Token = proto.String("token-" + name)
+	s[name] = &created
+	return &created, nil
+}
+
+func (s fakeIdentities) Delete(ctx context.Context, group, name string) error {
+	delete(s, name)
+	return nil
+}
+
+func (s fakeSecrets) CreateOrUpdate(ctx context.Context, group, name string, secret *keyvault.Secret) (*keyvault.Secret, error) {
+	s[*secret.VaultName+"/"+name] = *secret.Value
+	return secret, nil
+}
+
+func Test_IdentityTags(t *testing.T) {
+	identity := &VirtualMachineScaleSetIdentity{
+		Type:                   ResourceIdentityTypeSystemAssignedUserAssigned,
+		UserAssignedIdentities: map[string]*VirtualMachineScaleSetIdentityUserAssignedIdentitiesValue{"b": nil, "a": nil},
+		KeyVaultName:           proto.String("vault"),
+	}
+	tags := map[string]*string{"owner": proto.String("me")}
+
+	withIdentity, err := IdentityToTags(identity, tags)
+	assert.Nil(t, err)
+	assert.Len(t, tags, 1)
+	assert.Equal(t, "a,b", *withIdentity[identityUserAssignedTag])
+
+	got, other := IdentityFromTags(withIdentity)
+	assert.Equal(t, tags, other)
+	assert.Equal(t, identity.Type, got.Type)
+	assert.Equal(t, "vault", *got.KeyVaultName)
+	assert.Len(t, got.UserAssignedIdentities, 2)
+
+	got, _ = IdentityFromTags(tags)
+	assert.Nil(t, got)
+
+	_, err = IdentityToTags(nil, map[string]*string{identityTypeTag: proto.String("SystemAssigned")})
+	assert.True(t, errors.IsInvalidInput(err))
+}
+
+func Test_EnsureIdentities(t *testing.T) {
+	identities := fakeIdentities{"shared": {ID: proto.String("id-shared"), Name: proto.String("shared"), Certificate: proto.String("cert")}}
+	secrets := fakeSecrets{}
+	identity := &VirtualMachineScaleSetIdentity{
+		Type:                   ResourceIdentityTypeSystemAssignedUserAssigned,
+		UserAssignedIdentities: map[string]*VirtualMachineScaleSetIdentityUserAssignedIdentitiesValue{"shared": nil},
+		KeyVaultName:           proto.String("vault"),
+	}
+
+	assert.Nil(t, EnsureIdentities(context.Background(), identities, secrets, "group", "vmss", identity))
+	assert.Contains(t, identities, "vmss-identity")
+	assert.Equal(t, fakeSecrets{"vault/vmss-identity-token": "token-vmss-identity", "vault/shared-certificate": "cert"}, secrets)
+
+	assert.Nil(t, FillIdentityIDs(context.Background(), identities, "group", "vmss", identity))
+	assert.Equal(t, "id-vmss-identity", *identity.PrincipalID)
+	assert.Equal(t, "id-shared", *identity.UserAssignedIdentities["shared"].PrincipalID)
+	assert.Nil(t, identity.UserAssignedIdentities["shared"].ClientID)
+
+	assert.Nil(t, DeleteSystemAssignedIdentity(context.Background(), identities, "group", "vmss", identity))
+	assert.NotContains(t, identities, "vmss-identity")
+
+	missing := &VirtualMachineScaleSetIdentity{
+		Type:                   ResourceIdentityTypeUserAssigned,
+		UserAssignedIdentities: map[string]*VirtualMachineScaleSetIdentityUserAssignedIdentitiesValue{"missing": nil},
+	}
+	assert.True(t, errors.IsNotFound(EnsureIdentities(context.Background(), identities, nil, "group", "vm", missing)))
+	assert.True(t, errors.IsInvalidInput(EnsureIdentities(context.Background(), identities, nil, "group", "vm", &VirtualMachineScaleSetIdentity{Type: "Other"})))
+}
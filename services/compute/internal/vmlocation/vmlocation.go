@@ -0,0 +1,77 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+// Package vmlocation finds the nodes running virtual machines. The node agents do not report where a virtual machine
+// runs, so the agent of each node is asked: a virtual machine runs on the nodes whose agent does not report it as a
+// placeholder.
+package vmlocation
+
+import (
+	"context"
+
+	"github.com/microsoft/moc/pkg/errors"
+
+	"github.com/microsoft/wssd-sdk-for-go/services/compute"
+)
+
+// VirtualMachineGetter is the part of the virtual machine client used to find where a virtual machine runs
+type VirtualMachineGetter interface {
+	Get(context.Context, string, string) (*[]compute.VirtualMachine, error)
+}
+
+// NodeClientFactory connects to the node agent of a node
+type NodeClientFactory func(node string) (VirtualMachineGetter, error)
+
+// Locate returns the nodes running each of vmNames, in the order of nodes. Virtual machines no node runs are left out.
+func Locate(ctx context.Context, newNodeClient NodeClientFactory, nodes []string, vmNames []string) (map[string][]string, error) {
+	hosts := map[string][]string{}
+	for _, node := range nodes {
+		client, err := newNodeClient(node)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Unable to connect to node [%s]", node)
+		}
+		for _, vmName := range vmNames {
+			vms, err := client.Get(ctx, "", vmName)
+			if errors.IsNotFound(err) {
+				continue
+			}
+			if err != nil {
+				return nil, errors.Wrapf(err, "Unable to get Virtual Machine [%s] from node [%s]", vmName, node)
+			}
+			if vms == nil || len(*vms) == 0 || IsPlaceholder(&(*vms)[0]) {
+				continue
+			}
+			hosts[vmName] = append(hosts[vmName], node)
+		}
+	}
+	return hosts, nil
+}
+
+// IsPlaceholder returns whether the node agent reports vm as a placeholder for a virtual machine running on another node
+func IsPlaceholder(vm *compute.VirtualMachine) bool {
+	return vm.VirtualMachineProperties != nil && vm.IsPlaceholder != nil && *vm.IsPlaceholder
+}
+
+// NewFakeNodeClientFactory returns a NodeClientFactory to fake node agents, for tests. The agent of a node reports the
+// virtual machines placement lists for it, and all the others as placeholders.
+func NewFakeNodeClientFactory(placement map[string][]string) NodeClientFactory {
+	return func(node string) (VirtualMachineGetter, error) {
+		hosted := map[string]bool{}
+		for _, vm := range placement[node] {
+			hosted[vm] = true
+		}
+		return &fakeNode{hosted: hosted}, nil
+	}
+}
+
+type fakeNode struct {
+	hosted map[string]bool
+}
+
+func (n *fakeNode) Get(ctx context.Context, group, name string) (*[]compute.VirtualMachine, error) {
+	placeholder := !n.hosted[name]
+	return &[]compute.VirtualMachine{{
+		Name:                     &name,
+		VirtualMachineProperties: &compute.VirtualMachineProperties{IsPlaceholder: &placeholder},
+	}}, nil
+}
@@ -0,0 +1,25 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package vmlocation
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func Test_Locate(t *testing.T) {
+	newNodeClient := NewFakeNodeClientFactory(map[string][]string{
+		"node1": {"vm1", "vm2"},
+		"node2": {"vm2"},
+	})
+	hosts, err := Locate(context.Background(), newNodeClient, []string{"node1", "node2"}, []string{"vm1", "vm2", "vm3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]string{"vm1": {"node1"}, "vm2": {"node1", "node2"}}
+	if !reflect.DeepEqual(hosts, expected) {
+		t.Errorf("Expected %v, got %v", expected, hosts)
+	}
+}
@@ -8,7 +8,10 @@ import (
 
 	"github.com/microsoft/moc/pkg/auth"
 	"github.com/microsoft/wssd-sdk-for-go/services/compute"
+	"github.com/microsoft/wssd-sdk-for-go/services/compute/internal/vmlocation"
 	"github.com/microsoft/wssd-sdk-for-go/services/compute/placementgroup/internal"
+	"github.com/microsoft/wssd-sdk-for-go/services/compute/placementgroup/placement"
+	"github.com/microsoft/wssd-sdk-for-go/services/compute/virtualmachine"
 )
 
 type Service interface {
@@ -20,6 +23,10 @@ type Service interface {
 type PlacementGroupClient struct {
 	compute.BaseClient
 	internal Service
+	// node is the node the client is connected to
+	node string
+	// newNodeClient connects to the node agent of another node, to find the virtual machines it hosts
+	newNodeClient vmlocation.NodeClientFactory
 }
 
 func NewPlacementGroupClient(cloudFQDN string, authorizer auth.Authorizer) (*PlacementGroupClient, error) {
@@ -27,8 +34,11 @@ func NewPlacementGroupClient(cloudFQDN string, authorizer auth.Authorizer) (*Pla
 	if err != nil {
 		return nil, err
 	}
+	newNodeClient := func(node string) (vmlocation.VirtualMachineGetter, error) {
+		return virtualmachine.NewVirtualMachineClient(node, authorizer)
+	}
 
-	return &PlacementGroupClient{internal: c}, nil
+	return &PlacementGroupClient{internal: c, node: cloudFQDN, newNodeClient: newNodeClient}, nil
 }
 
 func (c *PlacementGroupClient) Get(ctx context.Context, name string) (*[]compute.PlacementGroup, error) {
@@ -42,3 +52,18 @@ func (c *PlacementGroupClient) CreateOrUpdate(ctx context.Context, name string,
 func (c *PlacementGroupClient) Delete(ctx context.Context, name string) error {
 	return c.internal.Delete(ctx, name)
 }
+
+// CheckAdmission evaluates placing a virtual machine as proposed. The node agent does not report where virtual machines
+// run, so state gives the nodes and virtual machines; when state has no placement groups, the ones of the node are used.
+func (c *PlacementGroupClient) CheckAdmission(ctx context.Context, state placement.State, proposal placement.Proposal) (*placement.Result, error) {
+	if state.PlacementGroups == nil {
+		pgroups, err := c.internal.Get(ctx, "")
+		if err != nil {
+			return nil, err
+		}
+		if pgroups != nil {
+			state.PlacementGroups = *pgroups
+		}
+	}
+	return placement.Evaluate(state, proposal)
+}
@@ -0,0 +1,141 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package placementgroup
+
+import (
+	"context"
+	"strings"
+
+	"github.com/microsoft/moc/pkg/errors"
+
+	"github.com/microsoft/wssd-sdk-for-go/services/compute"
+	"github.com/microsoft/wssd-sdk-for-go/services/compute/internal/vmlocation"
+	"github.com/microsoft/wssd-sdk-for-go/services/compute/placementgroup/placement"
+)
+
+// AddVmToPlacementGroup adds an existing virtual machine to the placement group pgroup. The virtual machine and the
+// members are looked up on nodes, or on the node the client is connected to when nodes is empty, and the virtual machine
+// is not added where it breaks a strict constraint of the group, such as StrictAntiAffinity. Adding a member is a no-op.
+func (c *PlacementGroupClient) AddVmToPlacementGroup(ctx context.Context, pgroup string, nodeagentVMName string, nodes []placement.Node) error {
+	group, err := c.getPlacementGroup(ctx, pgroup)
+	if err != nil {
+		return err
+	}
+	if isMember(group, nodeagentVMName) {
+		return nil
+	}
+
+	if len(nodes) == 0 {
+		nodes = []placement.Node{{Name: c.node}}
+	}
+	vmNames := []string{nodeagentVMName}
+	for _, vm := range group.VirtualMachines {
+		if vm != nil && vm.Name != nil {
+			vmNames = append(vmNames, *vm.Name)
+		}
+	}
+	vms, err := c.locateVirtualMachines(ctx, nodes, vmNames)
+	if err != nil {
+		return err
+	}
+	node := ""
+	for _, vm := range vms {
+		if vm.Name == nodeagentVMName {
+			node = vm.Node
+		}
+	}
+	if len(node) == 0 {
+		return errors.Wrapf(errors.NotFound, "Unable to find the node hosting Virtual Machine [%s]", nodeagentVMName)
+	}
+
+	state := placement.State{Nodes: nodes, PlacementGroups: []compute.PlacementGroup{*group}, VirtualMachines: vms}
+	result, err := placement.Evaluate(state, placement.Proposal{VirtualMachine: nodeagentVMName, PlacementGroups: []string{pgroup}, Node: node})
+	if err != nil {
+		return err
+	}
+	if !result.Admitted {
+		messages := []string{}
+		for _, violation := range result.Violations {
+			if violation.Strict {
+				messages = append(messages, violation.Message)
+			}
+		}
+		return errors.Wrapf(errors.InvalidInput, "Unable to add Virtual Machine [%s] to Placement Group [%s]: %s", nodeagentVMName, pgroup, strings.Join(messages, "; "))
+	}
+
+	name := nodeagentVMName
+	group.VirtualMachines = append(group.VirtualMachines, &compute.SubResource{Name: &name})
+	_, err = c.internal.CreateOrUpdate(ctx, pgroup, group)
+	return err
+}
+
+// RemoveVmFromPlacementGroup removes a virtual machine from the placement group pgroup. Removing a member cannot break a
+// constraint of the group. Removing a virtual machine that is not a member is a no-op.
+func (c *PlacementGroupClient) RemoveVmFromPlacementGroup(ctx context.Context, pgroup string, nodeagentVMName string) error {
+	group, err := c.getPlacementGroup(ctx, pgroup)
+	if err != nil {
+		return err
+	}
+	if !isMember(group, nodeagentVMName) {
+		return nil
+	}
+	members := []*compute.SubResource{}
+	for _, vm := range group.VirtualMachines {
+		if vm != nil && vm.Name != nil && *vm.Name != nodeagentVMName {
+			members = append(members, vm)
+		}
+	}
+	group.VirtualMachines = members
+	_, err = c.internal.CreateOrUpdate(ctx, pgroup, group)
+	return err
+}
+
+func (c *PlacementGroupClient) getPlacementGroup(ctx context.Context, name string) (*compute.PlacementGroup, error) {
+	if len(name) == 0 {
+		return nil, errors.Wrapf(errors.InvalidInput, "Missing Placement Group name")
+	}
+	pgroups, err := c.internal.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if pgroups == nil || len(*pgroups) == 0 {
+		return nil, errors.Wrapf(errors.NotFound, "Unable to find Placement Group [%s]", name)
+	}
+	group := (*pgroups)[0]
+	if group.PlacementGroupProperties == nil {
+		group.PlacementGroupProperties = &compute.PlacementGroupProperties{}
+	}
+	return &group, nil
+}
+
+// locateVirtualMachines returns the virtual machines of vmNames found running on nodes. A virtual machine reported by
+// several nodes is placed on the first of them.
+func (c *PlacementGroupClient) locateVirtualMachines(ctx context.Context, nodes []placement.Node, vmNames []string) ([]placement.VirtualMachine, error) {
+	nodeNames := []string{}
+	zones := map[string]string{}
+	for _, node := range nodes {
+		nodeNames = append(nodeNames, node.Name)
+		zones[node.Name] = node.Zone
+	}
+	hosts, err := vmlocation.Locate(ctx, c.newNodeClient, nodeNames, vmNames)
+	if err != nil {
+		return nil, err
+	}
+	vms := []placement.VirtualMachine{}
+	for _, vmName := range vmNames {
+		if found := hosts[vmName]; len(found) > 0 {
+			vms = append(vms, placement.VirtualMachine{Name: vmName, Node: found[0], Zone: zones[found[0]]})
+		}
+	}
+	return vms, nil
+}
+
+func isMember(group *compute.PlacementGroup, vmName string) bool {
+	for _, vm := range group.VirtualMachines {
+		if vm != nil && vm.Name != nil && *vm.Name == vmName {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package placementgroup
+
+import (
+	"context"
+	"testing"
+
+	"github.com/microsoft/moc/pkg/errors"
+
+	"github.com/microsoft/wssd-sdk-for-go/services/compute"
+	"github.com/microsoft/wssd-sdk-for-go/services/compute/internal/vmlocation"
+	"github.com/microsoft/wssd-sdk-for-go/services/compute/placementgroup/placement"
+)
+
+type fakeService struct {
+	pgroups map[string]compute.PlacementGroup
+	updates int
+}
+
+func (s *fakeService) Get(ctx context.Context, name string) (*[]compute.PlacementGroup, error) {
+	pgroup, ok := s.pgroups[name]
+	if !ok {
+		return nil, errors.Wrapf(errors.NotFound, "%s", name)
+	}
+	return &[]compute.PlacementGroup{pgroup}, nil
+}
+
+func (s *fakeService) CreateOrUpdate(ctx context.Context, name string, pgroup *compute.PlacementGroup) (*compute.PlacementGroup, error) {
+	s.pgroups[name] = *pgroup
+	s.updates++
+	return pgroup, nil
+}
+
+func (s *fakeService) Delete(ctx context.Context, name string) error {
+	delete(s.pgroups, name)
+	return nil
+}
+
+func newTestClient(placement map[string][]string, members ...string) (*PlacementGroupClient, *fakeService) {
+	name := "pg"
+	refs := []*compute.SubResource{}
+	for i := range members {
+		refs = append(refs, &compute.SubResource{Name: &members[i]})
+	}
+	service := &fakeService{pgroups: map[string]compute.PlacementGroup{
+		name: {
+			Name:                     &name,
+			Type:                     compute.StrictAntiAffinity,
+			PlacementGroupProperties: &compute.PlacementGroupProperties{Scope: compute.ServerScope, VirtualMachines: refs},
+		},
+	}}
+	return &PlacementGroupClient{
+		internal:      service,
+		node:          "node1",
+		newNodeClient: vmlocation.NewFakeNodeClientFactory(placement),
+	}, service
+}
+
+func Test_AddVmToPlacementGroup(t *testing.T) {
+	ctx := context.Background()
+	nodes := []placement.Node{{Name: "node1"}, {Name: "node2"}}
+	client, service := newTestClient(map[string][]string{
+		"node1": {"vm1", "vm3"},
+		"node2": {"vm2"},
+	}, "vm1")
+
+	if err := client.AddVmToPlacementGroup(ctx, "pg", "vm2", nodes); err != nil {
+		t.Fatal(err)
+	}
+	if !isMember(getGroup(service), "vm2") {
+		t.Errorf("Expected vm2 to be a member")
+	}
+	// vm3 shares node1 with vm1
+	if err := client.AddVmToPlacementGroup(ctx, "pg", "vm3", nodes); !errors.IsInvalidInput(err) {
+		t.Errorf("Expected InvalidInput, got %v", err)
+	}
+	if err := client.AddVmToPlacementGroup(ctx, "pg", "vm4", nodes); !errors.IsNotFound(err) {
+		t.Errorf("Expected NotFound, got %v", err)
+	}
+	if err := client.AddVmToPlacementGroup(ctx, "pg", "vm2", nodes); err != nil || service.updates != 1 {
+		t.Errorf("Expected adding a member to be a no-op, got %v after %d updates", err, service.updates)
+	}
+}
+
+func Test_RemoveVmFromPlacementGroup(t *testing.T) {
+	ctx := context.Background()
+	client, service := newTestClient(map[string][]string{"node1": {"vm1", "vm2"}}, "vm1", "vm2")
+
+	if err := client.RemoveVmFromPlacementGroup(ctx, "pg", "vm1"); err != nil {
+		t.Fatal(err)
+	}
+	if members := service.pgroups["pg"].VirtualMachines; len(members) != 1 || *members[0].Name != "vm2" {
+		t.Errorf("Expected vm2 to be the only member, got %v", members)
+	}
+	if err := client.RemoveVmFromPlacementGroup(ctx, "pg", "vm1"); err != nil || service.updates != 1 {
+		t.Errorf("Expected removing a non member to be a no-op, got %v after %d updates", err, service.updates)
+	}
+	if err := client.RemoveVmFromPlacementGroup(ctx, "missing", "vm1"); !errors.IsNotFound(err) {
+		t.Errorf("Expected NotFound, got %v", err)
+	}
+}
+
+func getGroup(service *fakeService) *compute.PlacementGroup {
+	group := service.pgroups["pg"]
+	return &group
+}
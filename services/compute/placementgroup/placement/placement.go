@@ -0,0 +1,302 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+// Package placement evaluates virtual machine placements against the constraints of placement groups
+package placement
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/microsoft/moc/pkg/errors"
+
+	"github.com/microsoft/wssd-sdk-for-go/services/compute"
+)
+
+// Node is a node virtual machines can be placed on
+type Node struct {
+	// Name - The node
+	Name string
+	// Zone - The zone of the node. Empty uses the zone configuration of the placement groups.
+	Zone string
+}
+
+// VirtualMachine is where a virtual machine runs
+type VirtualMachine struct {
+	// Name - The virtual machine
+	Name string
+	// Node - The node hosting the virtual machine
+	Node string
+	// Zone - The zone of the virtual machine. Empty uses the zone of Node.
+	Zone string
+}
+
+// State is the current placement the proposals are evaluated against
+type State struct {
+	// Nodes - The nodes virtual machines can be placed on
+	Nodes []Node
+	// PlacementGroups - The placement groups and their members
+	PlacementGroups []compute.PlacementGroup
+	// VirtualMachines - Where the virtual machines run. Members of a placement group missing here are ignored.
+	VirtualMachines []VirtualMachine
+}
+
+// Proposal places a virtual machine
+type Proposal struct {
+	// VirtualMachine - The virtual machine to place
+	VirtualMachine string
+	// PlacementGroups - The placement groups the virtual machine joins, in addition to the ones listing it as a member
+	PlacementGroups []string
+	// Node - The node to place the virtual machine on. Empty only computes the candidate nodes.
+	Node string
+}
+
+// Violation is a constraint of a placement group a placement breaks
+type Violation struct {
+	// PlacementGroup - The placement group
+	PlacementGroup string
+	// Node - The node of the placement
+	Node string
+	// Strict - The placement must not be admitted. Other violations are best effort constraints.
+	Strict bool
+	// Message - The broken constraint
+	Message string
+}
+
+// Result is the evaluation of a proposal
+type Result struct {
+	// Admitted - Placing the virtual machine on Proposal.Node breaks no strict constraint
+	Admitted bool
+	// Violations - The constraints placing the virtual machine on Proposal.Node breaks
+	Violations []Violation
+	// Candidates - The nodes breaking no strict constraint, those breaking the fewest best effort constraints first
+	Candidates []string
+}
+
+// Evaluate checks the proposal against the placement groups of state:
+//   - Affinity: the members share a node, or a zone with the Zone scope.
+//   - AntiAffinity and StrictAntiAffinity: no two members share a node, or a zone with the Zone scope.
+//   - A placement group with zones only places its members in those zones.
+//
+// StrictAntiAffinity, and the zones of a zone configuration with StrictPlacement, are strict; the other constraints are
+// best effort and only reported. With the Zone scope, a member or node of unknown zone breaks StrictAntiAffinity and is
+// ignored by the best effort constraints.
+func Evaluate(state State, proposal Proposal) (*Result, error) {
+	if len(proposal.VirtualMachine) == 0 {
+		return nil, errors.Wrapf(errors.InvalidInput, "Missing virtual machine name")
+	}
+	groups, err := getProposalGroups(state, proposal)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := []string{}
+	for _, node := range state.Nodes {
+		nodes = append(nodes, node.Name)
+	}
+	if len(proposal.Node) > 0 && getNode(state, proposal.Node) == nil {
+		return nil, errors.Wrapf(errors.NotFound, "Unable to find node [%s]", proposal.Node)
+	}
+
+	result := &Result{Candidates: []string{}}
+	if len(proposal.Node) > 0 {
+		result.Violations = evaluateNode(state, groups, proposal.VirtualMachine, proposal.Node)
+		result.Admitted = !hasStrictViolation(result.Violations)
+	}
+
+	softViolations := map[string]int{}
+	for _, node := range nodes {
+		violations := evaluateNode(state, groups, proposal.VirtualMachine, node)
+		if hasStrictViolation(violations) {
+			continue
+		}
+		softViolations[node] = len(violations)
+		result.Candidates = append(result.Candidates, node)
+	}
+	sort.SliceStable(result.Candidates, func(i, j int) bool {
+		a, b := result.Candidates[i], result.Candidates[j]
+		if softViolations[a] != softViolations[b] {
+			return softViolations[a] < softViolations[b]
+		}
+		return a < b
+	})
+	return result, nil
+}
+
+// evaluateNode returns the constraints of groups broken by placing vmName on node
+func evaluateNode(state State, groups []*compute.PlacementGroup, vmName, node string) []Violation {
+	violations := []Violation{}
+	for _, group := range groups {
+		groupName := getGroupName(group)
+		zoneScope := group.PlacementGroupProperties != nil && group.Scope == compute.ZoneScope
+		zone := getNodeZone(state, group, node)
+
+		if zones := getGroupZones(group); len(zones) > 0 && !zones[zone] {
+			violations = append(violations, Violation{
+				PlacementGroup: groupName,
+				Node:           node,
+				Strict:         isStrictPlacement(group),
+				Message:        fmt.Sprintf("Node [%s] is not in a zone of placement group [%s]", node, groupName),
+			})
+		}
+
+		for _, member := range getMembers(state, group, vmName) {
+			memberDomain, domain, scope := member.Node, node, "node"
+			if zoneScope {
+				memberDomain, domain, scope = getVirtualMachineZone(state, group, member), zone, "zone"
+				if len(memberDomain) == 0 || len(domain) == 0 {
+					// A strict constraint cannot be shown to hold without the zones
+					if group.Type == compute.StrictAntiAffinity {
+						violations = append(violations, Violation{
+							PlacementGroup: groupName,
+							Node:           node,
+							Strict:         true,
+							Message:        fmt.Sprintf("Unable to find the zones of node [%s] and of virtual machine [%s] of placement group [%s]", node, member.Name, groupName),
+						})
+					}
+					continue
+				}
+			}
+			switch group.Type {
+			case compute.Affinity:
+				if memberDomain != domain {
+					violations = append(violations, Violation{
+						PlacementGroup: groupName,
+						Node:           node,
+						Message:        fmt.Sprintf("Virtual machine [%s] of placement group [%s] is in another %s", member.Name, groupName, scope),
+					})
+				}
+			case compute.AntiAffinity, compute.StrictAntiAffinity:
+				if memberDomain == domain {
+					violations = append(violations, Violation{
+						PlacementGroup: groupName,
+						Node:           node,
+						Strict:         group.Type == compute.StrictAntiAffinity,
+						Message:        fmt.Sprintf("Virtual machine [%s] of placement group [%s] is in the same %s", member.Name, groupName, scope),
+					})
+				}
+			}
+		}
+	}
+	return violations
+}
+
+// getProposalGroups returns the placement groups listing the virtual machine and the ones it joins
+func getProposalGroups(state State, proposal Proposal) ([]*compute.PlacementGroup, error) {
+	joins := map[string]bool{}
+	for _, name := range proposal.PlacementGroups {
+		joins[name] = true
+	}
+	groups := []*compute.PlacementGroup{}
+	for i := range state.PlacementGroups {
+		group := &state.PlacementGroups[i]
+		name := getGroupName(group)
+		if joins[name] || isMember(group, proposal.VirtualMachine) {
+			groups = append(groups, group)
+		}
+		delete(joins, name)
+	}
+	for _, name := range proposal.PlacementGroups {
+		if joins[name] {
+			return nil, errors.Wrapf(errors.NotFound, "Unable to find placement group [%s]", name)
+		}
+	}
+	return groups, nil
+}
+
+// getMembers returns the placed members of group other than vmName
+func getMembers(state State, group *compute.PlacementGroup, vmName string) []VirtualMachine {
+	members := []VirtualMachine{}
+	if group.PlacementGroupProperties == nil {
+		return members
+	}
+	for _, vm := range state.VirtualMachines {
+		if vm.Name != vmName && len(vm.Node) > 0 && isMember(group, vm.Name) {
+			members = append(members, vm)
+		}
+	}
+	return members
+}
+
+func isMember(group *compute.PlacementGroup, vmName string) bool {
+	if group.PlacementGroupProperties == nil {
+		return false
+	}
+	for _, vm := range group.VirtualMachines {
+		if vm != nil && vm.Name != nil && *vm.Name == vmName {
+			return true
+		}
+	}
+	return false
+}
+
+func getNode(state State, name string) *Node {
+	for i := range state.Nodes {
+		if state.Nodes[i].Name == name {
+			return &state.Nodes[i]
+		}
+	}
+	return nil
+}
+
+// getNodeZone returns the zone of the node, from the node itself or else from the zones of group
+func getNodeZone(state State, group *compute.PlacementGroup, name string) string {
+	if node := getNode(state, name); node != nil && len(node.Zone) > 0 {
+		return node.Zone
+	}
+	if group.PlacementGroupProperties == nil || group.Zones == nil || group.Zones.Zones == nil {
+		return ""
+	}
+	for _, zone := range *group.Zones.Zones {
+		if zone.Name == nil || zone.Nodes == nil {
+			continue
+		}
+		for _, node := range *zone.Nodes {
+			if node == name {
+				return *zone.Name
+			}
+		}
+	}
+	return ""
+}
+
+func getVirtualMachineZone(state State, group *compute.PlacementGroup, vm VirtualMachine) string {
+	if len(vm.Zone) > 0 {
+		return vm.Zone
+	}
+	return getNodeZone(state, group, vm.Node)
+}
+
+// getGroupZones returns the zones of the zone configuration of group, if any
+func getGroupZones(group *compute.PlacementGroup) map[string]bool {
+	zones := map[string]bool{}
+	if group.PlacementGroupProperties == nil || group.Zones == nil || group.Zones.Zones == nil {
+		return zones
+	}
+	for _, zone := range *group.Zones.Zones {
+		if zone.Name != nil {
+			zones[*zone.Name] = true
+		}
+	}
+	return zones
+}
+
+func isStrictPlacement(group *compute.PlacementGroup) bool {
+	return group.Zones.StrictPlacement != nil && *group.Zones.StrictPlacement
+}
+
+func hasStrictViolation(violations []Violation) bool {
+	for _, violation := range violations {
+		if violation.Strict {
+			return true
+		}
+	}
+	return false
+}
+
+func getGroupName(group *compute.PlacementGroup) string {
+	if group.Name == nil {
+		return ""
+	}
+	return *group.Name
+}
@@ -0,0 +1,114 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package placement
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/microsoft/moc/pkg/errors"
+
+	"github.com/microsoft/wssd-sdk-for-go/services/compute"
+)
+
+func newPlacementGroup(name string, groupType compute.PlacementGroupType, scope compute.PlacementGroupScope, members ...string) compute.PlacementGroup {
+	refs := []*compute.SubResource{}
+	for i := range members {
+		refs = append(refs, &compute.SubResource{Name: &members[i]})
+	}
+	return compute.PlacementGroup{
+		Name: &name,
+		Type: groupType,
+		PlacementGroupProperties: &compute.PlacementGroupProperties{
+			Scope:           scope,
+			VirtualMachines: refs,
+		},
+	}
+}
+
+func newState(groups ...compute.PlacementGroup) State {
+	return State{
+		Nodes: []Node{{Name: "node1", Zone: "zoneA"}, {Name: "node2", Zone: "zoneA"}, {Name: "node3", Zone: "zoneB"}},
+		VirtualMachines: []VirtualMachine{
+			{Name: "vm1", Node: "node1"},
+			{Name: "vm2", Node: "node2"},
+		},
+		PlacementGroups: groups,
+	}
+}
+
+func Test_EvaluateStrictAntiAffinity(t *testing.T) {
+	state := newState(newPlacementGroup("pg", compute.StrictAntiAffinity, compute.ServerScope, "vm1", "vm2"))
+	result, err := Evaluate(state, Proposal{VirtualMachine: "vm3", PlacementGroups: []string{"pg"}, Node: "node1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Admitted || len(result.Violations) != 1 || !result.Violations[0].Strict {
+		t.Errorf("Expected a strict violation, got %+v", result)
+	}
+	if !reflect.DeepEqual(result.Candidates, []string{"node3"}) {
+		t.Errorf("Expected node3 as the only candidate, got %v", result.Candidates)
+	}
+}
+
+func Test_EvaluateZoneScope(t *testing.T) {
+	state := newState(newPlacementGroup("pg", compute.AntiAffinity, compute.ZoneScope, "vm1", "vm3"))
+	result, err := Evaluate(state, Proposal{VirtualMachine: "vm3", Node: "node2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Best effort anti-affinity is reported but admitted
+	if !result.Admitted || len(result.Violations) != 1 || result.Violations[0].Strict {
+		t.Errorf("Expected a best effort violation, got %+v", result)
+	}
+	if !reflect.DeepEqual(result.Candidates, []string{"node3", "node1", "node2"}) {
+		t.Errorf("Unexpected candidates %v", result.Candidates)
+	}
+}
+
+func Test_EvaluateZoneScopeUnknownZone(t *testing.T) {
+	state := newState(newPlacementGroup("pg", compute.StrictAntiAffinity, compute.ZoneScope, "vm1"))
+	state.Nodes = append(state.Nodes, Node{Name: "node4"})
+
+	result, err := Evaluate(state, Proposal{VirtualMachine: "vm3", PlacementGroups: []string{"pg"}, Node: "node4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Admitted || len(result.Violations) != 1 || !result.Violations[0].Strict {
+		t.Errorf("Expected a strict violation, got %+v", result)
+	}
+	if !reflect.DeepEqual(result.Candidates, []string{"node3"}) {
+		t.Errorf("Expected node3 as the only candidate, got %v", result.Candidates)
+	}
+}
+
+func Test_EvaluateAffinityAndZones(t *testing.T) {
+	group := newPlacementGroup("pg", compute.Affinity, compute.ServerScope, "vm1")
+	strict := true
+	zones := []compute.ZoneReference{{Name: stringPtr("zoneA")}}
+	group.Zones = &compute.ZoneConfiguration{Zones: &zones, StrictPlacement: &strict}
+	state := newState(group)
+
+	result, err := Evaluate(state, Proposal{VirtualMachine: "vm3", PlacementGroups: []string{"pg"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Admitted || len(result.Violations) != 0 {
+		t.Errorf("Expected no evaluation of a node, got %+v", result)
+	}
+	if !reflect.DeepEqual(result.Candidates, []string{"node1", "node2"}) {
+		t.Errorf("Unexpected candidates %v", result.Candidates)
+	}
+
+	if _, err := Evaluate(state, Proposal{VirtualMachine: "vm3", PlacementGroups: []string{"missing"}}); !errors.IsNotFound(err) {
+		t.Errorf("Expected NotFound, got %v", err)
+	}
+	if _, err := Evaluate(state, Proposal{VirtualMachine: "vm3", Node: "node9"}); !errors.IsNotFound(err) {
+		t.Errorf("Expected NotFound, got %v", err)
+	}
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
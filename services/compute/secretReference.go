@@ -0,0 +1,76 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package compute
+
+import (
+	"context"
+
+	"github.com/microsoft/moc/pkg/errors"
+
+	"github.com/microsoft/wssd-sdk-for-go/services/security/keyvault"
+)
+
+// SecretGetter is the part of the keyvault secret client used to resolve a SecretReference
+type SecretGetter interface {
+	Get(context.Context, string, string, string) (*[]keyvault.Secret, error)
+}
+
+// GetSecretValue reads the secret ref points at from the keyvault in group
+func GetSecretValue(ctx context.Context, secrets SecretGetter, group string, ref *SecretReference) (string, error) {
+	if ref == nil || ref.VaultName == nil || *ref.VaultName == "" || ref.SecretName == nil || *ref.SecretName == "" {
+		return "", errors.Wrapf(errors.InvalidInput, "A secret reference needs both VaultName and SecretName")
+	}
+	if secrets == nil {
+		return "", errors.Wrapf(errors.NotInitialized, "No keyvault secret client to resolve secret [%s]", *ref.SecretName)
+	}
+	found, err := secrets.Get(ctx, group, *ref.SecretName, *ref.VaultName)
+	if err != nil {
+		return "", errors.Wrapf(err, "Unable to get secret [%s] from keyvault [%s]", *ref.SecretName, *ref.VaultName)
+	}
+	if found == nil || len(*found) == 0 {
+		return "", errors.Wrapf(errors.NotFound, "Unable to find secret [%s] in keyvault [%s]", *ref.SecretName, *ref.VaultName)
+	}
+	if (*found)[0].Value == nil {
+		return "", errors.Wrapf(errors.InvalidConfiguration, "Secret [%s] in keyvault [%s] has no value", *ref.SecretName, *ref.VaultName)
+	}
+	return *(*found)[0].Value, nil
+}
+
+// ResolveOSProfileSecrets returns a copy of the profile with AdminPasswordReference replaced by the password it points at.
+// A profile without a reference is returned as is.
+func ResolveOSProfileSecrets(ctx context.Context, secrets SecretGetter, group string, profile *OSProfile) (*OSProfile, error) {
+	if profile == nil || profile.AdminPasswordReference == nil {
+		return profile, nil
+	}
+	if profile.AdminPassword != nil {
+		return nil, errors.Wrapf(errors.InvalidInput, "Set either AdminPassword or AdminPasswordReference, not both")
+	}
+	password, err := GetSecretValue(ctx, secrets, group, profile.AdminPasswordReference)
+	if err != nil {
+		return nil, err
+	}
+	resolved := *profile
+	resolved.AdminPassword = &password
+	resolved.AdminPasswordReference = nil
+	return &resolved, nil
+}
+
+// ResolveRunCommandSecrets returns a copy of the request with RunAsPasswordReference replaced by the password it points at.
+// A request without a reference is returned as is.
+func ResolveRunCommandSecrets(ctx context.Context, secrets SecretGetter, group string, request *VirtualMachineRunCommandRequest) (*VirtualMachineRunCommandRequest, error) {
+	if request == nil || request.RunAsPasswordReference == nil {
+		return request, nil
+	}
+	if request.RunAsPassword != nil {
+		return nil, errors.Wrapf(errors.InvalidInput, "Set either RunAsPassword or RunAsPasswordReference, not both")
+	}
+	password, err := GetSecretValue(ctx, secrets, group, request.RunAsPasswordReference)
+	if err != nil {
+		return nil, err
+	}
+	resolved := *request
+	resolved.RunAsPassword = &password
+	resolved.RunAsPasswordReference = nil
+	return &resolved, nil
+}
@@ -0,0 +1,69 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package compute
+
+import (
+	"context"
+	"testing"
+
+	"github.com/microsoft/moc/pkg/errors"
+	"github.com/microsoft/moc/pkg/errors/codes"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/microsoft/wssd-sdk-for-go/services/security/keyvault"
+)
+
+type fakeSecrets map[string]string
+
+func (s fakeSecrets) Get(ctx context.Context, group, name, vaultName string) (*[]keyvault.Secret, error) {
+	secrets := []keyvault.Secret{}
+	if value, found := s[vaultName+"/"+name]; found {
+		secrets = append(secrets, keyvault.Secret{Name: &name, Value: &value})
+	}
+	return &secrets, nil
+}
+
+func Test_ResolveOSProfileSecrets(t *testing.T) {
+	secrets := fakeSecrets{"vault/admin": "p@ssw0rd"}
+	ref := &SecretReference{VaultName: proto.String("vault"), SecretName: proto.String("admin")}
+
+	profile := &OSProfile{ComputerName: proto.String("vm1"), AdminPasswordReference: ref}
+	resolved, err := ResolveOSProfileSecrets(context.Background(), secrets, "group", profile)
+	assert.Nil(t, err)
+	assert.Equal(t, "p@ssw0rd", *resolved.AdminPassword)
+	assert.Nil(t, resolved.AdminPasswordReference)
+	assert.Nil(t, profile.AdminPassword)
+
+	inline := &OSProfile{AdminPassword: proto.String("inline")}
+	resolved, err = ResolveOSProfileSecrets(context.Background(), secrets, "group", inline)
+	assert.Nil(t, err)
+	assert.Equal(t, inline, resolved)
+
+	_, err = ResolveOSProfileSecrets(context.Background(), secrets, "group", &OSProfile{AdminPassword: proto.String("inline"), AdminPasswordReference: ref})
+	assert.True(t, errors.IsInvalidInput(err))
+
+	_, err = ResolveOSProfileSecrets(context.Background(), secrets, "group",
+		&OSProfile{AdminPasswordReference: &SecretReference{VaultName: proto.String("vault"), SecretName: proto.String("missing")}})
+	assert.True(t, errors.IsNotFound(err))
+
+	_, err = ResolveOSProfileSecrets(context.Background(), nil, "group", profile)
+	assert.True(t, errors.IsMocErrorCode(err, codes.NotInitialized))
+}
+
+func Test_ResolveRunCommandSecrets(t *testing.T) {
+	secrets := fakeSecrets{"vault/runas": "p@ssw0rd"}
+	request := &VirtualMachineRunCommandRequest{
+		RunAsUser:              proto.String("user"),
+		RunAsPasswordReference: &SecretReference{VaultName: proto.String("vault"), SecretName: proto.String("runas")},
+	}
+
+	resolved, err := ResolveRunCommandSecrets(context.Background(), secrets, "group", request)
+	assert.Nil(t, err)
+	assert.Equal(t, "p@ssw0rd", *resolved.RunAsPassword)
+	assert.Nil(t, request.RunAsPassword)
+
+	_, err = ResolveRunCommandSecrets(context.Background(), secrets, "group", &VirtualMachineRunCommandRequest{RunAsPasswordReference: &SecretReference{}})
+	assert.True(t, errors.IsInvalidInput(err))
+}
@@ -0,0 +1,224 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package compute
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// ValidationError describes a single invalid field of a resource spec
+type ValidationError struct {
+	// Field - The path of the invalid field, e.g. properties.hardwareProfile.customSize.cpuCount
+	Field string
+	// Message - Why the field is invalid
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+// ValidationErrors is the list of problems found by Validate
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e *ValidationErrors) add(field, format string, args ...interface{}) {
+	*e = append(*e, ValidationError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// sshKeyTypes are the public key algorithms accepted in SSHPublicKey.KeyData
+var sshKeyTypes = map[string]bool{
+	"ssh-rsa":                            true,
+	"ssh-dss":                            true,
+	"ssh-ed25519":                        true,
+	"ecdsa-sha2-nistp256":                true,
+	"ecdsa-sha2-nistp384":                true,
+	"ecdsa-sha2-nistp521":                true,
+	"sk-ssh-ed25519@openssh.com":         true,
+	"sk-ecdsa-sha2-nistp256@openssh.com": true,
+}
+
+// Validate checks a virtual machine spec on the client, before it is sent to the node agent.
+// It only applies the rules the conversion to the node agent enforces, plus the format of SSH keys, proxy URLs and
+// certificates; the compatibility of sizes, GPUs and security settings is left to the node agent.
+// It returns every problem found, or nil if the spec is valid.
+func Validate(vm *VirtualMachine) ValidationErrors {
+	errs := ValidationErrors{}
+	if vm == nil {
+		errs.add("virtualMachine", "is required")
+		return errs
+	}
+	if vm.Name == nil || len(strings.TrimSpace(*vm.Name)) == 0 {
+		errs.add("name", "is required")
+	}
+	if vm.VirtualMachineProperties != nil {
+		validateHardwareProfile(vm.HardwareProfile, "properties.hardwareProfile", &errs)
+		validateOSProfile(vm.OsProfile, "properties.osProfile", &errs)
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+func validateHardwareProfile(hw *HardwareProfile, path string, errs *ValidationErrors) {
+	if hw == nil {
+		return
+	}
+	if hw.VMSize == "" {
+		errs.add(path+".vmSize", "is required")
+	} else if _, err := GetSupportedWssdVirtualMachineSize(hw.VMSize); err != nil {
+		errs.add(path+".vmSize", "unsupported size [%s]", hw.VMSize)
+	}
+
+	switch hw.VMSize {
+	case VirtualMachineSizeTypesCustom, VirtualMachineSizeTypesCustomNK, VirtualMachineSizeTypesCustomGpupv:
+		if hw.CustomSize == nil {
+			errs.add(path+".customSize", "is required for size [%s]", hw.VMSize)
+			break
+		}
+		if hw.CustomSize.CpuCount == nil || *hw.CustomSize.CpuCount <= 0 {
+			errs.add(path+".customSize.cpuCount", "must be greater than 0 for size [%s]", hw.VMSize)
+		}
+		if hw.CustomSize.MemoryMB == nil || *hw.CustomSize.MemoryMB <= 0 {
+			errs.add(path+".customSize.memoryMB", "must be greater than 0 for size [%s]", hw.VMSize)
+		}
+	}
+
+	if hw.DynamicMemoryConfig != nil && hw.DynamicMemoryConfig.MinimumMemoryMB != nil && hw.DynamicMemoryConfig.MaximumMemoryMB != nil &&
+		*hw.DynamicMemoryConfig.MinimumMemoryMB > *hw.DynamicMemoryConfig.MaximumMemoryMB {
+		errs.add(path+".dynamicMemoryConfig.minimumMemoryMB", "cannot be greater than maximumMemoryMB")
+	}
+
+	for i, gpu := range hw.VirtualMachineGPUs {
+		gpuPath := fmt.Sprintf("%s.virtualMachineGPUs[%d]", path, i)
+		if gpu == nil {
+			errs.add(gpuPath, "cannot be nil")
+			continue
+		}
+		if gpu.Assignment == nil {
+			errs.add(gpuPath+".assignment", "is required")
+			continue
+		}
+		switch *gpu.Assignment {
+		case GpuDDA, GpuP, GpuPV, GpuDefault:
+		default:
+			errs.add(gpuPath+".assignment", "unsupported assignment [%s]", *gpu.Assignment)
+		}
+	}
+}
+
+func validateOSProfile(os *OSProfile, path string, errs *ValidationErrors) {
+	if os == nil {
+		return
+	}
+	if os.LinuxConfiguration != nil && os.LinuxConfiguration.SSH != nil && os.LinuxConfiguration.SSH.PublicKeys != nil {
+		for i, key := range *os.LinuxConfiguration.SSH.PublicKeys {
+			keyPath := fmt.Sprintf("%s.linuxConfiguration.ssh.publicKeys[%d].keyData", path, i)
+			if key.KeyData == nil {
+				errs.add(keyPath, "is required")
+				continue
+			}
+			if err := validateSSHPublicKey(*key.KeyData); err != nil {
+				errs.add(keyPath, "%v", err)
+			}
+		}
+	}
+	if os.ProxyConfiguration != nil {
+		proxyPath := path + ".proxyConfiguration"
+		if os.ProxyConfiguration.HttpProxy != nil {
+			if err := validateProxyURL(*os.ProxyConfiguration.HttpProxy); err != nil {
+				errs.add(proxyPath+".httpProxy", "%v", err)
+			}
+		}
+		if os.ProxyConfiguration.HttpsProxy != nil {
+			if err := validateProxyURL(*os.ProxyConfiguration.HttpsProxy); err != nil {
+				errs.add(proxyPath+".httpsProxy", "%v", err)
+			}
+		}
+		if os.ProxyConfiguration.TrustedCa != nil {
+			if err := validateCertificatePEM(*os.ProxyConfiguration.TrustedCa); err != nil {
+				errs.add(proxyPath+".trustedCa", "%v", err)
+			}
+		}
+	}
+}
+
+// validateSSHPublicKey checks a key in authorized_keys format: "<type> <base64 blob> [comment]"
+func validateSSHPublicKey(keyData string) error {
+	fields := strings.Fields(keyData)
+	if len(fields) < 2 {
+		return fmt.Errorf("expected \"<type> <key> [comment]\"")
+	}
+	if !sshKeyTypes[fields[0]] {
+		return fmt.Errorf("unsupported key type [%s]", fields[0])
+	}
+	blob, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return fmt.Errorf("key is not valid base64")
+	}
+	// The blob starts with the length-prefixed key type, which must match the declared one
+	if len(blob) < 4 {
+		return fmt.Errorf("key is truncated")
+	}
+	n := binary.BigEndian.Uint32(blob)
+	if uint64(n) > uint64(len(blob)-4) || !bytes.Equal(blob[4:4+n], []byte(fields[0])) {
+		return fmt.Errorf("key data does not match key type [%s]", fields[0])
+	}
+	return nil
+}
+
+func validateProxyURL(proxy string) error {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return fmt.Errorf("invalid URL: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("URL scheme must be http or https")
+	}
+	if u.Host == "" {
+		return fmt.Errorf("URL must include a host")
+	}
+	return nil
+}
+
+func validateCertificatePEM(data string) error {
+	rest := []byte(data)
+	count := 0
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return fmt.Errorf("unexpected PEM block [%s]", block.Type)
+		}
+		if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+			return fmt.Errorf("invalid certificate: %v", err)
+		}
+		count++
+	}
+	if count == 0 {
+		return fmt.Errorf("no PEM encoded certificate found")
+	}
+	if len(bytes.TrimSpace(rest)) != 0 {
+		return fmt.Errorf("unexpected data after the last certificate")
+	}
+	return nil
+}
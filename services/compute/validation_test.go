@@ -0,0 +1,141 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package compute
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+)
+
+func testSSHKey(keyType string) string {
+	blob := binary.BigEndian.AppendUint32(nil, uint32(len(keyType)))
+	blob = append(blob, keyType...)
+	blob = binary.BigEndian.AppendUint32(blob, 32)
+	blob = append(blob, make([]byte, 32)...)
+	return keyType + " " + base64.StdEncoding.EncodeToString(blob) + " user@host"
+}
+
+func testCertificatePEM(t *testing.T) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "proxy-ca"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func fields(errs ValidationErrors) []string {
+	out := []string{}
+	for _, err := range errs {
+		out = append(out, err.Field)
+	}
+	return out
+}
+
+func Test_ValidateValid(t *testing.T) {
+	dda := GpuDDA
+	vm := &VirtualMachine{
+		Name: proto.String("vm1"),
+		VirtualMachineProperties: &VirtualMachineProperties{
+			HardwareProfile: &HardwareProfile{
+				VMSize:             VirtualMachineSizeTypesCustom,
+				CustomSize:         &VirtualMachineCustomSize{CpuCount: proto.Int32(2), MemoryMB: proto.Int32(4096)},
+				VirtualMachineGPUs: []*VirtualMachineGPU{{Assignment: &dda, Name: proto.String("gpu0")}},
+			},
+			SecurityProfile: &SecurityProfile{
+				EnableTPM:    proto.Bool(true),
+				UefiSettings: &UefiSettings{SecureBootEnabled: proto.Bool(true)},
+				SecurityType: TrustedLaunch,
+			},
+			OsProfile: &OSProfile{
+				LinuxConfiguration: &LinuxConfiguration{
+					SSH: &SSHConfiguration{PublicKeys: &[]SSHPublicKey{{KeyData: proto.String(testSSHKey("ssh-ed25519"))}}},
+				},
+				ProxyConfiguration: &ProxyConfiguration{
+					HttpProxy: proto.String("http://proxy:3128"),
+					TrustedCa: proto.String(testCertificatePEM(t)),
+				},
+			},
+		},
+	}
+	assert.Nil(t, Validate(vm))
+}
+
+func Test_ValidateInvalid(t *testing.T) {
+	dda, bogus := GpuDDA, Assignment("Bogus")
+	badKey := testSSHKey("ssh-ed25519")
+	vm := &VirtualMachine{
+		VirtualMachineProperties: &VirtualMachineProperties{
+			HardwareProfile: &HardwareProfile{
+				VMSize:     VirtualMachineSizeTypesCustomGpupv,
+				CustomSize: &VirtualMachineCustomSize{CpuCount: proto.Int32(2)},
+				VirtualMachineGPUs: []*VirtualMachineGPU{
+					{Assignment: &dda, PartitionSizeMB: proto.Uint64(1024)},
+					{Assignment: &bogus},
+					nil,
+				},
+			},
+			SecurityProfile: &SecurityProfile{
+				EnableTPM:    proto.Bool(false),
+				SecurityType: ConfidentialVM,
+			},
+			OsProfile: &OSProfile{
+				LinuxConfiguration: &LinuxConfiguration{
+					SSH: &SSHConfiguration{PublicKeys: &[]SSHPublicKey{
+						{KeyData: proto.String("ssh-rsa " + badKey[len("ssh-ed25519 "):])},
+						{KeyData: proto.String("not a key")},
+					}},
+				},
+				ProxyConfiguration: &ProxyConfiguration{
+					HttpsProxy: proto.String("proxy:3128"),
+					TrustedCa:  proto.String("-----BEGIN CERTIFICATE-----\nAAAA\n-----END CERTIFICATE-----\n"),
+				},
+			},
+		},
+	}
+
+	errs := Validate(vm)
+	assert.Equal(t, []string{
+		"name",
+		"properties.hardwareProfile.customSize.memoryMB",
+		"properties.hardwareProfile.virtualMachineGPUs[1].assignment",
+		"properties.hardwareProfile.virtualMachineGPUs[2]",
+		"properties.osProfile.linuxConfiguration.ssh.publicKeys[0].keyData",
+		"properties.osProfile.linuxConfiguration.ssh.publicKeys[1].keyData",
+		"properties.osProfile.proxyConfiguration.httpsProxy",
+		"properties.osProfile.proxyConfiguration.trustedCa",
+	}, fields(errs))
+	assert.Contains(t, errs.Error(), "name: is required")
+}
+
+func Test_ValidateSecurityLeftToAgent(t *testing.T) {
+	vm := &VirtualMachine{
+		Name: proto.String("vm1"),
+		VirtualMachineProperties: &VirtualMachineProperties{
+			HardwareProfile: &HardwareProfile{VMSize: "Standard_Bogus"},
+			SecurityProfile: &SecurityProfile{
+				EnableTPM:    proto.Bool(true),
+				UefiSettings: &UefiSettings{SecureBootEnabled: proto.Bool(true)},
+			},
+		},
+	}
+	assert.Equal(t, []string{"properties.hardwareProfile.vmSize"}, fields(Validate(vm)))
+}
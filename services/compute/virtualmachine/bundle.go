@@ -0,0 +1,345 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package virtualmachine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/microsoft/moc/pkg/errors"
+	"github.com/microsoft/moc/pkg/marshal"
+	wssdcommonproto "github.com/microsoft/moc/rpc/common"
+
+	"github.com/microsoft/wssd-sdk-for-go/services/compute"
+	"github.com/microsoft/wssd-sdk-for-go/services/network"
+	"github.com/microsoft/wssd-sdk-for-go/services/storage"
+)
+
+const (
+	// BundleVersion is the version of the bundle format written by ExportVirtualMachine
+	BundleVersion = "1"
+)
+
+// VirtualMachineBundle is everything needed to recreate a virtual machine on another cluster
+type VirtualMachineBundle struct {
+	// Version - The bundle format version
+	Version string `json:"version"`
+	// ExportedAt - When the bundle was written
+	ExportedAt time.Time `json:"exportedAt"`
+	// SourceGroup - The group the virtual machine was exported from
+	SourceGroup string `json:"sourceGroup"`
+	// VirtualMachine - The virtual machine spec, without its identity and state
+	VirtualMachine *compute.VirtualMachine `json:"virtualMachine"`
+	// Disks - The OS disk followed by the data disks
+	Disks []BundleDisk `json:"disks"`
+	// NetworkInterfaces - The network interfaces, without their identity and state
+	NetworkInterfaces []network.VirtualNetworkInterface `json:"networkInterfaces"`
+}
+
+// BundleDisk is a virtual hard disk of a bundle and where its contents were uploaded
+type BundleDisk struct {
+	// VirtualHardDisk - The disk spec, without its identity, state and source
+	VirtualHardDisk *storage.VirtualHardDisk `json:"virtualHardDisk"`
+	// URL - Where the disk contents were uploaded
+	URL string `json:"url"`
+}
+
+// ExportOptions controls how ExportVirtualMachine writes a bundle
+type ExportOptions struct {
+	// DiskURL - Returns the URL each disk is uploaded to. Required.
+	DiskURL func(disk *storage.VirtualHardDisk) (string, error)
+}
+
+// ImportOptions controls how ImportVirtualMachine recreates a bundle.
+// The disks and network interfaces keep the names they were exported with.
+type ImportOptions struct {
+	// Name - The name of the imported virtual machine. Empty keeps the exported name.
+	Name string
+	// MapContainer - Returns the container a disk exported from the given container is created in. Nil keeps the container.
+	MapContainer func(container string) string
+	// MapDiskURL - Returns the URL a disk is imported from, for bundles whose disks were moved after the export. Nil keeps the URL.
+	MapDiskURL func(url string) string
+	// MapNetworkInterface - Edits each network interface before it is created, e.g. to point it at a virtual network
+	// of the target cluster. Nil creates the network interfaces as they were exported.
+	MapNetworkInterface func(nic *network.VirtualNetworkInterface) error
+	// KeepOnFailure - Leave the disks, network interfaces and virtual machine created so far in place if a step fails.
+	// Without it, they are deleted in reverse order.
+	KeepOnFailure bool
+	// AdminPasswordReference - The keyvault secret holding the administrator password of the imported virtual machine.
+	// Bundles do not carry the password, so this is required when the virtual machine of the bundle has an administrator.
+	AdminPasswordReference *compute.SecretReference
+}
+
+// ExportVirtualMachine uploads the disks of the virtual machine name, which must be off, to the URLs given by
+// options.DiskURL and writes a bundle describing the virtual machine, its disks and its network interfaces to w
+func (c *VirtualMachineClient) ExportVirtualMachine(ctx context.Context, group, name string, w io.Writer, options ExportOptions) (*VirtualMachineBundle, error) {
+	if options.DiskURL == nil {
+		return nil, errors.Wrapf(errors.InvalidInput, "Missing DiskURL")
+	}
+	if c.disks == nil || c.nics == nil {
+		return nil, errors.Wrapf(errors.NotInitialized, "Export needs the virtual hard disk and network interface clients")
+	}
+
+	src, err := c.getVirtualMachine(ctx, group, name)
+	if err != nil {
+		return nil, err
+	}
+	if state, found := src.Statuses["PowerState"]; !found || state == nil || *state != wssdcommonproto.PowerState_Off.String() {
+		return nil, errors.Wrapf(errors.InvalidInput, "Virtual Machine [%s] must be off to be exported", name)
+	}
+
+	vm := &compute.VirtualMachine{}
+	if err = marshal.Duplicate(src, vm); err != nil {
+		return nil, err
+	}
+	clearVirtualMachineState(vm)
+	bundle := &VirtualMachineBundle{
+		Version:           BundleVersion,
+		ExportedAt:        time.Now().UTC(),
+		SourceGroup:       group,
+		VirtualMachine:    vm,
+		Disks:             []BundleDisk{},
+		NetworkInterfaces: []network.VirtualNetworkInterface{},
+	}
+
+	for _, diskName := range getVirtualMachineDiskNames(vm) {
+		disk, err := c.exportDisk(ctx, diskName, options)
+		if err != nil {
+			return nil, err
+		}
+		bundle.Disks = append(bundle.Disks, *disk)
+	}
+
+	if vm.NetworkProfile != nil && vm.NetworkProfile.NetworkInterfaces != nil {
+		for _, ref := range *vm.NetworkProfile.NetworkInterfaces {
+			if ref.VirtualNetworkInterfaceReference == nil {
+				continue
+			}
+			nic, err := c.getNetworkInterface(ctx, group, *ref.VirtualNetworkInterfaceReference)
+			if err != nil {
+				return nil, err
+			}
+			clearNetworkInterfaceState(nic)
+			bundle.NetworkInterfaces = append(bundle.NetworkInterfaces, *nic)
+		}
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err = encoder.Encode(bundle); err != nil {
+		return nil, errors.Wrapf(err, "Unable to write the bundle of Virtual Machine [%s]", name)
+	}
+	return bundle, nil
+}
+
+// ImportVirtualMachine reads a bundle written by ExportVirtualMachine from r and recreates its disks, network interfaces
+// and virtual machine in group. The administrator password is read from options.AdminPasswordReference.
+// If any step fails, everything created so far is deleted unless options.KeepOnFailure is set.
+func (c *VirtualMachineClient) ImportVirtualMachine(ctx context.Context, group string, r io.Reader, options ImportOptions) (*compute.VirtualMachine, error) {
+	if c.disks == nil || c.nics == nil {
+		return nil, errors.Wrapf(errors.NotInitialized, "Import needs the virtual hard disk and network interface clients")
+	}
+	bundle := &VirtualMachineBundle{}
+	if err := json.NewDecoder(r).Decode(bundle); err != nil {
+		return nil, errors.Wrapf(errors.InvalidInput, "Unable to read the bundle: %v", err)
+	}
+	if bundle.Version != BundleVersion {
+		return nil, errors.Wrapf(errors.InvalidVersion, "Unsupported bundle version [%s], expected [%s]", bundle.Version, BundleVersion)
+	}
+	vm := bundle.VirtualMachine
+	if vm == nil || vm.Name == nil {
+		return nil, errors.Wrapf(errors.InvalidInput, "The bundle has no Virtual Machine")
+	}
+	if options.Name != "" {
+		vm.Name = &options.Name
+	}
+	name := *vm.Name
+	if err := c.ensureVirtualMachineAbsent(ctx, group, name); err != nil {
+		return nil, err
+	}
+	if err := c.setAdminPassword(ctx, group, name, vm, options.AdminPasswordReference); err != nil {
+		return nil, err
+	}
+
+	var steps []rollbackStep
+	created, err := c.importBundle(ctx, group, bundle, options, &steps)
+	if err != nil {
+		return nil, rollbackOnError(ctx, err, steps, options.KeepOnFailure)
+	}
+	return created, nil
+}
+
+// importBundle creates the disks, network interfaces and virtual machine of the bundle, recording each one in steps
+func (c *VirtualMachineClient) importBundle(ctx context.Context, group string, bundle *VirtualMachineBundle, options ImportOptions, steps *[]rollbackStep) (*compute.VirtualMachine, error) {
+	for _, disk := range bundle.Disks {
+		if err := c.importDisk(ctx, disk, options, steps); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range bundle.NetworkInterfaces {
+		nic := &bundle.NetworkInterfaces[i]
+		if nic.Name == nil {
+			return nil, errors.Wrapf(errors.InvalidInput, "A network interface of the bundle has no name")
+		}
+		if options.MapNetworkInterface != nil {
+			if err := options.MapNetworkInterface(nic); err != nil {
+				return nil, errors.Wrapf(err, "Unable to map Virtual Network Interface [%s]", *nic.Name)
+			}
+		}
+		nicName := *nic.Name
+		if _, err := c.nics.CreateOrUpdate(ctx, group, nicName, nic); err != nil {
+			return nil, errors.Wrapf(err, "Unable to create Virtual Network Interface [%s]", nicName)
+		}
+		*steps = append(*steps, rollbackStep{
+			description: fmt.Sprintf("Virtual Network Interface [%s]", nicName),
+			undo:        func(ctx context.Context) error { return c.nics.Delete(ctx, group, nicName) },
+		})
+	}
+
+	name := *bundle.VirtualMachine.Name
+	created, err := c.CreateOrUpdate(ctx, group, name, bundle.VirtualMachine)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to create Virtual Machine [%s]", name)
+	}
+	*steps = append(*steps, rollbackStep{
+		description: fmt.Sprintf("Virtual Machine [%s]", name),
+		undo:        func(ctx context.Context) error { return c.Delete(ctx, group, name) },
+	})
+	return created, nil
+}
+
+// exportDisk uploads the virtual hard disk name and returns its bundle entry
+func (c *VirtualMachineClient) exportDisk(ctx context.Context, name string, options ExportOptions) (*BundleDisk, error) {
+	src, err := c.getVirtualHardDisk(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	url, err := options.DiskURL(src)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to get the upload URL of Virtual Hard Disk [%s]", name)
+	}
+	if url == "" {
+		return nil, errors.Wrapf(errors.InvalidInput, "Empty upload URL for Virtual Hard Disk [%s]", name)
+	}
+	container := ""
+	if src.ContainerName != nil {
+		container = *src.ContainerName
+	}
+	if err = c.disks.Upload(ctx, container, name, url); err != nil {
+		return nil, errors.Wrapf(err, "Unable to upload Virtual Hard Disk [%s]", name)
+	}
+
+	return &BundleDisk{
+		URL: url,
+		VirtualHardDisk: &storage.VirtualHardDisk{
+			Name: src.Name,
+			Tags: src.Tags,
+			VirtualHardDiskProperties: &storage.VirtualHardDiskProperties{
+				DiskSizeBytes:       src.DiskSizeBytes,
+				Dynamic:             src.Dynamic,
+				Blocksizebytes:      src.Blocksizebytes,
+				Logicalsectorbytes:  src.Logicalsectorbytes,
+				Physicalsectorbytes: src.Physicalsectorbytes,
+				Virtualharddisktype: src.Virtualharddisktype,
+				CloudInitDataSource: src.CloudInitDataSource,
+				HyperVGeneration:    src.HyperVGeneration,
+				DiskFileFormat:      src.DiskFileFormat,
+				ContainerName:       src.ContainerName,
+			},
+		},
+	}, nil
+}
+
+// importDisk creates a virtual hard disk of the bundle from the URL it was uploaded to
+func (c *VirtualMachineClient) importDisk(ctx context.Context, disk BundleDisk, options ImportOptions, steps *[]rollbackStep) error {
+	vhd := disk.VirtualHardDisk
+	if vhd == nil || vhd.Name == nil {
+		return errors.Wrapf(errors.InvalidInput, "A disk of the bundle has no name")
+	}
+	name := *vhd.Name
+	if vhd.VirtualHardDiskProperties == nil {
+		vhd.VirtualHardDiskProperties = &storage.VirtualHardDiskProperties{}
+	}
+
+	url := disk.URL
+	if options.MapDiskURL != nil {
+		url = options.MapDiskURL(url)
+	}
+	if url == "" {
+		return errors.Wrapf(errors.InvalidInput, "Missing URL for Virtual Hard Disk [%s]", name)
+	}
+	container := ""
+	if vhd.ContainerName != nil {
+		container = *vhd.ContainerName
+	}
+	if options.MapContainer != nil {
+		container = options.MapContainer(container)
+	}
+	source, err := marshal.ToJSON(storage.HttpImageProperties{HttpURL: url})
+	if err != nil {
+		return err
+	}
+	vhd.Source = &source
+	vhd.SourceType = wssdcommonproto.ImageSource_HTTP_SOURCE
+	vhd.ContainerName = &container
+
+	if _, err = c.disks.CreateOrUpdate(ctx, container, name, vhd); err != nil {
+		return errors.Wrapf(err, "Unable to import Virtual Hard Disk [%s]", name)
+	}
+	*steps = append(*steps, rollbackStep{
+		description: fmt.Sprintf("Virtual Hard Disk [%s]", name),
+		undo:        func(ctx context.Context) error { return c.disks.Delete(ctx, container, name) },
+	})
+	return nil
+}
+
+// getVirtualMachineDiskNames returns the OS disk followed by the data disks of the virtual machine
+func getVirtualMachineDiskNames(vm *compute.VirtualMachine) []string {
+	names := []string{}
+	s := vm.StorageProfile
+	if s == nil {
+		return names
+	}
+	if s.OsDisk != nil && s.OsDisk.VhdName != nil {
+		names = append(names, *s.OsDisk.VhdName)
+	}
+	if s.DataDisks != nil {
+		for _, disk := range *s.DataDisks {
+			if disk.VhdName != nil {
+				names = append(names, *disk.VhdName)
+			}
+		}
+	}
+	return names
+}
+
+// clearNetworkInterfaceState clears the identity, the read-only state and the cluster-local references of a network interface
+func clearNetworkInterfaceState(nic *network.VirtualNetworkInterface) {
+	nic.ID = nil
+	nic.Type = nil
+	p := nic.VirtualNetworkInterfaceProperties
+	if p == nil {
+		return
+	}
+	p.VirtualMachineID = nil
+	p.ProvisioningState = nil
+	p.Statuses = nil
+	p.IsPlaceholder = nil
+	if p.IPConfigurations == nil {
+		return
+	}
+	for i := range *p.IPConfigurations {
+		ipConfig := &(*p.IPConfigurations)[i]
+		ipConfig.ID = nil
+		if ipConfig.IPConfigurationProperties != nil {
+			ipConfig.VirtualNetworkInterfaceID = nil
+			ipConfig.LoadBalancerBackendAddressPoolIDs = nil
+			ipConfig.LoadBalancerInboundNatPoolIDs = nil
+		}
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package virtualmachine
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/microsoft/moc/pkg/errors"
+	"github.com/microsoft/moc/pkg/marshal"
+	wssdcommonproto "github.com/microsoft/moc/rpc/common"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/microsoft/wssd-sdk-for-go/services/compute"
+	"github.com/microsoft/wssd-sdk-for-go/services/network"
+	"github.com/microsoft/wssd-sdk-for-go/services/storage"
+)
+
+func newImportTestClient() (*VirtualMachineClient, *fakeService, *fakeDiskService, *fakeNetworkInterfaceService) {
+	service := newFakeService()
+	disks := &fakeDiskService{disks: map[string]*storage.VirtualHardDisk{}, uploads: map[string]string{}}
+	nics := &fakeNetworkInterfaceService{nics: map[string]*network.VirtualNetworkInterface{}}
+	return &VirtualMachineClient{internal: service, disks: disks, nics: nics}, service, disks, nics
+}
+
+func Test_ExportImportVirtualMachine(t *testing.T) {
+	source, _, sourceDisks, _ := newCloneTestClient()
+	buf := &bytes.Buffer{}
+	bundle, err := source.ExportVirtualMachine(context.Background(), "group", "vm1", buf, ExportOptions{
+		DiskURL: func(disk *storage.VirtualHardDisk) (string, error) {
+			return "https://store/" + *disk.Name + ".vhdx", nil
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "https://store/vm1-os.vhdx", sourceDisks.uploads["vm1-os"])
+	assert.Equal(t, "https://store/vm1-data.vhdx", sourceDisks.uploads["vm1-data"])
+	assert.Len(t, bundle.Disks, 2)
+	assert.Len(t, bundle.NetworkInterfaces, 1)
+	assert.Nil(t, bundle.VirtualMachine.ID)
+	assert.Nil(t, bundle.VirtualMachine.Statuses)
+	assert.Nil(t, bundle.Disks[0].VirtualHardDisk.Path)
+
+	target, service, disks, nics := newImportTestClient()
+	vm, err := target.ImportVirtualMachine(context.Background(), "group2", buf, ImportOptions{
+		Name:         "vm1-imported",
+		MapContainer: func(container string) string { return "imported-" + container },
+		MapNetworkInterface: func(nic *network.VirtualNetworkInterface) error {
+			(*nic.IPConfigurations)[0].SubnetID = proto.String("subnet2")
+			return nil
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "vm1-imported", *vm.Name)
+	assert.Contains(t, service.vms, "vm1-imported")
+
+	disk := disks.disks["vm1-os"]
+	assert.Equal(t, wssdcommonproto.ImageSource_HTTP_SOURCE, disk.SourceType)
+	source2 := storage.HttpImageProperties{}
+	assert.Nil(t, marshal.FromJSON(*disk.Source, &source2))
+	assert.Equal(t, "https://store/vm1-os.vhdx", source2.HttpURL)
+	assert.Equal(t, "imported-disks", *disk.ContainerName)
+	assert.Equal(t, "subnet2", *(*nics.nics["vm1-nic"].IPConfigurations)[0].SubnetID)
+}
+
+func Test_ImportVirtualMachineRollback(t *testing.T) {
+	source, _, _, _ := newCloneTestClient()
+	buf := &bytes.Buffer{}
+	_, err := source.ExportVirtualMachine(context.Background(), "group", "vm1", buf, ExportOptions{
+		DiskURL: func(disk *storage.VirtualHardDisk) (string, error) { return "https://store/" + *disk.Name, nil },
+	})
+	assert.Nil(t, err)
+
+	target, service, disks, nics := newImportTestClient()
+	service.errs["CreateOrUpdate"] = errors.Failed
+	_, err = target.ImportVirtualMachine(context.Background(), "group2", buf, ImportOptions{})
+	assert.True(t, errors.IsFailed(err))
+	assert.Empty(t, disks.disks)
+	assert.Empty(t, nics.nics)
+
+	_, err = target.ImportVirtualMachine(context.Background(), "group2", strings.NewReader(`{"version":"0"}`), ImportOptions{})
+	assert.True(t, errors.IsInvalidVersion(err))
+}
+
+func Test_ImportVirtualMachineAdminPassword(t *testing.T) {
+	source, sourceService, _, _ := newCloneTestClient()
+	// The node agent returns the administrator but not the password
+	sourceService.vms["vm1"].OsProfile.AdminUsername = proto.String("admin")
+	buf := &bytes.Buffer{}
+	_, err := source.ExportVirtualMachine(context.Background(), "group", "vm1", buf, ExportOptions{
+		DiskURL: func(disk *storage.VirtualHardDisk) (string, error) { return "https://store/" + *disk.Name, nil },
+	})
+	assert.Nil(t, err)
+	exported := buf.Bytes()
+
+	target, service, disks, nics := newImportTestClient()
+	target.secrets = fakeSecrets{"vault/admin": "p@ssw0rd"}
+	_, err = target.ImportVirtualMachine(context.Background(), "group2", bytes.NewReader(exported), ImportOptions{})
+	assert.True(t, errors.IsInvalidInput(err))
+	assert.Empty(t, disks.disks)
+	assert.Empty(t, nics.nics)
+
+	reference := &compute.SecretReference{VaultName: proto.String("vault"), SecretName: proto.String("admin")}
+	_, err = target.ImportVirtualMachine(context.Background(), "group2", bytes.NewReader(exported), ImportOptions{AdminPasswordReference: reference})
+	assert.Nil(t, err)
+	assert.Equal(t, "p@ssw0rd", *service.vms["vm1"].OsProfile.AdminPassword)
+}
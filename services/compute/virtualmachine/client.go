@@ -5,14 +5,19 @@ package virtualmachine
 
 import (
 	"context"
+	"io"
 	"log"
 
 	"github.com/microsoft/moc/pkg/auth"
 	"github.com/microsoft/moc/pkg/errors"
-	"github.com/microsoft/moc/pkg/marshal"
 
+	"github.com/microsoft/wssd-sdk-for-go/pkg/redact"
 	"github.com/microsoft/wssd-sdk-for-go/services/compute"
 	"github.com/microsoft/wssd-sdk-for-go/services/compute/virtualmachine/internal"
+	"github.com/microsoft/wssd-sdk-for-go/services/network/virtualnetworkinterface"
+	"github.com/microsoft/wssd-sdk-for-go/services/security/identity"
+	"github.com/microsoft/wssd-sdk-for-go/services/security/keyvault/secret"
+	"github.com/microsoft/wssd-sdk-for-go/services/storage/virtualharddisk"
 )
 
 type Service interface {
@@ -36,6 +41,14 @@ type Service interface {
 type VirtualMachineClient struct {
 	compute.BaseClient
 	internal Service
+	// disks and nics are used by Clone
+	disks diskService
+	nics  networkInterfaceService
+	// secrets resolves the secret references of CreateOrUpdate and RunCommand
+	secrets compute.SecretGetter
+	// identities and identitySecrets bind and project the identities of CreateOrUpdate
+	identities      compute.IdentityService
+	identitySecrets compute.SecretSetter
 }
 
 func NewVirtualMachineClient(cloudFQDN string, authorizer auth.Authorizer) (*VirtualMachineClient, error) {
@@ -43,23 +56,92 @@ func NewVirtualMachineClient(cloudFQDN string, authorizer auth.Authorizer) (*Vir
 	if err != nil {
 		return nil, err
 	}
+	disks, err := virtualharddisk.NewVirtualHardDiskClient(cloudFQDN, authorizer)
+	if err != nil {
+		return nil, err
+	}
+	nics, err := virtualnetworkinterface.NewVirtualNetworkInterfaceClient(cloudFQDN, authorizer)
+	if err != nil {
+		return nil, err
+	}
+	secrets, err := secret.NewSecretClient(cloudFQDN, authorizer)
+	if err != nil {
+		return nil, err
+	}
+	identities, err := identity.NewIdentityClient(cloudFQDN, authorizer)
+	if err != nil {
+		return nil, err
+	}
 
-	return &VirtualMachineClient{internal: c}, nil
+	return &VirtualMachineClient{internal: c, disks: disks, nics: nics, secrets: secrets, identities: identities, identitySecrets: secrets}, nil
 }
 
-// Get methods invokes the client Get method
+// Get methods invokes the client Get method.
+// The principal IDs of the identities are read through the identity client, on a best effort basis: the Get does not
+// fail when they cannot be read.
 func (c *VirtualMachineClient) Get(ctx context.Context, group, name string) (*[]compute.VirtualMachine, error) {
-	return c.internal.Get(ctx, group, name)
+	vms, err := c.internal.Get(ctx, group, name)
+	if err != nil || vms == nil {
+		return vms, err
+	}
+	for i := range *vms {
+		vm := &(*vms)[i]
+		if vm.Identity == nil || vm.Name == nil {
+			continue
+		}
+		if err := compute.FillIdentityIDs(ctx, c.identities, group, *vm.Name, vm.Identity); err != nil {
+			log.Printf("Unable to read the identities of Virtual Machine [%s]: %v\n", *vm.Name, err)
+		}
+	}
+	return vms, nil
 }
 
-// CreateOrUpdate methods invokes create or update on the client
-func (c *VirtualMachineClient) CreateOrUpdate(ctx context.Context, group, name string, compute *compute.VirtualMachine) (*compute.VirtualMachine, error) {
-	return c.internal.CreateOrUpdate(ctx, group, name, compute)
+// CreateOrUpdate methods invokes create or update on the client.
+// An AdminPasswordReference is resolved through the keyvault secret client first, and the identities are created or
+// bound through the identity client.
+func (c *VirtualMachineClient) CreateOrUpdate(ctx context.Context, group, name string, vm *compute.VirtualMachine) (*compute.VirtualMachine, error) {
+	if vm != nil && vm.Identity != nil {
+		if err := compute.EnsureIdentities(ctx, c.identities, c.identitySecrets, group, name, vm.Identity); err != nil {
+			return nil, err
+		}
+	}
+	if vm != nil && vm.VirtualMachineProperties != nil && vm.OsProfile != nil && vm.OsProfile.AdminPasswordReference != nil {
+		osProfile, err := compute.ResolveOSProfileSecrets(ctx, c.secrets, group, vm.OsProfile)
+		if err != nil {
+			return nil, err
+		}
+		resolved := *vm
+		properties := *vm.VirtualMachineProperties
+		properties.OsProfile = osProfile
+		resolved.VirtualMachineProperties = &properties
+		vm = &resolved
+	}
+	result, err := c.internal.CreateOrUpdate(ctx, group, name, vm)
+	if err != nil || result == nil || result.Identity == nil {
+		return result, err
+	}
+	if err := compute.FillIdentityIDs(ctx, c.identities, group, name, result.Identity); err != nil {
+		log.Printf("Unable to read the identities of Virtual Machine [%s]: %v\n", name, err)
+	}
+	return result, nil
 }
 
-// Delete methods invokes delete of the compute resource
+// Delete methods invokes delete of the compute resource, and of its system assigned identity when there is an identity
+// client. Failing to delete the identity does not fail the Delete.
 func (c *VirtualMachineClient) Delete(ctx context.Context, group string, name string) error {
-	return c.internal.Delete(ctx, group, name)
+	var vmIdentity *compute.VirtualMachineIdentity
+	if c.identities != nil {
+		if vms, err := c.internal.Get(ctx, group, name); err == nil && vms != nil && len(*vms) > 0 {
+			vmIdentity = (*vms)[0].Identity
+		}
+	}
+	if err := c.internal.Delete(ctx, group, name); err != nil {
+		return err
+	}
+	if err := compute.DeleteSystemAssignedIdentity(ctx, c.identities, group, name, vmIdentity); err != nil {
+		log.Printf("Unable to delete the identity of Virtual Machine [%s]: %v\n", name, err)
+	}
+	return nil
 }
 
 // Hydrate methods creates MOC representation of the VM resource
@@ -256,7 +338,7 @@ func (c *VirtualMachineClient) NetworkInterfaceList(ctx context.Context, group s
 
 	vm := (*vms)[0]
 	for _, element := range *vm.NetworkProfile.NetworkInterfaces {
-		log.Printf("%+v\n", marshal.ToString(element))
+		log.Printf("%+v\n", redact.ToString(element))
 	}
 
 	return
@@ -275,7 +357,7 @@ func (c *VirtualMachineClient) NetworkInterfaceShow(ctx context.Context, group s
 	for _, nic := range *vm.NetworkProfile.NetworkInterfaces {
 		if *nic.VirtualNetworkInterfaceReference == nicName {
 			// TODO - implement detailed show
-			log.Printf("%+v\n", marshal.ToString(nic))
+			log.Printf("%+v\n", redact.ToString(nic))
 			break
 		}
 	}
@@ -283,7 +365,23 @@ func (c *VirtualMachineClient) NetworkInterfaceShow(ctx context.Context, group s
 	return
 }
 
+// GetSerialConsoleLog returns the serial console output captured for the virtual machine.
+// The node agent does not expose the COM port of a VM yet, so this always returns NotSupported.
+func (c *VirtualMachineClient) GetSerialConsoleLog(ctx context.Context, group, vmName string) (string, error) {
+	return "", errors.Wrapf(errors.NotSupported, "Serial console log is not supported by the node agent for Virtual Machine [%s]", vmName)
+}
+
+// AttachSerialConsole opens an interactive stream to the serial console of the virtual machine.
+// The node agent does not expose the COM port of a VM yet, so this always returns NotSupported.
+func (c *VirtualMachineClient) AttachSerialConsole(ctx context.Context, group, vmName string) (io.ReadWriteCloser, error) {
+	return nil, errors.Wrapf(errors.NotSupported, "Serial console attach is not supported by the node agent for Virtual Machine [%s]", vmName)
+}
+
 func (c *VirtualMachineClient) RunCommand(ctx context.Context, group, vmName string, request *compute.VirtualMachineRunCommandRequest) (response *compute.VirtualMachineRunCommandResponse, err error) {
+	request, err = compute.ResolveRunCommandSecrets(ctx, c.secrets, group, request)
+	if err != nil {
+		return nil, err
+	}
 	return c.internal.RunCommand(ctx, group, vmName, request)
 }
 
@@ -293,20 +391,26 @@ func isDifferentVmSize(oldSizeType, newSizeType compute.VirtualMachineSizeTypes,
 	}
 
 	// same vm size type, check custom size
-	// Note: fields in compute.VirtualMachineCustomSize are pointers, deference to compare the values
+	// Note: fields in compute.VirtualMachineCustomSize are pointers and may be nil on either side
 	switch newSizeType {
 	case compute.VirtualMachineSizeTypesCustomNK:
 		fallthrough
 	case compute.VirtualMachineSizeTypesCustomGpupv:
-		if *oldCustomSize.GpuCount != *newCustomSize.GpuCount {
+		if oldCustomSize == nil || newCustomSize == nil {
+			return oldCustomSize != newCustomSize
+		}
+		if isDifferentInt32(oldCustomSize.GpuCount, newCustomSize.GpuCount) {
 			return true
 		}
 		fallthrough
 	case compute.VirtualMachineSizeTypesCustom:
-		if *oldCustomSize.CpuCount != *newCustomSize.CpuCount {
+		if oldCustomSize == nil || newCustomSize == nil {
+			return oldCustomSize != newCustomSize
+		}
+		if isDifferentInt32(oldCustomSize.CpuCount, newCustomSize.CpuCount) {
 			return true
 		}
-		if *oldCustomSize.MemoryMB != *newCustomSize.MemoryMB {
+		if isDifferentInt32(oldCustomSize.MemoryMB, newCustomSize.MemoryMB) {
 			return true
 		}
 		return false
@@ -315,9 +419,16 @@ func isDifferentVmSize(oldSizeType, newSizeType compute.VirtualMachineSizeTypes,
 	}
 }
 
+func isDifferentInt32(a, b *int32) bool {
+	if a == nil || b == nil {
+		return a != b
+	}
+	return *a != *b
+}
+
 func isDifferentGpuList(oldGpuList, newGpuList []*compute.VirtualMachineGPU) bool {
-	// simultaneous addtion and removal of GPU is not supported
-	return len(oldGpuList) != len(newGpuList)
+	added, removed := diffGpuLists(oldGpuList, newGpuList)
+	return len(added) > 0 || len(removed) > 0
 }
 
 func (c *VirtualMachineClient) GetHyperVVmId(ctx context.Context, group string, name string) (*compute.VirtualMachineHyperVVmId, error) {
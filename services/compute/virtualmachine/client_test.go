@@ -0,0 +1,190 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package virtualmachine
+
+import (
+	"context"
+	"testing"
+
+	"github.com/microsoft/moc/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/microsoft/wssd-sdk-for-go/services/compute"
+	"github.com/microsoft/wssd-sdk-for-go/services/security"
+)
+
+func Test_isDifferentVmSizeNilCustomSize(t *testing.T) {
+	size := &compute.VirtualMachineCustomSize{CpuCount: proto.Int32(2), MemoryMB: proto.Int32(2048)}
+	assert.True(t, isDifferentVmSize(compute.VirtualMachineSizeTypesCustom, compute.VirtualMachineSizeTypesCustom, nil, size))
+	assert.False(t, isDifferentVmSize(compute.VirtualMachineSizeTypesCustomNK, compute.VirtualMachineSizeTypesCustomNK, nil, nil))
+	assert.True(t, isDifferentVmSize(compute.VirtualMachineSizeTypesCustomGpupv, compute.VirtualMachineSizeTypesCustomGpupv, size,
+		&compute.VirtualMachineCustomSize{CpuCount: proto.Int32(2), MemoryMB: proto.Int32(2048), GpuCount: proto.Int32(1)}))
+	assert.False(t, isDifferentVmSize(compute.VirtualMachineSizeTypesCustom, compute.VirtualMachineSizeTypesCustom, size,
+		&compute.VirtualMachineCustomSize{CpuCount: proto.Int32(2), MemoryMB: proto.Int32(2048)}))
+}
+
+// failingIdentities is an identity service that is not reachable
+type failingIdentities struct{}
+
+func (failingIdentities) Get(ctx context.Context, group, name string) (*[]security.Identity, error) {
+	return nil, errors.Wrapf(errors.Failed, "unreachable")
+}
+
+func (failingIdentities) CreateOrUpdate(ctx context.Context, group, name string, identity *security.Identity) (*security.Identity, error) {
+	return nil, errors.Wrapf(errors.Failed, "unreachable")
+}
+
+func (failingIdentities) Delete(ctx context.Context, group, name string) error {
+	return errors.Wrapf(errors.Failed, "unreachable")
+}
+
+func Test_IdentityBestEffort(t *testing.T) {
+	vm := &compute.VirtualMachine{Name: proto.String("vm"), Identity: &compute.VirtualMachineIdentity{Type: compute.ResourceIdentityTypeSystemAssigned}}
+	service := newFakeService(vm)
+	c := &VirtualMachineClient{internal: service, identities: failingIdentities{}}
+
+	vms, err := c.Get(context.Background(), "group", "vm")
+	assert.Nil(t, err)
+	assert.Len(t, *vms, 1)
+	assert.Nil(t, (*vms)[0].Identity.PrincipalID)
+	assert.Nil(t, c.Delete(context.Background(), "group", "vm"))
+	assert.Empty(t, service.vms)
+
+	// Without an identity client, Delete does not read the virtual machine first
+	service = newFakeService(&compute.VirtualMachine{Name: proto.String("vm")})
+	c = &VirtualMachineClient{internal: service}
+	assert.Nil(t, c.Delete(context.Background(), "group", "vm"))
+	assert.Equal(t, []string{"Delete:vm"}, service.calls)
+}
+
+// fakeService is an in-memory Service that records the operations invoked on it
+type fakeService struct {
+	vms   map[string]*compute.VirtualMachine
+	calls []string
+	// errs fails the named operation once
+	errs map[string]error
+	// ignoreShutdown makes guests ignore StopGraceful, as a hung guest would
+	ignoreShutdown bool
+}
+
+func newFakeService(vms ...*compute.VirtualMachine) *fakeService {
+	s := &fakeService{vms: map[string]*compute.VirtualMachine{}, errs: map[string]error{}}
+	for _, vm := range vms {
+		s.vms[*vm.Name] = vm
+	}
+	return s
+}
+
+func (s *fakeService) record(op, name string) error {
+	s.calls = append(s.calls, op+":"+name)
+	if err, found := s.errs[op]; found {
+		delete(s.errs, op)
+		return err
+	}
+	return nil
+}
+
+func (s *fakeService) setPowerState(name string, state string) error {
+	vm, found := s.vms[name]
+	if !found {
+		return errors.NotFound
+	}
+	if vm.Statuses == nil {
+		vm.Statuses = map[string]*string{}
+	}
+	vm.Statuses["PowerState"] = &state
+	return nil
+}
+
+func (s *fakeService) Get(ctx context.Context, group, name string) (*[]compute.VirtualMachine, error) {
+	if err := s.record("Get", name); err != nil {
+		return nil, err
+	}
+	vms := []compute.VirtualMachine{}
+	for vmName, vm := range s.vms {
+		if name == "" || name == vmName {
+			vms = append(vms, *vm)
+		}
+	}
+	return &vms, nil
+}
+
+func (s *fakeService) CreateOrUpdate(ctx context.Context, group, name string, vm *compute.VirtualMachine) (*compute.VirtualMachine, error) {
+	if err := s.record("CreateOrUpdate", name); err != nil {
+		return nil, err
+	}
+	created := *vm
+	s.vms[name] = &created
+	return &created, nil
+}
+
+func (s *fakeService) Delete(ctx context.Context, group, name string) error {
+	if err := s.record("Delete", name); err != nil {
+		return err
+	}
+	delete(s.vms, name)
+	return nil
+}
+
+func (s *fakeService) Hydrate(ctx context.Context, group, name string, vm *compute.VirtualMachine) (*compute.VirtualMachine, error) {
+	return vm, s.record("Hydrate", name)
+}
+
+func (s *fakeService) Start(ctx context.Context, group, name string) error {
+	if err := s.record("Start", name); err != nil {
+		return err
+	}
+	return s.setPowerState(name, "Running")
+}
+
+func (s *fakeService) Stop(ctx context.Context, group, name string) error {
+	if err := s.record("Stop", name); err != nil {
+		return err
+	}
+	return s.setPowerState(name, "Off")
+}
+
+func (s *fakeService) StopGraceful(ctx context.Context, group, name string) error {
+	if err := s.record("StopGraceful", name); err != nil {
+		return err
+	}
+	if s.ignoreShutdown {
+		return nil
+	}
+	return s.setPowerState(name, "Off")
+}
+
+func (s *fakeService) Pause(ctx context.Context, group, name string) error {
+	return s.record("Pause", name)
+}
+
+func (s *fakeService) Save(ctx context.Context, group, name string) error {
+	return s.record("Save", name)
+}
+
+func (s *fakeService) RemoveIsoDisk(ctx context.Context, group, name string) error {
+	return s.record("RemoveIsoDisk", name)
+}
+
+func (s *fakeService) RepairGuestAgent(ctx context.Context, group, name string) error {
+	return s.record("RepairGuestAgent", name)
+}
+
+func (s *fakeService) RunCommand(ctx context.Context, group, name string, request *compute.VirtualMachineRunCommandRequest) (*compute.VirtualMachineRunCommandResponse, error) {
+	return nil, s.record("RunCommand", name)
+}
+
+func (s *fakeService) Validate(ctx context.Context, group, name string) error {
+	return s.record("Validate", name)
+}
+
+func (s *fakeService) GetHyperVVmId(ctx context.Context, group, name string) (*compute.VirtualMachineHyperVVmId, error) {
+	return nil, s.record("GetHyperVVmId", name)
+}
+
+func (s *fakeService) HasHyperVVm(ctx context.Context, name string) (bool, error) {
+	_, found := s.vms[name]
+	return found, s.record("HasHyperVVm", name)
+}
@@ -0,0 +1,377 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package virtualmachine
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/microsoft/moc/pkg/errors"
+	"github.com/microsoft/moc/pkg/marshal"
+	wssdcommonproto "github.com/microsoft/moc/rpc/common"
+
+	"github.com/microsoft/wssd-sdk-for-go/services/compute"
+	"github.com/microsoft/wssd-sdk-for-go/services/network"
+	"github.com/microsoft/wssd-sdk-for-go/services/storage"
+)
+
+// diskService is the part of the virtual hard disk client used by Clone, ExportVirtualMachine and ImportVirtualMachine
+type diskService interface {
+	Get(context.Context, string, string) (*[]storage.VirtualHardDisk, error)
+	CreateOrUpdate(context.Context, string, string, *storage.VirtualHardDisk) (*storage.VirtualHardDisk, error)
+	Delete(context.Context, string, string) error
+	Upload(context.Context, string, string, string) error
+}
+
+// networkInterfaceService is the part of the virtual network interface client used by Clone, ExportVirtualMachine and ImportVirtualMachine
+type networkInterfaceService interface {
+	Get(context.Context, string, string) (*[]network.VirtualNetworkInterface, error)
+	CreateOrUpdate(context.Context, string, string, *network.VirtualNetworkInterface) (*network.VirtualNetworkInterface, error)
+	Delete(context.Context, string, string) error
+}
+
+// CloneOptions controls how Clone creates a virtual machine from an existing one
+type CloneOptions struct {
+	// ComputerName - The guest computer name of the clone. Empty uses the name of the clone.
+	ComputerName string
+	// DiskContainerName - The container the cloned disks are created in. Empty uses the container of each source disk.
+	DiskContainerName string
+	// Start - Start the clone once it is created
+	Start bool
+	// KeepOnFailure - Leave the disks, network interfaces and virtual machine created so far in place if a step fails.
+	// Without it, they are deleted in reverse order.
+	KeepOnFailure bool
+	// AdminPasswordReference - The keyvault secret holding the administrator password of the clone. The node agent does
+	// not return the password of the source, so this is required when the source has an administrator.
+	AdminPasswordReference *compute.SecretReference
+}
+
+// rollbackStep is a created resource and how to delete it
+type rollbackStep struct {
+	description string
+	undo        func(context.Context) error
+}
+
+// Clone creates the virtual machine target from the virtual machine source, which must be off.
+// Each disk is cloned and each network interface is recreated with a new MAC address and a dynamic IP address,
+// and the guest computer name is replaced. The administrator password is read from options.AdminPasswordReference.
+// If any step fails, everything created so far is deleted unless options.KeepOnFailure is set.
+func (c *VirtualMachineClient) Clone(ctx context.Context, group, source, target string, options CloneOptions) (*compute.VirtualMachine, error) {
+	if target == "" {
+		return nil, errors.Wrapf(errors.InvalidInput, "Missing target name")
+	}
+	if target == source {
+		return nil, errors.Wrapf(errors.InvalidInput, "Cannot clone Virtual Machine [%s] onto itself", source)
+	}
+	if c.disks == nil || c.nics == nil {
+		return nil, errors.Wrapf(errors.NotInitialized, "Clone needs the virtual hard disk and network interface clients")
+	}
+
+	if err := c.ensureVirtualMachineAbsent(ctx, group, target); err != nil {
+		return nil, err
+	}
+
+	src, err := c.getVirtualMachine(ctx, group, source)
+	if err != nil {
+		return nil, err
+	}
+	if state, found := src.Statuses["PowerState"]; !found || state == nil || *state != wssdcommonproto.PowerState_Off.String() {
+		return nil, errors.Wrapf(errors.InvalidInput, "Virtual Machine [%s] must be off to be cloned", source)
+	}
+
+	clone := &compute.VirtualMachine{}
+	if err = marshal.Duplicate(src, clone); err != nil {
+		return nil, err
+	}
+	scrubVirtualMachine(clone, target, options)
+	if err = c.setAdminPassword(ctx, group, source, clone, options.AdminPasswordReference); err != nil {
+		return nil, err
+	}
+
+	var steps []rollbackStep
+	vm, err := c.clone(ctx, group, target, clone, options, &steps)
+	if err != nil {
+		return nil, rollbackOnError(ctx, err, steps, options.KeepOnFailure)
+	}
+	return vm, nil
+}
+
+// clone creates the disks, network interfaces and virtual machine of the clone, recording each one in steps
+func (c *VirtualMachineClient) clone(ctx context.Context, group, target string, vm *compute.VirtualMachine, options CloneOptions, steps *[]rollbackStep) (*compute.VirtualMachine, error) {
+	if s := vm.StorageProfile; s != nil {
+		if s.OsDisk != nil && s.OsDisk.VhdName != nil {
+			name, err := c.cloneDisk(ctx, *s.OsDisk.VhdName, target+"-osdisk", options, steps)
+			if err != nil {
+				return nil, err
+			}
+			s.OsDisk.VhdName = &name
+		}
+		if s.DataDisks != nil {
+			for i := range *s.DataDisks {
+				disk := &(*s.DataDisks)[i]
+				if disk.VhdName == nil {
+					continue
+				}
+				name, err := c.cloneDisk(ctx, *disk.VhdName, fmt.Sprintf("%s-datadisk-%d", target, i), options, steps)
+				if err != nil {
+					return nil, err
+				}
+				disk.VhdName = &name
+			}
+		}
+	}
+
+	if vm.NetworkProfile != nil && vm.NetworkProfile.NetworkInterfaces != nil {
+		for i := range *vm.NetworkProfile.NetworkInterfaces {
+			nic := &(*vm.NetworkProfile.NetworkInterfaces)[i]
+			if nic.VirtualNetworkInterfaceReference == nil {
+				continue
+			}
+			name, err := c.cloneNetworkInterface(ctx, group, *nic.VirtualNetworkInterfaceReference, fmt.Sprintf("%s-nic-%d", target, i), steps)
+			if err != nil {
+				return nil, err
+			}
+			nic.VirtualNetworkInterfaceReference = &name
+		}
+	}
+
+	created, err := c.CreateOrUpdate(ctx, group, target, vm)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to create Virtual Machine [%s]", target)
+	}
+	*steps = append(*steps, rollbackStep{
+		description: fmt.Sprintf("Virtual Machine [%s]", target),
+		undo:        func(ctx context.Context) error { return c.Delete(ctx, group, target) },
+	})
+
+	if options.Start {
+		if err = c.Start(ctx, group, target); err != nil {
+			return nil, errors.Wrapf(err, "Unable to start Virtual Machine [%s]", target)
+		}
+	}
+	return created, nil
+}
+
+// cloneDisk creates the virtual hard disk name as a copy of the virtual hard disk source
+func (c *VirtualMachineClient) cloneDisk(ctx context.Context, source, name string, options CloneOptions, steps *[]rollbackStep) (string, error) {
+	src, err := c.getVirtualHardDisk(ctx, source)
+	if err != nil {
+		return "", err
+	}
+	if src.Path == nil || *src.Path == "" {
+		return "", errors.Wrapf(errors.InvalidConfiguration, "Virtual Hard Disk [%s] has no path to clone from", source)
+	}
+
+	container := options.DiskContainerName
+	if container == "" && src.ContainerName != nil {
+		container = *src.ContainerName
+	}
+	cloneSource, err := marshal.ToJSON(storage.CloneImageProperties{CloneSource: *src.Path})
+	if err != nil {
+		return "", err
+	}
+
+	vhd := &storage.VirtualHardDisk{
+		Name: &name,
+		Tags: src.Tags,
+		VirtualHardDiskProperties: &storage.VirtualHardDiskProperties{
+			Source:              &cloneSource,
+			SourceType:          wssdcommonproto.ImageSource_CLONE_SOURCE,
+			DiskSizeBytes:       src.DiskSizeBytes,
+			Dynamic:             src.Dynamic,
+			Blocksizebytes:      src.Blocksizebytes,
+			Logicalsectorbytes:  src.Logicalsectorbytes,
+			Physicalsectorbytes: src.Physicalsectorbytes,
+			Virtualharddisktype: src.Virtualharddisktype,
+			CloudInitDataSource: src.CloudInitDataSource,
+			HyperVGeneration:    src.HyperVGeneration,
+			DiskFileFormat:      src.DiskFileFormat,
+			ContainerName:       &container,
+		},
+	}
+	if _, err = c.disks.CreateOrUpdate(ctx, container, name, vhd); err != nil {
+		return "", errors.Wrapf(err, "Unable to clone Virtual Hard Disk [%s] to [%s]", source, name)
+	}
+	*steps = append(*steps, rollbackStep{
+		description: fmt.Sprintf("Virtual Hard Disk [%s]", name),
+		undo:        func(ctx context.Context) error { return c.disks.Delete(ctx, container, name) },
+	})
+	return name, nil
+}
+
+// cloneNetworkInterface creates the network interface name with the settings of the network interface source.
+// The MAC address is left for the node agent to assign, every IP configuration is switched to dynamic allocation
+// and load balancer memberships are not copied.
+func (c *VirtualMachineClient) cloneNetworkInterface(ctx context.Context, group, source, name string, steps *[]rollbackStep) (string, error) {
+	src, err := c.getNetworkInterface(ctx, group, source)
+	if err != nil {
+		return "", err
+	}
+
+	nic := &network.VirtualNetworkInterface{
+		Name: &name,
+		Tags: src.Tags,
+	}
+	if p := src.VirtualNetworkInterfaceProperties; p != nil {
+		nic.VirtualNetworkInterfaceProperties = &network.VirtualNetworkInterfaceProperties{
+			VirtualNetwork:                 p.VirtualNetwork,
+			IPConfigurations:               getClonedIPConfigurations(p.IPConfigurations),
+			DNSSettings:                    p.DNSSettings,
+			Routes:                         p.Routes,
+			EnableIPForwarding:             p.EnableIPForwarding,
+			EnableMACSpoofing:              p.EnableMACSpoofing,
+			EnableDHCPGuard:                p.EnableDHCPGuard,
+			EnableRouterAdvertisementGuard: p.EnableRouterAdvertisementGuard,
+			EnableAcceleratedNetworking:    p.EnableAcceleratedNetworking,
+		}
+	}
+	if _, err = c.nics.CreateOrUpdate(ctx, group, name, nic); err != nil {
+		return "", errors.Wrapf(err, "Unable to recreate Virtual Network Interface [%s] as [%s]", source, name)
+	}
+	*steps = append(*steps, rollbackStep{
+		description: fmt.Sprintf("Virtual Network Interface [%s]", name),
+		undo:        func(ctx context.Context) error { return c.nics.Delete(ctx, group, name) },
+	})
+	return name, nil
+}
+
+func getClonedIPConfigurations(ipConfigs *[]network.IPConfiguration) *[]network.IPConfiguration {
+	if ipConfigs == nil {
+		return nil
+	}
+	cloned := []network.IPConfiguration{}
+	for _, ipConfig := range *ipConfigs {
+		c := network.IPConfiguration{
+			Name: ipConfig.Name,
+			Tags: ipConfig.Tags,
+		}
+		if p := ipConfig.IPConfigurationProperties; p != nil {
+			c.IPConfigurationProperties = &network.IPConfigurationProperties{
+				SubnetID:           p.SubnetID,
+				NetworkType:        p.NetworkType,
+				Primary:            p.Primary,
+				IPAllocationMethod: network.Dynamic,
+			}
+		}
+		cloned = append(cloned, c)
+	}
+	return &cloned
+}
+
+// scrubVirtualMachine clears the identity and state of a copied virtual machine and gives it its new names
+func scrubVirtualMachine(vm *compute.VirtualMachine, target string, options CloneOptions) {
+	clearVirtualMachineState(vm)
+	vm.Name = &target
+
+	computerName := options.ComputerName
+	if computerName == "" {
+		computerName = target
+	}
+	if vm.OsProfile == nil {
+		vm.OsProfile = &compute.OSProfile{}
+	}
+	vm.OsProfile.ComputerName = &computerName
+}
+
+// clearVirtualMachineState clears the identity and the read-only state of a copied virtual machine.
+// The managed identities are cleared too, so that the copy is not bound to the identities of the source.
+func clearVirtualMachineState(vm *compute.VirtualMachine) {
+	vm.ID = nil
+	vm.Type = nil
+	vm.Identity = nil
+	if vm.VirtualMachineProperties == nil {
+		vm.VirtualMachineProperties = &compute.VirtualMachineProperties{}
+	}
+	vm.ProvisioningState = nil
+	vm.ValidationStatus = nil
+	vm.GuestAgentInstanceView = nil
+	vm.Statuses = nil
+	vm.IsPlaceholder = nil
+	vm.HighAvailabilityState = nil
+}
+
+// setAdminPassword sets the administrator password of vm, a copy of the virtual machine source read from the node agent
+// by Clone or ExportVirtualMachine, from passwordReference. The node agent does not return the password and creating vm
+// without it leaves the administrator without one, so the reference is required when vm has an administrator. It is
+// called before anything is created, so that a missing password does not leave resources behind.
+func (c *VirtualMachineClient) setAdminPassword(ctx context.Context, group, source string, vm *compute.VirtualMachine, passwordReference *compute.SecretReference) error {
+	if vm.VirtualMachineProperties == nil || vm.OsProfile == nil || vm.OsProfile.AdminUsername == nil || len(*vm.OsProfile.AdminUsername) == 0 {
+		return nil
+	}
+	if passwordReference == nil {
+		return errors.Wrapf(errors.InvalidInput, "The node agent does not return the administrator password of Virtual Machine [%s]: missing AdminPasswordReference", source)
+	}
+	osProfile := *vm.OsProfile
+	osProfile.AdminPassword = nil
+	osProfile.AdminPasswordReference = passwordReference
+	resolved, err := compute.ResolveOSProfileSecrets(ctx, c.secrets, group, &osProfile)
+	if err != nil {
+		return err
+	}
+	vm.OsProfile = resolved
+	return nil
+}
+
+// getVirtualHardDisk returns the virtual hard disk name, with non-nil properties
+func (c *VirtualMachineClient) getVirtualHardDisk(ctx context.Context, name string) (*storage.VirtualHardDisk, error) {
+	disks, err := c.disks.Get(ctx, "", name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to get Virtual Hard Disk [%s]", name)
+	}
+	if disks == nil || len(*disks) == 0 {
+		return nil, errors.Wrapf(errors.NotFound, "Unable to find Virtual Hard Disk [%s]", name)
+	}
+	disk := (*disks)[0]
+	if disk.VirtualHardDiskProperties == nil {
+		disk.VirtualHardDiskProperties = &storage.VirtualHardDiskProperties{}
+	}
+	return &disk, nil
+}
+
+// getNetworkInterface returns the virtual network interface name in group
+func (c *VirtualMachineClient) getNetworkInterface(ctx context.Context, group, name string) (*network.VirtualNetworkInterface, error) {
+	nics, err := c.nics.Get(ctx, group, name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to get Virtual Network Interface [%s]", name)
+	}
+	if nics == nil || len(*nics) == 0 {
+		return nil, errors.Wrapf(errors.NotFound, "Unable to find Virtual Network Interface [%s]", name)
+	}
+	return &(*nics)[0], nil
+}
+
+// ensureVirtualMachineAbsent fails with AlreadyExists if the virtual machine name exists in group
+func (c *VirtualMachineClient) ensureVirtualMachineAbsent(ctx context.Context, group, name string) error {
+	vms, err := c.Get(ctx, group, name)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	if err == nil && vms != nil && len(*vms) > 0 {
+		return errors.Wrapf(errors.AlreadyExists, "Virtual Machine [%s] already exists", name)
+	}
+	return nil
+}
+
+// rollbackOnError deletes the created resources unless keep is set, and returns err with the resources that could not be deleted
+func rollbackOnError(ctx context.Context, err error, steps []rollbackStep, keep bool) error {
+	if keep {
+		return err
+	}
+	if leftovers := rollback(context.WithoutCancel(ctx), steps); len(leftovers) > 0 {
+		return errors.Wrapf(err, "Unable to roll back, remove by hand: %s", strings.Join(leftovers, ", "))
+	}
+	return err
+}
+
+// rollback deletes the created resources in reverse order and returns the ones it could not delete
+func rollback(ctx context.Context, steps []rollbackStep) []string {
+	leftovers := []string{}
+	for i := len(steps) - 1; i >= 0; i-- {
+		if err := steps[i].undo(ctx); err != nil && !errors.IsNotFound(err) {
+			leftovers = append(leftovers, fmt.Sprintf("%s (%v)", steps[i].description, err))
+		}
+	}
+	return leftovers
+}
@@ -0,0 +1,204 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package virtualmachine
+
+import (
+	"context"
+	"testing"
+
+	"github.com/microsoft/moc/pkg/errors"
+	"github.com/microsoft/moc/pkg/marshal"
+	wssdcommonproto "github.com/microsoft/moc/rpc/common"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/microsoft/wssd-sdk-for-go/services/compute"
+	"github.com/microsoft/wssd-sdk-for-go/services/network"
+	"github.com/microsoft/wssd-sdk-for-go/services/security/keyvault"
+	"github.com/microsoft/wssd-sdk-for-go/services/storage"
+)
+
+type fakeDiskService struct {
+	disks map[string]*storage.VirtualHardDisk
+	// failCreate fails the CreateOrUpdate of the named disk
+	failCreate string
+	// uploads maps each uploaded disk to its target URL
+	uploads map[string]string
+}
+
+func (s *fakeDiskService) Get(ctx context.Context, container, name string) (*[]storage.VirtualHardDisk, error) {
+	disks := []storage.VirtualHardDisk{}
+	if disk, found := s.disks[name]; found {
+		disks = append(disks, *disk)
+	}
+	return &disks, nil
+}
+
+func (s *fakeDiskService) CreateOrUpdate(ctx context.Context, container, name string, disk *storage.VirtualHardDisk) (*storage.VirtualHardDisk, error) {
+	if name == s.failCreate {
+		return nil, errors.Failed
+	}
+	s.disks[name] = disk
+	return disk, nil
+}
+
+func (s *fakeDiskService) Delete(ctx context.Context, container, name string) error {
+	delete(s.disks, name)
+	return nil
+}
+
+func (s *fakeDiskService) Upload(ctx context.Context, container, name, targetURL string) error {
+	if _, found := s.disks[name]; !found {
+		return errors.NotFound
+	}
+	s.uploads[name] = targetURL
+	return nil
+}
+
+type fakeNetworkInterfaceService struct {
+	nics map[string]*network.VirtualNetworkInterface
+}
+
+func (s *fakeNetworkInterfaceService) Get(ctx context.Context, group, name string) (*[]network.VirtualNetworkInterface, error) {
+	nics := []network.VirtualNetworkInterface{}
+	if nic, found := s.nics[name]; found {
+		nics = append(nics, *nic)
+	}
+	return &nics, nil
+}
+
+func (s *fakeNetworkInterfaceService) CreateOrUpdate(ctx context.Context, group, name string, nic *network.VirtualNetworkInterface) (*network.VirtualNetworkInterface, error) {
+	s.nics[name] = nic
+	return nic, nil
+}
+
+func (s *fakeNetworkInterfaceService) Delete(ctx context.Context, group, name string) error {
+	delete(s.nics, name)
+	return nil
+}
+
+func newCloneTestClient() (*VirtualMachineClient, *fakeService, *fakeDiskService, *fakeNetworkInterfaceService) {
+	off := wssdcommonproto.PowerState_Off.String()
+	service := newFakeService(&compute.VirtualMachine{
+		Name: proto.String("vm1"),
+		ID:   proto.String("id1"),
+		Identity: &compute.VirtualMachineIdentity{
+			Type:        compute.ResourceIdentityTypeSystemAssigned,
+			PrincipalID: proto.String("vm1-identity-id"),
+		},
+		VirtualMachineProperties: &compute.VirtualMachineProperties{
+			StorageProfile: &compute.StorageProfile{
+				OsDisk:    &compute.OSDisk{VhdName: proto.String("vm1-os")},
+				DataDisks: &[]compute.DataDisk{{VhdName: proto.String("vm1-data")}},
+			},
+			OsProfile: &compute.OSProfile{ComputerName: proto.String("vm1")},
+			NetworkProfile: &compute.NetworkProfile{
+				NetworkInterfaces: &[]compute.NetworkInterfaceReference{{VirtualNetworkInterfaceReference: proto.String("vm1-nic")}},
+			},
+			Statuses: map[string]*string{"PowerState": &off},
+		},
+	})
+	disks := &fakeDiskService{uploads: map[string]string{}, disks: map[string]*storage.VirtualHardDisk{
+		"vm1-os": {Name: proto.String("vm1-os"), VirtualHardDiskProperties: &storage.VirtualHardDiskProperties{
+			Path: proto.String("c:\\disks\\vm1-os.vhdx"), ContainerName: proto.String("disks")}},
+		"vm1-data": {Name: proto.String("vm1-data"), VirtualHardDiskProperties: &storage.VirtualHardDiskProperties{
+			Path: proto.String("c:\\disks\\vm1-data.vhdx"), ContainerName: proto.String("disks")}},
+	}}
+	nics := &fakeNetworkInterfaceService{nics: map[string]*network.VirtualNetworkInterface{
+		"vm1-nic": {Name: proto.String("vm1-nic"), VirtualNetworkInterfaceProperties: &network.VirtualNetworkInterfaceProperties{
+			MACAddress: proto.String("00:15:5D:00:00:01"),
+			IPConfigurations: &[]network.IPConfiguration{{IPConfigurationProperties: &network.IPConfigurationProperties{
+				IPAddress: proto.String("10.0.0.4"), SubnetID: proto.String("subnet1"), IPAllocationMethod: network.Static}}},
+		}},
+	}}
+	return &VirtualMachineClient{internal: service, disks: disks, nics: nics}, service, disks, nics
+}
+
+func Test_Clone(t *testing.T) {
+	c, service, disks, nics := newCloneTestClient()
+
+	vm, err := c.Clone(context.Background(), "group", "vm1", "vm2", CloneOptions{ComputerName: "host2"})
+	assert.Nil(t, err)
+	assert.Equal(t, "vm2", *vm.Name)
+	assert.Nil(t, vm.ID)
+	assert.Nil(t, vm.Identity)
+	assert.Nil(t, vm.Statuses)
+	assert.Equal(t, "host2", *vm.OsProfile.ComputerName)
+	assert.Equal(t, "vm2-osdisk", *vm.StorageProfile.OsDisk.VhdName)
+	assert.Equal(t, "vm2-datadisk-0", *(*vm.StorageProfile.DataDisks)[0].VhdName)
+	assert.Equal(t, "vm2-nic-0", *(*vm.NetworkProfile.NetworkInterfaces)[0].VirtualNetworkInterfaceReference)
+	// The source is untouched
+	assert.Equal(t, "vm1-os", *service.vms["vm1"].StorageProfile.OsDisk.VhdName)
+
+	disk := disks.disks["vm2-osdisk"]
+	assert.Equal(t, wssdcommonproto.ImageSource_CLONE_SOURCE, disk.SourceType)
+	cloneSource := storage.CloneImageProperties{}
+	assert.Nil(t, marshal.FromJSON(*disk.Source, &cloneSource))
+	assert.Equal(t, "c:\\disks\\vm1-os.vhdx", cloneSource.CloneSource)
+	assert.Equal(t, "disks", *disk.ContainerName)
+
+	nic := nics.nics["vm2-nic-0"]
+	assert.Nil(t, nic.MACAddress)
+	ipConfig := (*nic.IPConfigurations)[0]
+	assert.Nil(t, ipConfig.IPAddress)
+	assert.Equal(t, "subnet1", *ipConfig.SubnetID)
+	assert.Equal(t, network.Dynamic, ipConfig.IPAllocationMethod)
+
+	_, err = c.Clone(context.Background(), "group", "vm1", "vm2", CloneOptions{})
+	assert.True(t, errors.IsAlreadyExists(err))
+}
+
+func Test_CloneRollback(t *testing.T) {
+	c, service, disks, nics := newCloneTestClient()
+	service.errs["CreateOrUpdate"] = errors.Failed
+
+	_, err := c.Clone(context.Background(), "group", "vm1", "vm2", CloneOptions{})
+	assert.True(t, errors.IsFailed(err))
+	assert.Len(t, disks.disks, 2)
+	assert.Len(t, nics.nics, 1)
+	assert.NotContains(t, service.vms, "vm2")
+
+	disks.failCreate = "vm2-datadisk-0"
+	_, err = c.Clone(context.Background(), "group", "vm1", "vm2", CloneOptions{KeepOnFailure: true})
+	assert.True(t, errors.IsFailed(err))
+	assert.Contains(t, disks.disks, "vm2-osdisk")
+}
+
+func Test_CloneRunningSource(t *testing.T) {
+	c, service, _, _ := newCloneTestClient()
+	assert.Nil(t, service.setPowerState("vm1", wssdcommonproto.PowerState_Running.String()))
+
+	_, err := c.Clone(context.Background(), "group", "vm1", "vm2", CloneOptions{})
+	assert.True(t, errors.IsInvalidInput(err))
+}
+
+// fakeSecrets holds secret values by vault and name
+type fakeSecrets map[string]string
+
+func (s fakeSecrets) Get(ctx context.Context, group, name, vaultName string) (*[]keyvault.Secret, error) {
+	value, ok := s[vaultName+"/"+name]
+	if !ok {
+		return nil, errors.Wrapf(errors.NotFound, "%s", name)
+	}
+	return &[]keyvault.Secret{{Name: &name, Value: &value}}, nil
+}
+
+func Test_CloneAdminPassword(t *testing.T) {
+	c, service, disks, nics := newCloneTestClient()
+	c.secrets = fakeSecrets{"vault/admin": "p@ssw0rd"}
+	// The node agent returns the administrator but not the password
+	service.vms["vm1"].OsProfile.AdminUsername = proto.String("admin")
+
+	_, err := c.Clone(context.Background(), "group", "vm1", "vm2", CloneOptions{})
+	assert.True(t, errors.IsInvalidInput(err))
+	assert.Len(t, disks.disks, 2)
+	assert.Len(t, nics.nics, 1)
+	assert.NotContains(t, service.vms, "vm2")
+
+	reference := &compute.SecretReference{VaultName: proto.String("vault"), SecretName: proto.String("admin")}
+	_, err = c.Clone(context.Background(), "group", "vm1", "vm2", CloneOptions{AdminPasswordReference: reference})
+	assert.Nil(t, err)
+	assert.Equal(t, "p@ssw0rd", *service.vms["vm2"].OsProfile.AdminPassword)
+	assert.Nil(t, service.vms["vm2"].OsProfile.AdminPasswordReference)
+}
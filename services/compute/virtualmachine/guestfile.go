@@ -0,0 +1,349 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package virtualmachine
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/microsoft/moc/pkg/errors"
+
+	"github.com/microsoft/wssd-sdk-for-go/services/compute"
+)
+
+// defaultGuestFileChunkSize encodes to 60 KiB of base64, leaving room for the script wrapper under 64 KiB
+const defaultGuestFileChunkSize = 44 * 1024
+
+// defaultLocalFileMode is given to files copied from a guest that does not report permission bits, such as Windows
+const defaultLocalFileMode os.FileMode = 0644
+
+// GuestFileCopyOptions controls CopyToGuest and CopyFromGuest
+type GuestFileCopyOptions struct {
+	// ChunkSizeBytes - Bytes of file content carried by a single run command. Defaults to 44 KiB.
+	ChunkSizeBytes int
+	// Mode - Permission bits applied to the file on a Linux guest by CopyToGuest, and to the local file by CopyFromGuest.
+	// CopyToGuest defaults to the mode of the local file. CopyFromGuest defaults to the mode of the file on a Linux guest,
+	// and to 0644 for a Windows guest, which does not report permission bits.
+	Mode os.FileMode
+	// Progress - Called after every chunk with the number of bytes transferred so far and the file size.
+	Progress func(transferred, total int64)
+}
+
+// guestScriptRunner runs a script in the guest and returns its stdout
+type guestScriptRunner func(ctx context.Context, script string) (string, error)
+
+// CopyToGuest copies a local file into the virtual machine through the guest agent.
+// The file is sent in chunks, written to a temporary file and moved into place once its SHA256 checksum matches.
+func (c *VirtualMachineClient) CopyToGuest(ctx context.Context, group, vmName, localPath, guestPath string, options *GuestFileCopyOptions) error {
+	options, err := getGuestFileCopyOptions(options)
+	if err != nil {
+		return err
+	}
+	scripts, run, err := c.getGuestFileScripts(ctx, group, vmName)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	mode := options.Mode
+	if mode == 0 {
+		mode = info.Mode().Perm()
+	}
+
+	return copyToGuest(ctx, run, scripts, f, info.Size(), guestPath, mode, options)
+}
+
+// CopyFromGuest copies a file out of the virtual machine through the guest agent.
+// The SHA256 checksum reported by the guest is verified before the local file is moved into place.
+// The local file gets GuestFileCopyOptions.Mode, or else the permission bits of the file on a Linux guest, or else 0644.
+func (c *VirtualMachineClient) CopyFromGuest(ctx context.Context, group, vmName, guestPath, localPath string, options *GuestFileCopyOptions) error {
+	options, err := getGuestFileCopyOptions(options)
+	if err != nil {
+		return err
+	}
+	scripts, run, err := c.getGuestFileScripts(ctx, group, vmName)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := localPath + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	mode, err := copyFromGuest(ctx, run, scripts, f, guestPath, options)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err = os.Chmod(tmpPath, getLocalFileMode(options.Mode, mode)); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, localPath)
+}
+
+// getLocalFileMode returns the mode of a file copied from the guest, given the requested mode and the mode reported by
+// the guest
+func getLocalFileMode(requested, guest os.FileMode) os.FileMode {
+	if requested != 0 {
+		return requested.Perm()
+	}
+	if guest != 0 {
+		return guest
+	}
+	return defaultLocalFileMode
+}
+
+func getGuestFileCopyOptions(options *GuestFileCopyOptions) (*GuestFileCopyOptions, error) {
+	if options == nil {
+		options = &GuestFileCopyOptions{}
+	}
+	if options.ChunkSizeBytes < 0 {
+		return nil, errors.Wrapf(errors.InvalidInput, "Chunk size cannot be negative")
+	}
+	if options.ChunkSizeBytes == 0 {
+		options.ChunkSizeBytes = defaultGuestFileChunkSize
+	}
+	return options, nil
+}
+
+func (c *VirtualMachineClient) getGuestFileScripts(ctx context.Context, group, vmName string) (guestFileScripts, guestScriptRunner, error) {
+	vms, err := c.Get(ctx, group, vmName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if vms == nil || len(*vms) == 0 {
+		return nil, nil, errors.Wrapf(errors.NotFound, "Unable to find Virtual Machine [%s]", vmName)
+	}
+
+	var scripts guestFileScripts = windowsGuestFileScripts{}
+	if getGuestOsType(&(*vms)[0]) == compute.Linux {
+		scripts = linuxGuestFileScripts{}
+	}
+	return scripts, c.getGuestScriptRunner(group, vmName), nil
+}
+
+func (c *VirtualMachineClient) getGuestScriptRunner(group, vmName string) guestScriptRunner {
+	return func(ctx context.Context, script string) (string, error) {
+		response, err := c.RunCommand(ctx, group, vmName, &compute.VirtualMachineRunCommandRequest{
+			Source: &compute.VirtualMachineRunCommandScriptSource{Script: &script},
+		})
+		if err != nil {
+			return "", err
+		}
+		view := response.InstanceView
+		if view == nil {
+			return "", errors.Wrapf(errors.RunCommandFailed, "Run command returned no instance view")
+		}
+		if view.ExecutionState != compute.ExecutionStateSucceeded || (view.ExitCode != nil && *view.ExitCode != 0) {
+			stderr := ""
+			if view.Error != nil {
+				stderr = *view.Error
+			}
+			return "", errors.Wrapf(errors.RunCommandFailed, "Guest script failed with state [%s]: %s", view.ExecutionState, stderr)
+		}
+		if view.Output == nil {
+			return "", nil
+		}
+		return *view.Output, nil
+	}
+}
+
+// getGuestOsType mirrors the conversion to the agent, where a VM without a Linux configuration is treated as Windows
+func getGuestOsType(vm *compute.VirtualMachine) compute.OperatingSystemTypes {
+	if vm.VirtualMachineProperties == nil {
+		return compute.Windows
+	}
+	if vm.OsProfile != nil && vm.OsProfile.LinuxConfiguration != nil {
+		return compute.Linux
+	}
+	if vm.StorageProfile != nil && vm.StorageProfile.OsDisk != nil && vm.StorageProfile.OsDisk.OsType != "" {
+		return vm.StorageProfile.OsDisk.OsType
+	}
+	return compute.Windows
+}
+
+func copyToGuest(ctx context.Context, run guestScriptRunner, scripts guestFileScripts, r io.Reader, size int64, guestPath string, mode os.FileMode, options *GuestFileCopyOptions) error {
+	tmpPath := guestPath + ".tmp"
+	hash := sha256.New()
+	buf := make([]byte, options.ChunkSizeBytes)
+	var transferred int64
+	for first := true; first || transferred < size; first = false {
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		hash.Write(buf[:n])
+		if _, err = run(ctx, scripts.writeChunk(tmpPath, base64.StdEncoding.EncodeToString(buf[:n]), first)); err != nil {
+			return errors.Wrapf(err, "Failed to write chunk at offset %d of [%s]", transferred, guestPath)
+		}
+		transferred += int64(n)
+		if options.Progress != nil {
+			options.Progress(transferred, size)
+		}
+		if n == 0 {
+			break
+		}
+	}
+
+	_, err := run(ctx, scripts.commit(tmpPath, guestPath, hex.EncodeToString(hash.Sum(nil)), mode))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to verify [%s]", guestPath)
+	}
+	return nil
+}
+
+func copyFromGuest(ctx context.Context, run guestScriptRunner, scripts guestFileScripts, w io.Writer, guestPath string, options *GuestFileCopyOptions) (os.FileMode, error) {
+	out, err := run(ctx, scripts.stat(guestPath))
+	if err != nil {
+		return 0, errors.Wrapf(err, "Failed to stat [%s]", guestPath)
+	}
+	size, checksum, mode, err := parseGuestFileStat(out)
+	if err != nil {
+		return 0, err
+	}
+
+	hash := sha256.New()
+	var transferred int64
+	for transferred < size {
+		out, err = run(ctx, scripts.readChunk(guestPath, transferred, options.ChunkSizeBytes))
+		if err != nil {
+			return 0, errors.Wrapf(err, "Failed to read chunk at offset %d of [%s]", transferred, guestPath)
+		}
+		data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(out))
+		if err != nil {
+			return 0, errors.Wrapf(errors.InvalidInput, "Guest returned an invalid chunk at offset %d of [%s]: %v", transferred, guestPath, err)
+		}
+		if len(data) == 0 {
+			return 0, errors.Wrapf(errors.InconsistentState, "[%s] shrank to %d bytes while it was copied", guestPath, transferred)
+		}
+		if _, err = w.Write(data); err != nil {
+			return 0, err
+		}
+		hash.Write(data)
+		transferred += int64(len(data))
+		if options.Progress != nil {
+			options.Progress(transferred, size)
+		}
+	}
+
+	if actual := hex.EncodeToString(hash.Sum(nil)); actual != checksum {
+		return 0, errors.Wrapf(errors.InconsistentState, "Checksum mismatch for [%s]: expected %s, got %s", guestPath, checksum, actual)
+	}
+	return mode, nil
+}
+
+// parseGuestFileStat parses the "<size> <sha256> [<octal mode>]" line printed by the stat script
+func parseGuestFileStat(out string) (size int64, checksum string, mode os.FileMode, err error) {
+	fields := strings.Fields(out)
+	if len(fields) < 2 {
+		err = errors.Wrapf(errors.InvalidInput, "Unexpected guest file stat output [%s]", out)
+		return
+	}
+	size, err = strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		err = errors.Wrapf(errors.InvalidInput, "Unexpected guest file size [%s]", fields[0])
+		return
+	}
+	checksum = strings.ToLower(fields[1])
+	if len(fields) > 2 {
+		var m uint64
+		m, err = strconv.ParseUint(fields[2], 8, 32)
+		if err != nil {
+			err = errors.Wrapf(errors.InvalidInput, "Unexpected guest file mode [%s]", fields[2])
+			return
+		}
+		mode = os.FileMode(m).Perm()
+	}
+	return
+}
+
+// guestFileScripts generates the guest side of the file transfer for an operating system
+type guestFileScripts interface {
+	// writeChunk writes base64 data to path, truncating it when first is set
+	writeChunk(path, data string, first bool) string
+	// commit verifies the checksum of tmpPath, applies mode and moves it to path
+	commit(tmpPath, path, checksum string, mode os.FileMode) string
+	// stat prints "<size> <sha256> [<octal mode>]" for path
+	stat(path string) string
+	// readChunk prints up to count bytes of path starting at offset as base64
+	readChunk(path string, offset int64, count int) string
+}
+
+type linuxGuestFileScripts struct{}
+
+func (linuxGuestFileScripts) writeChunk(path, data string, first bool) string {
+	redirect := ">>"
+	if first {
+		redirect = ">"
+	}
+	return fmt.Sprintf("set -e\nprintf '%%s' '%s' | base64 -d %s %s\n", data, redirect, shellQuote(path))
+}
+
+func (linuxGuestFileScripts) commit(tmpPath, path, checksum string, mode os.FileMode) string {
+	return fmt.Sprintf("set -e\necho '%s  '%s | sha256sum -c --status\nchmod %04o %s\nmv -f %s %s\n",
+		checksum, shellQuote(tmpPath), mode.Perm(), shellQuote(tmpPath), shellQuote(tmpPath), shellQuote(path))
+}
+
+func (linuxGuestFileScripts) stat(path string) string {
+	return fmt.Sprintf("set -e\necho \"$(stat -c %%s %s) $(sha256sum < %s | cut -d' ' -f1) $(stat -c %%a %s)\"\n",
+		shellQuote(path), shellQuote(path), shellQuote(path))
+}
+
+func (linuxGuestFileScripts) readChunk(path string, offset int64, count int) string {
+	return fmt.Sprintf("set -e\ntail -c +%d %s | head -c %d | base64 -w0\n", offset+1, shellQuote(path), count)
+}
+
+type windowsGuestFileScripts struct{}
+
+func (windowsGuestFileScripts) writeChunk(path, data string, first bool) string {
+	fileMode := "Append"
+	if first {
+		fileMode = "Create"
+	}
+	return fmt.Sprintf("$ErrorActionPreference = 'Stop'\n$b = [Convert]::FromBase64String('%s')\n$f = [IO.File]::Open(%s, [IO.FileMode]::%s)\ntry { $f.Write($b, 0, $b.Length) } finally { $f.Close() }\n",
+		data, powershellQuote(path), fileMode)
+}
+
+func (windowsGuestFileScripts) commit(tmpPath, path, checksum string, mode os.FileMode) string {
+	return fmt.Sprintf("$ErrorActionPreference = 'Stop'\nif ((Get-FileHash -Algorithm SHA256 -LiteralPath %s).Hash.ToLower() -ne '%s') { throw 'checksum mismatch' }\nMove-Item -Force -LiteralPath %s -Destination %s\n",
+		powershellQuote(tmpPath), checksum, powershellQuote(tmpPath), powershellQuote(path))
+}
+
+func (windowsGuestFileScripts) stat(path string) string {
+	return fmt.Sprintf("$ErrorActionPreference = 'Stop'\nWrite-Output ('{0} {1}' -f (Get-Item -LiteralPath %s).Length, (Get-FileHash -Algorithm SHA256 -LiteralPath %s).Hash.ToLower())\n",
+		powershellQuote(path), powershellQuote(path))
+}
+
+func (windowsGuestFileScripts) readChunk(path string, offset int64, count int) string {
+	return fmt.Sprintf("$ErrorActionPreference = 'Stop'\n$f = [IO.File]::OpenRead(%s)\ntry { [void]$f.Seek(%d, [IO.SeekOrigin]::Begin); $b = New-Object byte[] %d; $n = $f.Read($b, 0, %d) } finally { $f.Close() }\nWrite-Output ([Convert]::ToBase64String($b, 0, $n))\n",
+		powershellQuote(path), offset, count, count)
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func powershellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
@@ -0,0 +1,115 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package virtualmachine
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeGuestFileScripts emits "op|arg|..." commands that fakeGuest interprets against an in-memory file system
+type fakeGuestFileScripts struct{}
+
+func (fakeGuestFileScripts) writeChunk(path, data string, first bool) string {
+	return fmt.Sprintf("write|%s|%s|%t", path, data, first)
+}
+func (fakeGuestFileScripts) commit(tmpPath, path, checksum string, mode os.FileMode) string {
+	return fmt.Sprintf("commit|%s|%s|%s|%o", tmpPath, path, checksum, mode)
+}
+func (fakeGuestFileScripts) stat(path string) string { return "stat|" + path }
+func (fakeGuestFileScripts) readChunk(path string, offset int64, count int) string {
+	return fmt.Sprintf("read|%s|%d|%d", path, offset, count)
+}
+
+type fakeGuest struct {
+	files map[string][]byte
+	modes map[string]string
+	calls int
+}
+
+func (g *fakeGuest) run(ctx context.Context, script string) (string, error) {
+	g.calls++
+	args := strings.Split(script, "|")
+	switch args[0] {
+	case "write":
+		data, _ := base64.StdEncoding.DecodeString(args[2])
+		if args[3] == "true" {
+			g.files[args[1]] = nil
+		}
+		g.files[args[1]] = append(g.files[args[1]], data...)
+	case "commit":
+		sum := sha256.Sum256(g.files[args[1]])
+		if hex.EncodeToString(sum[:]) != args[3] {
+			return "", fmt.Errorf("checksum mismatch")
+		}
+		g.files[args[2]] = g.files[args[1]]
+		g.modes[args[2]] = args[4]
+		delete(g.files, args[1])
+	case "stat":
+		sum := sha256.Sum256(g.files[args[1]])
+		return fmt.Sprintf("%d %s 640\n", len(g.files[args[1]]), hex.EncodeToString(sum[:])), nil
+	case "read":
+		offset, _ := strconv.Atoi(args[2])
+		count, _ := strconv.Atoi(args[3])
+		data := g.files[args[1]][offset:]
+		if len(data) > count {
+			data = data[:count]
+		}
+		return base64.StdEncoding.EncodeToString(data), nil
+	}
+	return "", nil
+}
+
+func Test_copyToGuestAndBack(t *testing.T) {
+	guest := &fakeGuest{files: map[string][]byte{}, modes: map[string]string{}}
+	content := bytes.Repeat([]byte("kubelet-config\n"), 100)
+	var progress []int64
+	options := &GuestFileCopyOptions{
+		ChunkSizeBytes: 512,
+		Progress:       func(transferred, total int64) { progress = append(progress, transferred) },
+	}
+
+	err := copyToGuest(context.Background(), guest.run, fakeGuestFileScripts{}, bytes.NewReader(content), int64(len(content)), "/etc/kubelet.conf", 0600, options)
+	assert.NoError(t, err)
+	assert.Equal(t, content, guest.files["/etc/kubelet.conf"])
+	assert.Equal(t, "600", guest.modes["/etc/kubelet.conf"])
+	assert.Equal(t, int64(len(content)), progress[len(progress)-1])
+	assert.Len(t, progress, 3)
+
+	var out bytes.Buffer
+	mode, err := copyFromGuest(context.Background(), guest.run, fakeGuestFileScripts{}, &out, "/etc/kubelet.conf", options)
+	assert.NoError(t, err)
+	assert.Equal(t, content, out.Bytes())
+	assert.Equal(t, os.FileMode(0640), mode)
+}
+
+func Test_copyToGuestEmptyFile(t *testing.T) {
+	guest := &fakeGuest{files: map[string][]byte{}, modes: map[string]string{}}
+	err := copyToGuest(context.Background(), guest.run, fakeGuestFileScripts{}, bytes.NewReader(nil), 0, "/tmp/empty", 0644, &GuestFileCopyOptions{ChunkSizeBytes: 16})
+	assert.NoError(t, err)
+	assert.Contains(t, guest.files, "/tmp/empty")
+	assert.Equal(t, 2, guest.calls)
+}
+
+func Test_getLocalFileMode(t *testing.T) {
+	assert.Equal(t, os.FileMode(0600), getLocalFileMode(0600, 0640))
+	assert.Equal(t, os.FileMode(0640), getLocalFileMode(0, 0640))
+	// Windows guests report no permission bits
+	assert.Equal(t, os.FileMode(0644), getLocalFileMode(0, 0))
+}
+
+func Test_shellQuote(t *testing.T) {
+	assert.Equal(t, `'/tmp/it'\''s'`, shellQuote("/tmp/it's"))
+	assert.Equal(t, `'C:\it''s'`, powershellQuote(`C:\it's`))
+}
@@ -0,0 +1,149 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package virtualmachine
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/microsoft/moc/pkg/errors"
+
+	"github.com/microsoft/wssd-sdk-for-go/services/compute"
+)
+
+// The guest info scripts print one "key=value" line per fact.
+// Adapters are printed as "nic=<name>|<mac>|<ip>,<ip>" and integration services as "service=<name>|<state>".
+const linuxGuestInfoScript = `. /etc/os-release
+echo "hostname=$(hostname)"
+echo "osname=$NAME"
+echo "osversion=$VERSION_ID"
+for d in /sys/class/net/*; do
+  n=$(basename "$d")
+  [ "$n" = lo ] && continue
+  ips=$(ip -o addr show dev "$n" 2>/dev/null | awk '{print $4}' | cut -d/ -f1 | paste -sd, -)
+  echo "nic=$n|$(cat "$d/address")|$ips"
+done
+for s in hv-kvp-daemon hv-vss-daemon hv-fcopy-daemon; do
+  echo "service=$s|$(systemctl is-active "$s" 2>/dev/null || true)"
+done
+`
+
+const windowsGuestInfoScript = `$ErrorActionPreference = 'Stop'
+$os = Get-CimInstance Win32_OperatingSystem
+Write-Output "hostname=$env:COMPUTERNAME"
+Write-Output "osname=$($os.Caption)"
+Write-Output "osversion=$($os.Version)"
+Get-NetAdapter | ForEach-Object {
+  $ips = (Get-NetIPAddress -InterfaceIndex $_.ifIndex -ErrorAction SilentlyContinue | ForEach-Object { $_.IPAddress }) -join ','
+  Write-Output "nic=$($_.Name)|$($_.MacAddress)|$ips"
+}
+Get-Service vmicheartbeat, vmickvpexchange, vmicshutdown, vmictimesync, vmicvss -ErrorAction SilentlyContinue | ForEach-Object {
+  Write-Output "service=$($_.Name)|$($_.Status)"
+}
+`
+
+// GetGuestInfo returns the hostname, operating system, network adapters and integration service state reported by the guest.
+// The facts come from a script run by the guest agent; the heartbeat and agent version come from the guest agent instance view.
+// The Hyper-V KVP exchange is not read: the node agent does not expose it. IntegrationServices only reports whether the
+// integration service daemons, such as the KVP daemon, are running in the guest. GetGuestInfo needs a working guest agent.
+func (c *VirtualMachineClient) GetGuestInfo(ctx context.Context, group, vmName string) (*compute.GuestInfo, error) {
+	vms, err := c.Get(ctx, group, vmName)
+	if err != nil {
+		return nil, err
+	}
+	if vms == nil || len(*vms) == 0 {
+		return nil, errors.Wrapf(errors.NotFound, "Unable to find Virtual Machine [%s]", vmName)
+	}
+	vm := (*vms)[0]
+
+	script := windowsGuestInfoScript
+	if getGuestOsType(&vm) == compute.Linux {
+		script = linuxGuestInfoScript
+	}
+	out, err := c.getGuestScriptRunner(group, vmName)(ctx, script)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to query the guest of Virtual Machine [%s]", vmName)
+	}
+
+	info := parseGuestInfo(out)
+	if vm.VirtualMachineProperties != nil && vm.GuestAgentInstanceView != nil {
+		agentVersion := vm.GuestAgentInstanceView.AgentVersion
+		info.AgentVersion = &agentVersion
+		info.LastHeartbeat = getLastHeartbeat(vm.GuestAgentInstanceView.Statuses)
+	}
+	return info, nil
+}
+
+func parseGuestInfo(out string) *compute.GuestInfo {
+	info := &compute.GuestInfo{
+		NetworkInterfaces:   &[]compute.GuestNetworkInterface{},
+		IntegrationServices: map[string]*string{},
+	}
+	for _, line := range strings.Split(out, "\n") {
+		key, value, found := strings.Cut(strings.TrimSpace(line), "=")
+		if !found {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch key {
+		case "hostname":
+			info.Hostname = &value
+		case "osname":
+			info.OsName = &value
+		case "osversion":
+			info.OsVersion = &value
+		case "nic":
+			fields := strings.SplitN(value, "|", 3)
+			if len(fields) != 3 {
+				continue
+			}
+			ips := []string{}
+			for _, ip := range strings.Split(fields[2], ",") {
+				if ip = strings.TrimSpace(ip); ip != "" {
+					ips = append(ips, ip)
+				}
+			}
+			name, mac := fields[0], fields[1]
+			*info.NetworkInterfaces = append(*info.NetworkInterfaces, compute.GuestNetworkInterface{
+				Name:        &name,
+				MacAddress:  &mac,
+				IPAddresses: &ips,
+			})
+		case "service":
+			name, state, found := strings.Cut(value, "|")
+			if !found {
+				continue
+			}
+			if state == "" {
+				state = "Unknown"
+			}
+			info.IntegrationServices[name] = &state
+		}
+	}
+	return info
+}
+
+// getLastHeartbeat returns the most recent status time, falling back to the last reported one when the times cannot be parsed
+func getLastHeartbeat(statuses []*compute.InstanceViewStatus) *string {
+	var last *string
+	var lastTime time.Time
+	for _, status := range statuses {
+		if status == nil || status.Time == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, status.Time)
+		if err != nil {
+			if lastTime.IsZero() {
+				last = &status.Time
+			}
+			continue
+		}
+		if t.After(lastTime) {
+			lastTime = t
+			last = &status.Time
+		}
+	}
+	return last
+}
@@ -0,0 +1,41 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package virtualmachine
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/microsoft/wssd-sdk-for-go/services/compute"
+)
+
+func Test_parseGuestInfo(t *testing.T) {
+	out := "hostname=node-1\nosname=Ubuntu\nosversion=22.04\n" +
+		"nic=eth0|00:15:5d:01:02:03|10.0.0.4,fe80::1\n" +
+		"nic=eth1|00:15:5d:01:02:04|\n" +
+		"service=hv-kvp-daemon|active\n" +
+		"service=hv-vss-daemon|\n" +
+		"garbage\n"
+
+	info := parseGuestInfo(out)
+	assert.Equal(t, "node-1", *info.Hostname)
+	assert.Equal(t, "Ubuntu", *info.OsName)
+	assert.Equal(t, "22.04", *info.OsVersion)
+	assert.Len(t, *info.NetworkInterfaces, 2)
+	assert.Equal(t, []string{"10.0.0.4", "fe80::1"}, *(*info.NetworkInterfaces)[0].IPAddresses)
+	assert.Empty(t, *(*info.NetworkInterfaces)[1].IPAddresses)
+	assert.Equal(t, "active", *info.IntegrationServices["hv-kvp-daemon"])
+	assert.Equal(t, "Unknown", *info.IntegrationServices["hv-vss-daemon"])
+}
+
+func Test_getLastHeartbeat(t *testing.T) {
+	assert.Nil(t, getLastHeartbeat(nil))
+	last := getLastHeartbeat([]*compute.InstanceViewStatus{
+		{Time: "2024-01-01T10:00:00Z"},
+		{Time: "2024-01-01T12:00:00Z"},
+		{Time: "2024-01-01T11:00:00Z"},
+	})
+	assert.Equal(t, "2024-01-01T12:00:00Z", *last)
+}
@@ -0,0 +1,213 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package internal
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+
+	wssdcompute "github.com/microsoft/moc/rpc/nodeagent/compute"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/microsoft/wssd-sdk-for-go/internal/roundtrip"
+	"github.com/microsoft/wssd-sdk-for-go/services/compute"
+)
+
+func Test_VirtualMachineRoundTrip(t *testing.T) {
+	for seed := int64(0); seed < 500; seed++ {
+		checkVirtualMachineRoundTrip(t, seed, false)
+		checkVirtualMachineRoundTrip(t, seed, true)
+		checkWssdVirtualMachineRoundTrip(t, seed)
+	}
+}
+
+func FuzzVirtualMachineRoundTrip(f *testing.F) {
+	f.Add(int64(0), false)
+	f.Add(int64(1), true)
+	f.Fuzz(func(t *testing.T, seed int64, sparse bool) {
+		checkVirtualMachineRoundTrip(t, seed, sparse)
+		checkWssdVirtualMachineRoundTrip(t, seed)
+	})
+}
+
+// checkVirtualMachineRoundTrip converts a random spec to protobuf and back. A sparse spec may be rejected, a full one must not be.
+func checkVirtualMachineRoundTrip(t *testing.T, seed int64, sparse bool) {
+	r := rand.New(rand.NewSource(seed))
+	vm := &compute.VirtualMachine{}
+	if sparse {
+		roundtrip.FillSparse(vm, r)
+	} else {
+		roundtrip.Fill(vm, r)
+	}
+	canonicalizeVirtualMachine(vm, r)
+
+	c := client{}
+	wssdvm, err := c.getWssdVirtualMachine(vm)
+	if sparse && err != nil {
+		return
+	}
+	if !assert.Nil(t, err, "seed %d", seed) {
+		return
+	}
+	got := c.getVirtualMachine(wssdvm)
+	clearVirtualMachineOutputs(got)
+	assert.Nil(t, roundtrip.Diff(vm, got), "seed %d", seed)
+}
+
+// checkWssdVirtualMachineRoundTrip converts a random node agent virtual machine to the SDK and back, the way a Get followed by a
+// CreateOrUpdate does. The SDK view must not change.
+func checkWssdVirtualMachineRoundTrip(t *testing.T, seed int64) {
+	r := rand.New(rand.NewSource(seed))
+	wssdvm := &wssdcompute.VirtualMachine{}
+	roundtrip.FillSparse(wssdvm, r)
+
+	c := client{}
+	vm := c.getVirtualMachine(wssdvm)
+	clearVirtualMachineOutputs(vm)
+	defaultVirtualMachine(vm)
+	wssdvm, err := c.getWssdVirtualMachine(vm)
+	if err != nil {
+		return
+	}
+	got := c.getVirtualMachine(wssdvm)
+	clearVirtualMachineOutputs(got)
+	assert.Nil(t, roundtrip.Diff(vm, got), "seed %d", seed)
+}
+
+// canonicalizeVirtualMachine replaces random values with valid ones, spells out defaults the node agent returns, and clears
+// the fields the node agent does not carry
+func canonicalizeVirtualMachine(vm *compute.VirtualMachine, r *rand.Rand) {
+	clearVirtualMachineOutputs(vm)
+	vm.Identity = canonicalizeIdentity(vm.Identity)
+	if vm.VirtualMachineProperties == nil {
+		vm.VirtualMachineProperties = &compute.VirtualMachineProperties{}
+	}
+	// Kept in tags, which only exist for set values
+	if d := vm.DiagnosticsProfile; d != nil && (d.BootDiagnostics == nil || d.BootDiagnostics.Enabled == nil && d.BootDiagnostics.StorageURI == nil) {
+		vm.DiagnosticsProfile = nil
+	}
+
+	if vm.HardwareProfile == nil {
+		vm.HardwareProfile = &compute.HardwareProfile{}
+	}
+	sizes := compute.ListSizes()
+	vm.HardwareProfile.VMSize = sizes[r.Intn(len(sizes))].Name
+	for _, gpu := range vm.HardwareProfile.VirtualMachineGPUs {
+		if gpu != nil && gpu.Assignment != nil {
+			*gpu.Assignment = []compute.Assignment{compute.GpuDDA, compute.GpuP, compute.GpuPV, compute.GpuDefault}[r.Intn(4)]
+		}
+	}
+
+	if vm.SecurityProfile != nil {
+		vm.SecurityProfile.SecurityType = []compute.SecurityTypes{"", compute.TrustedLaunch, compute.ConfidentialVM}[r.Intn(3)]
+	}
+
+	if s := vm.StorageProfile; s != nil {
+		// Not carried: the node agent only references virtual hard disks by name
+		s.ImageReference = nil
+		if s.OsDisk != nil {
+			s.OsDisk.Name = nil
+			s.OsDisk.OsType = ""
+			if s.OsDisk.ManagedDisk != nil && s.OsDisk.ManagedDisk.SecurityProfile != nil {
+				s.OsDisk.ManagedDisk.SecurityProfile.SecurityEncryptionType = []compute.SecurityEncryptionTypes{"", compute.NonPersistedTPM}[r.Intn(2)]
+			}
+		}
+		if s.DataDisks != nil {
+			for i := range *s.DataDisks {
+				(*s.DataDisks)[i].Name = nil
+				(*s.DataDisks)[i].ImageReference = nil
+			}
+		}
+	}
+
+	if vm.OsProfile == nil {
+		vm.OsProfile = &compute.OSProfile{}
+	}
+	os := vm.OsProfile
+	os.OsBootstrapEngine = []compute.OperatingSystemBootstrapEngine{compute.CloudInit, compute.WindowsAnswerFiles}[r.Intn(2)]
+	// Not carried back: the administrator password is write-only
+	os.AdminPassword = nil
+	// Not carried: secret references are resolved by the client
+	os.AdminPasswordReference = nil
+	if os.WindowsConfiguration != nil {
+		clearSSHKeyPaths(os.WindowsConfiguration.SSH)
+		if os.LinuxConfiguration != nil {
+			// Not carried: the public keys are taken from the configuration of the OS type
+			os.WindowsConfiguration.SSH = nil
+		}
+		if os.WindowsConfiguration.WinRM != nil && os.WindowsConfiguration.WinRM.Listeners != nil {
+			for i := range *os.WindowsConfiguration.WinRM.Listeners {
+				(*os.WindowsConfiguration.WinRM.Listeners)[i].Protocol = []compute.ProtocolTypes{compute.HTTP, compute.HTTPS}[r.Intn(2)]
+			}
+		}
+	}
+	if os.LinuxConfiguration != nil {
+		clearSSHKeyPaths(os.LinuxConfiguration.SSH)
+	}
+
+	if vm.NetworkProfile != nil && vm.NetworkProfile.NetworkInterfaces != nil {
+		for i := range *vm.NetworkProfile.NetworkInterfaces {
+			// Not carried: the virtual network is a property of the network interface
+			(*vm.NetworkProfile.NetworkInterfaces)[i].VirtualNetworkReference = nil
+		}
+	}
+}
+
+// defaultVirtualMachine spells out the profiles a missing one is sent as
+func defaultVirtualMachine(vm *compute.VirtualMachine) {
+	if vm.VirtualMachineProperties == nil {
+		return
+	}
+	if vm.OsProfile == nil {
+		vm.OsProfile = &compute.OSProfile{OsBootstrapEngine: compute.CloudInit}
+	}
+}
+
+func clearSSHKeyPaths(ssh *compute.SSHConfiguration) {
+	if ssh == nil || ssh.PublicKeys == nil {
+		return
+	}
+	for i := range *ssh.PublicKeys {
+		// Not carried: the node agent decides where the keys are stored
+		(*ssh.PublicKeys)[i].Path = nil
+	}
+}
+
+func clearVirtualMachineOutputs(vm *compute.VirtualMachine) {
+	vm.ID = nil
+	vm.Type = nil
+	if vm.VirtualMachineProperties == nil {
+		return
+	}
+	vm.ProvisioningState = nil
+	vm.ValidationStatus = nil
+	vm.GuestAgentInstanceView = nil
+	vm.Statuses = nil
+	vm.HighAvailabilityState = nil
+}
+
+// canonicalizeIdentity clears the read-only IDs, which are filled in by the client, and the user assigned identity names
+// that cannot be kept in a tag
+func canonicalizeIdentity(identity *compute.VirtualMachineScaleSetIdentity) *compute.VirtualMachineScaleSetIdentity {
+	if identity == nil {
+		return nil
+	}
+	identity.PrincipalID = nil
+	identity.TenantID = nil
+	for name := range identity.UserAssignedIdentities {
+		if name == "" || strings.Contains(name, ",") {
+			delete(identity.UserAssignedIdentities, name)
+			continue
+		}
+		identity.UserAssignedIdentities[name] = &compute.VirtualMachineScaleSetIdentityUserAssignedIdentitiesValue{}
+	}
+	if len(identity.UserAssignedIdentities) == 0 {
+		identity.UserAssignedIdentities = nil
+	}
+	if identity.Type == "" && identity.UserAssignedIdentities == nil && identity.KeyVaultName == nil {
+		return nil
+	}
+	return identity
+}
@@ -18,9 +18,13 @@ func (c *client) getWssdVirtualMachine(vm *compute.VirtualMachine) (*wssdcompute
 		return nil, errors.Wrapf(errors.InvalidInput, "Virtual Machine name is missing")
 	}
 
+	tags, err := c.getWssdVirtualMachineTags(vm)
+	if err != nil {
+		return nil, err
+	}
 	wssdvm := &wssdcompute.VirtualMachine{
 		Name: *vm.Name,
-		Tags: getWssdTags(vm.Tags),
+		Tags: tags,
 	}
 
 	if vm.VirtualMachineProperties == nil {
@@ -64,7 +68,7 @@ func (c *client) getWssdVirtualMachine(vm *compute.VirtualMachine) (*wssdcompute
 
 	wssdvm = &wssdcompute.VirtualMachine{
 		Name:              *vm.Name,
-		Tags:              getWssdTags(vm.Tags),
+		Tags:              tags,
 		Storage:           storageConfig,
 		Hardware:          hardwareConfig,
 		Security:          securityConfig,
@@ -100,8 +104,15 @@ func (c *client) getWssdVirtualMachineHardwareConfiguration(vm *compute.VirtualM
 	var dynMemConfig *wssdcommonproto.DynamicMemoryConfiguration
 	var vmGPUs []*wssdcommonproto.VirtualMachineGPU
 	if vm.HardwareProfile != nil {
-		sizeType = compute.GetWssdVirtualMachineSizeFromVirtualMachineSize(vm.HardwareProfile.VMSize)
+		var err error
+		sizeType, err = compute.GetSupportedWssdVirtualMachineSize(vm.HardwareProfile.VMSize)
+		if err != nil {
+			return nil, err
+		}
 		if vm.HardwareProfile.CustomSize != nil {
+			if vm.HardwareProfile.CustomSize.CpuCount == nil || vm.HardwareProfile.CustomSize.MemoryMB == nil {
+				return nil, errors.Wrapf(errors.InvalidInput, "Custom size requires both CpuCount and MemoryMB")
+			}
 			customSize = &wssdcommonproto.VirtualMachineCustomSize{
 				CpuCount: *vm.HardwareProfile.CustomSize.CpuCount,
 				MemoryMB: *vm.HardwareProfile.CustomSize.MemoryMB,
@@ -140,19 +151,17 @@ func (c *client) getWssdVirtualMachineHardwareConfiguration(vm *compute.VirtualM
 					assignment = wssdcommonproto.AssignmentType_GpuPV
 				case compute.GpuDefault:
 					assignment = wssdcommonproto.AssignmentType_GpuDefault
+				default:
+					return nil, errors.Wrapf(errors.InvalidInput, "Unsupported GPU assignment [%s]", *gpu.Assignment)
 				}
-				if gpu.PartitionSizeMB == nil {
-					defaultInt := uint64(0)
-					gpu.PartitionSizeMB = &defaultInt
+				vmGPU := &wssdcommonproto.VirtualMachineGPU{
+					Assignment: assignment,
 				}
-				if gpu.Name == nil {
-					defaultString := ""
-					gpu.Name = &defaultString
+				if gpu.PartitionSizeMB != nil {
+					vmGPU.PartitionSizeMB = *gpu.PartitionSizeMB
 				}
-				vmGPU := &wssdcommonproto.VirtualMachineGPU{
-					Assignment:      assignment,
-					PartitionSizeMB: *gpu.PartitionSizeMB,
-					Name:            *gpu.Name,
+				if gpu.Name != nil {
+					vmGPU.Name = *gpu.Name
 				}
 				vmGPUs = append(vmGPUs, vmGPU)
 			}
@@ -302,9 +311,27 @@ func (c *client) getWssdVirtualMachineGuestAgentConfiguration(s *compute.GuestAg
 	return gac, nil
 }
 
+// getWssdVirtualMachineTags returns the tags of the virtual machine with the declarations the node agent does not carry:
+// the identity and the boot diagnostics
+func (c *client) getWssdVirtualMachineTags(vm *compute.VirtualMachine) (*wssdcommonproto.Tags, error) {
+	var diagnostics *compute.DiagnosticsProfile
+	if vm.VirtualMachineProperties != nil {
+		diagnostics = vm.DiagnosticsProfile
+	}
+	tags, err := compute.BootDiagnosticsToTags(diagnostics, vm.Tags)
+	if err != nil {
+		return nil, err
+	}
+	tags, err = compute.IdentityToTags(vm.Identity, tags)
+	if err != nil {
+		return nil, err
+	}
+	return getWssdTags(tags), nil
+}
+
 func (c *client) getWssdVirtualMachineOSSSHPublicKeys(ssh *compute.SSHConfiguration) ([]*wssdcompute.SSHPublicKey, error) {
 	keys := []*wssdcompute.SSHPublicKey{}
-	if ssh == nil {
+	if ssh == nil || ssh.PublicKeys == nil {
 		return keys, nil
 	}
 	for _, key := range *ssh.PublicKeys {
@@ -477,10 +504,13 @@ func (c *client) getVirtualMachine(vm *wssdcompute.VirtualMachine) *compute.Virt
 		return &compute.VirtualMachine{}
 	}
 
+	identity, tags := compute.IdentityFromTags(getComputeTags(vm.GetTags()))
+	diagnostics, tags := compute.BootDiagnosticsFromTags(tags)
 	return &compute.VirtualMachine{
-		Name: &vm.Name,
-		ID:   &vm.Id,
-		Tags: getComputeTags(vm.GetTags()),
+		Name:     &vm.Name,
+		ID:       &vm.Id,
+		Tags:     tags,
+		Identity: identity,
 		VirtualMachineProperties: &compute.VirtualMachineProperties{
 			HardwareProfile:         c.getVirtualMachineHardwareProfile(vm),
 			SecurityProfile:         c.getVirtualMachineSecurityProfile(vm),
@@ -489,6 +519,7 @@ func (c *client) getVirtualMachine(vm *wssdcompute.VirtualMachine) *compute.Virt
 			NetworkProfile:          c.getVirtualMachineNetworkProfile(vm.Network),
 			GuestAgentProfile:       c.getVirtualMachineGuestProfile(vm.GuestAgent),
 			GuestAgentInstanceView:  c.getVirtualMachineGuestInstanceView(vm.GuestAgentInstanceView),
+			DiagnosticsProfile:      diagnostics,
 			DisableHighAvailability: &vm.DisableHighAvailability,
 			ProvisioningState:       status.GetProvisioningState(vm.Status.GetProvisioningStatus()),
 			ValidationStatus:        status.GetValidationStatus(vm.GetStatus()),
@@ -612,6 +643,9 @@ func (c *client) getVirtualMachineSecurityProfile(vm *wssdcompute.VirtualMachine
 }
 
 func (c *client) getVirtualMachineStorageProfile(s *wssdcompute.StorageConfiguration) *compute.StorageProfile {
+	if s == nil {
+		return nil
+	}
 	return &compute.StorageProfile{
 		OsDisk:                c.getVirtualMachineStorageProfileOsDisk(s.Osdisk),
 		DataDisks:             c.getVirtualMachineStorageProfileDataDisks(s.Datadisks),
@@ -620,6 +654,9 @@ func (c *client) getVirtualMachineStorageProfile(s *wssdcompute.StorageConfigura
 }
 
 func (c *client) getVirtualMachineStorageProfileOsDisk(d *wssdcompute.Disk) *compute.OSDisk {
+	if d == nil {
+		return nil
+	}
 	var managedDisk *compute.VirtualMachineManagedDiskParameters
 	if d.ManagedDisk != nil {
 		managedDisk = &compute.VirtualMachineManagedDiskParameters{}
@@ -646,6 +683,9 @@ func (c *client) getVirtualMachineStorageProfileDataDisks(dd []*wssdcompute.Disk
 	cdd := []compute.DataDisk{}
 
 	for _, i := range dd {
+		if i == nil {
+			continue
+		}
 		cdd = append(cdd, compute.DataDisk{VhdName: &(i.Diskname)})
 	}
 
@@ -747,6 +787,9 @@ func (c *client) getVirtualMachineLinuxConfiguration(linuxConfiguration *wssdcom
 }
 
 func (c *client) getVirtualMachineOSProfile(o *wssdcompute.OperatingSystemConfiguration) *compute.OSProfile {
+	if o == nil {
+		return nil
+	}
 	var osBootstrapEngine compute.OperatingSystemBootstrapEngine
 	switch o.OsBootstrapEngine {
 	case wssdcommonproto.OperatingSystemBootstrapEngine_WINDOWS_ANSWER_FILES:
@@ -757,17 +800,60 @@ func (c *client) getVirtualMachineOSProfile(o *wssdcompute.OperatingSystemConfig
 		osBootstrapEngine = compute.CloudInit
 	}
 
-	return &compute.OSProfile{
+	osProfile := &compute.OSProfile{
 		ComputerName: &o.ComputerName,
-		// AdminUsername: &o.Administrator.Username,
-		// AdminPassword: &o.Administrator.Password,
-		// Publickeys: &o.Publickeys,
-		// Users : &o.Users,
+		// The administrator password is write-only
+		AdminUsername:        c.getVirtualMachineAdminUsername(o.Administrator),
+		CustomData:           c.getVirtualMachineCustomData(o.CustomData),
 		OsBootstrapEngine:    osBootstrapEngine,
 		WindowsConfiguration: c.getVirtualMachineWindowsConfiguration(o.WindowsConfiguration),
 		LinuxConfiguration:   c.getVirtualMachineLinuxConfiguration(o.LinuxConfiguration),
 		ProxyConfiguration:   c.getVirtualMachineProxyConfiguration(o.ProxyConfiguration),
 	}
+
+	// The public keys are sent from the configuration of the OS type, see getWssdVirtualMachineOSConfiguration
+	if ssh := c.getVirtualMachineSSHConfiguration(o.Publickeys); ssh != nil {
+		if o.Ostype == wssdcommonproto.OperatingSystemType_LINUX || osProfile.LinuxConfiguration != nil {
+			if osProfile.LinuxConfiguration == nil {
+				osProfile.LinuxConfiguration = &compute.LinuxConfiguration{}
+			}
+			osProfile.LinuxConfiguration.SSH = ssh
+		} else {
+			if osProfile.WindowsConfiguration == nil {
+				osProfile.WindowsConfiguration = &compute.WindowsConfiguration{}
+			}
+			osProfile.WindowsConfiguration.SSH = ssh
+		}
+	}
+	return osProfile
+}
+
+func (c *client) getVirtualMachineCustomData(customData string) *string {
+	if customData == "" {
+		return nil
+	}
+	return &customData
+}
+
+func (c *client) getVirtualMachineAdminUsername(user *wssdcompute.UserConfiguration) *string {
+	if user == nil {
+		return nil
+	}
+	return &user.Username
+}
+
+func (c *client) getVirtualMachineSSHConfiguration(keys []*wssdcompute.SSHPublicKey) *compute.SSHConfiguration {
+	if len(keys) == 0 {
+		return nil
+	}
+	publicKeys := []compute.SSHPublicKey{}
+	for _, key := range keys {
+		if key == nil {
+			continue
+		}
+		publicKeys = append(publicKeys, compute.SSHPublicKey{KeyData: &key.Keydata})
+	}
+	return &compute.SSHConfiguration{PublicKeys: &publicKeys}
 }
 
 func (c *client) getInstanceViewStatus(status *wssdcommonproto.InstanceViewStatus) *compute.InstanceViewStatus {
@@ -810,13 +896,20 @@ func (c *client) getWssdVirtualMachineZoneConfiguration(zoneProfile *compute.Zon
 	}
 
 	wssdZones := []*wssdcompute.ZoneReference{}
-	for _, computeZone := range *zoneProfile.Zones {
-		nodes := []string{}
-		nodes = append(nodes, *computeZone.Nodes...)
-		wssdZones = append(wssdZones, &wssdcompute.ZoneReference{
-			Name:  *computeZone.Name,
-			Nodes: nodes,
-		})
+	if zoneProfile.Zones != nil {
+		for _, computeZone := range *zoneProfile.Zones {
+			if computeZone.Name == nil {
+				return nil, errors.Wrapf(errors.InvalidInput, "Zone name is missing")
+			}
+			nodes := []string{}
+			if computeZone.Nodes != nil {
+				nodes = append(nodes, *computeZone.Nodes...)
+			}
+			wssdZones = append(wssdZones, &wssdcompute.ZoneReference{
+				Name:  *computeZone.Name,
+				Nodes: nodes,
+			})
+		}
 	}
 	strictPlacement := false
 	if zoneProfile.StrictPlacement != nil {
@@ -831,7 +924,7 @@ func (c *client) getWssdVirtualMachineZoneConfiguration(zoneProfile *compute.Zon
 
 func (c *client) getVirtualMachineZoneConfiguration(vm *wssdcompute.VirtualMachine) *compute.ZoneConfiguration {
 	zones := vm.GetZoneConfiguration().GetZones()
-	if zones == nil || len(zones) == 0 {
+	if len(zones) == 0 && !vm.GetZoneConfiguration().GetStrictPlacement() {
 		return nil
 	}
 
@@ -308,6 +308,10 @@ func (c *client) getVirtualMachineRunCommandResponse(mocResponse *wssdcompute.Vi
 		executionState = compute.ExecutionStateSucceeded
 	case wssdcommonproto.VirtualMachineRunCommandExecutionState_ExecutionState_FAILED:
 		executionState = compute.ExecutionStateFailed
+	case wssdcommonproto.VirtualMachineRunCommandExecutionState_ExecutionState_PENDING:
+		executionState = compute.ExecutionStatePending
+	case wssdcommonproto.VirtualMachineRunCommandExecutionState_ExecutionState_REBOOTING:
+		executionState = compute.ExecutionStateRebooting
 	}
 
 	instanceView := &compute.VirtualMachineRunCommandInstanceView{
@@ -0,0 +1,283 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package virtualmachine
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/microsoft/moc/pkg/errors"
+
+	"github.com/microsoft/wssd-sdk-for-go/services/compute"
+)
+
+const defaultMetricsInterval = 5 * time.Second
+
+// The metrics scripts print cumulative counters, one "|" separated record per line:
+//
+//	time|<unix seconds>
+//	cpu|<busy ticks>|<total ticks>
+//	mem|<total KB>|<available KB>
+//	disk|<name>|<reads>|<read bytes>|<writes>|<write bytes>
+//	net|<name>|<received bytes>|<received packets>|<sent bytes>|<sent packets>
+const linuxMetricsScript = `echo "time|$(date +%s.%N)"
+awk '/^cpu /{t=0; for(i=2;i<=NF;i++) t+=$i; print "cpu|" t-$5-$6 "|" t}' /proc/stat
+awk '/^MemTotal:/{t=$2} /^MemAvailable:/{a=$2} END{print "mem|" t "|" a}' /proc/meminfo
+awk '$3 ~ /^(sd[a-z]+|vd[a-z]+|xvd[a-z]+|nvme[0-9]+n[0-9]+)$/ {print "disk|" $3 "|" $4 "|" $6*512 "|" $8 "|" $10*512}' /proc/diskstats
+awk 'NR>2 {sub(/^ +/, ""); split($0, a, /[: ]+/); if (a[1] != "lo") print "net|" a[1] "|" a[2] "|" a[3] "|" a[10] "|" a[11]}' /proc/net/dev
+`
+
+const windowsMetricsScript = `$ErrorActionPreference = 'Stop'
+Write-Output ("time|{0}" -f ([DateTimeOffset]::UtcNow.ToUnixTimeMilliseconds() / 1000))
+$cpu = Get-CimInstance Win32_PerfRawData_PerfOS_Processor -Filter "Name='_Total'"
+Write-Output ("cpu|{0}|{1}" -f ($cpu.Timestamp_Sys100NS - $cpu.PercentProcessorTime), $cpu.Timestamp_Sys100NS)
+$os = Get-CimInstance Win32_OperatingSystem
+Write-Output ("mem|{0}|{1}" -f $os.TotalVisibleMemorySize, $os.FreePhysicalMemory)
+Get-CimInstance Win32_PerfRawData_PerfDisk_PhysicalDisk | Where-Object { $_.Name -ne '_Total' } | ForEach-Object {
+  Write-Output ("disk|{0}|{1}|{2}|{3}|{4}" -f $_.Name, $_.DiskReadsPersec, $_.DiskReadBytesPersec, $_.DiskWritesPersec, $_.DiskWriteBytesPersec)
+}
+Get-CimInstance Win32_PerfRawData_Tcpip_NetworkInterface | ForEach-Object {
+  Write-Output ("net|{0}|{1}|{2}|{3}|{4}" -f $_.Name, $_.BytesReceivedPersec, $_.PacketsReceivedPersec, $_.BytesSentPersec, $_.PacketsSentPersec)
+}
+`
+
+// MetricsOptions controls the sampling done by GetMetrics and StreamMetrics
+type MetricsOptions struct {
+	// Interval - The length of a sampling interval. Defaults to 5 seconds.
+	Interval time.Duration
+	// Samples - The number of samples returned by GetMetrics. Defaults to 1. Ignored by StreamMetrics.
+	Samples int
+}
+
+// metricsCounters are the cumulative counters of a device at one point in time
+type metricsCounters [4]float64
+
+type metricsSnapshot struct {
+	time       time.Time
+	cpuBusy    float64
+	cpuTotal   float64
+	memTotalKB uint64
+	memAvailKB uint64
+	disks      map[string]metricsCounters
+	nics       map[string]metricsCounters
+	// order keeps devices in the order the guest reported them
+	diskOrder []string
+	nicOrder  []string
+}
+
+// GetMetrics samples the CPU, memory, disk and network utilization of the virtual machine.
+// Each sample is computed from the counters read inside the guest, through the guest agent, at the start and end of options.Interval.
+func (c *VirtualMachineClient) GetMetrics(ctx context.Context, group, vmName string, options MetricsOptions) (*[]compute.VirtualMachineMetricsSample, error) {
+	if options.Samples < 0 {
+		return nil, errors.Wrapf(errors.InvalidInput, "Sample count cannot be negative")
+	}
+	if options.Samples == 0 {
+		options.Samples = 1
+	}
+
+	samples := []compute.VirtualMachineMetricsSample{}
+	err := c.collectMetrics(ctx, group, vmName, options, func(sample compute.VirtualMachineMetricsSample) error {
+		samples = append(samples, sample)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &samples, nil
+}
+
+// StreamMetrics samples the virtual machine every options.Interval and passes each sample to handler.
+// It returns when ctx is done, a sample cannot be collected, or handler returns an error.
+func (c *VirtualMachineClient) StreamMetrics(ctx context.Context, group, vmName string, options MetricsOptions, handler func(compute.VirtualMachineMetricsSample) error) error {
+	options.Samples = 0
+	err := c.collectMetrics(ctx, group, vmName, options, handler)
+	if err != nil && ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+func (c *VirtualMachineClient) collectMetrics(ctx context.Context, group, vmName string, options MetricsOptions, handler func(compute.VirtualMachineMetricsSample) error) error {
+	if options.Interval < 0 {
+		return errors.Wrapf(errors.InvalidInput, "Sampling interval cannot be negative")
+	}
+	if options.Interval == 0 {
+		options.Interval = defaultMetricsInterval
+	}
+
+	vms, err := c.Get(ctx, group, vmName)
+	if err != nil {
+		return err
+	}
+	if vms == nil || len(*vms) == 0 {
+		return errors.Wrapf(errors.NotFound, "Unable to find Virtual Machine [%s]", vmName)
+	}
+	script := windowsMetricsScript
+	if getGuestOsType(&(*vms)[0]) == compute.Linux {
+		script = linuxMetricsScript
+	}
+	run := c.getGuestScriptRunner(group, vmName)
+
+	snapshot := func(ctx context.Context) (*metricsSnapshot, error) {
+		out, err := run(ctx, script)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Unable to read counters of Virtual Machine [%s]", vmName)
+		}
+		return parseMetricsSnapshot(out)
+	}
+	return sampleMetrics(ctx, snapshot, options.Interval, options.Samples, handler)
+}
+
+// sampleMetrics takes count+1 snapshots interval apart and reports the difference between consecutive ones.
+// A count of zero samples until ctx is done.
+func sampleMetrics(ctx context.Context, snapshot func(context.Context) (*metricsSnapshot, error), interval time.Duration, count int, handler func(compute.VirtualMachineMetricsSample) error) error {
+	prev, err := snapshot(ctx)
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for i := 0; count == 0 || i < count; i++ {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		next, err := snapshot(ctx)
+		if err != nil {
+			return err
+		}
+		if err = handler(getMetricsSample(prev, next)); err != nil {
+			return err
+		}
+		prev = next
+	}
+	return nil
+}
+
+func parseMetricsSnapshot(out string) (*metricsSnapshot, error) {
+	s := &metricsSnapshot{
+		disks: map[string]metricsCounters{},
+		nics:  map[string]metricsCounters{},
+	}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(strings.TrimSpace(line), "|")
+		switch fields[0] {
+		case "time", "cpu", "mem", "disk", "net":
+		default:
+			continue
+		}
+		values, err := parseMetricsValues(fields)
+		if err != nil {
+			return nil, errors.Wrapf(errors.InvalidInput, "Unexpected metrics line [%s]: %v", line, err)
+		}
+		switch {
+		case fields[0] == "time" && len(values) == 1:
+			sec, frac := math.Modf(values[0])
+			s.time = time.Unix(int64(sec), int64(frac*1e9)).UTC()
+		case fields[0] == "cpu" && len(values) == 2:
+			s.cpuBusy, s.cpuTotal = values[0], values[1]
+		case fields[0] == "mem" && len(values) == 2:
+			s.memTotalKB, s.memAvailKB = uint64(values[0]), uint64(values[1])
+		case fields[0] == "disk" && len(values) == 4:
+			s.disks[fields[1]] = metricsCounters{values[0], values[1], values[2], values[3]}
+			s.diskOrder = append(s.diskOrder, fields[1])
+		case fields[0] == "net" && len(values) == 4:
+			s.nics[fields[1]] = metricsCounters{values[0], values[1], values[2], values[3]}
+			s.nicOrder = append(s.nicOrder, fields[1])
+		}
+	}
+	if s.time.IsZero() {
+		return nil, errors.Wrapf(errors.InvalidInput, "Guest did not report a timestamp")
+	}
+	return s, nil
+}
+
+// parseMetricsValues parses the numeric fields of a record, skipping the record type and the device name
+func parseMetricsValues(fields []string) ([]float64, error) {
+	skip := 1
+	if fields[0] == "disk" || fields[0] == "net" {
+		skip = 2
+	}
+	if len(fields) < skip {
+		return nil, nil
+	}
+	values := []float64{}
+	for _, f := range fields[skip:] {
+		v, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+func getMetricsSample(prev, next *metricsSnapshot) compute.VirtualMachineMetricsSample {
+	elapsed := next.time.Sub(prev.time).Seconds()
+	rate := func(a, b float64) *float64 {
+		r := 0.0
+		if elapsed > 0 && b >= a {
+			r = (b - a) / elapsed
+		}
+		return &r
+	}
+
+	cpu := 0.0
+	if total := next.cpuTotal - prev.cpuTotal; total > 0 {
+		cpu = math.Max(0, math.Min(100, 100*(next.cpuBusy-prev.cpuBusy)/total))
+	}
+	assigned := next.memTotalKB / 1024
+	used := uint64(0)
+	if next.memTotalKB > next.memAvailKB {
+		used = (next.memTotalKB - next.memAvailKB) / 1024
+	}
+	t := next.time
+
+	disks := []compute.VirtualMachineDiskMetrics{}
+	for _, name := range next.diskOrder {
+		a, found := prev.disks[name]
+		if !found {
+			continue
+		}
+		b := next.disks[name]
+		n := name
+		disks = append(disks, compute.VirtualMachineDiskMetrics{
+			Name:                &n,
+			ReadIOPS:            rate(a[0], b[0]),
+			ReadBytesPerSecond:  rate(a[1], b[1]),
+			WriteIOPS:           rate(a[2], b[2]),
+			WriteBytesPerSecond: rate(a[3], b[3]),
+		})
+	}
+
+	nics := []compute.VirtualMachineNetworkInterfaceMetrics{}
+	for _, name := range next.nicOrder {
+		a, found := prev.nics[name]
+		if !found {
+			continue
+		}
+		b := next.nics[name]
+		n := name
+		nics = append(nics, compute.VirtualMachineNetworkInterfaceMetrics{
+			Name:                     &n,
+			BytesReceivedPerSecond:   rate(a[0], b[0]),
+			PacketsReceivedPerSecond: rate(a[1], b[1]),
+			BytesSentPerSecond:       rate(a[2], b[2]),
+			PacketsSentPerSecond:     rate(a[3], b[3]),
+		})
+	}
+
+	return compute.VirtualMachineMetricsSample{
+		Time:              &t,
+		CpuPercent:        &cpu,
+		AssignedMemoryMB:  &assigned,
+		GuestUsedMemoryMB: &used,
+		Disks:             &disks,
+		NetworkInterfaces: &nics,
+	}
+}
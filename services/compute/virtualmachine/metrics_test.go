@@ -0,0 +1,62 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package virtualmachine
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/microsoft/wssd-sdk-for-go/services/compute"
+)
+
+func Test_getMetricsSample(t *testing.T) {
+	prev, err := parseMetricsSnapshot("time|100\ncpu|200|1000\nmem|4194304|2097152\ndisk|sda|10|4096|20|8192\nnet|eth0|1000|10|2000|20\nwarning: ignored\n")
+	assert.NoError(t, err)
+	next, err := parseMetricsSnapshot("time|102\ncpu|450|2000\nmem|4194304|1048576\ndisk|sda|30|12288|20|8192\ndisk|sdb|5|5|5|5\nnet|eth0|3000|30|2000|20\n")
+	assert.NoError(t, err)
+
+	sample := getMetricsSample(prev, next)
+	assert.Equal(t, 25.0, *sample.CpuPercent)
+	assert.Equal(t, uint64(4096), *sample.AssignedMemoryMB)
+	assert.Equal(t, uint64(3072), *sample.GuestUsedMemoryMB)
+	assert.Len(t, *sample.Disks, 1)
+	assert.Equal(t, 10.0, *(*sample.Disks)[0].ReadIOPS)
+	assert.Equal(t, 4096.0, *(*sample.Disks)[0].ReadBytesPerSecond)
+	assert.Equal(t, 0.0, *(*sample.Disks)[0].WriteIOPS)
+	assert.Equal(t, 1000.0, *(*sample.NetworkInterfaces)[0].BytesReceivedPerSecond)
+}
+
+func Test_parseMetricsSnapshotErrors(t *testing.T) {
+	_, err := parseMetricsSnapshot("cpu|1|2\n")
+	assert.Error(t, err)
+	_, err = parseMetricsSnapshot("time|1\ncpu|x|2\n")
+	assert.Error(t, err)
+}
+
+func Test_sampleMetrics(t *testing.T) {
+	now := 0
+	snapshot := func(ctx context.Context) (*metricsSnapshot, error) {
+		now++
+		return parseMetricsSnapshot(fmt.Sprintf("time|%d\ncpu|%d|%d\nmem|1024|0\n", now, now*10, now*100))
+	}
+
+	samples := []compute.VirtualMachineMetricsSample{}
+	err := sampleMetrics(context.Background(), snapshot, time.Millisecond, 3, func(s compute.VirtualMachineMetricsSample) error {
+		samples = append(samples, s)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Len(t, samples, 3)
+	assert.Equal(t, 4, now)
+	assert.Equal(t, 10.0, *samples[2].CpuPercent)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = sampleMetrics(ctx, snapshot, time.Hour, 0, func(compute.VirtualMachineMetricsSample) error { return nil })
+	assert.Equal(t, context.Canceled, err)
+}
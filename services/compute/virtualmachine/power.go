@@ -0,0 +1,235 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package virtualmachine
+
+import (
+	"context"
+	"time"
+
+	"github.com/microsoft/moc/pkg/errors"
+	wssdcommonproto "github.com/microsoft/moc/rpc/common"
+)
+
+const (
+	// DefaultGracefulTimeout is how long StopWithOptions waits for the guest to shut down when no timeout is given
+	DefaultGracefulTimeout = 5 * time.Minute
+)
+
+// powerStatePollInterval is how often the power state is read while waiting for it to change
+var powerStatePollInterval = 2 * time.Second
+
+// StopOptions controls how StopWithOptions shuts a virtual machine down
+type StopOptions struct {
+	// GracefulTimeout - How long to wait for the guest to shut down. Zero uses DefaultGracefulTimeout.
+	GracefulTimeout time.Duration
+	// ForceAfterTimeout - Turn the virtual machine off if the guest has not shut down within GracefulTimeout, or the
+	// shutdown request failed. Without it, StopWithOptions returns the error of the graceful shutdown and leaves the
+	// virtual machine as it is.
+	ForceAfterTimeout bool
+}
+
+// StopPath is how a virtual machine reached the Off state
+type StopPath string
+
+const (
+	// StopPathAlreadyOff - The virtual machine was off before the request
+	StopPathAlreadyOff StopPath = "AlreadyOff"
+	// StopPathGraceful - The guest shut down
+	StopPathGraceful StopPath = "Graceful"
+	// StopPathForced - The virtual machine was turned off after the graceful shutdown failed or timed out
+	StopPathForced StopPath = "Forced"
+	// StopPathHard - The virtual machine was turned off without asking the guest
+	StopPathHard StopPath = "Hard"
+)
+
+// StopResult describes how a virtual machine was stopped
+type StopResult struct {
+	// Path - How the virtual machine reached the Off state; empty if it did not
+	Path StopPath
+	// GracefulError - Why the graceful shutdown did not complete, if it was tried and failed or timed out
+	GracefulError error
+	// Duration - Time from the request until the virtual machine was observed off
+	Duration time.Duration
+}
+
+// RestartStrategy is how RestartWithOptions stops a virtual machine before starting it again
+type RestartStrategy string
+
+const (
+	// RestartGraceful - Shut the guest down and fail if it does not shut down in time
+	RestartGraceful RestartStrategy = "Graceful"
+	// RestartHard - Turn the virtual machine off without asking the guest
+	RestartHard RestartStrategy = "Hard"
+	// RestartGracefulThenHard - Shut the guest down and turn the virtual machine off if it does not shut down in time
+	RestartGracefulThenHard RestartStrategy = "GracefulThenHard"
+)
+
+// RestartOptions controls how RestartWithOptions restarts a virtual machine
+type RestartOptions struct {
+	// Strategy - How to stop the virtual machine. Empty uses RestartGraceful, like Restart.
+	Strategy RestartStrategy
+	// GracefulTimeout - How long to wait for the guest to shut down. Zero uses DefaultGracefulTimeout.
+	GracefulTimeout time.Duration
+}
+
+// RestartResult describes how a virtual machine was restarted
+type RestartResult struct {
+	// Strategy - The strategy that was applied
+	Strategy RestartStrategy
+	// Stop - How the virtual machine was stopped
+	Stop StopResult
+	// Started - Whether the virtual machine was observed running again
+	Started bool
+	// Duration - Time from the request until the virtual machine was observed running again
+	Duration time.Duration
+}
+
+// StopWithOptions shuts the guest down and waits until the virtual machine is off.
+// If the guest does not shut down within options.GracefulTimeout, or the shutdown request fails, the virtual machine is
+// turned off when options.ForceAfterTimeout is set. Otherwise the error of the graceful shutdown is returned: a Timeout
+// error if options.GracefulTimeout expired, or the error of the shutdown request.
+func (c *VirtualMachineClient) StopWithOptions(ctx context.Context, group, name string, options StopOptions) (*StopResult, error) {
+	if options.GracefulTimeout < 0 {
+		return nil, errors.Wrapf(errors.InvalidInput, "Graceful timeout cannot be negative")
+	}
+	if options.GracefulTimeout == 0 {
+		options.GracefulTimeout = DefaultGracefulTimeout
+	}
+	start := time.Now()
+	result := &StopResult{}
+
+	off, err := c.isVirtualMachineOff(ctx, group, name)
+	if err != nil {
+		return nil, err
+	}
+	if off {
+		result.Path = StopPathAlreadyOff
+		result.Duration = time.Since(start)
+		return result, nil
+	}
+
+	result.GracefulError = c.stopGraceful(ctx, group, name, options.GracefulTimeout)
+	if result.GracefulError == nil {
+		result.Path = StopPathGraceful
+		result.Duration = time.Since(start)
+		return result, nil
+	}
+	if ctx.Err() != nil {
+		return result, ctx.Err()
+	}
+	if !options.ForceAfterTimeout {
+		return result, result.GracefulError
+	}
+
+	if err = c.stopHard(ctx, group, name); err != nil {
+		return result, errors.Wrapf(err, "Unable to turn off Virtual Machine [%s] after the graceful shutdown failed", name)
+	}
+	result.Path = StopPathForced
+	result.Duration = time.Since(start)
+	return result, nil
+}
+
+// RestartWithOptions stops the virtual machine following options.Strategy, waits until it is off, starts it
+// and waits until it is running again
+func (c *VirtualMachineClient) RestartWithOptions(ctx context.Context, group, name string, options RestartOptions) (*RestartResult, error) {
+	if options.Strategy == "" {
+		options.Strategy = RestartGraceful
+	}
+	start := time.Now()
+	result := &RestartResult{Strategy: options.Strategy}
+
+	switch options.Strategy {
+	case RestartGraceful, RestartGracefulThenHard:
+		stop, err := c.StopWithOptions(ctx, group, name, StopOptions{
+			GracefulTimeout:   options.GracefulTimeout,
+			ForceAfterTimeout: options.Strategy == RestartGracefulThenHard,
+		})
+		if stop != nil {
+			result.Stop = *stop
+		}
+		if err != nil {
+			return result, err
+		}
+	case RestartHard:
+		off, err := c.isVirtualMachineOff(ctx, group, name)
+		if err != nil {
+			return nil, err
+		}
+		result.Stop.Path = StopPathAlreadyOff
+		if !off {
+			if err = c.stopHard(ctx, group, name); err != nil {
+				return result, err
+			}
+			result.Stop.Path = StopPathHard
+		}
+		result.Stop.Duration = time.Since(start)
+	default:
+		return nil, errors.Wrapf(errors.InvalidInput, "Unknown restart strategy [%s]", options.Strategy)
+	}
+
+	if err := c.Start(ctx, group, name); err != nil {
+		return result, errors.Wrapf(err, "Unable to start Virtual Machine [%s] after stopping it", name)
+	}
+	if err := c.waitForPowerState(ctx, group, name, wssdcommonproto.PowerState_Running); err != nil {
+		return result, err
+	}
+	result.Started = true
+	result.Duration = time.Since(start)
+	return result, nil
+}
+
+// stopGraceful asks the guest to shut down and waits until the virtual machine is off, for at most timeout.
+// It fails with a Timeout error only if timeout expired; a failed shutdown request returns its own error.
+func (c *VirtualMachineClient) stopGraceful(ctx context.Context, group, name string, timeout time.Duration) error {
+	gracefulCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := c.internal.StopGraceful(gracefulCtx, group, name)
+	if err == nil {
+		err = c.waitForPowerState(gracefulCtx, group, name, wssdcommonproto.PowerState_Off)
+	}
+	if err != nil && ctx.Err() == nil && gracefulCtx.Err() == context.DeadlineExceeded {
+		return errors.Wrapf(errors.Timeout, "Virtual Machine [%s] did not shut down within %s: %v", name, timeout, err)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Unable to shut down Virtual Machine [%s]", name)
+	}
+	return nil
+}
+
+// stopHard turns the virtual machine off and waits until it is observed off
+func (c *VirtualMachineClient) stopHard(ctx context.Context, group, name string) error {
+	if err := c.internal.Stop(ctx, group, name); err != nil {
+		return err
+	}
+	return c.waitForPowerState(ctx, group, name, wssdcommonproto.PowerState_Off)
+}
+
+func (c *VirtualMachineClient) isVirtualMachineOff(ctx context.Context, group, name string) (bool, error) {
+	vm, err := c.getVirtualMachine(ctx, group, name)
+	if err != nil {
+		return false, err
+	}
+	state, found := vm.Statuses["PowerState"]
+	return found && state != nil && *state == wssdcommonproto.PowerState_Off.String(), nil
+}
+
+// waitForPowerState polls the virtual machine until it reports the given power state or ctx is done
+func (c *VirtualMachineClient) waitForPowerState(ctx context.Context, group, name string, powerState wssdcommonproto.PowerState) error {
+	ticker := time.NewTicker(powerStatePollInterval)
+	defer ticker.Stop()
+	for {
+		vm, err := c.getVirtualMachine(ctx, group, name)
+		if err != nil {
+			return err
+		}
+		if state, found := vm.Statuses["PowerState"]; found && state != nil && *state == powerState.String() {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(errors.Timeout, "Virtual Machine [%s] did not reach power state [%s]: %v", name, powerState, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package virtualmachine
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/microsoft/moc/pkg/errors"
+	"github.com/microsoft/moc/pkg/errors/codes"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/microsoft/wssd-sdk-for-go/services/compute"
+)
+
+func newPowerTestClient(t *testing.T) (*VirtualMachineClient, *fakeService) {
+	interval := powerStatePollInterval
+	powerStatePollInterval = time.Millisecond
+	t.Cleanup(func() { powerStatePollInterval = interval })
+
+	running := "Running"
+	service := newFakeService(&compute.VirtualMachine{
+		Name: proto.String("vm1"),
+		VirtualMachineProperties: &compute.VirtualMachineProperties{
+			Statuses: map[string]*string{"PowerState": &running},
+		},
+	})
+	return &VirtualMachineClient{internal: service}, service
+}
+
+func Test_StopWithOptions(t *testing.T) {
+	client, service := newPowerTestClient(t)
+	ctx := context.Background()
+
+	result, err := client.StopWithOptions(ctx, "", "vm1", StopOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, StopPathGraceful, result.Path)
+	assert.Nil(t, result.GracefulError)
+
+	service.calls = nil
+	result, err = client.StopWithOptions(ctx, "", "vm1", StopOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, StopPathAlreadyOff, result.Path)
+	assert.NotZero(t, result.Duration)
+	assert.Equal(t, []string{"Get:vm1"}, service.calls)
+
+	// A guest that ignores the shutdown is left running unless forcing is allowed
+	service.ignoreShutdown = true
+	assert.NoError(t, service.setPowerState("vm1", "Running"))
+	result, err = client.StopWithOptions(ctx, "", "vm1", StopOptions{GracefulTimeout: 20 * time.Millisecond})
+	assert.True(t, errors.IsMocErrorCode(err, codes.Timeout))
+	assert.Equal(t, StopPath(""), result.Path)
+	assert.NotNil(t, result.GracefulError)
+	assert.Equal(t, "Running", *service.vms["vm1"].Statuses["PowerState"])
+
+	// A failed shutdown request is not a timeout
+	service.errs["StopGraceful"] = errors.Failed
+	result, err = client.StopWithOptions(ctx, "", "vm1", StopOptions{GracefulTimeout: time.Minute})
+	assert.True(t, errors.IsFailed(err))
+	assert.False(t, errors.IsMocErrorCode(err, codes.Timeout))
+	assert.Equal(t, StopPath(""), result.Path)
+	delete(service.errs, "StopGraceful")
+
+	service.calls = nil
+	result, err = client.StopWithOptions(ctx, "", "vm1", StopOptions{GracefulTimeout: 20 * time.Millisecond, ForceAfterTimeout: true})
+	assert.NoError(t, err)
+	assert.Equal(t, StopPathForced, result.Path)
+	assert.Contains(t, service.calls, "Stop:vm1")
+	assert.Equal(t, "Off", *service.vms["vm1"].Statuses["PowerState"])
+}
+
+func Test_RestartWithOptions(t *testing.T) {
+	client, service := newPowerTestClient(t)
+	ctx := context.Background()
+
+	result, err := client.RestartWithOptions(ctx, "", "vm1", RestartOptions{Strategy: RestartHard})
+	assert.NoError(t, err)
+	assert.Equal(t, StopPathHard, result.Stop.Path)
+	assert.True(t, result.Started)
+	assert.NotContains(t, service.calls, "StopGraceful:vm1")
+
+	// A failed shutdown request falls back to turning the virtual machine off
+	service.calls = nil
+	service.errs["StopGraceful"] = errors.Failed
+	result, err = client.RestartWithOptions(ctx, "", "vm1", RestartOptions{Strategy: RestartGracefulThenHard})
+	assert.NoError(t, err)
+	assert.Equal(t, StopPathForced, result.Stop.Path)
+	assert.True(t, errors.IsFailed(result.Stop.GracefulError))
+	assert.Equal(t, []string{"Get:vm1", "StopGraceful:vm1", "Stop:vm1"}, service.calls[:3])
+	assert.Equal(t, "Running", *service.vms["vm1"].Statuses["PowerState"])
+
+	service.errs["StopGraceful"] = errors.Failed
+	result, err = client.RestartWithOptions(ctx, "", "vm1", RestartOptions{})
+	assert.True(t, errors.IsFailed(err))
+	assert.Equal(t, RestartGraceful, result.Strategy)
+	assert.False(t, result.Started)
+
+	_, err = client.RestartWithOptions(ctx, "", "vm1", RestartOptions{Strategy: "Sometimes"})
+	assert.True(t, errors.IsInvalidInput(err))
+}
@@ -0,0 +1,302 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package virtualmachine
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/microsoft/moc/pkg/errors"
+	wssdcommonproto "github.com/microsoft/moc/rpc/common"
+
+	"github.com/microsoft/wssd-sdk-for-go/services/compute"
+)
+
+// ResizeChange is a single hardware setting changed by a resize
+type ResizeChange struct {
+	// Field - The changed setting, e.g. cpuCount or dynamicMemoryConfig.maximumMemoryMB
+	Field string
+	// From - The current value
+	From string
+	// To - The target value
+	To string
+	// RequiresRestart - Whether the change can only be applied while the virtual machine is off
+	RequiresRestart bool
+}
+
+// ResizePlan is the difference between the current and the target hardware profile of a virtual machine
+type ResizePlan struct {
+	// Changes - The settings that change, in a stable order
+	Changes []ResizeChange
+	// GpusAdded - GPUs in the target profile that are not assigned today
+	GpusAdded []*compute.VirtualMachineGPU
+	// GpusRemoved - GPUs assigned today that are not in the target profile
+	GpusRemoved []*compute.VirtualMachineGPU
+	// Target - The hardware profile applied by ApplyResize
+	Target *compute.HardwareProfile
+}
+
+// IsEmpty returns true if the resize does not change anything
+func (p *ResizePlan) IsEmpty() bool {
+	return len(p.Changes) == 0
+}
+
+// RequiresRestart returns true if any change can only be applied while the virtual machine is off
+func (p *ResizePlan) RequiresRestart() bool {
+	for _, change := range p.Changes {
+		if change.RequiresRestart {
+			return true
+		}
+	}
+	return false
+}
+
+// ResizeOptions controls how ApplyResize handles changes that cannot be applied to a running virtual machine
+type ResizeOptions struct {
+	// AllowRestart - Stop the virtual machine gracefully, apply the change and start it again when required.
+	// Without it, ApplyResize fails instead of restarting a running virtual machine.
+	AllowRestart bool
+}
+
+// PlanResize computes the changes needed to move the virtual machine to the target hardware profile, without applying them
+func (c *VirtualMachineClient) PlanResize(ctx context.Context, group, name string, target *compute.HardwareProfile) (*ResizePlan, error) {
+	vm, err := c.getVirtualMachine(ctx, group, name)
+	if err != nil {
+		return nil, err
+	}
+	return getResizePlan(vm.HardwareProfile, target)
+}
+
+// ApplyResize moves the virtual machine to the target hardware profile.
+// Changes that cannot be applied to a running virtual machine are applied between StopGraceful and Start if options.AllowRestart is set.
+// A nil target DynamicMemoryConfig keeps the current one. The virtual machine is started again even if applying the change fails.
+func (c *VirtualMachineClient) ApplyResize(ctx context.Context, group, name string, target *compute.HardwareProfile, options ResizeOptions) (*ResizePlan, error) {
+	vm, err := c.getVirtualMachine(ctx, group, name)
+	if err != nil {
+		return nil, err
+	}
+	plan, err := getResizePlan(vm.HardwareProfile, target)
+	if err != nil || plan.IsEmpty() {
+		return plan, err
+	}
+
+	restart := isVirtualMachineRunning(vm) && plan.RequiresRestart()
+	if restart && !options.AllowRestart {
+		return plan, errors.Wrapf(errors.PreCheckFailed, "Resizing Virtual Machine [%s] requires a restart", name)
+	}
+
+	vm.HardwareProfile = getResizedHardwareProfile(vm.HardwareProfile, plan.Target)
+	if restart {
+		if err = c.StopGraceful(ctx, group, name); err != nil {
+			return plan, errors.Wrapf(err, "Unable to stop Virtual Machine [%s] for resize", name)
+		}
+	}
+	_, err = c.CreateOrUpdate(ctx, group, name, vm)
+	if restart {
+		if startErr := c.Start(ctx, group, name); startErr != nil {
+			if err != nil {
+				return plan, errors.Wrapf(err, "Unable to restart Virtual Machine [%s] after failed resize: %v", name, startErr)
+			}
+			return plan, errors.Wrapf(startErr, "Unable to start Virtual Machine [%s] after resize", name)
+		}
+	}
+	return plan, err
+}
+
+func (c *VirtualMachineClient) getVirtualMachine(ctx context.Context, group, name string) (*compute.VirtualMachine, error) {
+	vms, err := c.Get(ctx, group, name)
+	if err != nil {
+		return nil, err
+	}
+	if vms == nil || len(*vms) == 0 {
+		return nil, errors.Wrapf(errors.NotFound, "Unable to find Virtual Machine [%s]", name)
+	}
+	vm := (*vms)[0]
+	if vm.VirtualMachineProperties == nil {
+		vm.VirtualMachineProperties = &compute.VirtualMachineProperties{}
+	}
+	return &vm, nil
+}
+
+// getResizedHardwareProfile keeps the current dynamic memory configuration unless the target sets one
+func getResizedHardwareProfile(current, target *compute.HardwareProfile) *compute.HardwareProfile {
+	resized := *target
+	if resized.DynamicMemoryConfig == nil && current != nil {
+		resized.DynamicMemoryConfig = current.DynamicMemoryConfig
+	}
+	return &resized
+}
+
+func isVirtualMachineRunning(vm *compute.VirtualMachine) bool {
+	if vm.VirtualMachineProperties == nil || vm.Statuses == nil {
+		return false
+	}
+	state, found := vm.Statuses["PowerState"]
+	return found && state != nil && *state == wssdcommonproto.PowerState_Running.String()
+}
+
+// hardwareShape is the CPU and memory a hardware profile resolves to; nil when the size is not in the catalog
+type hardwareShape struct {
+	size     compute.VirtualMachineSizeTypes
+	cpuCount *int32
+	memoryMB *int32
+	gpuCount *int32
+}
+
+func getHardwareShape(hw *compute.HardwareProfile) hardwareShape {
+	size := compute.VirtualMachineSizeTypesDefault
+	if hw != nil && hw.VMSize != "" {
+		size = hw.VMSize
+	}
+	if hw != nil && hw.CustomSize != nil {
+		switch size {
+		case compute.VirtualMachineSizeTypesCustom, compute.VirtualMachineSizeTypesCustomNK, compute.VirtualMachineSizeTypesCustomGpupv:
+			return hardwareShape{size: size, cpuCount: hw.CustomSize.CpuCount, memoryMB: hw.CustomSize.MemoryMB, gpuCount: hw.CustomSize.GpuCount}
+		}
+	}
+	vmSize, err := compute.GetSize(size)
+	if err != nil || vmSize.CpuCount == nil {
+		return hardwareShape{size: size}
+	}
+	return hardwareShape{size: size, cpuCount: vmSize.CpuCount, memoryMB: vmSize.MemoryMB, gpuCount: vmSize.GpuCount}
+}
+
+// getResizePlan diffs two hardware profiles.
+// Hyper-V can hot-resize static memory, raise the dynamic memory maximum and lower the minimum of a running virtual machine;
+// changing the processor count, switching dynamic memory on or off and assigning GPUs need the virtual machine to be off.
+func getResizePlan(current, target *compute.HardwareProfile) (*ResizePlan, error) {
+	if target == nil {
+		return nil, errors.Wrapf(errors.InvalidInput, "Target hardware profile is nil")
+	}
+	if target.VMSize != "" {
+		if _, err := compute.GetSupportedWssdVirtualMachineSize(target.VMSize); err != nil {
+			return nil, err
+		}
+	}
+	if current == nil {
+		current = &compute.HardwareProfile{}
+	}
+	plan := &ResizePlan{Target: target}
+
+	currentShape, targetShape := getHardwareShape(current), getHardwareShape(target)
+	shapeKnown := currentShape.cpuCount != nil && currentShape.memoryMB != nil && targetShape.cpuCount != nil && targetShape.memoryMB != nil
+	if currentShape.size != targetShape.size {
+		plan.add("vmSize", currentShape.size, targetShape.size, !shapeKnown)
+	}
+	if shapeKnown {
+		if *currentShape.cpuCount != *targetShape.cpuCount {
+			plan.add("cpuCount", *currentShape.cpuCount, *targetShape.cpuCount, true)
+		}
+		if *currentShape.memoryMB != *targetShape.memoryMB {
+			// The startup memory of a dynamic memory virtual machine is only read at boot
+			dynamic := current.DynamicMemoryConfig != nil || target.DynamicMemoryConfig != nil
+			plan.add("memoryMB", *currentShape.memoryMB, *targetShape.memoryMB, dynamic)
+		}
+	}
+	if currentShape.gpuCount != nil && targetShape.gpuCount != nil && *currentShape.gpuCount != *targetShape.gpuCount {
+		plan.add("gpuCount", *currentShape.gpuCount, *targetShape.gpuCount, true)
+	}
+
+	if target.DynamicMemoryConfig != nil {
+		plan.addDynamicMemoryChanges(current.DynamicMemoryConfig, target.DynamicMemoryConfig)
+	}
+
+	plan.GpusAdded, plan.GpusRemoved = diffGpuLists(current.VirtualMachineGPUs, target.VirtualMachineGPUs)
+	if len(plan.GpusAdded) > 0 || len(plan.GpusRemoved) > 0 {
+		plan.add("virtualMachineGPUs", getGpuListString(current.VirtualMachineGPUs), getGpuListString(target.VirtualMachineGPUs), true)
+	}
+	return plan, nil
+}
+
+func (p *ResizePlan) add(field string, from, to interface{}, requiresRestart bool) {
+	p.Changes = append(p.Changes, ResizeChange{
+		Field:           field,
+		From:            fmt.Sprint(from),
+		To:              fmt.Sprint(to),
+		RequiresRestart: requiresRestart,
+	})
+}
+
+func (p *ResizePlan) addDynamicMemoryChanges(current, target *compute.DynamicMemoryConfiguration) {
+	if current == nil {
+		p.add("dynamicMemoryConfig", "disabled", "enabled", true)
+		return
+	}
+	if a, b := uint64OrZero(current.MaximumMemoryMB), uint64OrZero(target.MaximumMemoryMB); target.MaximumMemoryMB != nil && a != b {
+		p.add("dynamicMemoryConfig.maximumMemoryMB", a, b, b < a)
+	}
+	if a, b := uint64OrZero(current.MinimumMemoryMB), uint64OrZero(target.MinimumMemoryMB); target.MinimumMemoryMB != nil && a != b {
+		p.add("dynamicMemoryConfig.minimumMemoryMB", a, b, b > a)
+	}
+	if current.TargetMemoryBuffer == nil || target.TargetMemoryBuffer == nil {
+		if target.TargetMemoryBuffer != nil {
+			p.add("dynamicMemoryConfig.targetMemoryBuffer", "", *target.TargetMemoryBuffer, false)
+		}
+	} else if *current.TargetMemoryBuffer != *target.TargetMemoryBuffer {
+		p.add("dynamicMemoryConfig.targetMemoryBuffer", *current.TargetMemoryBuffer, *target.TargetMemoryBuffer, false)
+	}
+}
+
+func uint64OrZero(v *uint64) uint64 {
+	if v == nil {
+		return 0
+	}
+	return *v
+}
+
+func getGpuKey(gpu *compute.VirtualMachineGPU) string {
+	assignment, name, partition := "", "", uint64(0)
+	if gpu.Assignment != nil {
+		assignment = string(*gpu.Assignment)
+	}
+	if gpu.Name != nil {
+		name = *gpu.Name
+	}
+	if gpu.PartitionSizeMB != nil {
+		partition = *gpu.PartitionSizeMB
+	}
+	return fmt.Sprintf("%s/%s/%d", assignment, name, partition)
+}
+
+func getGpuListString(gpus []*compute.VirtualMachineGPU) string {
+	keys := []string{}
+	for _, gpu := range gpus {
+		if gpu != nil {
+			keys = append(keys, getGpuKey(gpu))
+		}
+	}
+	return fmt.Sprint(keys)
+}
+
+// diffGpuLists matches GPUs by assignment, name and partition size, so a swap shows up as one removal and one addition
+func diffGpuLists(oldGpuList, newGpuList []*compute.VirtualMachineGPU) (added, removed []*compute.VirtualMachineGPU) {
+	remaining := map[string]int{}
+	for _, gpu := range oldGpuList {
+		if gpu != nil {
+			remaining[getGpuKey(gpu)]++
+		}
+	}
+	for _, gpu := range newGpuList {
+		if gpu == nil {
+			continue
+		}
+		key := getGpuKey(gpu)
+		if remaining[key] > 0 {
+			remaining[key]--
+			continue
+		}
+		added = append(added, gpu)
+	}
+	for _, gpu := range oldGpuList {
+		if gpu == nil {
+			continue
+		}
+		key := getGpuKey(gpu)
+		if remaining[key] > 0 {
+			remaining[key]--
+			removed = append(removed, gpu)
+		}
+	}
+	return
+}
@@ -0,0 +1,119 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package virtualmachine
+
+import (
+	"context"
+	"testing"
+
+	"github.com/microsoft/moc/pkg/errors"
+	"github.com/microsoft/moc/pkg/errors/codes"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/microsoft/wssd-sdk-for-go/services/compute"
+)
+
+func changedFields(plan *ResizePlan) map[string]bool {
+	fields := map[string]bool{}
+	for _, change := range plan.Changes {
+		fields[change.Field] = change.RequiresRestart
+	}
+	return fields
+}
+
+func Test_getResizePlanStaticMemory(t *testing.T) {
+	current := &compute.HardwareProfile{VMSize: compute.VirtualMachineSizeTypesStandardD2sV3}
+	target := &compute.HardwareProfile{
+		VMSize:     compute.VirtualMachineSizeTypesCustom,
+		CustomSize: &compute.VirtualMachineCustomSize{CpuCount: proto.Int32(2), MemoryMB: proto.Int32(16384)},
+	}
+	plan, err := getResizePlan(current, target)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{"vmSize": false, "memoryMB": false}, changedFields(plan))
+	assert.False(t, plan.RequiresRestart())
+
+	target.CustomSize.CpuCount = proto.Int32(4)
+	plan, _ = getResizePlan(current, target)
+	assert.True(t, changedFields(plan)["cpuCount"])
+	assert.True(t, plan.RequiresRestart())
+
+	plan, _ = getResizePlan(&compute.HardwareProfile{VMSize: compute.VirtualMachineSizeTypesDefault}, &compute.HardwareProfile{})
+	assert.True(t, plan.IsEmpty())
+}
+
+func Test_getResizePlanDynamicMemory(t *testing.T) {
+	current := &compute.HardwareProfile{
+		DynamicMemoryConfig: &compute.DynamicMemoryConfiguration{MaximumMemoryMB: proto.Uint64(8192), MinimumMemoryMB: proto.Uint64(1024)},
+	}
+	plan, err := getResizePlan(current, &compute.HardwareProfile{
+		DynamicMemoryConfig: &compute.DynamicMemoryConfiguration{MaximumMemoryMB: proto.Uint64(16384), MinimumMemoryMB: proto.Uint64(512), TargetMemoryBuffer: proto.Uint32(20)},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{
+		"dynamicMemoryConfig.maximumMemoryMB":    false,
+		"dynamicMemoryConfig.minimumMemoryMB":    false,
+		"dynamicMemoryConfig.targetMemoryBuffer": false,
+	}, changedFields(plan))
+
+	plan, _ = getResizePlan(current, &compute.HardwareProfile{
+		DynamicMemoryConfig: &compute.DynamicMemoryConfiguration{MaximumMemoryMB: proto.Uint64(4096)},
+	})
+	assert.Equal(t, map[string]bool{"dynamicMemoryConfig.maximumMemoryMB": true}, changedFields(plan))
+
+	plan, _ = getResizePlan(&compute.HardwareProfile{}, current)
+	assert.Equal(t, map[string]bool{"dynamicMemoryConfig": true}, changedFields(plan))
+}
+
+func Test_getResizePlanGpuSwap(t *testing.T) {
+	dda, pv := compute.GpuDDA, compute.GpuPV
+	current := &compute.HardwareProfile{VirtualMachineGPUs: []*compute.VirtualMachineGPU{
+		{Assignment: &dda, Name: proto.String("gpu0")},
+		{Assignment: &pv, PartitionSizeMB: proto.Uint64(4096)},
+	}}
+	target := &compute.HardwareProfile{VirtualMachineGPUs: []*compute.VirtualMachineGPU{
+		{Assignment: &dda, Name: proto.String("gpu1")},
+		{Assignment: &pv, PartitionSizeMB: proto.Uint64(4096)},
+	}}
+	plan, err := getResizePlan(current, target)
+	assert.NoError(t, err)
+	assert.Len(t, plan.GpusAdded, 1)
+	assert.Equal(t, "gpu1", *plan.GpusAdded[0].Name)
+	assert.Len(t, plan.GpusRemoved, 1)
+	assert.Equal(t, "gpu0", *plan.GpusRemoved[0].Name)
+	assert.True(t, plan.RequiresRestart())
+	assert.True(t, isDifferentGpuList(current.VirtualMachineGPUs, target.VirtualMachineGPUs))
+	assert.False(t, isDifferentGpuList(current.VirtualMachineGPUs, current.VirtualMachineGPUs))
+}
+
+func Test_ApplyResize(t *testing.T) {
+	running := "Running"
+	service := newFakeService(&compute.VirtualMachine{
+		Name: proto.String("vm1"),
+		VirtualMachineProperties: &compute.VirtualMachineProperties{
+			HardwareProfile: &compute.HardwareProfile{VMSize: compute.VirtualMachineSizeTypesStandardD2sV3},
+			Statuses:        map[string]*string{"PowerState": &running},
+		},
+	})
+	client := &VirtualMachineClient{internal: service}
+	target := &compute.HardwareProfile{VMSize: compute.VirtualMachineSizeTypesStandardD4sV3}
+
+	_, err := client.ApplyResize(context.Background(), "", "vm1", target, ResizeOptions{})
+	assert.True(t, errors.IsMocErrorCode(err, codes.PreCheckFailed))
+	assert.Equal(t, compute.VirtualMachineSizeTypesStandardD2sV3, service.vms["vm1"].HardwareProfile.VMSize)
+
+	service.calls = nil
+	plan, err := client.ApplyResize(context.Background(), "", "vm1", target, ResizeOptions{AllowRestart: true})
+	assert.NoError(t, err)
+	assert.True(t, plan.RequiresRestart())
+	assert.Equal(t, []string{"Get:vm1", "StopGraceful:vm1", "CreateOrUpdate:vm1", "Start:vm1"}, service.calls)
+	assert.Equal(t, compute.VirtualMachineSizeTypesStandardD4sV3, service.vms["vm1"].HardwareProfile.VMSize)
+	assert.Equal(t, "Running", *service.vms["vm1"].Statuses["PowerState"])
+
+	service.calls = nil
+	plan, err = client.ApplyResize(context.Background(), "", "vm1", target, ResizeOptions{})
+	assert.NoError(t, err)
+	assert.True(t, plan.IsEmpty())
+	assert.Equal(t, []string{"Get:vm1"}, service.calls)
+}
@@ -0,0 +1,256 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package virtualmachine
+
+import (
+	"context"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/microsoft/moc/pkg/errors"
+
+	"github.com/microsoft/wssd-sdk-for-go/services/compute"
+)
+
+// runCommandChunkSize is the largest slice of output delivered in a single RunCommandOutputChunk
+const runCommandChunkSize = 32 * 1024
+
+// RunCommandStream identifies the stream a chunk of run command output was read from
+type RunCommandStream string
+
+const (
+	RunCommandStdout RunCommandStream = "Stdout"
+	RunCommandStderr RunCommandStream = "Stderr"
+)
+
+// RunCommandOptions controls the execution of an asynchronous run command
+type RunCommandOptions struct {
+	// Timeout - Cancels the command if the agent has not returned within this duration. Zero means no timeout.
+	Timeout time.Duration
+	// MaxOutputBytes - Truncates the stdout and stderr streams to at most this many bytes each, without splitting a UTF-8
+	// character. Zero means no limit.
+	MaxOutputBytes int
+}
+
+// RunCommandOutputChunk is a piece of output produced by a run command
+type RunCommandOutputChunk struct {
+	Stream RunCommandStream
+	Data   []byte
+}
+
+// RunCommandHandle tracks a run command started by RunCommandAsync.
+// The node agent returns the script output once the script exits, so the chunks on Output()
+// are delivered when the command completes rather than while the script is still running.
+type RunCommandHandle struct {
+	ctx        context.Context
+	cancel     context.CancelFunc
+	stop       chan struct{}
+	stopOnce   sync.Once
+	done       chan struct{}
+	output     chan RunCommandOutputChunk
+	outputOnce sync.Once
+
+	mu        sync.Mutex
+	state     compute.ExecutionState
+	truncated bool
+	response  *compute.VirtualMachineRunCommandResponse
+	err       error
+}
+
+// RunCommandAsync starts the run command in the background and returns a handle to follow it.
+// The output is not streamed: the node agent only returns it once the script exits.
+func (c *VirtualMachineClient) RunCommandAsync(ctx context.Context, group, vmName string, request *compute.VirtualMachineRunCommandRequest, options *RunCommandOptions) (*RunCommandHandle, error) {
+	if request == nil || request.Source == nil {
+		return nil, errors.Wrapf(errors.InvalidInput, "Run command source is missing")
+	}
+	if options == nil {
+		options = &RunCommandOptions{}
+	}
+	if options.Timeout < 0 || options.MaxOutputBytes < 0 {
+		return nil, errors.Wrapf(errors.InvalidInput, "Run command timeout and output limit cannot be negative")
+	}
+	request, err := compute.ResolveRunCommandSecrets(ctx, c.secrets, group, request)
+	if err != nil {
+		return nil, err
+	}
+
+	var runCtx context.Context
+	var cancel context.CancelFunc
+	if options.Timeout > 0 {
+		runCtx, cancel = context.WithTimeout(ctx, options.Timeout)
+	} else {
+		runCtx, cancel = context.WithCancel(ctx)
+	}
+
+	h := &RunCommandHandle{
+		ctx:    ctx,
+		cancel: cancel,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		output: make(chan RunCommandOutputChunk),
+		state:  compute.ExecutionStateRunning,
+	}
+
+	go h.run(runCtx, options.MaxOutputBytes, func(ctx context.Context) (*compute.VirtualMachineRunCommandResponse, error) {
+		return c.internal.RunCommand(ctx, group, vmName, request)
+	})
+
+	return h, nil
+}
+
+func (h *RunCommandHandle) run(ctx context.Context, maxOutputBytes int, runCommand func(context.Context) (*compute.VirtualMachineRunCommandResponse, error)) {
+	defer h.cancel()
+
+	response, err := runCommand(ctx)
+
+	h.mu.Lock()
+	switch {
+	case err != nil && ctx.Err() == context.DeadlineExceeded:
+		h.state = compute.ExecutionStateTimedOut
+		h.err = errors.Wrapf(errors.Timeout, "Run command did not complete in time: %v", err)
+	case err != nil && ctx.Err() == context.Canceled:
+		h.state = compute.ExecutionStateCanceled
+		h.err = errors.Wrapf(errors.NoActionTaken, "Run command was canceled: %v", err)
+	case err != nil:
+		h.state = compute.ExecutionStateFailed
+		h.err = err
+	case response == nil || response.InstanceView == nil:
+		h.state = compute.ExecutionStateUnknown
+		h.response = response
+	default:
+		h.truncated = truncateRunCommandOutput(response.InstanceView, maxOutputBytes)
+		h.state = response.InstanceView.ExecutionState
+		h.response = response
+	}
+	h.mu.Unlock()
+	close(h.done)
+}
+
+// deliver sends the output once the command completes. It is only started by Output, and returns when the handle is
+// canceled or the context passed to RunCommandAsync is done, so consumers that stop reading do not keep it running.
+func (h *RunCommandHandle) deliver() {
+	defer close(h.output)
+	select {
+	case <-h.done:
+	case <-h.stop:
+		return
+	case <-h.ctx.Done():
+		return
+	}
+	if h.response == nil || h.response.InstanceView == nil {
+		return
+	}
+	h.emit(RunCommandStdout, h.response.InstanceView.Output)
+	h.emit(RunCommandStderr, h.response.InstanceView.Error)
+}
+
+// emit splits the stream into chunks
+func (h *RunCommandHandle) emit(stream RunCommandStream, data *string) {
+	if data == nil {
+		return
+	}
+	b := []byte(*data)
+	for len(b) > 0 {
+		n := len(b)
+		if n > runCommandChunkSize {
+			n = runCommandChunkSize
+		}
+		select {
+		case h.output <- RunCommandOutputChunk{Stream: stream, Data: b[:n]}:
+		case <-h.stop:
+			return
+		case <-h.ctx.Done():
+			return
+		}
+		b = b[n:]
+	}
+}
+
+func truncateRunCommandOutput(view *compute.VirtualMachineRunCommandInstanceView, maxOutputBytes int) bool {
+	if maxOutputBytes == 0 {
+		return false
+	}
+	truncated := false
+	for _, stream := range []*string{view.Output, view.Error} {
+		if stream != nil && len(*stream) > maxOutputBytes {
+			*stream = (*stream)[:runeBoundary(*stream, maxOutputBytes)]
+			truncated = true
+		}
+	}
+	return truncated
+}
+
+// runeBoundary returns the largest offset of s no greater than n that does not split a UTF-8 character
+func runeBoundary(s string, n int) int {
+	for n > 0 && n < len(s) && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return n
+}
+
+// Output returns the stdout and stderr chunks of the command. The output is not streamed: the chunks are only sent after
+// the command completes, stdout first. The channel is closed once all output has been delivered, or early when the
+// handle is canceled or the context passed to RunCommandAsync is done. Callers that only need Wait or ExitCode do not
+// have to call Output.
+func (h *RunCommandHandle) Output() <-chan RunCommandOutputChunk {
+	h.outputOnce.Do(func() { go h.deliver() })
+	return h.output
+}
+
+// Done is closed once the agent has returned or the command was canceled or timed out
+func (h *RunCommandHandle) Done() <-chan struct{} {
+	return h.done
+}
+
+// Status returns the current execution state of the command
+func (h *RunCommandHandle) Status() compute.ExecutionState {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.state
+}
+
+// Truncated reports whether the output was cut to RunCommandOptions.MaxOutputBytes
+func (h *RunCommandHandle) Truncated() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.truncated
+}
+
+// ExitCode returns the exit code of the script. It fails with PendingState while the command is still running.
+func (h *RunCommandHandle) ExitCode() (int32, error) {
+	select {
+	case <-h.done:
+	default:
+		return 0, errors.Wrapf(errors.PendingState, "Run command is still running")
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.err != nil {
+		return 0, h.err
+	}
+	if h.response == nil || h.response.InstanceView == nil || h.response.InstanceView.ExitCode == nil {
+		return 0, errors.Wrapf(errors.NotSet, "Run command did not report an exit code")
+	}
+	return *h.response.InstanceView.ExitCode, nil
+}
+
+// Wait blocks until the command completes or ctx is done, and returns the final response
+func (h *RunCommandHandle) Wait(ctx context.Context) (*compute.VirtualMachineRunCommandResponse, error) {
+	select {
+	case <-h.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.response, h.err
+}
+
+// Cancel stops waiting for the command and releases the output channel.
+// The agent call is canceled, but a script that already started in the guest may keep running.
+func (h *RunCommandHandle) Cancel() {
+	h.stopOnce.Do(func() { close(h.stop) })
+	h.cancel()
+}
@@ -0,0 +1,154 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package virtualmachine
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/microsoft/wssd-sdk-for-go/services/compute"
+)
+
+func newTestRunCommandHandle(ctx context.Context) (*RunCommandHandle, context.Context) {
+	runCtx, cancel := context.WithCancel(ctx)
+	return &RunCommandHandle{
+		ctx:    ctx,
+		cancel: cancel,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		output: make(chan RunCommandOutputChunk),
+		state:  compute.ExecutionStateRunning,
+	}, runCtx
+}
+
+func Test_RunCommandHandle_Output(t *testing.T) {
+	h, ctx := newTestRunCommandHandle(context.Background())
+	stdout := strings.Repeat("o", runCommandChunkSize+10)
+	go h.run(ctx, 0, func(context.Context) (*compute.VirtualMachineRunCommandResponse, error) {
+		return &compute.VirtualMachineRunCommandResponse{
+			InstanceView: &compute.VirtualMachineRunCommandInstanceView{
+				ExecutionState: compute.ExecutionStateSucceeded,
+				ExitCode:       proto.Int32(3),
+				Output:         proto.String(stdout),
+				Error:          proto.String("e"),
+			},
+		}, nil
+	})
+
+	var out, errOut []byte
+	chunks := 0
+	for chunk := range h.Output() {
+		chunks++
+		if chunk.Stream == RunCommandStdout {
+			out = append(out, chunk.Data...)
+		} else {
+			errOut = append(errOut, chunk.Data...)
+		}
+	}
+	assert.Equal(t, 3, chunks)
+	assert.Equal(t, stdout, string(out))
+	assert.Equal(t, "e", string(errOut))
+	assert.Equal(t, compute.ExecutionStateSucceeded, h.Status())
+	code, err := h.ExitCode()
+	assert.NoError(t, err)
+	assert.Equal(t, int32(3), code)
+}
+
+func Test_RunCommandHandle_Truncate(t *testing.T) {
+	h, ctx := newTestRunCommandHandle(context.Background())
+	go h.run(ctx, 4, func(context.Context) (*compute.VirtualMachineRunCommandResponse, error) {
+		return &compute.VirtualMachineRunCommandResponse{
+			InstanceView: &compute.VirtualMachineRunCommandInstanceView{
+				ExecutionState: compute.ExecutionStateSucceeded,
+				Output:         proto.String("0123456789"),
+				Error:          proto.String("aé€"),
+			},
+		}, nil
+	})
+	response, err := h.Wait(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "0123", *response.InstanceView.Output)
+	// "aé" is 3 bytes, the euro sign another 3
+	assert.Equal(t, "aé", *response.InstanceView.Error)
+	assert.True(t, h.Truncated())
+	h.Cancel()
+}
+
+func Test_RunCommandHandle_Cancel(t *testing.T) {
+	h, ctx := newTestRunCommandHandle(context.Background())
+	go h.run(ctx, 0, func(ctx context.Context) (*compute.VirtualMachineRunCommandResponse, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+
+	_, err := h.ExitCode()
+	assert.Error(t, err)
+
+	h.Cancel()
+	select {
+	case <-h.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("run command was not canceled")
+	}
+	assert.Equal(t, compute.ExecutionStateCanceled, h.Status())
+	_, err = h.Wait(context.Background())
+	assert.Error(t, err)
+}
+
+func Test_RunCommandHandle_WaitOnly(t *testing.T) {
+	h, ctx := newTestRunCommandHandle(context.Background())
+	finished := make(chan struct{})
+	go func() {
+		h.run(ctx, 0, func(context.Context) (*compute.VirtualMachineRunCommandResponse, error) {
+			return &compute.VirtualMachineRunCommandResponse{
+				InstanceView: &compute.VirtualMachineRunCommandInstanceView{
+					ExecutionState: compute.ExecutionStateSucceeded,
+					Output:         proto.String("output nobody reads"),
+				},
+			}, nil
+		})
+		close(finished)
+	}()
+
+	_, err := h.Wait(context.Background())
+	assert.NoError(t, err)
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("run command goroutine did not exit")
+	}
+}
+
+func Test_RunCommandHandle_OutputParentCanceled(t *testing.T) {
+	parent, cancel := context.WithCancel(context.Background())
+	h, ctx := newTestRunCommandHandle(parent)
+	go h.run(ctx, 0, func(context.Context) (*compute.VirtualMachineRunCommandResponse, error) {
+		return &compute.VirtualMachineRunCommandResponse{
+			InstanceView: &compute.VirtualMachineRunCommandInstanceView{
+				ExecutionState: compute.ExecutionStateSucceeded,
+				Output:         proto.String("o"),
+				Error:          proto.String("e"),
+			},
+		}, nil
+	})
+	_, err := h.Wait(context.Background())
+	assert.NoError(t, err)
+
+	output := h.Output()
+	<-output
+	cancel()
+	select {
+	case _, ok := <-output:
+		for ok {
+			_, ok = <-output
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("output channel was not closed")
+	}
+}
@@ -0,0 +1,330 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+// Package autoscale changes the capacity of a virtual machine scale set from rules evaluated against metrics.
+package autoscale
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/microsoft/moc/pkg/errors"
+
+	"github.com/microsoft/wssd-sdk-for-go/services/compute"
+	"github.com/microsoft/wssd-sdk-for-go/services/compute/virtualmachinescaleset"
+)
+
+const (
+	// DefaultInterval is how often Run evaluates the rules when no interval is given
+	DefaultInterval = time.Minute
+)
+
+// Operator compares a metric with the threshold of a rule
+type Operator string
+
+const (
+	GreaterThan        Operator = "GreaterThan"
+	GreaterThanOrEqual Operator = "GreaterThanOrEqual"
+	LessThan           Operator = "LessThan"
+	LessThanOrEqual    Operator = "LessThanOrEqual"
+)
+
+// Direction is how a rule changes the capacity
+type Direction string
+
+const (
+	// ScaleOut - Add instances when the rule is met. The scale set scales out when any scale out rule is met.
+	ScaleOut Direction = "ScaleOut"
+	// ScaleIn - Remove instances when the rule is met. The scale set scales in only when every scale in rule is met
+	// and no scale out rule is.
+	ScaleIn Direction = "ScaleIn"
+)
+
+// Rule scales the scale set when a metric crosses a threshold
+type Rule struct {
+	// Metric - The metric to compare
+	Metric MetricName
+	// Source - Where to read the metric. Nil uses the source of the autoscaler.
+	Source MetricSource
+	// Operator - How to compare the metric with Threshold
+	Operator Operator
+	// Threshold - The value the metric is compared with
+	Threshold float64
+	// Direction - Whether to add or remove instances
+	Direction Direction
+	// Change - The number of instances to add or remove
+	Change int64
+	// Cooldown - How long after the last scale action the rule is ignored
+	Cooldown time.Duration
+}
+
+// ScaleSet is the part of the scale set client used by the autoscaler
+type ScaleSet interface {
+	Get(context.Context, string, string) (*[]compute.VirtualMachineScaleSet, error)
+	SetCapacity(context.Context, string, string, int64, virtualmachinescaleset.ScaleOptions) (*virtualmachinescaleset.ScaleResult, error)
+}
+
+// Settings configures an autoscaler
+type Settings struct {
+	// Group - The group of the scale set
+	Group string
+	// Name - The name of the scale set
+	Name string
+	// Minimum - The lowest capacity the autoscaler sets
+	Minimum int64
+	// Maximum - The highest capacity the autoscaler sets
+	Maximum int64
+	// Default - The capacity to set when no metric can be read. Nil leaves the capacity as it is.
+	Default *int64
+	// Rules - The rules to evaluate
+	Rules []Rule
+	// Source - Where to read the metrics of rules without a source
+	Source MetricSource
+	// Interval - How often Run evaluates the rules. Zero uses DefaultInterval.
+	Interval time.Duration
+	// DryRun - Log the decisions without changing the capacity
+	DryRun bool
+	// ScaleOptions - How to scale the scale set
+	ScaleOptions virtualmachinescaleset.ScaleOptions
+	// Logf - Where to log the decisions. Nil uses log.Printf.
+	Logf func(format string, v ...interface{})
+}
+
+// Decision is the outcome of one evaluation of the rules
+type Decision struct {
+	// Time - When the rules were evaluated
+	Time time.Time
+	// PreviousCapacity - The capacity of the scale set before the decision
+	PreviousCapacity int64
+	// Capacity - The capacity decided
+	Capacity int64
+	// Reason - Why the capacity was decided
+	Reason string
+	// Metrics - The metric values read, by metric name
+	Metrics map[MetricName]float64
+	// Applied - Whether the capacity of the scale set was changed
+	Applied bool
+	// Result - The scale operation, if the capacity was changed
+	Result *virtualmachinescaleset.ScaleResult
+}
+
+// Autoscaler evaluates rules and changes the capacity of a scale set accordingly
+type Autoscaler struct {
+	scaleSet ScaleSet
+	settings Settings
+	now      func() time.Time
+
+	mu        sync.Mutex
+	lastScale time.Time
+}
+
+// NewAutoscaler returns an autoscaler for the scale set settings.Name
+func NewAutoscaler(scaleSet ScaleSet, settings Settings) (*Autoscaler, error) {
+	if scaleSet == nil {
+		return nil, errors.Wrapf(errors.InvalidInput, "Missing scale set client")
+	}
+	if len(settings.Name) == 0 {
+		return nil, errors.Wrapf(errors.InvalidInput, "Missing scale set name")
+	}
+	if settings.Minimum < 0 || settings.Maximum < settings.Minimum {
+		return nil, errors.Wrapf(errors.InvalidInput, "Invalid capacity limits [%d, %d]", settings.Minimum, settings.Maximum)
+	}
+	if settings.Default != nil && (*settings.Default < settings.Minimum || *settings.Default > settings.Maximum) {
+		return nil, errors.Wrapf(errors.InvalidInput, "Default capacity %d is outside [%d, %d]", *settings.Default, settings.Minimum, settings.Maximum)
+	}
+	if settings.Interval < 0 {
+		return nil, errors.Wrapf(errors.InvalidInput, "Interval cannot be negative")
+	}
+	for i, rule := range settings.Rules {
+		if err := validateRule(rule, settings.Source); err != nil {
+			return nil, errors.Wrapf(err, "Invalid rule %d", i)
+		}
+	}
+	if settings.Interval == 0 {
+		settings.Interval = DefaultInterval
+	}
+	if settings.Logf == nil {
+		settings.Logf = log.Printf
+	}
+	return &Autoscaler{scaleSet: scaleSet, settings: settings, now: time.Now}, nil
+}
+
+// Run evaluates the rules every settings.Interval until ctx is done. Evaluation errors are logged.
+func (a *Autoscaler) Run(ctx context.Context) {
+	ticker := time.NewTicker(a.settings.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := a.Evaluate(ctx); err != nil && ctx.Err() == nil {
+			a.settings.Logf("autoscale [%s]: %v", a.settings.Name, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Evaluate reads the metrics, decides the capacity of the scale set and, unless in dry run, applies it
+func (a *Autoscaler) Evaluate(ctx context.Context) (*Decision, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	vmsss, err := a.scaleSet.Get(ctx, a.settings.Group, a.settings.Name)
+	if err != nil {
+		return nil, err
+	}
+	if vmsss == nil || len(*vmsss) == 0 {
+		return nil, errors.Wrapf(errors.NotFound, "Unable to find Virtual Machine Scale Set [%s]", a.settings.Name)
+	}
+	vmss := (*vmsss)[0]
+	capacity := int64(0)
+	if vmss.Sku != nil && vmss.Sku.Capacity != nil {
+		capacity = *vmss.Sku.Capacity
+	}
+
+	decision := &Decision{Time: a.now(), PreviousCapacity: capacity, Metrics: map[MetricName]float64{}}
+	decision.Capacity, decision.Reason = a.decide(ctx, capacity, decision.Time, decision.Metrics)
+	if decision.Capacity == capacity {
+		return decision, nil
+	}
+
+	if a.settings.DryRun {
+		a.settings.Logf("autoscale [%s]: dry run, would scale from %d to %d: %s", a.settings.Name, capacity, decision.Capacity, decision.Reason)
+		return decision, nil
+	}
+	a.settings.Logf("autoscale [%s]: scaling from %d to %d: %s", a.settings.Name, capacity, decision.Capacity, decision.Reason)
+	a.lastScale = decision.Time
+	decision.Result, err = a.scaleSet.SetCapacity(ctx, a.settings.Group, a.settings.Name, decision.Capacity, a.settings.ScaleOptions)
+	decision.Applied = err == nil
+	return decision, err
+}
+
+// decide returns the capacity the rules ask for and why
+func (a *Autoscaler) decide(ctx context.Context, capacity int64, now time.Time, metrics map[MetricName]float64) (int64, string) {
+	if capacity < a.settings.Minimum {
+		return a.settings.Minimum, fmt.Sprintf("capacity is below the minimum of %d", a.settings.Minimum)
+	}
+	if capacity > a.settings.Maximum {
+		return a.settings.Maximum, fmt.Sprintf("capacity is above the maximum of %d", a.settings.Maximum)
+	}
+
+	scaleOut, scaleIn := int64(0), int64(0)
+	outReason, inReason := "", ""
+	scaleInRules, metScaleInRules := 0, 0
+	read := 0
+	for _, rule := range a.settings.Rules {
+		if rule.Direction == ScaleIn {
+			scaleInRules++
+		}
+		value, err := a.readMetric(ctx, rule, metrics)
+		if err != nil {
+			a.settings.Logf("autoscale [%s]: unable to read metric [%s]: %v", a.settings.Name, rule.Metric, err)
+			continue
+		}
+		read++
+		if !compare(value, rule.Operator, rule.Threshold) || a.inCooldown(rule, now) {
+			continue
+		}
+		reason := fmt.Sprintf("%s %g is %s %g", rule.Metric, value, rule.Operator, rule.Threshold)
+		switch rule.Direction {
+		case ScaleOut:
+			if rule.Change > scaleOut {
+				scaleOut, outReason = rule.Change, reason
+			}
+		case ScaleIn:
+			metScaleInRules++
+			if rule.Change > scaleIn {
+				scaleIn, inReason = rule.Change, reason
+			}
+		}
+	}
+
+	switch {
+	case read == 0 && len(a.settings.Rules) > 0 && a.settings.Default != nil:
+		return *a.settings.Default, "no metric could be read, using the default capacity"
+	case scaleOut > 0 && capacity < a.settings.Maximum:
+		return minInt64(capacity+scaleOut, a.settings.Maximum), outReason
+	case scaleOut == 0 && scaleInRules > 0 && metScaleInRules == scaleInRules && capacity > a.settings.Minimum:
+		return maxInt64(capacity-scaleIn, a.settings.Minimum), inReason
+	}
+	return capacity, "no rule is met"
+}
+
+// readMetric reads the metric of rule once per evaluation
+func (a *Autoscaler) readMetric(ctx context.Context, rule Rule, metrics map[MetricName]float64) (float64, error) {
+	if rule.Source == nil {
+		if value, found := metrics[rule.Metric]; found {
+			return value, nil
+		}
+	}
+	source := rule.Source
+	if source == nil {
+		source = a.settings.Source
+	}
+	value, err := source.GetMetric(ctx, a.settings.Group, a.settings.Name, rule.Metric)
+	if err != nil {
+		return 0, err
+	}
+	metrics[rule.Metric] = value
+	return value, nil
+}
+
+func (a *Autoscaler) inCooldown(rule Rule, now time.Time) bool {
+	return !a.lastScale.IsZero() && now.Sub(a.lastScale) < rule.Cooldown
+}
+
+func validateRule(rule Rule, source MetricSource) error {
+	if len(rule.Metric) == 0 {
+		return errors.Wrapf(errors.InvalidInput, "Missing metric")
+	}
+	if rule.Source == nil && source == nil {
+		return errors.Wrapf(errors.InvalidInput, "Missing source for metric [%s]", rule.Metric)
+	}
+	switch rule.Operator {
+	case GreaterThan, GreaterThanOrEqual, LessThan, LessThanOrEqual:
+	default:
+		return errors.Wrapf(errors.InvalidInput, "Unknown operator [%s]", rule.Operator)
+	}
+	if rule.Direction != ScaleOut && rule.Direction != ScaleIn {
+		return errors.Wrapf(errors.InvalidInput, "Unknown direction [%s]", rule.Direction)
+	}
+	if rule.Change <= 0 {
+		return errors.Wrapf(errors.InvalidInput, "Change must be positive, got %d", rule.Change)
+	}
+	if rule.Cooldown < 0 {
+		return errors.Wrapf(errors.InvalidInput, "Cooldown cannot be negative")
+	}
+	return nil
+}
+
+func compare(value float64, operator Operator, threshold float64) bool {
+	switch operator {
+	case GreaterThan:
+		return value > threshold
+	case GreaterThanOrEqual:
+		return value >= threshold
+	case LessThan:
+		return value < threshold
+	case LessThanOrEqual:
+		return value <= threshold
+	}
+	return false
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
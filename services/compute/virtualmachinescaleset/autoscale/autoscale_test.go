@@ -0,0 +1,103 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package autoscale
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/microsoft/moc/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/microsoft/wssd-sdk-for-go/services/compute"
+	"github.com/microsoft/wssd-sdk-for-go/services/compute/virtualmachinescaleset"
+)
+
+type fakeScaleSet struct {
+	capacity int64
+	sets     []int64
+}
+
+func (s *fakeScaleSet) Get(ctx context.Context, group, name string) (*[]compute.VirtualMachineScaleSet, error) {
+	capacity := s.capacity
+	return &[]compute.VirtualMachineScaleSet{{Name: &name, Sku: &compute.Sku{Capacity: &capacity}}}, nil
+}
+
+func (s *fakeScaleSet) SetCapacity(ctx context.Context, group, name string, capacity int64, options virtualmachinescaleset.ScaleOptions) (*virtualmachinescaleset.ScaleResult, error) {
+	s.sets = append(s.sets, capacity)
+	result := &virtualmachinescaleset.ScaleResult{PreviousCapacity: s.capacity, Capacity: capacity}
+	s.capacity = capacity
+	return result, nil
+}
+
+func newTestAutoscaler(t *testing.T, capacity int64, metrics map[MetricName]float64, settings Settings) (*Autoscaler, *fakeScaleSet, *time.Time) {
+	scaleSet := &fakeScaleSet{capacity: capacity}
+	settings.Name = "vmss"
+	settings.Source = MetricSourceFunc(func(ctx context.Context, group, name string, metric MetricName) (float64, error) {
+		if value, found := metrics[metric]; found {
+			return value, nil
+		}
+		return 0, errors.NotFound
+	})
+	settings.Logf = func(format string, v ...interface{}) { t.Log(fmt.Sprintf(format, v...)) }
+	a, err := NewAutoscaler(scaleSet, settings)
+	assert.Nil(t, err)
+	now := time.Unix(0, 0)
+	a.now = func() time.Time { return now }
+	return a, scaleSet, &now
+}
+
+var cpuRules = []Rule{
+	{Metric: MetricCpuPercent, Operator: GreaterThan, Threshold: 70, Direction: ScaleOut, Change: 2, Cooldown: 5 * time.Minute},
+	{Metric: MetricCpuPercent, Operator: LessThan, Threshold: 20, Direction: ScaleIn, Change: 1, Cooldown: 5 * time.Minute},
+	{Metric: "QueueLength", Operator: LessThan, Threshold: 10, Direction: ScaleIn, Change: 1},
+}
+
+func Test_Evaluate(t *testing.T) {
+	metrics := map[MetricName]float64{MetricCpuPercent: 90, "QueueLength": 0}
+	a, scaleSet, now := newTestAutoscaler(t, 2, metrics, Settings{Minimum: 1, Maximum: 5, Rules: cpuRules})
+
+	decision, err := a.Evaluate(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, decision.Applied)
+	assert.Equal(t, int64(4), decision.Capacity)
+
+	// Cooldown
+	*now = now.Add(time.Minute)
+	decision, _ = a.Evaluate(context.Background())
+	assert.Equal(t, int64(4), decision.Capacity)
+	assert.False(t, decision.Applied)
+
+	// Capped at the maximum
+	*now = now.Add(5 * time.Minute)
+	decision, _ = a.Evaluate(context.Background())
+	assert.Equal(t, int64(5), decision.Capacity)
+
+	// Scale in only when every scale in rule is met
+	*now = now.Add(10 * time.Minute)
+	metrics[MetricCpuPercent] = 10
+	metrics["QueueLength"] = 50
+	decision, _ = a.Evaluate(context.Background())
+	assert.Equal(t, int64(5), decision.Capacity)
+	metrics["QueueLength"] = 1
+	decision, _ = a.Evaluate(context.Background())
+	assert.Equal(t, int64(4), decision.Capacity)
+	assert.Equal(t, []int64{4, 5, 4}, scaleSet.sets)
+}
+
+func Test_EvaluateDefaultAndDryRun(t *testing.T) {
+	capacity := int64(3)
+	a, scaleSet, _ := newTestAutoscaler(t, 1, map[MetricName]float64{}, Settings{Minimum: 1, Maximum: 5, Default: &capacity, Rules: cpuRules, DryRun: true})
+
+	decision, err := a.Evaluate(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), decision.Capacity)
+	assert.False(t, decision.Applied)
+	assert.Empty(t, scaleSet.sets)
+
+	_, err = NewAutoscaler(scaleSet, Settings{Name: "vmss", Maximum: 1, Rules: []Rule{{Metric: MetricCpuPercent, Operator: GreaterThan, Direction: ScaleOut, Change: 1}}})
+	assert.True(t, errors.IsInvalidInput(err))
+}
@@ -0,0 +1,107 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package autoscale
+
+import (
+	"context"
+
+	"github.com/microsoft/moc/pkg/errors"
+	wssdcommonproto "github.com/microsoft/moc/rpc/common"
+
+	"github.com/microsoft/wssd-sdk-for-go/services/compute"
+	"github.com/microsoft/wssd-sdk-for-go/services/compute/virtualmachine"
+	"github.com/microsoft/wssd-sdk-for-go/services/compute/virtualmachinescaleset"
+)
+
+// MetricName names a metric of a scale set
+type MetricName string
+
+const (
+	// MetricCpuPercent - The average processor utilization of the running instances, 0 to 100
+	MetricCpuPercent MetricName = "CpuPercent"
+	// MetricMemoryPercent - The average share of the memory of the guest operating system it reports in use, over the
+	// running instances, 0 to 100. This is not the Hyper-V memory demand.
+	MetricMemoryPercent MetricName = "MemoryPercent"
+)
+
+// MetricSource reads a metric of the scale set name
+type MetricSource interface {
+	GetMetric(ctx context.Context, group, name string, metric MetricName) (float64, error)
+}
+
+// MetricSourceFunc adapts a function, such as a custom metric callback, to a MetricSource
+type MetricSourceFunc func(ctx context.Context, group, name string, metric MetricName) (float64, error)
+
+// GetMetric calls f
+func (f MetricSourceFunc) GetMetric(ctx context.Context, group, name string, metric MetricName) (float64, error) {
+	return f(ctx, group, name, metric)
+}
+
+// instanceLister is the part of the scale set client used to read instance metrics
+type instanceLister interface {
+	List(context.Context, string, string) (*[]compute.VirtualMachine, error)
+}
+
+// metricsGetter is the part of the virtual machine client used to read instance metrics
+type metricsGetter interface {
+	GetMetrics(context.Context, string, string, virtualmachine.MetricsOptions) (*[]compute.VirtualMachineMetricsSample, error)
+}
+
+// InstanceMetricSource reads MetricCpuPercent and MetricMemoryPercent from the guest of each running instance
+type InstanceMetricSource struct {
+	scaleSet instanceLister
+	vms      metricsGetter
+	options  virtualmachine.MetricsOptions
+}
+
+// NewInstanceMetricSource returns a source that samples the instances of the scale set with options
+func NewInstanceMetricSource(scaleSet *virtualmachinescaleset.VirtualMachineScaleSetClient, vms *virtualmachine.VirtualMachineClient, options virtualmachine.MetricsOptions) *InstanceMetricSource {
+	return &InstanceMetricSource{scaleSet: scaleSet, vms: vms, options: options}
+}
+
+// GetMetric returns the average of metric over the running instances that could be sampled
+func (s *InstanceMetricSource) GetMetric(ctx context.Context, group, name string, metric MetricName) (float64, error) {
+	if metric != MetricCpuPercent && metric != MetricMemoryPercent {
+		return 0, errors.Wrapf(errors.NotSupported, "Metric [%s] is not reported by the instances", metric)
+	}
+	instances, err := s.scaleSet.List(ctx, group, name)
+	if err != nil {
+		return 0, err
+	}
+	total, count := 0.0, 0
+	for _, instance := range *instances {
+		if instance.Name == nil || instance.VirtualMachineProperties == nil {
+			continue
+		}
+		if state := instance.Statuses["PowerState"]; state == nil || *state != wssdcommonproto.PowerState_Running.String() {
+			continue
+		}
+		samples, err := s.vms.GetMetrics(ctx, group, *instance.Name, s.options)
+		if err != nil || samples == nil || len(*samples) == 0 {
+			continue
+		}
+		if value, ok := getSampleMetric((*samples)[len(*samples)-1], metric); ok {
+			total += value
+			count++
+		}
+	}
+	if count == 0 {
+		return 0, errors.Wrapf(errors.NotFound, "No running instance of Virtual Machine Scale Set [%s] reported [%s]", name, metric)
+	}
+	return total / float64(count), nil
+}
+
+func getSampleMetric(sample compute.VirtualMachineMetricsSample, metric MetricName) (float64, bool) {
+	switch metric {
+	case MetricCpuPercent:
+		if sample.CpuPercent != nil {
+			return *sample.CpuPercent, true
+		}
+	case MetricMemoryPercent:
+		if sample.GuestUsedMemoryMB != nil && sample.AssignedMemoryMB != nil && *sample.AssignedMemoryMB > 0 {
+			return float64(*sample.GuestUsedMemoryMB) * 100 / float64(*sample.AssignedMemoryMB), true
+		}
+	}
+	return 0, false
+}
@@ -5,9 +5,15 @@ package virtualmachinescaleset
 
 import (
 	"context"
+	"log"
+	"sync"
+
 	"github.com/microsoft/moc/pkg/auth"
 	"github.com/microsoft/wssd-sdk-for-go/services/compute"
+	"github.com/microsoft/wssd-sdk-for-go/services/compute/virtualmachine"
 	"github.com/microsoft/wssd-sdk-for-go/services/compute/virtualmachinescaleset/internal"
+	"github.com/microsoft/wssd-sdk-for-go/services/security/identity"
+	"github.com/microsoft/wssd-sdk-for-go/services/security/keyvault/secret"
 )
 
 type Service interface {
@@ -20,6 +26,24 @@ type Service interface {
 type VirtualMachineScaleSetClient struct {
 	compute.BaseClient
 	internal Service
+	// secrets resolves the secret references of CreateOrUpdate
+	secrets compute.SecretGetter
+	// vms operates on the instances of the scale set
+	vms virtualMachineService
+	// identities and identitySecrets bind and project the identities of CreateOrUpdate
+	identities      compute.IdentityService
+	identitySecrets compute.SecretSetter
+	// ownOperations holds the ownOperation of each instance this client deleted or stopped, by instanceKey, so that
+	// WatchEvictions does not report it as an eviction
+	ownOperations sync.Map
+}
+
+// virtualMachineService is the part of the virtual machine client used to operate on instances
+type virtualMachineService interface {
+	Delete(context.Context, string, string) error
+	Start(context.Context, string, string) error
+	Stop(context.Context, string, string) error
+	Restart(context.Context, string, string) error
 }
 
 func NewVirtualMachineScaleSetClient(cloudFQDN string, authorizer auth.Authorizer) (*VirtualMachineScaleSetClient, error) {
@@ -27,13 +51,40 @@ func NewVirtualMachineScaleSetClient(cloudFQDN string, authorizer auth.Authorize
 	if err != nil {
 		return nil, err
 	}
+	secrets, err := secret.NewSecretClient(cloudFQDN, authorizer)
+	if err != nil {
+		return nil, err
+	}
+	vms, err := virtualmachine.NewVirtualMachineClient(cloudFQDN, authorizer)
+	if err != nil {
+		return nil, err
+	}
+	identities, err := identity.NewIdentityClient(cloudFQDN, authorizer)
+	if err != nil {
+		return nil, err
+	}
 
-	return &VirtualMachineScaleSetClient{internal: c}, nil
+	return &VirtualMachineScaleSetClient{internal: c, secrets: secrets, vms: vms, identities: identities, identitySecrets: secrets}, nil
 }
 
-// Get methods invokes the client Get method
+// Get methods invokes the client Get method.
+// The principal IDs of the identities are read through the identity client, on a best effort basis: the Get does not
+// fail when they cannot be read.
 func (c *VirtualMachineScaleSetClient) Get(ctx context.Context, group, name string) (*[]compute.VirtualMachineScaleSet, error) {
-	return c.internal.Get(ctx, group, name)
+	vmsss, err := c.internal.Get(ctx, group, name)
+	if err != nil || vmsss == nil {
+		return vmsss, err
+	}
+	for i := range *vmsss {
+		vmss := &(*vmsss)[i]
+		if vmss.Identity == nil || vmss.Name == nil {
+			continue
+		}
+		if err := compute.FillIdentityIDs(ctx, c.identities, group, *vmss.Name, vmss.Identity); err != nil {
+			log.Printf("Unable to read the identities of Virtual Machine Scale Set [%s]: %v\n", *vmss.Name, err)
+		}
+	}
+	return vmsss, nil
 }
 
 // Get methods invokes the client Get method
@@ -41,12 +92,56 @@ func (c *VirtualMachineScaleSetClient) List(ctx context.Context, group, name str
 	return c.internal.GetVirtualMachines(ctx, group, name)
 }
 
-// CreateOrUpdate methods invokes create or update on the client
-func (c *VirtualMachineScaleSetClient) CreateOrUpdate(ctx context.Context, group, name string, compute *compute.VirtualMachineScaleSet) (*compute.VirtualMachineScaleSet, error) {
-	return c.internal.CreateOrUpdate(ctx, group, name, compute)
+// CreateOrUpdate methods invokes create or update on the client.
+// An AdminPasswordReference in the virtual machine profile is resolved through the keyvault secret client first, and
+// the identities are created or bound through the identity client.
+func (c *VirtualMachineScaleSetClient) CreateOrUpdate(ctx context.Context, group, name string, vmss *compute.VirtualMachineScaleSet) (*compute.VirtualMachineScaleSet, error) {
+	if vmss != nil && vmss.Identity != nil {
+		if err := compute.EnsureIdentities(ctx, c.identities, c.identitySecrets, group, name, vmss.Identity); err != nil {
+			return nil, err
+		}
+	}
+	if vmss != nil && vmss.VirtualMachineScaleSetProperties != nil && vmss.VirtualMachineProfile != nil &&
+		vmss.VirtualMachineProfile.VirtualMachineScaleSetVMProfileProperties != nil && vmss.VirtualMachineProfile.OsProfile != nil &&
+		vmss.VirtualMachineProfile.OsProfile.AdminPasswordReference != nil {
+		osProfile, err := compute.ResolveOSProfileSecrets(ctx, c.secrets, group, vmss.VirtualMachineProfile.OsProfile)
+		if err != nil {
+			return nil, err
+		}
+		vmProfileProperties := *vmss.VirtualMachineProfile.VirtualMachineScaleSetVMProfileProperties
+		vmProfileProperties.OsProfile = osProfile
+		vmProfile := *vmss.VirtualMachineProfile
+		vmProfile.VirtualMachineScaleSetVMProfileProperties = &vmProfileProperties
+		properties := *vmss.VirtualMachineScaleSetProperties
+		properties.VirtualMachineProfile = &vmProfile
+		resolved := *vmss
+		resolved.VirtualMachineScaleSetProperties = &properties
+		vmss = &resolved
+	}
+	result, err := c.internal.CreateOrUpdate(ctx, group, name, vmss)
+	if err != nil || result == nil || result.Identity == nil {
+		return result, err
+	}
+	if err := compute.FillIdentityIDs(ctx, c.identities, group, name, result.Identity); err != nil {
+		log.Printf("Unable to read the identities of Virtual Machine Scale Set [%s]: %v\n", name, err)
+	}
+	return result, nil
 }
 
-// Delete methods invokes delete of the compute resource
+// Delete methods invokes delete of the compute resource, and of its system assigned identity when there is an identity
+// client. Failing to delete the identity does not fail the Delete.
 func (c *VirtualMachineScaleSetClient) Delete(ctx context.Context, group, name string) error {
-	return c.internal.Delete(ctx, group, name)
+	var vmssIdentity *compute.VirtualMachineScaleSetIdentity
+	if c.identities != nil {
+		if vmsss, err := c.internal.Get(ctx, group, name); err == nil && vmsss != nil && len(*vmsss) > 0 {
+			vmssIdentity = (*vmsss)[0].Identity
+		}
+	}
+	if err := c.internal.Delete(ctx, group, name); err != nil {
+		return err
+	}
+	if err := compute.DeleteSystemAssignedIdentity(ctx, c.identities, group, name, vmssIdentity); err != nil {
+		log.Printf("Unable to delete the identity of Virtual Machine Scale Set [%s]: %v\n", name, err)
+	}
+	return nil
 }
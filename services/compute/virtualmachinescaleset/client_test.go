@@ -0,0 +1,125 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package virtualmachinescaleset
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/microsoft/moc/pkg/errors"
+	wssdcommonproto "github.com/microsoft/moc/rpc/common"
+
+	"github.com/microsoft/wssd-sdk-for-go/services/compute"
+)
+
+// fakeService is an in-memory scale set that creates and removes instances the way the node agent does:
+// new instances are appended and, if the capacity is lowered, the newest ones are removed
+type fakeService struct {
+	vmss      *compute.VirtualMachineScaleSet
+	instances []*compute.VirtualMachine
+	created   int
+	calls     []string
+	// onList, if set, is called before the instances are listed
+	onList func()
+}
+
+func newFakeService(name string, capacity int64) *fakeService {
+	s := &fakeService{vmss: &compute.VirtualMachineScaleSet{
+		Name:                             &name,
+		Sku:                              &compute.Sku{Capacity: &capacity},
+		VirtualMachineScaleSetProperties: &compute.VirtualMachineScaleSetProperties{},
+	}}
+	s.reconcile()
+	return s
+}
+
+func (s *fakeService) reconcile() {
+	capacity := int(*s.vmss.Sku.Capacity)
+	for len(s.instances) < capacity {
+		name := fmt.Sprintf("%s-%d", *s.vmss.Name, s.created)
+		running := wssdcommonproto.PowerState_Running.String()
+		s.instances = append(s.instances, &compute.VirtualMachine{
+			Name:                     &name,
+			VirtualMachineProperties: &compute.VirtualMachineProperties{Statuses: map[string]*string{"PowerState": &running}},
+		})
+		s.created++
+	}
+	if len(s.instances) > capacity {
+		s.instances = s.instances[:capacity]
+	}
+}
+
+func (s *fakeService) Get(ctx context.Context, group, name string) (*[]compute.VirtualMachineScaleSet, error) {
+	s.calls = append(s.calls, "Get:"+name)
+	vmss := *s.vmss
+	return &[]compute.VirtualMachineScaleSet{vmss}, nil
+}
+
+func (s *fakeService) GetVirtualMachines(ctx context.Context, group, name string) (*[]compute.VirtualMachine, error) {
+	if s.onList != nil {
+		s.onList()
+	}
+	vms := []compute.VirtualMachine{}
+	for _, vm := range s.instances {
+		vms = append(vms, *vm)
+	}
+	return &vms, nil
+}
+
+func (s *fakeService) CreateOrUpdate(ctx context.Context, group, name string, vmss *compute.VirtualMachineScaleSet) (*compute.VirtualMachineScaleSet, error) {
+	s.calls = append(s.calls, "CreateOrUpdate:"+name)
+	updated := *vmss
+	s.vmss = &updated
+	s.reconcile()
+	return &updated, nil
+}
+
+func (s *fakeService) Delete(ctx context.Context, group, name string) error {
+	s.calls = append(s.calls, "Delete:"+name)
+	return nil
+}
+
+// fakeVirtualMachineService operates on the instances of a fakeService
+type fakeVirtualMachineService struct {
+	vmss *fakeService
+}
+
+func (s *fakeVirtualMachineService) Delete(ctx context.Context, group, name string) error {
+	s.vmss.calls = append(s.vmss.calls, "DeleteInstance:"+name)
+	for i, vm := range s.vmss.instances {
+		if *vm.Name == name {
+			s.vmss.instances = append(s.vmss.instances[:i], s.vmss.instances[i+1:]...)
+			return nil
+		}
+	}
+	return errors.NotFound
+}
+
+func (s *fakeVirtualMachineService) Start(ctx context.Context, group, name string) error {
+	return s.setPowerState(name, wssdcommonproto.PowerState_Running)
+}
+
+func (s *fakeVirtualMachineService) Stop(ctx context.Context, group, name string) error {
+	return s.setPowerState(name, wssdcommonproto.PowerState_Off)
+}
+
+func (s *fakeVirtualMachineService) Restart(ctx context.Context, group, name string) error {
+	return s.setPowerState(name, wssdcommonproto.PowerState_Running)
+}
+
+func (s *fakeVirtualMachineService) setPowerState(name string, state wssdcommonproto.PowerState) error {
+	for _, vm := range s.vmss.instances {
+		if *vm.Name == name {
+			powerState := state.String()
+			vm.Statuses = map[string]*string{"PowerState": &powerState}
+			return nil
+		}
+	}
+	return errors.NotFound
+}
+
+func newTestClient(capacity int64) (*VirtualMachineScaleSetClient, *fakeService) {
+	service := newFakeService("vmss", capacity)
+	return &VirtualMachineScaleSetClient{internal: service, vms: &fakeVirtualMachineService{vmss: service}}, service
+}
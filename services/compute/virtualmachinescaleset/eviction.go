@@ -0,0 +1,279 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package virtualmachinescaleset
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/microsoft/moc/pkg/errors"
+	wssdcommonproto "github.com/microsoft/moc/rpc/common"
+
+	"github.com/microsoft/wssd-sdk-for-go/services/compute"
+)
+
+const (
+	// DefaultEvictionWatchInterval is how often WatchEvictions reads the instances when no interval is given
+	DefaultEvictionWatchInterval = 30 * time.Second
+	// ownOperationIntervals is for how many watch intervals after an operation of this client ends WatchEvictions skips
+	// the instances it deleted or stopped
+	ownOperationIntervals = 3
+)
+
+// ownOperation is an instance this client deleted or stopped
+type ownOperation struct {
+	// at - When the operation was started or, once it is over, when it ended
+	at time.Time
+	// scaledIn - The instance was deleted by a scale in, which lowers the capacity
+	scaledIn bool
+}
+
+// EvictionReason is how an eviction was observed
+type EvictionReason string
+
+const (
+	// EvictionStopped - The instance left the Running power state
+	EvictionStopped EvictionReason = "Stopped"
+	// EvictionRemoved - The instance disappeared and the capacity of the scale set did not go down by as much
+	EvictionRemoved EvictionReason = "Removed"
+)
+
+// EvictionEvent reports an evicted instance of a low priority scale set
+type EvictionEvent struct {
+	// Time - When the eviction was observed
+	Time time.Time
+	// InstanceID - The evicted instance
+	InstanceID string
+	// Reason - How the eviction was observed
+	Reason EvictionReason
+	// PowerState - The power state of a stopped instance
+	PowerState string
+}
+
+// EvictionWatchOptions controls WatchEvictions
+type EvictionWatchOptions struct {
+	// Interval - How often to read the instances. Zero uses DefaultEvictionWatchInterval.
+	Interval time.Duration
+	// ScaleOptions - How HandleEvictions deletes evicted instances and lowers the capacity
+	ScaleOptions ScaleOptions
+}
+
+// WatchEvictions reads the instances of a low priority scale set every options.Interval and passes each eviction to handler.
+// The node agent does not report evictions, so any running instance that stops, or that disappears without the capacity
+// going down, is reported. When the capacity goes down by fewer instances than disappeared, the node agent does not say
+// which of them the scale in removed, so the remaining count is reported, in instance ID order.
+// Instances deleted or stopped through this client, such as by a scale in, a reimage, a rolling upgrade, an automatic
+// repair or StopInstances, are not reported if they are seen within a few intervals of the operation; instances stopped
+// or deleted through other clients, and instances restarted through this client and seen while off, are.
+// It returns when ctx is done or handler returns an error.
+func (c *VirtualMachineScaleSetClient) WatchEvictions(ctx context.Context, group, name string, options EvictionWatchOptions, handler func(EvictionEvent) error) error {
+	if options.Interval < 0 {
+		return errors.Wrapf(errors.InvalidInput, "Interval cannot be negative")
+	}
+	if options.Interval == 0 {
+		options.Interval = DefaultEvictionWatchInterval
+	}
+	vmss, err := c.getVirtualMachineScaleSet(ctx, group, name)
+	if err != nil {
+		return err
+	}
+	if getPriority(vmss) != compute.Low {
+		return errors.Wrapf(errors.InvalidInput, "Virtual Machine Scale Set [%s] is not low priority", name)
+	}
+	capacity := getCapacity(vmss)
+	previous, err := c.getPowerStates(ctx, group, name)
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(options.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		vmss, err := c.getVirtualMachineScaleSet(ctx, group, name)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		current, err := c.getPowerStates(ctx, group, name)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		// Instances removed by a scale in are not evictions
+		scaledIn := capacity - getCapacity(vmss)
+		capacity = getCapacity(vmss)
+
+		running := wssdcommonproto.PowerState_Running.String()
+		events := []EvictionEvent{}
+		removed := []EvictionEvent{}
+		for _, id := range sortedKeys(previous) {
+			state, found := current[id]
+			event := EvictionEvent{Time: time.Now(), InstanceID: id, PowerState: state}
+			switch {
+			case !found:
+				event.Reason = EvictionRemoved
+			case previous[id] == running && state != running:
+				event.Reason = EvictionStopped
+			default:
+				continue
+			}
+			if own, ownScaledIn := c.takeOwnOperation(group, name, id, options.Interval); own {
+				if !found && ownScaledIn {
+					scaledIn--
+				}
+				continue
+			}
+			if found {
+				events = append(events, event)
+			} else {
+				removed = append(removed, event)
+			}
+		}
+		if scaledIn > 0 {
+			removed = removed[:max(0, len(removed)-int(scaledIn))]
+		}
+		for _, event := range append(events, removed...) {
+			if err := handler(event); err != nil {
+				return err
+			}
+		}
+		previous = current
+	}
+}
+
+// HandleEviction applies the eviction policy of the scale set to an evicted instance. With Deallocate, the default, a
+// stopped instance is kept stopped. With Delete, the capacity is lowered for a removed instance so that it is not
+// replaced. A stopped instance is not deleted: it may have been stopped by the caller rather than evicted, so deleting it
+// is left to the caller, with DeleteInstances. It returns nil when there is nothing to do.
+// Lowering the capacity sends the scale set back, with the administrator password read from options.AdminPasswordReference.
+func (c *VirtualMachineScaleSetClient) HandleEviction(ctx context.Context, group, name string, event EvictionEvent, options ScaleOptions) (*InstanceResult, error) {
+	if c.vms == nil {
+		return nil, errors.Wrapf(errors.NotInitialized, "Eviction handling needs the virtual machine client")
+	}
+	vmss, err := c.getVirtualMachineScaleSet(ctx, group, name)
+	if err != nil {
+		return nil, err
+	}
+
+	switch getEvictionPolicy(vmss) {
+	case compute.Deallocate:
+		if event.Reason != EvictionStopped {
+			return nil, nil
+		}
+		result := &InstanceResult{InstanceID: event.InstanceID, Action: InstanceStopped}
+		if err := c.vms.Stop(ctx, group, event.InstanceID); err != nil && !errors.IsNotFound(err) {
+			result.Error = err
+		}
+		return result, result.Error
+	case compute.Delete:
+		if event.Reason != EvictionRemoved {
+			return nil, nil
+		}
+		result := &InstanceResult{InstanceID: event.InstanceID, Action: InstanceDeleted}
+		if capacity := getCapacity(vmss); capacity > 0 {
+			writable, err := c.getWritableScaleSet(ctx, group, vmss, options.AdminPasswordReference)
+			if err != nil {
+				return nil, err
+			}
+			result.Error = c.setCapacity(ctx, group, writable, capacity-1)
+		}
+		return result, result.Error
+	default:
+		return nil, errors.Wrapf(errors.InvalidInput, "Unknown eviction policy [%s]", getEvictionPolicy(vmss))
+	}
+}
+
+// HandleEvictions watches the evictions of the scale set, handles each of them with HandleEviction and passes the
+// outcome to notify, which may be nil. It returns when ctx is done or notify returns an error.
+func (c *VirtualMachineScaleSetClient) HandleEvictions(ctx context.Context, group, name string, options EvictionWatchOptions, notify func(EvictionEvent, *InstanceResult, error) error) error {
+	return c.WatchEvictions(ctx, group, name, options, func(event EvictionEvent) error {
+		result, err := c.HandleEviction(ctx, group, name, event, options.ScaleOptions)
+		if notify == nil {
+			return nil
+		}
+		return notify(event, result, err)
+	})
+}
+
+// markOwnOperation records that this client is about to delete or stop the instances ids, or has just done so. scaledIn
+// tells that the capacity goes down with them. It is called again once the operation is over, so that the mark lasts a
+// few watch intervals from then, and unmarkOwnOperation is called for the instances the operation failed on.
+func (c *VirtualMachineScaleSetClient) markOwnOperation(group, name string, ids []string, scaledIn bool) {
+	operation := ownOperation{at: time.Now(), scaledIn: scaledIn}
+	for _, id := range ids {
+		c.ownOperations.Store(instanceKey(group, name, id), operation)
+	}
+}
+
+// unmarkOwnOperation forgets an instance this client failed to delete or stop
+func (c *VirtualMachineScaleSetClient) unmarkOwnOperation(group, name, id string) {
+	c.ownOperations.Delete(instanceKey(group, name, id))
+}
+
+// takeOwnOperation returns whether this client deleted or stopped the instance within the last few intervals, and
+// whether by a scale in, and forgets it. Older operations, which the watcher would already have seen, are ignored.
+func (c *VirtualMachineScaleSetClient) takeOwnOperation(group, name, id string, interval time.Duration) (bool, bool) {
+	marked, found := c.ownOperations.LoadAndDelete(instanceKey(group, name, id))
+	if !found {
+		return false, false
+	}
+	operation := marked.(ownOperation)
+	if time.Since(operation.at) >= ownOperationIntervals*interval {
+		return false, false
+	}
+	return true, operation.scaledIn
+}
+
+func instanceKey(group, name, id string) string {
+	return group + "/" + name + "/" + id
+}
+
+// getPowerStates returns the power state of each instance
+func (c *VirtualMachineScaleSetClient) getPowerStates(ctx context.Context, group, name string) (map[string]string, error) {
+	instances, err := c.List(ctx, group, name)
+	if err != nil {
+		return nil, err
+	}
+	states := map[string]string{}
+	for i := range *instances {
+		states[getInstanceID(&(*instances)[i])] = getPowerState(&(*instances)[i])
+	}
+	return states, nil
+}
+
+func getPriority(vmss *compute.VirtualMachineScaleSet) compute.VirtualMachinePriorityTypes {
+	if vmss.VirtualMachineScaleSetProperties == nil || vmss.VirtualMachineProfile == nil ||
+		vmss.VirtualMachineProfile.VirtualMachineScaleSetVMProfileProperties == nil || vmss.VirtualMachineProfile.Priority == "" {
+		return compute.Regular
+	}
+	return vmss.VirtualMachineProfile.Priority
+}
+
+func getEvictionPolicy(vmss *compute.VirtualMachineScaleSet) compute.VirtualMachineEvictionPolicyTypes {
+	if vmss.VirtualMachineScaleSetProperties == nil || vmss.VirtualMachineProfile == nil ||
+		vmss.VirtualMachineProfile.VirtualMachineScaleSetVMProfileProperties == nil || vmss.VirtualMachineProfile.EvictionPolicy == "" {
+		return compute.Deallocate
+	}
+	return vmss.VirtualMachineProfile.EvictionPolicy
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,177 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package virtualmachinescaleset
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/microsoft/moc/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/microsoft/wssd-sdk-for-go/services/compute"
+)
+
+func setLowPriority(service *fakeService, policy compute.VirtualMachineEvictionPolicyTypes) {
+	service.vmss.VirtualMachineProfile = &compute.VirtualMachineScaleSetVMProfile{
+		VirtualMachineScaleSetVMProfileProperties: &compute.VirtualMachineScaleSetVMProfileProperties{Priority: compute.Low, EvictionPolicy: policy},
+	}
+}
+
+func Test_HandleEvictions(t *testing.T) {
+	setFastInstancePolling(t)
+	c, service := newTestClient(3)
+	setLowPriority(service, compute.Delete)
+
+	// The host stops vmss-1 and reclaims vmss-2
+	lists := 0
+	service.onList = func() {
+		lists++
+		if lists == 2 {
+			_ = c.vms.Stop(context.Background(), "group", "vmss-1")
+			service.instances = service.instances[:2]
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := []EvictionEvent{}
+	results := []*InstanceResult{}
+	err := c.HandleEvictions(ctx, "group", "vmss", EvictionWatchOptions{Interval: time.Millisecond}, func(event EvictionEvent, result *InstanceResult, err error) error {
+		assert.Nil(t, err)
+		events = append(events, event)
+		results = append(results, result)
+		if len(events) == 2 {
+			cancel()
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "vmss-1", events[0].InstanceID)
+	assert.Equal(t, EvictionStopped, events[0].Reason)
+	assert.Equal(t, "vmss-2", events[1].InstanceID)
+	assert.Equal(t, EvictionRemoved, events[1].Reason)
+	// The stopped instance may have been stopped by the caller, so it is not deleted
+	assert.Equal(t, []*InstanceResult{nil, {InstanceID: "vmss-2", Action: InstanceDeleted}}, results)
+	assert.Equal(t, int64(2), *service.vmss.Sku.Capacity)
+	assert.Equal(t, []string{"vmss-0", "vmss-1"}, instanceNames(service))
+}
+
+func Test_WatchEvictionsSkipsOwnOperations(t *testing.T) {
+	setFastInstancePolling(t)
+	c, service := newTestClient(3)
+	setLowPriority(service, compute.Delete)
+
+	// The scale set is reimaged and stopped through the client while it is watched
+	lists := 0
+	service.onList = func() {
+		lists++
+		if lists == 2 {
+			service.onList = nil
+			_, err := c.ReimageInstances(context.Background(), "group", "vmss", []string{"vmss-0"}, ScaleOptions{})
+			assert.Nil(t, err)
+			_, err = c.StopInstances(context.Background(), "group", "vmss", []string{"vmss-1"})
+			assert.Nil(t, err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	events := []EvictionEvent{}
+	err := c.WatchEvictions(ctx, "group", "vmss", EvictionWatchOptions{Interval: time.Millisecond}, func(event EvictionEvent) error {
+		events = append(events, event)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Empty(t, events)
+	assert.Equal(t, int64(3), *service.vmss.Sku.Capacity)
+}
+
+func Test_WatchEvictionsPartialScaleIn(t *testing.T) {
+	c, service := newTestClient(4)
+	setLowPriority(service, "")
+
+	// The capacity goes down by one while three instances disappear
+	lists := 0
+	service.onList = func() {
+		lists++
+		switch lists {
+		case 2:
+			service.vmss.Sku = &compute.Sku{Capacity: proto.Int64(3)}
+		case 3:
+			service.instances = service.instances[:1]
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	events := []EvictionEvent{}
+	err := c.WatchEvictions(ctx, "group", "vmss", EvictionWatchOptions{Interval: time.Millisecond}, func(event EvictionEvent) error {
+		events = append(events, event)
+		return nil
+	})
+	assert.Nil(t, err)
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, "vmss-1", events[0].InstanceID)
+		assert.Equal(t, EvictionRemoved, events[0].Reason)
+		assert.Equal(t, "vmss-2", events[1].InstanceID)
+		assert.Equal(t, EvictionRemoved, events[1].Reason)
+	}
+}
+
+func Test_WatchEvictionsAfterOwnOperations(t *testing.T) {
+	c, service := newTestClient(2)
+	setLowPriority(service, "")
+	// vmss-1 was stopped through the client long ago
+	c.ownOperations.Store(instanceKey("group", "vmss", "vmss-1"), ownOperation{at: time.Now().Add(-time.Second)})
+
+	// vmss-0 is restarted through the client without being seen off, then both instances are evicted
+	lists := 0
+	var onList func()
+	onList = func() {
+		lists++
+		switch lists {
+		case 2:
+			service.onList = nil
+			_, err := c.RestartInstances(context.Background(), "group", "vmss", []string{"vmss-0"})
+			assert.Nil(t, err)
+			service.onList = onList
+		case 3:
+			_ = c.vms.Stop(context.Background(), "group", "vmss-0")
+			_ = c.vms.Stop(context.Background(), "group", "vmss-1")
+		}
+	}
+	service.onList = onList
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	events := []EvictionEvent{}
+	err := c.WatchEvictions(ctx, "group", "vmss", EvictionWatchOptions{Interval: time.Millisecond}, func(event EvictionEvent) error {
+		events = append(events, event)
+		return nil
+	})
+	assert.Nil(t, err)
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, "vmss-0", events[0].InstanceID)
+		assert.Equal(t, EvictionStopped, events[0].Reason)
+		assert.Equal(t, "vmss-1", events[1].InstanceID)
+		assert.Equal(t, EvictionStopped, events[1].Reason)
+	}
+}
+
+func Test_HandleEvictionDeallocate(t *testing.T) {
+	c, service := newTestClient(2)
+	setLowPriority(service, "")
+
+	result, err := c.HandleEviction(context.Background(), "group", "vmss", EvictionEvent{InstanceID: "vmss-0", Reason: EvictionStopped}, ScaleOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, &InstanceResult{InstanceID: "vmss-0", Action: InstanceStopped}, result)
+	assert.Equal(t, "Off", getPowerState(service.instances[0]))
+
+	result, err = c.HandleEviction(context.Background(), "group", "vmss", EvictionEvent{InstanceID: "vmss-1", Reason: EvictionRemoved}, ScaleOptions{})
+	assert.Nil(t, err)
+	assert.Nil(t, result)
+
+	service.vmss.VirtualMachineProfile = nil
+	err = c.WatchEvictions(context.Background(), "group", "vmss", EvictionWatchOptions{}, nil)
+	assert.True(t, errors.IsInvalidInput(err))
+}
@@ -0,0 +1,138 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package virtualmachinescaleset
+
+import (
+	"context"
+
+	"github.com/microsoft/moc/pkg/errors"
+
+	"github.com/microsoft/wssd-sdk-for-go/services/compute"
+)
+
+// GetInstance returns the instance instanceID of the scale set
+func (c *VirtualMachineScaleSetClient) GetInstance(ctx context.Context, group, name, instanceID string) (*compute.VirtualMachine, error) {
+	instances, err := c.getInstances(ctx, group, name, []string{instanceID})
+	if err != nil {
+		return nil, err
+	}
+	return &instances[0], nil
+}
+
+// StartInstances starts the instances instanceIDs of the scale set
+func (c *VirtualMachineScaleSetClient) StartInstances(ctx context.Context, group, name string, instanceIDs []string) ([]InstanceResult, error) {
+	return c.runInstances(ctx, group, name, instanceIDs, InstanceStarted, func(ctx context.Context, id string) error {
+		return c.vms.Start(ctx, group, id)
+	})
+}
+
+// StopInstances stops the instances instanceIDs of the scale set
+func (c *VirtualMachineScaleSetClient) StopInstances(ctx context.Context, group, name string, instanceIDs []string) ([]InstanceResult, error) {
+	return c.runInstances(ctx, group, name, instanceIDs, InstanceStopped, func(ctx context.Context, id string) error {
+		return c.vms.Stop(ctx, group, id)
+	})
+}
+
+// RestartInstances restarts the instances instanceIDs of the scale set
+func (c *VirtualMachineScaleSetClient) RestartInstances(ctx context.Context, group, name string, instanceIDs []string) ([]InstanceResult, error) {
+	return c.runInstances(ctx, group, name, instanceIDs, InstanceRestarted, func(ctx context.Context, id string) error {
+		return c.vms.Restart(ctx, group, id)
+	})
+}
+
+// ReimageInstances replaces the instances instanceIDs of the scale set by new instances created from the current
+// profile. The node agent names the new instances, so they come back with new IDs, returned as InstanceCreated results.
+// The administrator password of the profile is read from options.AdminPasswordReference.
+func (c *VirtualMachineScaleSetClient) ReimageInstances(ctx context.Context, group, name string, instanceIDs []string, options ScaleOptions) ([]InstanceResult, error) {
+	if c.vms == nil {
+		return nil, errors.Wrapf(errors.NotInitialized, "Instance operations need the virtual machine client")
+	}
+	if _, err := c.getInstances(ctx, group, name, instanceIDs); err != nil {
+		return nil, err
+	}
+	created, err := c.recreateInstances(ctx, group, name, instanceIDs, options.AdminPasswordReference)
+	results := []InstanceResult{}
+	for _, id := range instanceIDs {
+		results = append(results, InstanceResult{InstanceID: id, Action: InstanceReimaged, Error: err})
+	}
+	return append(results, created...), err
+}
+
+// DeleteInstances removes the instances instanceIDs from the scale set and lowers its capacity accordingly
+func (c *VirtualMachineScaleSetClient) DeleteInstances(ctx context.Context, group, name string, instanceIDs []string, options ScaleOptions) ([]InstanceResult, error) {
+	if _, err := c.getInstances(ctx, group, name, instanceIDs); err != nil {
+		return nil, err
+	}
+	result, err := c.ScaleIn(ctx, group, name, 0, ScaleInPolicy{Rule: ScaleInInstances, InstanceIDs: instanceIDs}, options)
+	if result == nil {
+		return nil, err
+	}
+	return result.Instances, err
+}
+
+// runInstances validates that instanceIDs belong to the scale set and runs operation on each of them
+func (c *VirtualMachineScaleSetClient) runInstances(ctx context.Context, group, name string, instanceIDs []string, action InstanceAction, operation func(context.Context, string) error) ([]InstanceResult, error) {
+	if c.vms == nil {
+		return nil, errors.Wrapf(errors.NotInitialized, "Instance operations need the virtual machine client")
+	}
+	if _, err := c.getInstances(ctx, group, name, instanceIDs); err != nil {
+		return nil, err
+	}
+	results := []InstanceResult{}
+	// Restarted instances are not marked: a restart may be over before the watcher sees the instance off, and the mark
+	// would then hide a later eviction
+	stopping := action == InstanceStopped
+	if stopping {
+		c.markOwnOperation(group, name, instanceIDs, false)
+	}
+	for _, id := range instanceIDs {
+		result := InstanceResult{InstanceID: id, Action: action}
+		err := operation(ctx, id)
+		if err != nil {
+			result.Error = errors.Wrapf(err, "Unable to %s instance [%s]", actionVerbs[action], id)
+		}
+		if stopping && err != nil {
+			c.unmarkOwnOperation(group, name, id)
+		} else if stopping {
+			c.markOwnOperation(group, name, []string{id}, false)
+		}
+		results = append(results, result)
+	}
+	return results, getInstanceResultsError(results)
+}
+
+var actionVerbs = map[InstanceAction]string{
+	InstanceStarted:   "start",
+	InstanceStopped:   "stop",
+	InstanceRestarted: "restart",
+}
+
+// getInstances returns the instances instanceIDs, in order, and fails if any of them is not part of the scale set
+func (c *VirtualMachineScaleSetClient) getInstances(ctx context.Context, group, name string, instanceIDs []string) ([]compute.VirtualMachine, error) {
+	if len(instanceIDs) == 0 {
+		return nil, errors.Wrapf(errors.InvalidInput, "No instance IDs specified")
+	}
+	instances, err := c.List(ctx, group, name)
+	if err != nil {
+		return nil, err
+	}
+	byID := map[string]compute.VirtualMachine{}
+	for _, instance := range *instances {
+		byID[getInstanceID(&instance)] = instance
+	}
+	selected := []compute.VirtualMachine{}
+	seen := map[string]bool{}
+	for _, id := range instanceIDs {
+		if seen[id] {
+			return nil, errors.Wrapf(errors.InvalidInput, "Instance [%s] is specified more than once", id)
+		}
+		seen[id] = true
+		instance, found := byID[id]
+		if !found {
+			return nil, errors.Wrapf(errors.NotFound, "Instance [%s] is not part of Virtual Machine Scale Set [%s]", id, name)
+		}
+		selected = append(selected, instance)
+	}
+	return selected, nil
+}
@@ -0,0 +1,66 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package virtualmachinescaleset
+
+import (
+	"context"
+	"testing"
+
+	"github.com/microsoft/moc/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_InstanceOperations(t *testing.T) {
+	setFastInstancePolling(t)
+	c, service := newTestClient(3)
+
+	vm, err := c.GetInstance(context.Background(), "group", "vmss", "vmss-1")
+	assert.Nil(t, err)
+	assert.Equal(t, "vmss-1", *vm.Name)
+	_, err = c.GetInstance(context.Background(), "group", "vmss", "other-1")
+	assert.True(t, errors.IsNotFound(err))
+
+	results, err := c.StopInstances(context.Background(), "group", "vmss", []string{"vmss-0", "vmss-2"})
+	assert.Nil(t, err)
+	assert.Equal(t, []InstanceResult{{InstanceID: "vmss-0", Action: InstanceStopped}, {InstanceID: "vmss-2", Action: InstanceStopped}}, results)
+	vm, _ = c.GetInstance(context.Background(), "group", "vmss", "vmss-0")
+	assert.Equal(t, "Off", getPowerState(vm))
+
+	_, err = c.StartInstances(context.Background(), "group", "vmss", []string{"vmss-0", "vmss-0"})
+	assert.True(t, errors.IsInvalidInput(err))
+
+	results, err = c.ReimageInstances(context.Background(), "group", "vmss", []string{"vmss-1"}, ScaleOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, []InstanceResult{
+		{InstanceID: "vmss-1", Action: InstanceReimaged},
+		{InstanceID: "vmss-3", Action: InstanceCreated, PowerState: "Running"},
+	}, results)
+
+	results, err = c.DeleteInstances(context.Background(), "group", "vmss", []string{"vmss-0"}, ScaleOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, []InstanceResult{{InstanceID: "vmss-0", Action: InstanceDeleted}}, results)
+	assert.Equal(t, []string{"vmss-2", "vmss-3"}, instanceNames(service))
+	assert.Equal(t, int64(2), *service.vmss.Sku.Capacity)
+}
+
+func Test_ReimageInstancesFailed(t *testing.T) {
+	setFastInstancePolling(t)
+	c, service := newTestClient(1)
+	// The replacement fails to provision and never runs
+	service.onList = func() {
+		for _, vm := range service.instances {
+			if *vm.Name != "vmss-0" {
+				failed, off := "CREATE_FAILED", "Off"
+				vm.ProvisioningState = &failed
+				vm.Statuses = map[string]*string{"PowerState": &off}
+			}
+		}
+	}
+
+	results, err := c.ReimageInstances(context.Background(), "group", "vmss", []string{"vmss-0"}, ScaleOptions{})
+	assert.True(t, errors.IsFailed(err))
+	assert.Len(t, results, 2)
+	assert.Equal(t, InstanceResult{InstanceID: "vmss-1", Action: InstanceCreated, PowerState: "Off", Error: results[1].Error}, results[1])
+	assert.True(t, errors.IsFailed(results[1].Error))
+}
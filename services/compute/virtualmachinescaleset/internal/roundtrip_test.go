@@ -0,0 +1,246 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package internal
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+
+	wssdcompute "github.com/microsoft/moc/rpc/nodeagent/compute"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/microsoft/wssd-sdk-for-go/internal/roundtrip"
+	"github.com/microsoft/wssd-sdk-for-go/services/compute"
+	"github.com/microsoft/wssd-sdk-for-go/services/network"
+)
+
+func Test_VirtualMachineScaleSetRoundTrip(t *testing.T) {
+	for seed := int64(0); seed < 500; seed++ {
+		checkVirtualMachineScaleSetRoundTrip(t, seed, false)
+		checkVirtualMachineScaleSetRoundTrip(t, seed, true)
+		checkWssdVirtualMachineScaleSetRoundTrip(t, seed)
+	}
+}
+
+func FuzzVirtualMachineScaleSetRoundTrip(f *testing.F) {
+	f.Add(int64(0), false)
+	f.Add(int64(1), true)
+	f.Fuzz(func(t *testing.T, seed int64, sparse bool) {
+		checkVirtualMachineScaleSetRoundTrip(t, seed, sparse)
+		checkWssdVirtualMachineScaleSetRoundTrip(t, seed)
+	})
+}
+
+// checkVirtualMachineScaleSetRoundTrip converts a random spec to protobuf and back. A sparse spec may be rejected, a full one must not be.
+func checkVirtualMachineScaleSetRoundTrip(t *testing.T, seed int64, sparse bool) {
+	r := rand.New(rand.NewSource(seed))
+	vmss := &compute.VirtualMachineScaleSet{}
+	if sparse {
+		roundtrip.FillSparse(vmss, r)
+	} else {
+		roundtrip.Fill(vmss, r)
+	}
+	canonicalizeVirtualMachineScaleSet(vmss, r)
+
+	c := client{}
+	wssdvmss, err := c.getWssdVirtualMachineScaleSet(vmss)
+	if sparse && err != nil {
+		return
+	}
+	if !assert.Nil(t, err, "seed %d", seed) {
+		return
+	}
+	got, err := c.getVirtualMachineScaleSet(wssdvmss)
+	assert.Nil(t, err, "seed %d", seed)
+	clearVirtualMachineScaleSetOutputs(got)
+	assert.Nil(t, roundtrip.Diff(vmss, got), "seed %d", seed)
+}
+
+// checkWssdVirtualMachineScaleSetRoundTrip converts a random node agent scale set to the SDK and back. The SDK view must not change.
+func checkWssdVirtualMachineScaleSetRoundTrip(t *testing.T, seed int64) {
+	r := rand.New(rand.NewSource(seed))
+	wssdvmss := &wssdcompute.VirtualMachineScaleSet{}
+	roundtrip.FillSparse(wssdvmss, r)
+
+	c := client{}
+	vmss, err := c.getVirtualMachineScaleSet(wssdvmss)
+	if !assert.Nil(t, err, "seed %d", seed) {
+		return
+	}
+	clearVirtualMachineScaleSetOutputs(vmss)
+	if profile := vmss.VirtualMachineProfile; profile != nil && profile.OsProfile == nil {
+		// A missing OS profile is sent as the default one
+		profile.OsProfile = &compute.OSProfile{OsBootstrapEngine: compute.CloudInit}
+	}
+	wssdvmss, err = c.getWssdVirtualMachineScaleSet(vmss)
+	if err != nil {
+		return
+	}
+	got, err := c.getVirtualMachineScaleSet(wssdvmss)
+	assert.Nil(t, err, "seed %d", seed)
+	clearVirtualMachineScaleSetOutputs(got)
+	assert.Nil(t, roundtrip.Diff(vmss, got), "seed %d", seed)
+}
+
+// canonicalizeVirtualMachineScaleSet replaces random values with valid ones, spells out defaults the node agent returns, and
+// clears the fields the node agent does not carry
+func canonicalizeVirtualMachineScaleSet(vmss *compute.VirtualMachineScaleSet, r *rand.Rand) {
+	clearVirtualMachineScaleSetOutputs(vmss)
+	vmss.Identity = canonicalizeIdentity(vmss.Identity)
+	if vmss.VirtualMachineScaleSetProperties == nil || vmss.VirtualMachineProfile == nil {
+		return
+	}
+	profile := vmss.VirtualMachineProfile
+	// Not carried: the profile is not a resource of its own
+	profile.ID = nil
+	profile.Type = nil
+	profile.Tags = nil
+	if profile.VirtualMachineScaleSetVMProfileProperties == nil {
+		profile.VirtualMachineScaleSetVMProfileProperties = &compute.VirtualMachineScaleSetVMProfileProperties{}
+	}
+	// Kept in tags, which only exist for set values
+	if d := profile.DiagnosticsProfile; d != nil && (d.BootDiagnostics == nil || d.BootDiagnostics.Enabled == nil && d.BootDiagnostics.StorageURI == nil) {
+		profile.DiagnosticsProfile = nil
+	}
+
+	if profile.HardwareProfile == nil {
+		profile.HardwareProfile = &compute.HardwareProfile{}
+	}
+	sizes := compute.ListSizes()
+	profile.HardwareProfile.VMSize = sizes[r.Intn(len(sizes))].Name
+	for _, gpu := range profile.HardwareProfile.VirtualMachineGPUs {
+		if gpu != nil && gpu.Assignment != nil {
+			*gpu.Assignment = []compute.Assignment{compute.GpuDDA, compute.GpuP, compute.GpuPV, compute.GpuDefault}[r.Intn(4)]
+		}
+	}
+	if profile.SecurityProfile == nil {
+		profile.SecurityProfile = &compute.SecurityProfile{}
+	}
+	profile.SecurityProfile.SecurityType = []compute.SecurityTypes{"", compute.TrustedLaunch, compute.ConfidentialVM}[r.Intn(3)]
+
+	if s := profile.StorageProfile; s != nil {
+		// Not carried: the node agent only references virtual hard disks by name
+		s.ImageReference = nil
+		if s.OsDisk != nil {
+			s.OsDisk.Name = nil
+			s.OsDisk.OsType = ""
+			if s.OsDisk.ManagedDisk != nil && s.OsDisk.ManagedDisk.SecurityProfile != nil {
+				s.OsDisk.ManagedDisk.SecurityProfile.SecurityEncryptionType = []compute.SecurityEncryptionTypes{"", compute.NonPersistedTPM}[r.Intn(2)]
+			}
+		}
+		if s.DataDisks != nil {
+			for i := range *s.DataDisks {
+				(*s.DataDisks)[i].Name = nil
+				(*s.DataDisks)[i].ImageReference = nil
+			}
+		}
+	}
+
+	if profile.OsProfile == nil {
+		profile.OsProfile = &compute.OSProfile{}
+	}
+	os := profile.OsProfile
+	os.OsBootstrapEngine = []compute.OperatingSystemBootstrapEngine{compute.CloudInit, compute.WindowsAnswerFiles}[r.Intn(2)]
+	// Not carried back: the administrator password is write-only
+	os.AdminPassword = nil
+	// Not carried: secret references are resolved by the client
+	os.AdminPasswordReference = nil
+	if os.WindowsConfiguration != nil {
+		clearSSHKeyPaths(os.WindowsConfiguration.SSH)
+		if os.LinuxConfiguration != nil {
+			// Not carried: the public keys are taken from the configuration of the OS type
+			os.WindowsConfiguration.SSH = nil
+		}
+		if os.WindowsConfiguration.WinRM != nil && os.WindowsConfiguration.WinRM.Listeners != nil {
+			for i := range *os.WindowsConfiguration.WinRM.Listeners {
+				(*os.WindowsConfiguration.WinRM.Listeners)[i].Protocol = []compute.ProtocolTypes{compute.HTTP, compute.HTTPS}[r.Intn(2)]
+			}
+		}
+	}
+	if os.LinuxConfiguration != nil {
+		clearSSHKeyPaths(os.LinuxConfiguration.SSH)
+	}
+
+	if profile.NetworkProfile != nil && profile.NetworkProfile.NetworkInterfaceConfigurations != nil {
+		for i := range *profile.NetworkProfile.NetworkInterfaceConfigurations {
+			nic := &(*profile.NetworkProfile.NetworkInterfaceConfigurations)[i]
+			// Not carried: the network interfaces are created per virtual machine
+			nic.ID = nil
+			nic.Type = nil
+			if nic.VirtualMachineScaleSetNetworkConfigurationProperties == nil {
+				continue
+			}
+			nic.EnableIPForwarding = nil
+			if nic.IPConfigurations == nil {
+				continue
+			}
+			for j := range *nic.IPConfigurations {
+				canonicalizeIPConfiguration(&(*nic.IPConfigurations)[j], r)
+			}
+		}
+	}
+}
+
+func canonicalizeIPConfiguration(ipconfig *network.IPConfiguration, r *rand.Rand) {
+	// Not carried: IP configurations are not resources of their own, and load balancing is configured elsewhere
+	ipconfig.ID = nil
+	ipconfig.Name = nil
+	ipconfig.Type = nil
+	ipconfig.Tags = nil
+	if ipconfig.IPConfigurationProperties == nil {
+		return
+	}
+	ipconfig.VirtualNetworkInterfaceID = nil
+	ipconfig.LoadBalancerBackendAddressPoolIDs = nil
+	ipconfig.LoadBalancerInboundNatPoolIDs = nil
+	ipconfig.NetworkType = []network.NetworkType{network.Virtual, network.Logical}[r.Intn(2)]
+	ipconfig.IPAllocationMethod = []network.IPAllocationMethod{network.Static, network.Dynamic}[r.Intn(2)]
+}
+
+func clearSSHKeyPaths(ssh *compute.SSHConfiguration) {
+	if ssh == nil || ssh.PublicKeys == nil {
+		return
+	}
+	for i := range *ssh.PublicKeys {
+		// Not carried: the node agent decides where the keys are stored
+		(*ssh.PublicKeys)[i].Path = nil
+	}
+}
+
+func clearVirtualMachineScaleSetOutputs(vmss *compute.VirtualMachineScaleSet) {
+	vmss.ID = nil
+	vmss.Type = nil
+	vmss.Statuses = nil
+	vmss.HighAvailabilityState = nil
+	if vmss.VirtualMachineScaleSetProperties == nil {
+		return
+	}
+	vmss.ProvisioningState = nil
+	vmss.VirtualMachineScaleSetProperties.Statuses = nil
+}
+
+// canonicalizeIdentity clears the read-only IDs, which are filled in by the client, and the user assigned identity names
+// that cannot be kept in a tag
+func canonicalizeIdentity(identity *compute.VirtualMachineScaleSetIdentity) *compute.VirtualMachineScaleSetIdentity {
+	if identity == nil {
+		return nil
+	}
+	identity.PrincipalID = nil
+	identity.TenantID = nil
+	for name := range identity.UserAssignedIdentities {
+		if name == "" || strings.Contains(name, ",") {
+			delete(identity.UserAssignedIdentities, name)
+			continue
+		}
+		identity.UserAssignedIdentities[name] = &compute.VirtualMachineScaleSetIdentityUserAssignedIdentitiesValue{}
+	}
+	if len(identity.UserAssignedIdentities) == 0 {
+		identity.UserAssignedIdentities = nil
+	}
+	if identity.Type == "" && identity.UserAssignedIdentities == nil && identity.KeyVaultName == nil {
+		return nil
+	}
+	return identity
+}
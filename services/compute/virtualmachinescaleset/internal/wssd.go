@@ -5,10 +5,13 @@ package internal
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 
+	"github.com/google/go-cmp/cmp"
 	"github.com/microsoft/moc/pkg/auth"
 	"github.com/microsoft/moc/pkg/errors"
+	prototags "github.com/microsoft/moc/pkg/tags"
 	wssdcommonproto "github.com/microsoft/moc/rpc/common"
 	wssdcompute "github.com/microsoft/moc/rpc/nodeagent/compute"
 	wssdnetwork "github.com/microsoft/moc/rpc/nodeagent/network"
@@ -20,6 +23,14 @@ import (
 	"github.com/microsoft/wssd-sdk-for-go/services/network"
 )
 
+// The node agent has no priority and no upgrade policy; the declarations are kept in tags of the scale set, as are the
+// identity and the boot diagnostics of the profile
+const (
+	priorityTag       = "wssdsdk.priority"
+	evictionPolicyTag = "wssdsdk.evictionpolicy"
+	upgradePolicyTag  = "wssdsdk.upgradepolicy"
+)
+
 type client struct {
 	subID    string
 	vmclient *virtualmachine.VirtualMachineClient
@@ -75,9 +86,15 @@ func (c *client) GetVirtualMachines(ctx context.Context, group, name string) (*[
 			if tvms == nil || len(*tvms) == 0 {
 				return nil, fmt.Errorf("Vmss doesnt have any Vms")
 			}
-			// FIXME: Make sure Vms only on this scale set is returned.
-			// If another Vm with the same name exists, that could also potentially be returned.
-			vms = append(vms, (*tvms)[0])
+			owned, err := getOwnedVirtualMachine(name, vm, *tvms)
+			if err != nil {
+				return nil, err
+			}
+			if owned == nil {
+				// A virtual machine with the same name that is not known to belong to this scale set
+				continue
+			}
+			vms = append(vms, *owned)
 		}
 	}
 
@@ -121,6 +138,21 @@ func (c *client) Delete(ctx context.Context, group, name string) error {
 
 ///////// private methods ////////
 
+// getOwnedVirtualMachine returns the candidate that is the instance vm reported by the scale set name, or nil if none is.
+// The instance is matched by ID, as a virtual machine with the same name is not necessarily an instance of the scale set.
+// An instance reported without an ID cannot be matched and fails with NotSet, rather than being left out of the list.
+func getOwnedVirtualMachine(name string, vm *wssdcompute.VirtualMachine, candidates []compute.VirtualMachine) (*compute.VirtualMachine, error) {
+	if vm.Id == "" {
+		return nil, errors.Wrapf(errors.NotSet, "The node agent reported instance [%s] of Virtual Machine Scale Set [%s] without an ID", vm.Name, name)
+	}
+	for i := range candidates {
+		if candidates[i].ID != nil && *candidates[i].ID == vm.Id {
+			return &candidates[i], nil
+		}
+	}
+	return nil, nil
+}
+
 // Conversion from proto to sdk
 func (c *client) getVirtualMachineScaleSetFromResponse(response *wssdcompute.VirtualMachineScaleSetResponse) (*[]compute.VirtualMachineScaleSet, error) {
 	vmsss := []compute.VirtualMachineScaleSet{}
@@ -164,15 +196,22 @@ func (c *client) getVirtualMachineScaleSet(vmss *wssdcompute.VirtualMachineScale
 	if err != nil {
 		return nil, err
 	}
+	identity, tags := compute.IdentityFromTags(prototags.ProtoToMap(vmss.Tags))
+	tags = c.setVirtualMachineScaleSetPriority(vmprofile, tags)
+	tags = c.setVirtualMachineScaleSetDiagnosticsProfile(vmprofile, tags)
+	upgradePolicy, tags, err := c.getVirtualMachineScaleSetUpgradePolicy(tags)
+	if err != nil {
+		return nil, err
+	}
 	return &compute.VirtualMachineScaleSet{
-		Name: &vmss.Name,
-		ID:   &vmss.Id,
-		Sku: &compute.Sku{
-			Name:     &vmss.Sku.Name,
-			Capacity: &vmss.Sku.Capacity,
-		},
+		Name:     &vmss.Name,
+		ID:       &vmss.Id,
+		Tags:     tags,
+		Sku:      c.getVirtualMachineScaleSetSku(vmss.Sku),
+		Identity: identity,
 		VirtualMachineScaleSetProperties: &compute.VirtualMachineScaleSetProperties{
 			VirtualMachineProfile: vmprofile,
+			UpgradePolicy:         upgradePolicy,
 			ProvisioningState:     status.GetProvisioningState(vmss.Status.GetProvisioningStatus()),
 			Statuses:              status.GetStatuses(vmss.Status),
 		},
@@ -182,6 +221,57 @@ func (c *client) getVirtualMachineScaleSet(vmss *wssdcompute.VirtualMachineScale
 	}, nil
 }
 
+// setVirtualMachineScaleSetPriority moves the priority and eviction policy kept in tags to the profile, and returns the other tags
+func (c *client) setVirtualMachineScaleSetPriority(profile *compute.VirtualMachineScaleSetVMProfile, tags map[string]*string) map[string]*string {
+	priority, hasPriority := tags[priorityTag]
+	evictionPolicy, hasEvictionPolicy := tags[evictionPolicyTag]
+	delete(tags, priorityTag)
+	delete(tags, evictionPolicyTag)
+	if profile == nil || profile.VirtualMachineScaleSetVMProfileProperties == nil {
+		return tags
+	}
+	if hasPriority && priority != nil {
+		profile.Priority = compute.VirtualMachinePriorityTypes(*priority)
+	}
+	if hasEvictionPolicy && evictionPolicy != nil {
+		profile.EvictionPolicy = compute.VirtualMachineEvictionPolicyTypes(*evictionPolicy)
+	}
+	return tags
+}
+
+// setVirtualMachineScaleSetDiagnosticsProfile moves the boot diagnostics kept in tags to the profile, and returns the other tags
+func (c *client) setVirtualMachineScaleSetDiagnosticsProfile(profile *compute.VirtualMachineScaleSetVMProfile, tags map[string]*string) map[string]*string {
+	diagnostics, tags := compute.BootDiagnosticsFromTags(tags)
+	if profile != nil && profile.VirtualMachineScaleSetVMProfileProperties != nil {
+		profile.DiagnosticsProfile = diagnostics
+	}
+	return tags
+}
+
+// getVirtualMachineScaleSetUpgradePolicy reads the upgrade policy kept in tags, and returns the other tags
+func (c *client) getVirtualMachineScaleSetUpgradePolicy(tags map[string]*string) (*compute.UpgradePolicy, map[string]*string, error) {
+	value, found := tags[upgradePolicyTag]
+	delete(tags, upgradePolicyTag)
+	if !found || value == nil {
+		return nil, tags, nil
+	}
+	policy := &compute.UpgradePolicy{}
+	if err := json.Unmarshal([]byte(*value), policy); err != nil {
+		return nil, nil, errors.Wrapf(errors.InvalidConfiguration, "Invalid upgrade policy [%s]: %v", *value, err)
+	}
+	return policy, tags, nil
+}
+
+func (c *client) getVirtualMachineScaleSetSku(sku *wssdcompute.Sku) *compute.Sku {
+	if sku == nil {
+		return nil
+	}
+	return &compute.Sku{
+		Name:     &sku.Name,
+		Capacity: &sku.Capacity,
+	}
+}
+
 func (c *client) getVirtualMachineIsPlaceholder(vmss *wssdcompute.VirtualMachineScaleSet) *bool {
 	isPlaceholder := false
 	entity := vmss.GetEntity()
@@ -210,6 +300,9 @@ func (c *client) getVirtualMachineScaleSetHighAvailabilityState(vmss *wssdcomput
 }
 
 func (c *client) getVirtualMachineScaleSetVMProfile(vm *wssdcompute.VirtualMachineProfile) (*compute.VirtualMachineScaleSetVMProfile, error) {
+	if vm == nil {
+		return nil, nil
+	}
 	net, err := c.getVirtualMachineScaleSetNetworkProfile(vm.Network)
 	if err != nil {
 		return nil, err
@@ -230,6 +323,7 @@ func (c *client) getVirtualMachineScaleSetVMProfile(vm *wssdcompute.VirtualMachi
 func (c *client) getVirtualMachineScaleSetHardwareProfile(vm *wssdcompute.VirtualMachineProfile) *compute.HardwareProfile {
 	sizeType := compute.VirtualMachineSizeTypesDefault
 	var customSize *compute.VirtualMachineCustomSize
+	var dynamicMemoryConfig *compute.DynamicMemoryConfiguration
 	var vmGPUs []*compute.VirtualMachineGPU
 	if vm.Hardware != nil {
 		sizeType = compute.GetVirtualMachineSizeFromWssdVirtualMachineSize(vm.Hardware.VMSize)
@@ -237,48 +331,76 @@ func (c *client) getVirtualMachineScaleSetHardwareProfile(vm *wssdcompute.Virtua
 			customSize = &compute.VirtualMachineCustomSize{
 				CpuCount: &vm.Hardware.CustomSize.CpuCount,
 				MemoryMB: &vm.Hardware.CustomSize.MemoryMB,
+				GpuCount: &vm.Hardware.CustomSize.GpuCount,
 			}
 		}
-		if vm.Hardware.VirtualMachineGPUs != nil {
-			for _, commonVMGPU := range vm.Hardware.VirtualMachineGPUs {
-				var assignment compute.Assignment
-				switch commonVMGPU.Assignment {
-				case wssdcommonproto.AssignmentType_GpuDDA:
-					assignment = compute.GpuDDA
-				case wssdcommonproto.AssignmentType_GpuP:
-					assignment = compute.GpuP
-				case wssdcommonproto.AssignmentType_GpuPV:
-					assignment = compute.GpuPV
-				case wssdcommonproto.AssignmentType_GpuDefault:
-					assignment = compute.GpuDefault
-				}
-				vmGPU := &compute.VirtualMachineGPU{
-					Assignment:      &assignment,
-					PartitionSizeMB: &commonVMGPU.PartitionSizeMB,
-					Name:            &commonVMGPU.Name,
-				}
-				vmGPUs = append(vmGPUs, vmGPU)
+		if vm.Hardware.DynamicMemoryConfiguration != nil {
+			dynamicMemoryConfig = &compute.DynamicMemoryConfiguration{
+				MaximumMemoryMB:    &vm.Hardware.DynamicMemoryConfiguration.MaximumMemoryMB,
+				MinimumMemoryMB:    &vm.Hardware.DynamicMemoryConfiguration.MinimumMemoryMB,
+				TargetMemoryBuffer: &vm.Hardware.DynamicMemoryConfiguration.TargetMemoryBuffer,
+			}
+		}
+		for _, commonVMGPU := range vm.Hardware.VirtualMachineGPUs {
+			if commonVMGPU == nil {
+				continue
+			}
+			var assignment compute.Assignment
+			switch commonVMGPU.Assignment {
+			case wssdcommonproto.AssignmentType_GpuDDA:
+				assignment = compute.GpuDDA
+			case wssdcommonproto.AssignmentType_GpuP:
+				assignment = compute.GpuP
+			case wssdcommonproto.AssignmentType_GpuPV:
+				assignment = compute.GpuPV
+			case wssdcommonproto.AssignmentType_GpuDefault:
+				assignment = compute.GpuDefault
 			}
+			vmGPU := &compute.VirtualMachineGPU{
+				Assignment:      &assignment,
+				PartitionSizeMB: &commonVMGPU.PartitionSizeMB,
+				Name:            &commonVMGPU.Name,
+			}
+			vmGPUs = append(vmGPUs, vmGPU)
 		}
 	}
 	return &compute.HardwareProfile{
-		VMSize:             sizeType,
-		CustomSize:         customSize,
-		VirtualMachineGPUs: vmGPUs,
+		VMSize:              sizeType,
+		CustomSize:          customSize,
+		DynamicMemoryConfig: dynamicMemoryConfig,
+		VirtualMachineGPUs:  vmGPUs,
 	}
 }
 
 func (c *client) getVirtualMachineScaleSetSecurityProfile(vm *wssdcompute.VirtualMachineProfile) *compute.SecurityProfile {
 	enableTPM := false
+	var uefiSettings *compute.UefiSettings
+	var securityType compute.SecurityTypes = ""
 	if vm.Security != nil {
 		enableTPM = vm.Security.EnableTPM
+		if vm.Security.UefiSettings != nil {
+			uefiSettings = &compute.UefiSettings{
+				SecureBootEnabled: &vm.Security.UefiSettings.SecureBootEnabled,
+			}
+		}
+		switch vm.Security.SecurityType {
+		case wssdcommonproto.SecurityType_TRUSTEDLAUNCH:
+			securityType = compute.TrustedLaunch
+		case wssdcommonproto.SecurityType_CONFIDENTIALVM:
+			securityType = compute.ConfidentialVM
+		}
 	}
 	return &compute.SecurityProfile{
-		EnableTPM: &enableTPM,
+		EnableTPM:    &enableTPM,
+		UefiSettings: uefiSettings,
+		SecurityType: securityType,
 	}
 }
 
 func (c *client) getVirtualMachineScaleSetStorageProfile(s *wssdcompute.StorageConfiguration) *compute.StorageProfile {
+	if s == nil {
+		return nil
+	}
 	return &compute.StorageProfile{
 		OsDisk:                c.getVirtualMachineScaleSetStorageProfileOsDisk(s.Osdisk),
 		DataDisks:             c.getVirtualMachineScaleSetStorageProfileDataDisks(s.Datadisks),
@@ -287,8 +409,25 @@ func (c *client) getVirtualMachineScaleSetStorageProfile(s *wssdcompute.StorageC
 }
 
 func (c *client) getVirtualMachineScaleSetStorageProfileOsDisk(d *wssdcompute.Disk) *compute.OSDisk {
+	if d == nil {
+		return nil
+	}
+	var managedDisk *compute.VirtualMachineManagedDiskParameters
+	if d.ManagedDisk != nil {
+		managedDisk = &compute.VirtualMachineManagedDiskParameters{}
+		if d.ManagedDisk.SecurityProfile != nil {
+			var securityEncryptionType compute.SecurityEncryptionTypes
+			if d.ManagedDisk.SecurityProfile.SecurityEncryptionType == wssdcommonproto.SecurityEncryptionTypes_NonPersistedTPM {
+				securityEncryptionType = compute.NonPersistedTPM
+			}
+			managedDisk.SecurityProfile = &compute.VMDiskSecurityProfile{
+				SecurityEncryptionType: securityEncryptionType,
+			}
+		}
+	}
 	return &compute.OSDisk{
-		VhdName: &d.Diskname,
+		VhdName:     &d.Diskname,
+		ManagedDisk: managedDisk,
 	}
 }
 
@@ -296,6 +435,9 @@ func (c *client) getVirtualMachineScaleSetStorageProfileDataDisks(dd []*wssdcomp
 	cdd := []compute.DataDisk{}
 
 	for _, i := range dd {
+		if i == nil {
+			continue
+		}
 		cdd = append(cdd, compute.DataDisk{VhdName: &(i.Diskname)})
 	}
 
@@ -307,6 +449,9 @@ func (c *client) getVirtualMachineScaleSetNetworkProfile(n *wssdcompute.NetworkC
 	np := &compute.VirtualMachineScaleSetNetworkProfile{
 		NetworkInterfaceConfigurations: &[]compute.VirtualMachineScaleSetNetworkConfiguration{},
 	}
+	if n == nil {
+		return np, nil
+	}
 
 	for _, nic := range n.Interfaces {
 		if nic == nil {
@@ -324,12 +469,18 @@ func (c *client) getVirtualMachineScaleSetNetworkProfile(n *wssdcompute.NetworkC
 func (c *client) getVirtualMachineScaleSetNetworkConfiguration(nic *wssdnetwork.VirtualNetworkInterface) (*compute.VirtualMachineScaleSetNetworkConfiguration, error) {
 	ipconfigs := []network.IPConfiguration{}
 	for _, wssdipconfig := range nic.Ipconfigs {
+		if wssdipconfig == nil {
+			continue
+		}
 		ipconfigs = append(ipconfigs, *(c.getVirtualMachineScaleSetNetworkConfigurationIPConfiguration(wssdipconfig)))
 	}
 
 	return &compute.VirtualMachineScaleSetNetworkConfiguration{
+		Name: &nic.Name,
+		Tags: prototags.ProtoToMap(nic.Tags),
 		VirtualMachineScaleSetNetworkConfigurationProperties: &compute.VirtualMachineScaleSetNetworkConfigurationProperties{
 			IPConfigurations: &ipconfigs,
+			DNSSettings:      c.getVirtualMachineScaleSetNetworkConfigurationDNSSettings(nic.DnsSettings),
 		},
 	}, nil
 }
@@ -337,24 +488,100 @@ func (c *client) getVirtualMachineScaleSetNetworkConfiguration(nic *wssdnetwork.
 func (c *client) getVirtualMachineScaleSetNetworkConfigurationIPConfiguration(wssdipconfig *wssdnetwork.IpConfiguration) *network.IPConfiguration {
 	return &network.IPConfiguration{
 		IPConfigurationProperties: &network.IPConfigurationProperties{
-			SubnetID:     &wssdipconfig.Subnetid,
-			PrefixLength: &wssdipconfig.Prefixlength,
-			IPAddress:    &wssdipconfig.Ipaddress,
+			SubnetID:           &wssdipconfig.Subnetid,
+			PrefixLength:       &wssdipconfig.Prefixlength,
+			IPAddress:          &wssdipconfig.Ipaddress,
+			Gateway:            &wssdipconfig.Gateway,
+			Primary:            &wssdipconfig.Primary,
+			IPAllocationMethod: ipAllocationMethodProtobufToSdk(wssdipconfig.Allocation),
+			NetworkType:        networkTypeProtobufToSdk(wssdipconfig.NetworkType),
 		},
 	}
 }
 
+func (c *client) getVirtualMachineScaleSetNetworkConfigurationDNSSettings(dns *wssdcommonproto.Dns) *network.DNSSetting {
+	if dns == nil {
+		return nil
+	}
+	return &network.DNSSetting{
+		Servers: &dns.Servers,
+		Domain:  &dns.Domain,
+		Search:  &dns.Search,
+		Options: &dns.Options,
+	}
+}
+
+func networkTypeProtobufToSdk(networkType wssdnetwork.NetworkType) network.NetworkType {
+	switch networkType {
+	case wssdnetwork.NetworkType_LOGICAL_NETWORK:
+		return network.Logical
+	case wssdnetwork.NetworkType_VIRTUAL_NETWORK:
+		return network.Virtual
+	}
+	return network.Virtual
+}
+
+func networkTypeSdkToProtobuf(networkType network.NetworkType) wssdnetwork.NetworkType {
+	switch networkType {
+	case network.Logical:
+		return wssdnetwork.NetworkType_LOGICAL_NETWORK
+	case network.Virtual:
+		return wssdnetwork.NetworkType_VIRTUAL_NETWORK
+	}
+	return wssdnetwork.NetworkType_VIRTUAL_NETWORK
+}
+
+func ipAllocationMethodProtobufToSdk(allocation wssdcommonproto.IPAllocationMethod) network.IPAllocationMethod {
+	switch allocation {
+	case wssdcommonproto.IPAllocationMethod_Static:
+		return network.Static
+	case wssdcommonproto.IPAllocationMethod_Dynamic:
+		return network.Dynamic
+	}
+	return network.Dynamic
+}
+
+func ipAllocationMethodSdkToProtobuf(allocation network.IPAllocationMethod) wssdcommonproto.IPAllocationMethod {
+	switch allocation {
+	case network.Static:
+		return wssdcommonproto.IPAllocationMethod_Static
+	case network.Dynamic:
+		return wssdcommonproto.IPAllocationMethod_Dynamic
+	}
+	return wssdcommonproto.IPAllocationMethod_Dynamic
+}
+
 func (c *client) getVirtualMachineWindowsConfiguration(windowsConfiguration *wssdcompute.WindowsConfiguration) *compute.WindowsConfiguration {
+	if windowsConfiguration == nil || cmp.Equal(windowsConfiguration, wssdcompute.WindowsConfiguration{}) {
+		return nil
+	}
+
 	wc := &compute.WindowsConfiguration{
 		RDP: &compute.RDPConfiguration{},
 	}
-
-	if windowsConfiguration == nil {
-		return wc
+	if windowsConfiguration.WinRMConfiguration != nil && len(windowsConfiguration.WinRMConfiguration.Listeners) >= 1 {
+		listeners := []compute.WinRMListener{}
+		for _, listener := range windowsConfiguration.WinRMConfiguration.Listeners {
+			if listener == nil {
+				continue
+			}
+			protocol := compute.HTTP
+			if listener.Protocol == wssdcommonproto.WinRMProtocolType_HTTPS {
+				protocol = compute.HTTPS
+			}
+			listeners = append(listeners, compute.WinRMListener{
+				Protocol: protocol,
+			})
+		}
+		wc.WinRM = &compute.WinRMConfiguration{
+			Listeners: &listeners,
+		}
 	}
 
 	if windowsConfiguration.RDPConfiguration != nil {
 		wc.RDP.DisableRDP = &windowsConfiguration.RDPConfiguration.DisableRDP
+		rdpPort := uint16(windowsConfiguration.RDPConfiguration.Port)
+		wc.RDP.Port = &rdpPort
 	}
 
 	wc.EnableAutomaticUpdates = &windowsConfiguration.EnableAutomaticUpdates
@@ -364,15 +591,33 @@ func (c *client) getVirtualMachineWindowsConfiguration(windowsConfiguration *wss
 }
 
 func (c *client) getVirtualMachineLinuxConfiguration(linuxConfiguration *wssdcompute.LinuxConfiguration) *compute.LinuxConfiguration {
-	lc := &compute.LinuxConfiguration{
+	if linuxConfiguration == nil || cmp.Equal(linuxConfiguration, wssdcompute.LinuxConfiguration{}) {
+		return nil
+	}
+
+	return &compute.LinuxConfiguration{
 		DisablePasswordAuthentication: &linuxConfiguration.DisablePasswordAuthentication,
 		CloudInitDataSource:           linuxConfiguration.CloudInitDataSource,
 	}
+}
 
-	return lc
+func (c *client) getVirtualMachineProxyConfiguration(proxyConfiguration *wssdcommonproto.ProxyConfiguration) *compute.ProxyConfiguration {
+	if proxyConfiguration == nil {
+		return nil
+	}
+
+	return &compute.ProxyConfiguration{
+		HttpProxy:  &proxyConfiguration.HttpProxy,
+		HttpsProxy: &proxyConfiguration.HttpsProxy,
+		NoProxy:    &proxyConfiguration.NoProxy,
+		TrustedCa:  &proxyConfiguration.TrustedCa,
+	}
 }
 
 func (c *client) getVirtualMachineScaleSetOSProfile(o *wssdcompute.OperatingSystemConfiguration) *compute.OSProfile {
+	if o == nil {
+		return nil
+	}
 	var osBootstrapEngine compute.OperatingSystemBootstrapEngine
 	switch o.OsBootstrapEngine {
 	case wssdcommonproto.OperatingSystemBootstrapEngine_WINDOWS_ANSWER_FILES:
@@ -383,23 +628,59 @@ func (c *client) getVirtualMachineScaleSetOSProfile(o *wssdcompute.OperatingSyst
 		osBootstrapEngine = compute.CloudInit
 	}
 
-	return &compute.OSProfile{
+	osProfile := &compute.OSProfile{
 		ComputerName: &o.ComputerName,
-		// AdminUsername: &o.Administrator.Username,
-		// AdminPassword: &o.Administrator.Password,
-		// Publickeys: &o.Publickeys,
-		// Users : &o.Users,
+		// The administrator password is write-only
 		OsBootstrapEngine:    osBootstrapEngine,
 		WindowsConfiguration: c.getVirtualMachineWindowsConfiguration(o.WindowsConfiguration),
 		LinuxConfiguration:   c.getVirtualMachineLinuxConfiguration(o.LinuxConfiguration),
+		ProxyConfiguration:   c.getVirtualMachineProxyConfiguration(o.ProxyConfiguration),
 	}
+	if o.Administrator != nil {
+		osProfile.AdminUsername = &o.Administrator.Username
+	}
+	if o.CustomData != "" {
+		osProfile.CustomData = &o.CustomData
+	}
+
+	// The public keys are sent from the configuration of the OS type, see getWssdVirtualMachineScaleSetOSConfiguration
+	publicKeys := []compute.SSHPublicKey{}
+	for _, key := range o.Publickeys {
+		if key == nil {
+			continue
+		}
+		publicKeys = append(publicKeys, compute.SSHPublicKey{KeyData: &key.Keydata})
+	}
+	if len(publicKeys) > 0 {
+		ssh := &compute.SSHConfiguration{PublicKeys: &publicKeys}
+		if o.Ostype == wssdcommonproto.OperatingSystemType_LINUX || osProfile.LinuxConfiguration != nil {
+			if osProfile.LinuxConfiguration == nil {
+				osProfile.LinuxConfiguration = &compute.LinuxConfiguration{}
+			}
+			osProfile.LinuxConfiguration.SSH = ssh
+		} else {
+			if osProfile.WindowsConfiguration == nil {
+				osProfile.WindowsConfiguration = &compute.WindowsConfiguration{}
+			}
+			osProfile.WindowsConfiguration.SSH = ssh
+		}
+	}
+	return osProfile
 }
 
 // Conversion from sdk to protobuf
 func (c *client) getWssdVirtualMachineScaleSet(vmss *compute.VirtualMachineScaleSet) (*wssdcompute.VirtualMachineScaleSet, error) {
-	vm, err := c.getWssdVirtualMachineScaleSetVMProfile(vmss.VirtualMachineProfile)
-	if err != nil {
-		return nil, err
+	if vmss.Name == nil {
+		return nil, errors.Wrapf(errors.InvalidInput, "Virtual Machine Scale Set name is missing")
+	}
+
+	var vm *wssdcompute.VirtualMachineProfile
+	if vmss.VirtualMachineScaleSetProperties != nil && vmss.VirtualMachineProfile != nil {
+		var err error
+		vm, err = c.getWssdVirtualMachineScaleSetVMProfile(vmss.VirtualMachineProfile)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	var disableHighAvailability bool = false
@@ -412,12 +693,14 @@ func (c *client) getWssdVirtualMachineScaleSet(vmss *compute.VirtualMachineScale
 		isPlaceholder = *vmss.IsPlaceholder
 	}
 
+	tags, err := c.getWssdVirtualMachineScaleSetTags(vmss)
+	if err != nil {
+		return nil, err
+	}
 	return &wssdcompute.VirtualMachineScaleSet{
-		Name: *(vmss.Name),
-		Sku: &wssdcompute.Sku{
-			Name:     *(vmss.Sku.Name),
-			Capacity: *(vmss.Sku.Capacity),
-		},
+		Name:                    *(vmss.Name),
+		Tags:                    prototags.MapToProto(tags),
+		Sku:                     c.getWssdVirtualMachineScaleSetSku(vmss.Sku),
 		Virtualmachineprofile:   vm,
 		DisableHighAvailability: disableHighAvailability,
 		Entity: &wssdcommonproto.Entity{
@@ -426,104 +709,273 @@ func (c *client) getWssdVirtualMachineScaleSet(vmss *compute.VirtualMachineScale
 	}, nil
 }
 
+// getWssdVirtualMachineScaleSetTags returns the tags of the scale set with the declarations the node agent does not carry:
+// the identity, the upgrade policy, and the priority, eviction policy and boot diagnostics of the profile
+func (c *client) getWssdVirtualMachineScaleSetTags(vmss *compute.VirtualMachineScaleSet) (map[string]*string, error) {
+	for key := range vmss.Tags {
+		switch key {
+		case upgradePolicyTag:
+			return nil, errors.Wrapf(errors.InvalidInput, "Tag [%s] is reserved for the upgrade policy", key)
+		case priorityTag, evictionPolicyTag:
+			return nil, errors.Wrapf(errors.InvalidInput, "Tag [%s] is reserved for the priority of the profile", key)
+		}
+	}
+	var diagnostics *compute.DiagnosticsProfile
+	if vmss.VirtualMachineScaleSetProperties != nil && vmss.VirtualMachineProfile != nil &&
+		vmss.VirtualMachineProfile.VirtualMachineScaleSetVMProfileProperties != nil {
+		diagnostics = vmss.VirtualMachineProfile.DiagnosticsProfile
+	}
+	withDiagnostics, err := compute.BootDiagnosticsToTags(diagnostics, vmss.Tags)
+	if err != nil {
+		return nil, err
+	}
+	withIdentity, err := compute.IdentityToTags(vmss.Identity, withDiagnostics)
+	if err != nil {
+		return nil, err
+	}
+	tags := map[string]*string{}
+	for key, value := range withIdentity {
+		tags[key] = value
+	}
+	if vmss.VirtualMachineScaleSetProperties != nil && vmss.UpgradePolicy != nil {
+		policy, err := json.Marshal(vmss.UpgradePolicy)
+		if err != nil {
+			return nil, errors.Wrapf(errors.InvalidInput, "Invalid upgrade policy: %v", err)
+		}
+		value := string(policy)
+		tags[upgradePolicyTag] = &value
+	}
+	if vmss.VirtualMachineScaleSetProperties == nil || vmss.VirtualMachineProfile == nil ||
+		vmss.VirtualMachineProfile.VirtualMachineScaleSetVMProfileProperties == nil {
+		return tags, nil
+	}
+	profile := vmss.VirtualMachineProfile
+	if profile.Priority != "" {
+		priority := string(profile.Priority)
+		tags[priorityTag] = &priority
+	}
+	if profile.EvictionPolicy != "" {
+		evictionPolicy := string(profile.EvictionPolicy)
+		tags[evictionPolicyTag] = &evictionPolicy
+	}
+	return tags, nil
+}
+
+func (c *client) getWssdVirtualMachineScaleSetSku(sku *compute.Sku) *wssdcompute.Sku {
+	if sku == nil {
+		return nil
+	}
+	wssdsku := &wssdcompute.Sku{}
+	if sku.Name != nil {
+		wssdsku.Name = *sku.Name
+	}
+	if sku.Capacity != nil {
+		wssdsku.Capacity = *sku.Capacity
+	}
+	return wssdsku
+}
+
 func (c *client) getWssdVirtualMachineScaleSetVMProfile(vmp *compute.VirtualMachineScaleSetVMProfile) (*wssdcompute.VirtualMachineProfile, error) {
+	profile := &wssdcompute.VirtualMachineProfile{}
+	if vmp.Name != nil {
+		profile.Vmprefix = *vmp.Name
+	}
+	if vmp.VirtualMachineScaleSetVMProfileProperties == nil {
+		return profile, nil
+	}
+
 	net, err := c.getWssdVirtualMachineScaleSetNetworkConfiguration(vmp.NetworkProfile)
 	if err != nil {
 		return nil, err
 	}
+	hardware, err := c.getWssdVirtualMachineScaleSetHardwareConfiguration(vmp)
+	if err != nil {
+		return nil, err
+	}
+	storage, err := c.getWssdVirtualMachineScaleSetStorageConfiguration(vmp.StorageProfile)
+	if err != nil {
+		return nil, err
+	}
+	os, err := c.getWssdVirtualMachineScaleSetOSConfiguration(vmp.OsProfile)
+	if err != nil {
+		return nil, err
+	}
 
-	return &wssdcompute.VirtualMachineProfile{
-		Vmprefix: *vmp.Name,
-		Hardware: c.getWssdVirtualMachineScaleSetHardwareConfiguration(vmp),
-		Security: c.getWssdVirtualMachineScaleSetSecurityConfiguration(vmp),
-		Storage:  c.getWssdVirtualMachineScaleSetStorageConfiguration(vmp.StorageProfile),
-		Os:       c.getWssdVirtualMachineScaleSetOSConfiguration(vmp.OsProfile),
-		Network:  net,
-	}, nil
+	profile.Hardware = hardware
+	profile.Security = c.getWssdVirtualMachineScaleSetSecurityConfiguration(vmp)
+	profile.Storage = storage
+	profile.Os = os
+	profile.Network = net
+	return profile, nil
 
 }
 
-func (c *client) getWssdVirtualMachineScaleSetHardwareConfiguration(vmp *compute.VirtualMachineScaleSetVMProfile) *wssdcompute.HardwareConfiguration {
+func (c *client) getWssdVirtualMachineScaleSetHardwareConfiguration(vmp *compute.VirtualMachineScaleSetVMProfile) (*wssdcompute.HardwareConfiguration, error) {
 	sizeType := wssdcommonproto.VirtualMachineSizeType_Default
 	var customSize *wssdcommonproto.VirtualMachineCustomSize
+	var dynMemConfig *wssdcommonproto.DynamicMemoryConfiguration
 	var vmGPUs []*wssdcommonproto.VirtualMachineGPU
 	if vmp.HardwareProfile != nil {
-		sizeType = compute.GetWssdVirtualMachineSizeFromVirtualMachineSize(vmp.HardwareProfile.VMSize)
+		var err error
+		sizeType, err = compute.GetSupportedWssdVirtualMachineSize(vmp.HardwareProfile.VMSize)
+		if err != nil {
+			return nil, err
+		}
 		if vmp.HardwareProfile.CustomSize != nil {
+			if vmp.HardwareProfile.CustomSize.CpuCount == nil || vmp.HardwareProfile.CustomSize.MemoryMB == nil {
+				return nil, errors.Wrapf(errors.InvalidInput, "Custom size requires both CpuCount and MemoryMB")
+			}
 			customSize = &wssdcommonproto.VirtualMachineCustomSize{
 				CpuCount: *vmp.HardwareProfile.CustomSize.CpuCount,
 				MemoryMB: *vmp.HardwareProfile.CustomSize.MemoryMB,
 			}
+			if vmp.HardwareProfile.CustomSize.GpuCount != nil {
+				customSize.GpuCount = *vmp.HardwareProfile.CustomSize.GpuCount
+			}
+		}
+		if vmp.HardwareProfile.DynamicMemoryConfig != nil {
+			dynMemConfig = &wssdcommonproto.DynamicMemoryConfiguration{}
+			if vmp.HardwareProfile.DynamicMemoryConfig.MaximumMemoryMB != nil {
+				dynMemConfig.MaximumMemoryMB = *vmp.HardwareProfile.DynamicMemoryConfig.MaximumMemoryMB
+			}
+			if vmp.HardwareProfile.DynamicMemoryConfig.MinimumMemoryMB != nil {
+				dynMemConfig.MinimumMemoryMB = *vmp.HardwareProfile.DynamicMemoryConfig.MinimumMemoryMB
+			}
+			if vmp.HardwareProfile.DynamicMemoryConfig.TargetMemoryBuffer != nil {
+				dynMemConfig.TargetMemoryBuffer = *vmp.HardwareProfile.DynamicMemoryConfig.TargetMemoryBuffer
+			}
 		}
-		if vmp.HardwareProfile.VirtualMachineGPUs != nil {
-			for _, gpu := range vmp.HardwareProfile.VirtualMachineGPUs {
-				if gpu != nil && gpu.Assignment != nil && gpu.PartitionSizeMB != nil && gpu.Name != nil {
-					var assignment wssdcommonproto.AssignmentType
-					switch *gpu.Assignment {
-					case compute.GpuDDA:
-						assignment = wssdcommonproto.AssignmentType_GpuDDA
-					case compute.GpuP:
-						assignment = wssdcommonproto.AssignmentType_GpuP
-					case compute.GpuPV:
-						assignment = wssdcommonproto.AssignmentType_GpuPV
-					case compute.GpuDefault:
-						assignment = wssdcommonproto.AssignmentType_GpuDefault
-					}
-					vmGPU := &wssdcommonproto.VirtualMachineGPU{
-						Assignment:      assignment,
-						PartitionSizeMB: *gpu.PartitionSizeMB,
-						Name:            *gpu.Name,
-					}
-					vmGPUs = append(vmGPUs, vmGPU)
-				}
+		for _, gpu := range vmp.HardwareProfile.VirtualMachineGPUs {
+			if gpu == nil {
+				return nil, errors.Wrapf(errors.InvalidInput, "nil value in Hardware.VirtualMachineGPUs")
+			}
+			if gpu.Assignment == nil {
+				return nil, errors.Wrapf(errors.InvalidInput, "GPU assignment cannot be nil")
+			}
+			var assignment wssdcommonproto.AssignmentType
+			switch *gpu.Assignment {
+			case compute.GpuDDA:
+				assignment = wssdcommonproto.AssignmentType_GpuDDA
+			case compute.GpuP:
+				assignment = wssdcommonproto.AssignmentType_GpuP
+			case compute.GpuPV:
+				assignment = wssdcommonproto.AssignmentType_GpuPV
+			case compute.GpuDefault:
+				assignment = wssdcommonproto.AssignmentType_GpuDefault
+			default:
+				return nil, errors.Wrapf(errors.InvalidInput, "Unsupported GPU assignment [%s]", *gpu.Assignment)
+			}
+			vmGPU := &wssdcommonproto.VirtualMachineGPU{
+				Assignment: assignment,
+			}
+			if gpu.PartitionSizeMB != nil {
+				vmGPU.PartitionSizeMB = *gpu.PartitionSizeMB
 			}
+			if gpu.Name != nil {
+				vmGPU.Name = *gpu.Name
+			}
+			vmGPUs = append(vmGPUs, vmGPU)
 		}
 	}
 	return &wssdcompute.HardwareConfiguration{
-		VMSize:             sizeType,
-		CustomSize:         customSize,
-		VirtualMachineGPUs: vmGPUs,
-	}
+		VMSize:                     sizeType,
+		CustomSize:                 customSize,
+		DynamicMemoryConfiguration: dynMemConfig,
+		VirtualMachineGPUs:         vmGPUs,
+	}, nil
 }
 
 func (c *client) getWssdVirtualMachineScaleSetSecurityConfiguration(vmp *compute.VirtualMachineScaleSetVMProfile) *wssdcompute.SecurityConfiguration {
 	enableTPM := false
+	var uefiSettings *wssdcompute.UefiSettings
+	securityType := wssdcommonproto.SecurityType_NOTCONFIGURED
 	if vmp.SecurityProfile != nil {
-		enableTPM = *vmp.SecurityProfile.EnableTPM
+		if vmp.SecurityProfile.EnableTPM != nil {
+			enableTPM = *vmp.SecurityProfile.EnableTPM
+		}
+		if vmp.SecurityProfile.UefiSettings != nil && vmp.SecurityProfile.UefiSettings.SecureBootEnabled != nil {
+			uefiSettings = &wssdcompute.UefiSettings{
+				SecureBootEnabled: *vmp.SecurityProfile.UefiSettings.SecureBootEnabled,
+			}
+		}
+		switch vmp.SecurityProfile.SecurityType {
+		case compute.TrustedLaunch:
+			securityType = wssdcommonproto.SecurityType_TRUSTEDLAUNCH
+		case compute.ConfidentialVM:
+			securityType = wssdcommonproto.SecurityType_CONFIDENTIALVM
+		}
 	}
 	return &wssdcompute.SecurityConfiguration{
-		EnableTPM: enableTPM,
+		EnableTPM:    enableTPM,
+		UefiSettings: uefiSettings,
+		SecurityType: securityType,
 	}
 }
 
-func (c *client) getWssdVirtualMachineScaleSetStorageConfiguration(s *compute.StorageProfile) *wssdcompute.StorageConfiguration {
-	vmConfigContainerName := ""
+func (c *client) getWssdVirtualMachineScaleSetStorageConfiguration(s *compute.StorageProfile) (*wssdcompute.StorageConfiguration, error) {
+	wssdstorage := &wssdcompute.StorageConfiguration{
+		Osdisk:    &wssdcompute.Disk{},
+		Datadisks: []*wssdcompute.Disk{},
+	}
+	if s == nil {
+		return wssdstorage, nil
+	}
+
 	if s.VmConfigContainerName != nil {
-		vmConfigContainerName = *s.VmConfigContainerName
+		wssdstorage.VmConfigContainerName = *s.VmConfigContainerName
 	}
-	return &wssdcompute.StorageConfiguration{
-		Osdisk:                c.getWssdVirtualMachineScaleSetStorageConfigurationOsDisk(s.OsDisk),
-		Datadisks:             c.getWssdVirtualMachineScaleSetStorageConfigurationDataDisks(s.DataDisks),
-		VmConfigContainerName: vmConfigContainerName,
+	if s.OsDisk != nil {
+		osdisk, err := c.getWssdVirtualMachineScaleSetStorageConfigurationOsDisk(s.OsDisk)
+		if err != nil {
+			return nil, err
+		}
+		wssdstorage.Osdisk = osdisk
 	}
+	datadisks, err := c.getWssdVirtualMachineScaleSetStorageConfigurationDataDisks(s.DataDisks)
+	if err != nil {
+		return nil, err
+	}
+	wssdstorage.Datadisks = datadisks
+
+	return wssdstorage, nil
 }
 
-func (c *client) getWssdVirtualMachineScaleSetStorageConfigurationOsDisk(s *compute.OSDisk) *wssdcompute.Disk {
-	return &wssdcompute.Disk{
-		Diskname: *s.VhdName,
+func (c *client) getWssdVirtualMachineScaleSetStorageConfigurationOsDisk(s *compute.OSDisk) (*wssdcompute.Disk, error) {
+	if s.VhdName == nil {
+		return nil, errors.Wrapf(errors.InvalidInput, "Vhd Name is missing in OSDisk")
+	}
+	var managedDisk *wssdcommonproto.VirtualMachineManagedDiskParameters
+	if s.ManagedDisk != nil {
+		managedDisk = &wssdcommonproto.VirtualMachineManagedDiskParameters{}
+		if s.ManagedDisk.SecurityProfile != nil {
+			securityEncryptionType := wssdcommonproto.SecurityEncryptionTypes_SecurityEncryptionNone
+			if s.ManagedDisk.SecurityProfile.SecurityEncryptionType == compute.NonPersistedTPM {
+				securityEncryptionType = wssdcommonproto.SecurityEncryptionTypes_NonPersistedTPM
+			}
+			managedDisk.SecurityProfile = &wssdcommonproto.VMDiskSecurityProfile{
+				SecurityEncryptionType: securityEncryptionType,
+			}
+		}
 	}
+	return &wssdcompute.Disk{
+		Diskname:    *s.VhdName,
+		ManagedDisk: managedDisk,
+	}, nil
 }
 
-func (c *client) getWssdVirtualMachineScaleSetStorageConfigurationDataDisks(s *[]compute.DataDisk) []*wssdcompute.Disk {
+func (c *client) getWssdVirtualMachineScaleSetStorageConfigurationDataDisks(s *[]compute.DataDisk) ([]*wssdcompute.Disk, error) {
 	datadisks := []*wssdcompute.Disk{}
 	if s == nil {
-		return datadisks
+		return datadisks, nil
 	}
 	for _, d := range *s {
+		if d.VhdName == nil {
+			return nil, errors.Wrapf(errors.InvalidInput, "Vhd Name is missing in DataDisk")
+		}
 		datadisks = append(datadisks, &wssdcompute.Disk{Diskname: *d.VhdName})
 	}
 
-	return datadisks
+	return datadisks, nil
 
 }
 
@@ -552,6 +1004,7 @@ func (c *client) getWssdVirtualMachineScaleSetNetworkConfigurationNetworkInterfa
 	}
 	wssdvnic := &wssdnetwork.VirtualNetworkInterface{
 		Name: nicName,
+		Tags: prototags.MapToProto(nic.Tags),
 	}
 	if nic.VirtualMachineScaleSetNetworkConfigurationProperties == nil ||
 		nic.IPConfigurations == nil ||
@@ -566,6 +1019,7 @@ func (c *client) getWssdVirtualMachineScaleSetNetworkConfigurationNetworkInterfa
 		}
 		wssdvnic.Ipconfigs = append(wssdvnic.Ipconfigs, wssdipconfig)
 	}
+	wssdvnic.DnsSettings = c.getWssdVirtualMachineScaleSetNetworkConfigurationDNSSettings(nic.DNSSettings)
 
 	return wssdvnic, nil
 }
@@ -579,7 +1033,9 @@ func (c *client) getWssdVirtualMachineScaleSetNetworkConfigurationNetworkInterfa
 	}
 
 	wssdipconfig := &wssdnetwork.IpConfiguration{
-		Subnetid: *ipconfig.SubnetID,
+		Subnetid:    *ipconfig.SubnetID,
+		NetworkType: networkTypeSdkToProtobuf(ipconfig.NetworkType),
+		Allocation:  ipAllocationMethodSdkToProtobuf(ipconfig.IPAllocationMethod),
 	}
 
 	if ipconfig.IPAddress != nil {
@@ -588,19 +1044,48 @@ func (c *client) getWssdVirtualMachineScaleSetNetworkConfigurationNetworkInterfa
 	if ipconfig.PrefixLength != nil {
 		wssdipconfig.Prefixlength = *ipconfig.PrefixLength
 	}
+	if ipconfig.Gateway != nil {
+		wssdipconfig.Gateway = *ipconfig.Gateway
+	}
+	if ipconfig.Primary != nil {
+		wssdipconfig.Primary = *ipconfig.Primary
+	}
 
 	return wssdipconfig, nil
 }
 
-func (c *client) getWssdVirtualMachineScaleSetOSSSHPublicKeys(ssh *compute.SSHConfiguration) []*wssdcompute.SSHPublicKey {
+func (c *client) getWssdVirtualMachineScaleSetNetworkConfigurationDNSSettings(dnssetting *network.DNSSetting) *wssdcommonproto.Dns {
+	if dnssetting == nil {
+		return nil
+	}
+	dns := &wssdcommonproto.Dns{}
+	if dnssetting.Servers != nil {
+		dns.Servers = *dnssetting.Servers
+	}
+	if dnssetting.Domain != nil {
+		dns.Domain = *dnssetting.Domain
+	}
+	if dnssetting.Search != nil {
+		dns.Search = *dnssetting.Search
+	}
+	if dnssetting.Options != nil {
+		dns.Options = *dnssetting.Options
+	}
+	return dns
+}
+
+func (c *client) getWssdVirtualMachineScaleSetOSSSHPublicKeys(ssh *compute.SSHConfiguration) ([]*wssdcompute.SSHPublicKey, error) {
 	keys := []*wssdcompute.SSHPublicKey{}
-	if ssh == nil {
-		return keys
+	if ssh == nil || ssh.PublicKeys == nil {
+		return keys, nil
 	}
 	for _, key := range *ssh.PublicKeys {
+		if key.KeyData == nil {
+			return nil, errors.Wrapf(errors.InvalidInput, "SSH KeyData is missing")
+		}
 		keys = append(keys, &wssdcompute.SSHPublicKey{Keydata: *key.KeyData})
 	}
-	return keys
+	return keys, nil
 
 }
 
@@ -613,8 +1098,29 @@ func (c *client) getWssdVirtualMachineWindowsConfiguration(windowsConfiguration
 		return wc
 	}
 
-	if windowsConfiguration.RDP.DisableRDP != nil {
-		wc.RDPConfiguration.DisableRDP = *windowsConfiguration.RDP.DisableRDP
+	if windowsConfiguration.WinRM != nil && windowsConfiguration.WinRM.Listeners != nil && len(*windowsConfiguration.WinRM.Listeners) >= 1 {
+		listeners := make([]*wssdcommonproto.WinRMListener, len(*windowsConfiguration.WinRM.Listeners))
+		for i, listener := range *windowsConfiguration.WinRM.Listeners {
+			protocol := wssdcommonproto.WinRMProtocolType_HTTP
+			if listener.Protocol == compute.HTTPS {
+				protocol = wssdcommonproto.WinRMProtocolType_HTTPS
+			}
+			listeners[i] = &wssdcommonproto.WinRMListener{
+				Protocol: protocol,
+			}
+		}
+		wc.WinRMConfiguration = &wssdcommonproto.WinRMConfiguration{
+			Listeners: listeners,
+		}
+	}
+
+	if windowsConfiguration.RDP != nil {
+		if windowsConfiguration.RDP.DisableRDP != nil {
+			wc.RDPConfiguration.DisableRDP = *windowsConfiguration.RDP.DisableRDP
+		}
+		if windowsConfiguration.RDP.Port != nil {
+			wc.RDPConfiguration.Port = uint32(*windowsConfiguration.RDP.Port)
+		}
 	}
 
 	if windowsConfiguration.EnableAutomaticUpdates != nil {
@@ -640,13 +1146,53 @@ func (c *client) getWssdVirtualMachineLinuxConfiguration(linuxConfiguration *com
 
 }
 
-func (c *client) getWssdVirtualMachineScaleSetOSConfiguration(s *compute.OSProfile) *wssdcompute.OperatingSystemConfiguration {
-	publickeys := []*wssdcompute.SSHPublicKey{}
+func (c *client) getWssdVirtualMachineProxyConfiguration(proxyConfig *compute.ProxyConfiguration) *wssdcommonproto.ProxyConfiguration {
+	if proxyConfig == nil {
+		return nil
+	}
+
+	proxyConfiguration := &wssdcommonproto.ProxyConfiguration{}
+	if proxyConfig.HttpProxy != nil {
+		proxyConfiguration.HttpProxy = *proxyConfig.HttpProxy
+	}
+	if proxyConfig.HttpsProxy != nil {
+		proxyConfiguration.HttpsProxy = *proxyConfig.HttpsProxy
+	}
+	if proxyConfig.NoProxy != nil {
+		proxyConfiguration.NoProxy = *proxyConfig.NoProxy
+	}
+	if proxyConfig.TrustedCa != nil {
+		proxyConfiguration.TrustedCa = *proxyConfig.TrustedCa
+	}
+
+	return proxyConfiguration
+}
+
+func (c *client) getWssdVirtualMachineScaleSetOSConfiguration(s *compute.OSProfile) (*wssdcompute.OperatingSystemConfiguration, error) {
+	osconfig := &wssdcompute.OperatingSystemConfiguration{
+		Users:             []*wssdcompute.UserConfiguration{},
+		Publickeys:        []*wssdcompute.SSHPublicKey{},
+		Ostype:            wssdcommonproto.OperatingSystemType_WINDOWS,
+		OsBootstrapEngine: wssdcommonproto.OperatingSystemBootstrapEngine_CLOUD_INIT,
+	}
+	if s == nil {
+		return osconfig, nil
+	}
+
+	var err error
 	if s.LinuxConfiguration != nil {
-		publickeys = c.getWssdVirtualMachineScaleSetOSSSHPublicKeys(s.LinuxConfiguration.SSH)
+		osconfig.Publickeys, err = c.getWssdVirtualMachineScaleSetOSSSHPublicKeys(s.LinuxConfiguration.SSH)
 	} else if s.WindowsConfiguration != nil {
-		publickeys = c.getWssdVirtualMachineScaleSetOSSSHPublicKeys(s.WindowsConfiguration.SSH)
+		osconfig.Publickeys, err = c.getWssdVirtualMachineScaleSetOSSSHPublicKeys(s.WindowsConfiguration.SSH)
 	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "SSH Configuration Invalid")
+	}
+
+	if s.ComputerName == nil {
+		return nil, errors.Wrapf(errors.InvalidInput, "ComputerName is missing")
+	}
+	osconfig.ComputerName = *s.ComputerName
 
 	adminuser := &wssdcompute.UserConfiguration{}
 	if s.AdminUsername != nil {
@@ -655,44 +1201,25 @@ func (c *client) getWssdVirtualMachineScaleSetOSConfiguration(s *compute.OSProfi
 	if s.AdminPassword != nil {
 		adminuser.Password = *s.AdminPassword
 	}
+	osconfig.Administrator = adminuser
 
-	var osBootstrapEngine wssdcommonproto.OperatingSystemBootstrapEngine
-	switch s.OsBootstrapEngine {
-	case compute.WindowsAnswerFiles:
-		osBootstrapEngine = wssdcommonproto.OperatingSystemBootstrapEngine_WINDOWS_ANSWER_FILES
-	case compute.CloudInit:
-		fallthrough
-	default:
-		osBootstrapEngine = wssdcommonproto.OperatingSystemBootstrapEngine_CLOUD_INIT
+	if s.OsBootstrapEngine == compute.WindowsAnswerFiles {
+		osconfig.OsBootstrapEngine = wssdcommonproto.OperatingSystemBootstrapEngine_WINDOWS_ANSWER_FILES
 	}
 
-	var windowsConfiguration *wssdcompute.WindowsConfiguration = nil
 	if s.WindowsConfiguration != nil {
-		windowsConfiguration = c.getWssdVirtualMachineWindowsConfiguration(s.WindowsConfiguration)
-	}
-
-	var linuxConfiguration *wssdcompute.LinuxConfiguration = nil
-	if s.LinuxConfiguration != nil {
-		linuxConfiguration = c.getWssdVirtualMachineLinuxConfiguration(s.LinuxConfiguration)
-	}
-
-	osconfig := wssdcompute.OperatingSystemConfiguration{
-		ComputerName:         *s.ComputerName,
-		Administrator:        adminuser,
-		Users:                []*wssdcompute.UserConfiguration{},
-		Publickeys:           publickeys,
-		Ostype:               wssdcommonproto.OperatingSystemType_WINDOWS,
-		OsBootstrapEngine:    osBootstrapEngine,
-		WindowsConfiguration: windowsConfiguration,
-		LinuxConfiguration:   linuxConfiguration,
+		osconfig.WindowsConfiguration = c.getWssdVirtualMachineWindowsConfiguration(s.WindowsConfiguration)
 	}
 
 	if s.LinuxConfiguration != nil {
+		osconfig.LinuxConfiguration = c.getWssdVirtualMachineLinuxConfiguration(s.LinuxConfiguration)
 		osconfig.Ostype = wssdcommonproto.OperatingSystemType_LINUX
 	}
 
 	if s.CustomData != nil {
 		osconfig.CustomData = *s.CustomData
 	}
-	return &osconfig
+	osconfig.ProxyConfiguration = c.getWssdVirtualMachineProxyConfiguration(s.ProxyConfiguration)
+
+	return osconfig, nil
 }
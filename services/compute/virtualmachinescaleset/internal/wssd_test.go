@@ -0,0 +1,120 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package internal
+
+import (
+	"testing"
+
+	"github.com/microsoft/moc/pkg/errors"
+	wssdcompute "github.com/microsoft/moc/rpc/nodeagent/compute"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/microsoft/wssd-sdk-for-go/services/compute"
+)
+
+func Test_getOwnedVirtualMachine(t *testing.T) {
+	mine := compute.VirtualMachine{Name: proto.String("vm"), ID: proto.String("id1")}
+	other := compute.VirtualMachine{Name: proto.String("vm"), ID: proto.String("id2")}
+
+	owned, err := getOwnedVirtualMachine("vmss", &wssdcompute.VirtualMachine{Name: "vm", Id: "id1"}, []compute.VirtualMachine{other, mine})
+	assert.Nil(t, err)
+	assert.Equal(t, &mine, owned)
+	owned, err = getOwnedVirtualMachine("vmss", &wssdcompute.VirtualMachine{Name: "vm", Id: "id1"}, []compute.VirtualMachine{other})
+	assert.Nil(t, err)
+	assert.Nil(t, owned)
+	// Without an ID, the instance cannot be told apart from a virtual machine with the same name
+	_, err = getOwnedVirtualMachine("vmss", &wssdcompute.VirtualMachine{Name: "vm"}, []compute.VirtualMachine{other, mine})
+	assert.True(t, errors.IsNotSet(err))
+}
+
+func Test_UpgradePolicyKeptInTags(t *testing.T) {
+	batch := int32(25)
+	vmss := &compute.VirtualMachineScaleSet{
+		Name: proto.String("vmss"),
+		Tags: map[string]*string{"team": proto.String("a")},
+		VirtualMachineScaleSetProperties: &compute.VirtualMachineScaleSetProperties{
+			UpgradePolicy: &compute.UpgradePolicy{
+				Mode:                 compute.UpgradeModeRolling,
+				RollingUpgradePolicy: &compute.RollingUpgradePolicy{MaxBatchPercent: &batch},
+			},
+		},
+	}
+
+	c := client{}
+	// The node agent scale set has no upgrade policy, only the tags
+	wssdvmss, err := c.getWssdVirtualMachineScaleSet(vmss)
+	assert.Nil(t, err)
+	got, err := c.getVirtualMachineScaleSet(&wssdcompute.VirtualMachineScaleSet{Name: wssdvmss.Name, Tags: wssdvmss.Tags})
+	assert.Nil(t, err)
+	assert.Equal(t, vmss.UpgradePolicy, got.UpgradePolicy)
+	assert.Equal(t, vmss.Tags, got.Tags)
+
+	got, err = c.getVirtualMachineScaleSet(&wssdcompute.VirtualMachineScaleSet{Name: "vmss"})
+	assert.Nil(t, err)
+	assert.Nil(t, got.UpgradePolicy)
+
+	// The tag is reserved, with or without an upgrade policy
+	vmss.Tags["wssdsdk.upgradepolicy"] = proto.String("manual")
+	_, err = c.getWssdVirtualMachineScaleSet(vmss)
+	assert.True(t, errors.IsInvalidInput(err))
+	vmss.UpgradePolicy = nil
+	_, err = c.getWssdVirtualMachineScaleSet(vmss)
+	assert.True(t, errors.IsInvalidInput(err))
+}
+
+func Test_BootDiagnosticsKeptInTags(t *testing.T) {
+	vmss := &compute.VirtualMachineScaleSet{
+		Name: proto.String("vmss"),
+		VirtualMachineScaleSetProperties: &compute.VirtualMachineScaleSetProperties{
+			VirtualMachineProfile: &compute.VirtualMachineScaleSetVMProfile{
+				VirtualMachineScaleSetVMProfileProperties: &compute.VirtualMachineScaleSetVMProfileProperties{
+					DiagnosticsProfile: &compute.DiagnosticsProfile{
+						BootDiagnostics: &compute.BootDiagnostics{Enabled: proto.Bool(true), StorageURI: proto.String("https://diag")},
+					},
+				},
+			},
+		},
+	}
+
+	c := client{}
+	wssdvmss, err := c.getWssdVirtualMachineScaleSet(vmss)
+	assert.Nil(t, err)
+	got, err := c.getVirtualMachineScaleSet(wssdvmss)
+	assert.Nil(t, err)
+	assert.Equal(t, vmss.VirtualMachineProfile.DiagnosticsProfile, got.VirtualMachineProfile.DiagnosticsProfile)
+	assert.Empty(t, got.Tags)
+
+	vmss.Tags = map[string]*string{"wssdsdk.bootdiagnostics.enabled": proto.String("false")}
+	_, err = c.getWssdVirtualMachineScaleSet(vmss)
+	assert.True(t, errors.IsInvalidInput(err))
+}
+
+func Test_PriorityKeptInTags(t *testing.T) {
+	vmss := &compute.VirtualMachineScaleSet{
+		Name: proto.String("vmss"),
+		VirtualMachineScaleSetProperties: &compute.VirtualMachineScaleSetProperties{
+			VirtualMachineProfile: &compute.VirtualMachineScaleSetVMProfile{
+				VirtualMachineScaleSetVMProfileProperties: &compute.VirtualMachineScaleSetVMProfileProperties{
+					Priority:       compute.Low,
+					EvictionPolicy: compute.Delete,
+				},
+			},
+		},
+	}
+
+	c := client{}
+	wssdvmss, err := c.getWssdVirtualMachineScaleSet(vmss)
+	assert.Nil(t, err)
+	got, err := c.getVirtualMachineScaleSet(wssdvmss)
+	assert.Nil(t, err)
+	assert.Equal(t, compute.Low, got.VirtualMachineProfile.Priority)
+	assert.Equal(t, compute.Delete, got.VirtualMachineProfile.EvictionPolicy)
+
+	for _, key := range []string{"wssdsdk.priority", "wssdsdk.evictionpolicy"} {
+		vmss.Tags = map[string]*string{key: proto.String("Regular")}
+		_, err = c.getWssdVirtualMachineScaleSet(vmss)
+		assert.True(t, errors.IsInvalidInput(err), key)
+	}
+}
@@ -0,0 +1,264 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package virtualmachinescaleset
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/microsoft/moc/pkg/errors"
+	wssdcommonproto "github.com/microsoft/moc/rpc/common"
+
+	"github.com/microsoft/wssd-sdk-for-go/services/compute"
+)
+
+const (
+	// DefaultRepairGracePeriod is how long an instance stays unhealthy before it is repaired when no grace period is given
+	DefaultRepairGracePeriod = 10 * time.Minute
+	// DefaultRepairInterval is how often Run checks the instances when no interval is given
+	DefaultRepairInterval = time.Minute
+	// maxRepairEvents is the number of events kept by an AutomaticRepair
+	maxRepairEvents = 1000
+)
+
+// HealthProbe checks an instance and returns an error if it is unhealthy
+type HealthProbe func(ctx context.Context, group string, vm *compute.VirtualMachine) error
+
+// AutomaticRepairPolicy controls when unhealthy instances are repaired
+type AutomaticRepairPolicy struct {
+	// GracePeriod - How long an instance must stay unhealthy before it is repaired. Zero uses DefaultRepairGracePeriod.
+	GracePeriod time.Duration
+	// Interval - How often Run checks the instances. Zero uses DefaultRepairInterval.
+	Interval time.Duration
+	// MaxRepairs - The most instances repaired within RateLimitWindow. Zero does not limit repairs.
+	MaxRepairs int
+	// RateLimitWindow - The window MaxRepairs applies to
+	RateLimitWindow time.Duration
+	// Probe - An additional check of running instances
+	Probe HealthProbe
+	// SkipGuestAgentCheck - Do not require the guest agent of an instance to report ready.
+	// Instances that are not running, including stopped ones, are always unhealthy.
+	SkipGuestAgentCheck bool
+	// AdminPasswordReference - The keyvault secret holding the administrator password of the virtual machine profile,
+	// required when the profile has an administrator. See ScaleOptions.AdminPasswordReference.
+	AdminPasswordReference *compute.SecretReference
+}
+
+// RepairEventType is the kind of a repair event
+type RepairEventType string
+
+const (
+	RepairEventUnhealthy   RepairEventType = "Unhealthy"
+	RepairEventRecovered   RepairEventType = "Recovered"
+	RepairEventThrottled   RepairEventType = "Throttled"
+	RepairEventStarted     RepairEventType = "RepairStarted"
+	RepairEventRepaired    RepairEventType = "Repaired"
+	RepairEventFailed      RepairEventType = "RepairFailed"
+	RepairEventCheckFailed RepairEventType = "CheckFailed"
+)
+
+// RepairEvent is an entry of the event log of an AutomaticRepair
+type RepairEvent struct {
+	// Time - When the event happened
+	Time time.Time
+	// Type - What happened
+	Type RepairEventType
+	// InstanceID - The instance concerned, if any
+	InstanceID string
+	// Message - Details, such as why the instance is unhealthy
+	Message string
+}
+
+// AutomaticRepair monitors the instances of a scale set and recreates the ones that stay unhealthy
+type AutomaticRepair struct {
+	client *VirtualMachineScaleSetClient
+	group  string
+	name   string
+	policy AutomaticRepairPolicy
+	now    func() time.Time
+
+	// checking serializes Check. mu only guards the event log, so that Events does not wait for a repair.
+	checking       sync.Mutex
+	unhealthySince map[string]time.Time
+	repairs        []time.Time
+	mu             sync.Mutex
+	events         []RepairEvent
+}
+
+// NewAutomaticRepair returns an AutomaticRepair of the scale set name. Call Run, or Check periodically, to repair instances.
+func (c *VirtualMachineScaleSetClient) NewAutomaticRepair(group, name string, policy AutomaticRepairPolicy) (*AutomaticRepair, error) {
+	if c.vms == nil {
+		return nil, errors.Wrapf(errors.NotInitialized, "Automatic repair needs the virtual machine client")
+	}
+	if len(name) == 0 {
+		return nil, errors.Wrapf(errors.InvalidInput, "Missing scale set name")
+	}
+	if policy.GracePeriod < 0 || policy.Interval < 0 || policy.RateLimitWindow < 0 || policy.MaxRepairs < 0 {
+		return nil, errors.Wrapf(errors.InvalidInput, "Automatic repair policy values cannot be negative")
+	}
+	if policy.MaxRepairs > 0 && policy.RateLimitWindow == 0 {
+		return nil, errors.Wrapf(errors.InvalidInput, "MaxRepairs needs a RateLimitWindow")
+	}
+	if policy.GracePeriod == 0 {
+		policy.GracePeriod = DefaultRepairGracePeriod
+	}
+	if policy.Interval == 0 {
+		policy.Interval = DefaultRepairInterval
+	}
+	return &AutomaticRepair{
+		client:         c,
+		group:          group,
+		name:           name,
+		policy:         policy,
+		now:            time.Now,
+		unhealthySince: map[string]time.Time{},
+	}, nil
+}
+
+// Run checks the instances every policy.Interval until ctx is done
+func (r *AutomaticRepair) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.policy.Interval)
+	defer ticker.Stop()
+	for {
+		r.Check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check evaluates the health of every instance once and repairs the instances unhealthy for longer than the grace
+// period, within the rate limit. It returns the events of this check, which are also added to the event log.
+func (r *AutomaticRepair) Check(ctx context.Context) []RepairEvent {
+	r.checking.Lock()
+	defer r.checking.Unlock()
+
+	events := []RepairEvent{}
+	record := func(eventType RepairEventType, id, message string) {
+		event := RepairEvent{Time: r.now(), Type: eventType, InstanceID: id, Message: message}
+		events = append(events, event)
+		r.addEvent(event)
+	}
+
+	instances, err := r.client.List(ctx, r.group, r.name)
+	if err != nil {
+		record(RepairEventCheckFailed, "", err.Error())
+		return events
+	}
+
+	now := r.now()
+	seen := map[string]bool{}
+	due := []string{}
+	for i := range *instances {
+		id := getInstanceID(&(*instances)[i])
+		seen[id] = true
+		reason := r.getUnhealthyReason(ctx, &(*instances)[i])
+		since, wasUnhealthy := r.unhealthySince[id]
+		switch {
+		case reason == "" && wasUnhealthy:
+			delete(r.unhealthySince, id)
+			record(RepairEventRecovered, id, "")
+		case reason != "" && !wasUnhealthy:
+			r.unhealthySince[id] = now
+			record(RepairEventUnhealthy, id, reason)
+		case reason != "" && now.Sub(since) >= r.policy.GracePeriod:
+			due = append(due, id)
+		}
+	}
+	// Forget the instances that are gone
+	for id := range r.unhealthySince {
+		if !seen[id] {
+			delete(r.unhealthySince, id)
+		}
+	}
+	if len(due) == 0 {
+		return events
+	}
+
+	sort.Strings(due)
+	allowed := r.allowedRepairs(now)
+	if allowed >= 0 && allowed < len(due) {
+		for _, id := range due[allowed:] {
+			record(RepairEventThrottled, id, fmt.Sprintf("At most %d repairs every %s", r.policy.MaxRepairs, r.policy.RateLimitWindow))
+		}
+		due = due[:allowed]
+	}
+	if len(due) == 0 {
+		return events
+	}
+
+	for _, id := range due {
+		record(RepairEventStarted, id, "")
+		r.repairs = append(r.repairs, now)
+	}
+	created, err := r.client.recreateInstances(ctx, r.group, r.name, due, r.policy.AdminPasswordReference)
+	for _, id := range due {
+		delete(r.unhealthySince, id)
+		if err != nil {
+			record(RepairEventFailed, id, err.Error())
+		} else {
+			record(RepairEventRepaired, id, "Replaced by ["+strings.Join(getInstanceIDs(created), ", ")+"]")
+		}
+	}
+	return events
+}
+
+// Events returns a copy of the event log, oldest first
+func (r *AutomaticRepair) Events() []RepairEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]RepairEvent{}, r.events...)
+}
+
+func (r *AutomaticRepair) addEvent(event RepairEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+	if len(r.events) > maxRepairEvents {
+		r.events = append([]RepairEvent{}, r.events[len(r.events)-maxRepairEvents:]...)
+	}
+}
+
+// allowedRepairs returns the number of repairs the rate limit still allows, or -1 if repairs are not limited
+func (r *AutomaticRepair) allowedRepairs(now time.Time) int {
+	if r.policy.MaxRepairs == 0 {
+		return -1
+	}
+	recent := r.repairs[:0]
+	for _, repair := range r.repairs {
+		if now.Sub(repair) < r.policy.RateLimitWindow {
+			recent = append(recent, repair)
+		}
+	}
+	r.repairs = recent
+	if len(recent) >= r.policy.MaxRepairs {
+		return 0
+	}
+	return r.policy.MaxRepairs - len(recent)
+}
+
+// getUnhealthyReason returns why the instance is unhealthy, or an empty string if it is healthy
+func (r *AutomaticRepair) getUnhealthyReason(ctx context.Context, vm *compute.VirtualMachine) string {
+	if failed, state := isProvisioningFailed(vm); failed {
+		return "Provisioning state is " + state
+	}
+	if state := getPowerState(vm); state != wssdcommonproto.PowerState_Running.String() {
+		return "Power state is [" + state + "]"
+	}
+	if !r.policy.SkipGuestAgentCheck && !isInstanceHealthy(vm, false) {
+		return "Guest agent is not ready"
+	}
+	if r.policy.Probe != nil {
+		if err := r.policy.Probe(ctx, r.group, vm); err != nil {
+			return "Health probe failed: " + err.Error()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,87 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package virtualmachinescaleset
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/microsoft/moc/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/microsoft/wssd-sdk-for-go/services/compute"
+)
+
+func repairEventTypes(events []RepairEvent) []string {
+	types := []string{}
+	for _, event := range events {
+		types = append(types, string(event.Type)+":"+event.InstanceID)
+	}
+	return types
+}
+
+func Test_AutomaticRepair(t *testing.T) {
+	setFastInstancePolling(t)
+	c, service := newTestClient(3)
+	r, err := c.NewAutomaticRepair("group", "vmss", AutomaticRepairPolicy{
+		GracePeriod:         5 * time.Minute,
+		MaxRepairs:          1,
+		RateLimitWindow:     time.Hour,
+		SkipGuestAgentCheck: true,
+		Probe: func(ctx context.Context, group string, vm *compute.VirtualMachine) error {
+			if *vm.Name == "vmss-2" {
+				return errors.Failed
+			}
+			return nil
+		},
+	})
+	assert.Nil(t, err)
+	now := time.Unix(0, 0)
+	r.now = func() time.Time { return now }
+
+	assert.Nil(t, c.vms.Stop(context.Background(), "group", "vmss-1"))
+	assert.Equal(t, []string{"Unhealthy:vmss-1", "Unhealthy:vmss-2"}, repairEventTypes(r.Check(context.Background())))
+
+	// Within the grace period
+	now = now.Add(time.Minute)
+	assert.Empty(t, r.Check(context.Background()))
+
+	// One repair per hour
+	now = now.Add(5 * time.Minute)
+	assert.Equal(t, []string{"Throttled:vmss-2", "RepairStarted:vmss-1", "Repaired:vmss-1"}, repairEventTypes(r.Check(context.Background())))
+	assert.Equal(t, []string{"vmss-0", "vmss-2", "vmss-3"}, instanceNames(service))
+
+	now = now.Add(time.Hour)
+	assert.Equal(t, []string{"RepairStarted:vmss-2", "Repaired:vmss-2"}, repairEventTypes(r.Check(context.Background())))
+	assert.Equal(t, []string{"vmss-0", "vmss-3", "vmss-4"}, instanceNames(service))
+	assert.Len(t, r.Events(), 7)
+
+	// The guest agent has not reported on the fake instances
+	r.policy.SkipGuestAgentCheck = false
+	assert.Equal(t, []string{"Unhealthy:vmss-0", "Unhealthy:vmss-3", "Unhealthy:vmss-4"}, repairEventTypes(r.Check(context.Background())))
+}
+
+func Test_AutomaticRepairEventsDuringRepair(t *testing.T) {
+	setFastInstancePolling(t)
+	c, service := newTestClient(1)
+	r, err := c.NewAutomaticRepair("group", "vmss", AutomaticRepairPolicy{GracePeriod: time.Minute, SkipGuestAgentCheck: true})
+	assert.Nil(t, err)
+	now := time.Unix(0, 0)
+	r.now = func() time.Time { return now }
+
+	assert.Nil(t, c.vms.Stop(context.Background(), "group", "vmss-0"))
+	r.Check(context.Background())
+	now = now.Add(time.Minute)
+
+	// Events does not wait for the repair in progress, and reports it started
+	var during []RepairEvent
+	service.onList = func() {
+		if len(service.instances) == 1 && *service.instances[0].Name == "vmss-1" && during == nil {
+			during = r.Events()
+		}
+	}
+	assert.Equal(t, []string{"RepairStarted:vmss-0", "Repaired:vmss-0"}, repairEventTypes(r.Check(context.Background())))
+	assert.Equal(t, []string{"Unhealthy:vmss-0", "RepairStarted:vmss-0"}, repairEventTypes(during))
+}
@@ -0,0 +1,491 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package virtualmachinescaleset
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/microsoft/moc/pkg/errors"
+	wssdcommonproto "github.com/microsoft/moc/rpc/common"
+
+	"github.com/microsoft/wssd-sdk-for-go/services/compute"
+)
+
+const (
+	// DefaultScaleTimeout is how long a scale operation waits for the instances when no timeout is given
+	DefaultScaleTimeout = 30 * time.Minute
+)
+
+// instancePollInterval is how often the instances are read while waiting for a scale operation
+var instancePollInterval = 5 * time.Second
+
+// ScaleInRule is how ScaleIn picks the instances to remove
+type ScaleInRule string
+
+const (
+	// ScaleInNewest - Remove the instances the node agent lists last. The node agent reports no creation time, so the
+	// list order stands in for the creation order.
+	ScaleInNewest ScaleInRule = "Newest"
+	// ScaleInOldest - Remove the instances the node agent lists first
+	ScaleInOldest ScaleInRule = "Oldest"
+	// ScaleInInstances - Remove the instances named in ScaleInPolicy.InstanceIDs
+	ScaleInInstances ScaleInRule = "Instances"
+	// ScaleInZoneBalanced - Remove the last listed instance of the zone with the most instances, one at a time. Ties go to the zone that sorts first.
+	ScaleInZoneBalanced ScaleInRule = "ZoneBalanced"
+	// ScaleInNodeBalanced - Remove the last listed instance of the node with the most instances, one at a time.
+	// Not supported: the node agent does not report the node an instance runs on.
+	ScaleInNodeBalanced ScaleInRule = "NodeBalanced"
+)
+
+// ScaleInPolicy selects the instances removed by ScaleIn
+type ScaleInPolicy struct {
+	// Rule - How to pick the instances. Empty uses ScaleInNewest.
+	Rule ScaleInRule
+	// InstanceIDs - The instances to remove with ScaleInInstances
+	InstanceIDs []string
+}
+
+// ScaleOptions controls how a scale operation waits for the instances
+type ScaleOptions struct {
+	// ScaleInPolicy - The instances SetCapacity removes when it lowers the capacity
+	ScaleInPolicy ScaleInPolicy
+	// Timeout - How long to wait for the instances to reach the desired state. Zero uses DefaultScaleTimeout.
+	Timeout time.Duration
+	// AdminPasswordReference - The keyvault secret holding the administrator password of the virtual machine profile.
+	// Changing the capacity sends the scale set back, and the node agent does not return the password, so it is
+	// required when the profile has an administrator.
+	AdminPasswordReference *compute.SecretReference
+}
+
+// InstanceAction is what a scale or instance operation did to an instance
+type InstanceAction string
+
+const (
+	// InstanceCreated - The instance was added
+	InstanceCreated InstanceAction = "Created"
+	// InstanceDeleted - The instance was removed
+	InstanceDeleted InstanceAction = "Deleted"
+	// InstanceStarted - The instance was started
+	InstanceStarted InstanceAction = "Started"
+	// InstanceStopped - The instance was stopped
+	InstanceStopped InstanceAction = "Stopped"
+	// InstanceRestarted - The instance was restarted
+	InstanceRestarted InstanceAction = "Restarted"
+	// InstanceReimaged - The instance was replaced by a new one created from the current profile
+	InstanceReimaged InstanceAction = "Reimaged"
+)
+
+// InstanceResult is the outcome of a scale or instance operation for a single instance
+type InstanceResult struct {
+	// InstanceID - The name of the instance virtual machine
+	InstanceID string
+	// Action - What was done to the instance
+	Action InstanceAction
+	// PowerState - The last power state observed for a created instance
+	PowerState string
+	// Error - Why the instance did not reach the desired state, if it did not
+	Error error
+}
+
+// ScaleResult describes a scale operation
+type ScaleResult struct {
+	// PreviousCapacity - The capacity before the operation
+	PreviousCapacity int64
+	// Capacity - The capacity requested
+	Capacity int64
+	// Instances - The instances created or deleted
+	Instances []InstanceResult
+	// Duration - Time from the request until the instances reached the desired state
+	Duration time.Duration
+}
+
+// SetCapacity changes the number of instances of the scale set and waits until the added instances are running or the
+// removed ones are gone. Instances are removed following options.ScaleInPolicy.
+func (c *VirtualMachineScaleSetClient) SetCapacity(ctx context.Context, group, name string, capacity int64, options ScaleOptions) (*ScaleResult, error) {
+	if capacity < 0 {
+		return nil, errors.Wrapf(errors.InvalidInput, "Capacity cannot be negative")
+	}
+	vmss, err := c.getVirtualMachineScaleSet(ctx, group, name)
+	if err != nil {
+		return nil, err
+	}
+	current := getCapacity(vmss)
+	if capacity < current {
+		return c.scaleIn(ctx, group, vmss, current-capacity, options.ScaleInPolicy, options)
+	}
+	return c.scaleOut(ctx, group, vmss, capacity-current, options)
+}
+
+// ScaleOut adds count instances to the scale set and waits until they are running
+func (c *VirtualMachineScaleSetClient) ScaleOut(ctx context.Context, group, name string, count int64, options ScaleOptions) (*ScaleResult, error) {
+	if count < 0 {
+		return nil, errors.Wrapf(errors.InvalidInput, "Instance count cannot be negative")
+	}
+	vmss, err := c.getVirtualMachineScaleSet(ctx, group, name)
+	if err != nil {
+		return nil, err
+	}
+	return c.scaleOut(ctx, group, vmss, count, options)
+}
+
+// ScaleIn removes count instances picked by policy from the scale set and waits until they are gone.
+// With ScaleInInstances, a zero count removes every instance in policy.InstanceIDs.
+func (c *VirtualMachineScaleSetClient) ScaleIn(ctx context.Context, group, name string, count int64, policy ScaleInPolicy, options ScaleOptions) (*ScaleResult, error) {
+	if count < 0 {
+		return nil, errors.Wrapf(errors.InvalidInput, "Instance count cannot be negative")
+	}
+	if policy.Rule == ScaleInInstances && count == 0 {
+		count = int64(len(policy.InstanceIDs))
+	}
+	vmss, err := c.getVirtualMachineScaleSet(ctx, group, name)
+	if err != nil {
+		return nil, err
+	}
+	return c.scaleIn(ctx, group, vmss, count, policy, options)
+}
+
+func (c *VirtualMachineScaleSetClient) scaleOut(ctx context.Context, group string, vmss *compute.VirtualMachineScaleSet, count int64, options ScaleOptions) (*ScaleResult, error) {
+	start := time.Now()
+	name := *vmss.Name
+	current := getCapacity(vmss)
+	result := &ScaleResult{PreviousCapacity: current, Capacity: current + count, Instances: []InstanceResult{}}
+	if count == 0 {
+		return result, nil
+	}
+
+	writable, err := c.getWritableScaleSet(ctx, group, vmss, options.AdminPasswordReference)
+	if err != nil {
+		return nil, err
+	}
+	before, err := c.List(ctx, group, name)
+	if err != nil {
+		return nil, err
+	}
+	existing := map[string]bool{}
+	for _, vm := range *before {
+		existing[getInstanceID(&vm)] = true
+	}
+
+	if err = c.setCapacity(ctx, group, writable, result.Capacity); err != nil {
+		return result, err
+	}
+
+	ctx, cancel := withScaleTimeout(ctx, options)
+	defer cancel()
+	err = c.waitForInstances(ctx, group, name, func(instances []compute.VirtualMachine) bool {
+		result.Instances = result.Instances[:0]
+		done := int64(len(instances)) == result.Capacity
+		for i := range instances {
+			id := getInstanceID(&instances[i])
+			if existing[id] {
+				continue
+			}
+			instance := InstanceResult{InstanceID: id, Action: InstanceCreated, PowerState: getPowerState(&instances[i])}
+			if failed, state := isProvisioningFailed(&instances[i]); failed {
+				instance.Error = errors.Wrapf(errors.Failed, "Instance [%s] provisioning state is [%s]", id, state)
+			} else if instance.PowerState != wssdcommonproto.PowerState_Running.String() {
+				done = false
+			}
+			result.Instances = append(result.Instances, instance)
+		}
+		return done
+	})
+	result.Duration = time.Since(start)
+	if err != nil {
+		return result, err
+	}
+	return result, getInstanceResultsError(result.Instances)
+}
+
+func (c *VirtualMachineScaleSetClient) scaleIn(ctx context.Context, group string, vmss *compute.VirtualMachineScaleSet, count int64, policy ScaleInPolicy, options ScaleOptions) (*ScaleResult, error) {
+	start := time.Now()
+	name := *vmss.Name
+	current := getCapacity(vmss)
+	if count > current {
+		return nil, errors.Wrapf(errors.InvalidInput, "Cannot remove %d instances from Virtual Machine Scale Set [%s] with capacity %d", count, name, current)
+	}
+	result := &ScaleResult{PreviousCapacity: current, Capacity: current - count, Instances: []InstanceResult{}}
+	if count == 0 {
+		return result, nil
+	}
+	if c.vms == nil {
+		return nil, errors.Wrapf(errors.NotInitialized, "Scale in needs the virtual machine client")
+	}
+	writable, err := c.getWritableScaleSet(ctx, group, vmss, options.AdminPasswordReference)
+	if err != nil {
+		return nil, err
+	}
+
+	instances, err := c.List(ctx, group, name)
+	if err != nil {
+		return nil, err
+	}
+	victims, err := selectScaleInInstances(*instances, int(count), policy)
+	if err != nil {
+		return nil, err
+	}
+
+	// The selected instances are deleted before the capacity is lowered, so that the node agent does not pick its own
+	removed := map[string]bool{}
+	c.markOwnOperation(group, name, victims, true)
+	for _, id := range victims {
+		instance := InstanceResult{InstanceID: id, Action: InstanceDeleted}
+		if err := c.vms.Delete(ctx, group, id); err != nil && !errors.IsNotFound(err) {
+			instance.Error = err
+			c.unmarkOwnOperation(group, name, id)
+		} else {
+			removed[id] = true
+			c.markOwnOperation(group, name, []string{id}, true)
+		}
+		result.Instances = append(result.Instances, instance)
+	}
+	if err = c.setCapacity(ctx, group, writable, current-int64(len(removed))); err != nil {
+		return result, err
+	}
+	result.Capacity = current - int64(len(removed))
+
+	ctx, cancel := withScaleTimeout(ctx, options)
+	defer cancel()
+	err = c.waitForInstances(ctx, group, name, func(instances []compute.VirtualMachine) bool {
+		if int64(len(instances)) != result.Capacity {
+			return false
+		}
+		for i := range instances {
+			if removed[getInstanceID(&instances[i])] {
+				return false
+			}
+		}
+		return true
+	})
+	result.Duration = time.Since(start)
+	if err != nil {
+		return result, err
+	}
+	return result, getInstanceResultsError(result.Instances)
+}
+
+// selectScaleInInstances returns the names of count instances picked by policy
+func selectScaleInInstances(instances []compute.VirtualMachine, count int, policy ScaleInPolicy) ([]string, error) {
+	ids := make([]string, 0, len(instances))
+	for i := range instances {
+		ids = append(ids, getInstanceID(&instances[i]))
+	}
+
+	switch policy.Rule {
+	case "", ScaleInNewest:
+		victims := []string{}
+		for i := len(ids) - 1; i >= 0 && len(victims) < count; i-- {
+			victims = append(victims, ids[i])
+		}
+		return victims, nil
+	case ScaleInOldest:
+		if count > len(ids) {
+			count = len(ids)
+		}
+		return ids[:count], nil
+	case ScaleInInstances:
+		if len(policy.InstanceIDs) != count {
+			return nil, errors.Wrapf(errors.InvalidInput, "Expected %d instance IDs, got %d", count, len(policy.InstanceIDs))
+		}
+		known := map[string]bool{}
+		for _, id := range ids {
+			known[id] = true
+		}
+		for _, id := range policy.InstanceIDs {
+			if !known[id] {
+				return nil, errors.Wrapf(errors.NotFound, "Instance [%s] is not part of the scale set", id)
+			}
+		}
+		return policy.InstanceIDs, nil
+	case ScaleInZoneBalanced:
+		zones := map[string][]string{}
+		for i := range instances {
+			zone := getInstanceZone(&instances[i])
+			zones[zone] = append(zones[zone], ids[i])
+		}
+		victims := []string{}
+		for len(victims) < count {
+			largest := ""
+			names := make([]string, 0, len(zones))
+			for zone := range zones {
+				names = append(names, zone)
+			}
+			sort.Strings(names)
+			for _, zone := range names {
+				if len(zones[zone]) > len(zones[largest]) {
+					largest = zone
+				}
+			}
+			members := zones[largest]
+			if len(members) == 0 {
+				break
+			}
+			victims = append(victims, members[len(members)-1])
+			zones[largest] = members[:len(members)-1]
+		}
+		return victims, nil
+	case ScaleInNodeBalanced:
+		return nil, errors.Wrapf(errors.NotSupported, "The node agent does not report the node of an instance")
+	default:
+		return nil, errors.Wrapf(errors.InvalidInput, "Unknown scale in rule [%s]", policy.Rule)
+	}
+}
+
+// setCapacity sends the scale set back with the new capacity. vmss comes from getWritableScaleSet.
+func (c *VirtualMachineScaleSetClient) setCapacity(ctx context.Context, group string, vmss *compute.VirtualMachineScaleSet, capacity int64) error {
+	updated := *vmss
+	sku := compute.Sku{}
+	if vmss.Sku != nil {
+		sku = *vmss.Sku
+	}
+	sku.Capacity = &capacity
+	updated.Sku = &sku
+	if _, err := c.CreateOrUpdate(ctx, group, *vmss.Name, &updated); err != nil {
+		return errors.Wrapf(err, "Unable to set the capacity of Virtual Machine Scale Set [%s] to %d", *vmss.Name, capacity)
+	}
+	return nil
+}
+
+// getWritableScaleSet returns vmss, read from the node agent, ready to be sent back. The node agent does not return the
+// administrator password and sending the scale set back without it clears it, so the password is read from
+// passwordReference when the profile has an administrator, and the call fails without one.
+// It is called before any instance is touched, so that a missing password does not leave the scale set half changed.
+func (c *VirtualMachineScaleSetClient) getWritableScaleSet(ctx context.Context, group string, vmss *compute.VirtualMachineScaleSet, passwordReference *compute.SecretReference) (*compute.VirtualMachineScaleSet, error) {
+	if vmss.VirtualMachineScaleSetProperties == nil || vmss.VirtualMachineProfile == nil ||
+		vmss.VirtualMachineProfile.VirtualMachineScaleSetVMProfileProperties == nil || vmss.VirtualMachineProfile.OsProfile == nil ||
+		vmss.VirtualMachineProfile.OsProfile.AdminUsername == nil || len(*vmss.VirtualMachineProfile.OsProfile.AdminUsername) == 0 {
+		return vmss, nil
+	}
+	if passwordReference == nil {
+		return nil, errors.Wrapf(errors.InvalidInput, "The node agent does not return the administrator password of Virtual Machine Scale Set [%s]: missing AdminPasswordReference", *vmss.Name)
+	}
+	osProfile := *vmss.VirtualMachineProfile.OsProfile
+	osProfile.AdminPassword = nil
+	osProfile.AdminPasswordReference = passwordReference
+	resolved, err := compute.ResolveOSProfileSecrets(ctx, c.secrets, group, &osProfile)
+	if err != nil {
+		return nil, err
+	}
+	vmProfileProperties := *vmss.VirtualMachineProfile.VirtualMachineScaleSetVMProfileProperties
+	vmProfileProperties.OsProfile = resolved
+	vmProfile := *vmss.VirtualMachineProfile
+	vmProfile.VirtualMachineScaleSetVMProfileProperties = &vmProfileProperties
+	properties := *vmss.VirtualMachineScaleSetProperties
+	properties.VirtualMachineProfile = &vmProfile
+	writable := *vmss
+	writable.VirtualMachineScaleSetProperties = &properties
+	return &writable, nil
+}
+
+// waitForInstances polls the instances of the scale set until done returns true or ctx is done
+func (c *VirtualMachineScaleSetClient) waitForInstances(ctx context.Context, group, name string, done func([]compute.VirtualMachine) bool) error {
+	ticker := time.NewTicker(instancePollInterval)
+	defer ticker.Stop()
+	for {
+		instances, err := c.List(ctx, group, name)
+		if err != nil {
+			return err
+		}
+		if done(*instances) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(errors.Timeout, "Instances of Virtual Machine Scale Set [%s] did not reach the desired state: %v", name, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *VirtualMachineScaleSetClient) getVirtualMachineScaleSet(ctx context.Context, group, name string) (*compute.VirtualMachineScaleSet, error) {
+	vmsss, err := c.Get(ctx, group, name)
+	if err != nil {
+		return nil, err
+	}
+	if vmsss == nil || len(*vmsss) == 0 {
+		return nil, errors.Wrapf(errors.NotFound, "Unable to find Virtual Machine Scale Set [%s]", name)
+	}
+	vmss := (*vmsss)[0]
+	if vmss.Name == nil {
+		vmss.Name = &name
+	}
+	return &vmss, nil
+}
+
+func withScaleTimeout(ctx context.Context, options ScaleOptions) (context.Context, context.CancelFunc) {
+	timeout := options.Timeout
+	if timeout <= 0 {
+		timeout = DefaultScaleTimeout
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func getCapacity(vmss *compute.VirtualMachineScaleSet) int64 {
+	if vmss.Sku == nil || vmss.Sku.Capacity == nil {
+		return 0
+	}
+	return *vmss.Sku.Capacity
+}
+
+// getInstanceID returns the ID of an instance, which is the name of its virtual machine
+func getInstanceID(vm *compute.VirtualMachine) string {
+	if vm.Name == nil {
+		return ""
+	}
+	return *vm.Name
+}
+
+func getPowerState(vm *compute.VirtualMachine) string {
+	if vm.VirtualMachineProperties == nil {
+		return ""
+	}
+	if state, found := vm.Statuses["PowerState"]; found && state != nil {
+		return *state
+	}
+	return ""
+}
+
+func isProvisioningFailed(vm *compute.VirtualMachine) (bool, string) {
+	if vm.VirtualMachineProperties == nil || vm.ProvisioningState == nil {
+		return false, ""
+	}
+	return strings.HasSuffix(*vm.ProvisioningState, "_FAILED"), *vm.ProvisioningState
+}
+
+// getInstanceZone returns the first zone of an instance, or an empty string if it has none
+func getInstanceZone(vm *compute.VirtualMachine) string {
+	if vm.VirtualMachineProperties == nil || vm.ZoneConfiguration == nil || vm.ZoneConfiguration.Zones == nil {
+		return ""
+	}
+	for _, zone := range *vm.ZoneConfiguration.Zones {
+		if zone.Name != nil {
+			return *zone.Name
+		}
+	}
+	return ""
+}
+
+func getInstanceIDs(instances []InstanceResult) []string {
+	ids := []string{}
+	for _, instance := range instances {
+		ids = append(ids, instance.InstanceID)
+	}
+	return ids
+}
+
+func getInstanceResultsError(instances []InstanceResult) error {
+	failed := []string{}
+	for _, instance := range instances {
+		if instance.Error != nil {
+			failed = append(failed, instance.InstanceID)
+		}
+	}
+	if len(failed) > 0 {
+		return errors.Wrapf(errors.Failed, "Instances [%s] did not reach the desired state", strings.Join(failed, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package virtualmachinescaleset
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/microsoft/moc/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/microsoft/wssd-sdk-for-go/services/compute"
+	"github.com/microsoft/wssd-sdk-for-go/services/security/keyvault"
+)
+
+// fakeSecrets holds secret values by vault and name
+type fakeSecrets map[string]string
+
+func (s fakeSecrets) Get(ctx context.Context, group, name, vaultName string) (*[]keyvault.Secret, error) {
+	value, ok := s[vaultName+"/"+name]
+	if !ok {
+		return nil, errors.Wrapf(errors.NotFound, "%s", name)
+	}
+	return &[]keyvault.Secret{{Name: &name, Value: &value}}, nil
+}
+
+func setFastInstancePolling(t *testing.T) {
+	interval := instancePollInterval
+	instancePollInterval = time.Millisecond
+	t.Cleanup(func() { instancePollInterval = interval })
+}
+
+func Test_ScaleOut(t *testing.T) {
+	setFastInstancePolling(t)
+	c, service := newTestClient(2)
+
+	result, err := c.ScaleOut(context.Background(), "group", "vmss", 2, ScaleOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), result.PreviousCapacity)
+	assert.Equal(t, int64(4), result.Capacity)
+	assert.Equal(t, []InstanceResult{
+		{InstanceID: "vmss-2", Action: InstanceCreated, PowerState: "Running"},
+		{InstanceID: "vmss-3", Action: InstanceCreated, PowerState: "Running"},
+	}, result.Instances)
+	assert.Len(t, service.instances, 4)
+}
+
+func Test_ScaleIn(t *testing.T) {
+	setFastInstancePolling(t)
+	c, service := newTestClient(4)
+
+	result, err := c.ScaleIn(context.Background(), "group", "vmss", 0, ScaleInPolicy{Rule: ScaleInInstances, InstanceIDs: []string{"vmss-1"}}, ScaleOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), result.Capacity)
+	assert.Equal(t, []InstanceResult{{InstanceID: "vmss-1", Action: InstanceDeleted}}, result.Instances)
+	assert.Equal(t, []string{"Get:vmss", "DeleteInstance:vmss-1", "CreateOrUpdate:vmss"}, service.calls)
+	assert.Equal(t, []string{"vmss-0", "vmss-2", "vmss-3"}, instanceNames(service))
+
+	result, err = c.SetCapacity(context.Background(), "group", "vmss", 2, ScaleOptions{ScaleInPolicy: ScaleInPolicy{Rule: ScaleInOldest}})
+	assert.Nil(t, err)
+	assert.Equal(t, "vmss-0", result.Instances[0].InstanceID)
+	assert.Equal(t, []string{"vmss-2", "vmss-3"}, instanceNames(service))
+
+	_, err = c.ScaleIn(context.Background(), "group", "vmss", 3, ScaleInPolicy{}, ScaleOptions{})
+	assert.True(t, errors.IsInvalidInput(err))
+	_, err = c.ScaleIn(context.Background(), "group", "vmss", 1, ScaleInPolicy{Rule: ScaleInNodeBalanced}, ScaleOptions{})
+	assert.True(t, errors.IsNotSupported(err))
+}
+
+func Test_SetCapacityAdminPassword(t *testing.T) {
+	setFastInstancePolling(t)
+	c, service := newTestClient(2)
+	c.secrets = fakeSecrets{"vault/admin": "p@ssw0rd"}
+	// The node agent returns the administrator but not the password
+	service.vmss.VirtualMachineProfile = &compute.VirtualMachineScaleSetVMProfile{
+		VirtualMachineScaleSetVMProfileProperties: &compute.VirtualMachineScaleSetVMProfileProperties{
+			OsProfile: &compute.OSProfile{AdminUsername: proto.String("admin")},
+		},
+	}
+
+	_, err := c.ScaleIn(context.Background(), "group", "vmss", 1, ScaleInPolicy{}, ScaleOptions{})
+	assert.True(t, errors.IsInvalidInput(err))
+	assert.Equal(t, []string{"Get:vmss"}, service.calls, "No instance is deleted without the password")
+
+	reference := &compute.SecretReference{VaultName: proto.String("vault"), SecretName: proto.String("admin")}
+	_, err = c.SetCapacity(context.Background(), "group", "vmss", 1, ScaleOptions{AdminPasswordReference: reference})
+	assert.Nil(t, err)
+	assert.Equal(t, "p@ssw0rd", *service.vmss.VirtualMachineProfile.OsProfile.AdminPassword)
+}
+
+func Test_selectScaleInInstances(t *testing.T) {
+	instance := func(name, zone string) compute.VirtualMachine {
+		return compute.VirtualMachine{Name: proto.String(name), VirtualMachineProperties: &compute.VirtualMachineProperties{
+			ZoneConfiguration: &compute.ZoneConfiguration{Zones: &[]compute.ZoneReference{{Name: proto.String(zone)}}},
+		}}
+	}
+	instances := []compute.VirtualMachine{instance("a", "z1"), instance("b", "z1"), instance("c", "z1"), instance("d", "z2"), instance("e", "z2")}
+
+	victims, err := selectScaleInInstances(instances, 2, ScaleInPolicy{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"e", "d"}, victims)
+
+	victims, err = selectScaleInInstances(instances, 3, ScaleInPolicy{Rule: ScaleInZoneBalanced})
+	assert.Nil(t, err)
+	// Ties go to the zone that sorts first
+	assert.Equal(t, []string{"c", "b", "e"}, victims)
+
+	_, err = selectScaleInInstances(instances, 1, ScaleInPolicy{Rule: ScaleInInstances, InstanceIDs: []string{"x"}})
+	assert.True(t, errors.IsNotFound(err))
+}
+
+func instanceNames(service *fakeService) []string {
+	names := []string{}
+	for _, vm := range service.instances {
+		names = append(names, *vm.Name)
+	}
+	return names
+}
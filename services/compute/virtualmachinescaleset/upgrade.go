@@ -0,0 +1,482 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package virtualmachinescaleset
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/microsoft/moc/pkg/errors"
+	wssdcommonproto "github.com/microsoft/moc/rpc/common"
+
+	"github.com/microsoft/wssd-sdk-for-go/services/compute"
+)
+
+const (
+	// DefaultMaxBatchPercent is the share of instances recreated at once when the policy does not set one
+	DefaultMaxBatchPercent = 20
+	// DefaultMaxUnhealthyPercent is the share of unhealthy instances tolerated when the policy does not set one
+	DefaultMaxUnhealthyPercent = 20
+	// DefaultHealthTimeout is how long a rolling upgrade waits for a batch to become healthy when no timeout is given
+	DefaultHealthTimeout = 10 * time.Minute
+)
+
+// RollingUpgradeState is the state of a rolling upgrade
+type RollingUpgradeState string
+
+const (
+	RollingUpgradeRollingForward RollingUpgradeState = "RollingForward"
+	RollingUpgradePaused         RollingUpgradeState = "Paused"
+	RollingUpgradeCompleted      RollingUpgradeState = "Completed"
+	RollingUpgradeCancelled      RollingUpgradeState = "Cancelled"
+	RollingUpgradeFailed         RollingUpgradeState = "Failed"
+)
+
+// RollingUpgradeOptions controls a rolling upgrade
+type RollingUpgradeOptions struct {
+	// Policy - The batches to use. Nil uses the rolling upgrade policy of the scale set, or all instances at once
+	// for a scale set in Automatic mode.
+	Policy *compute.RollingUpgradePolicy
+	// HealthTimeout - How long to wait for a recreated batch to become healthy. Zero uses DefaultHealthTimeout.
+	HealthTimeout time.Duration
+	// SkipGuestAgentCheck - Consider a running instance healthy without a report from its guest agent
+	SkipGuestAgentCheck bool
+	// AdminPasswordReference - The keyvault secret holding the administrator password of the virtual machine profile,
+	// required when the profile has an administrator. See ScaleOptions.AdminPasswordReference.
+	AdminPasswordReference *compute.SecretReference
+}
+
+// RollingUpgradeStatus is the progress of a rolling upgrade
+type RollingUpgradeStatus struct {
+	// State - The state of the upgrade
+	State RollingUpgradeState
+	// TotalBatches - The number of batches
+	TotalBatches int
+	// CompletedBatches - The number of batches recreated and found healthy
+	CompletedBatches int
+	// UpgradedInstances - The instances created by the upgrade
+	UpgradedInstances []string
+	// PendingInstances - The instances not recreated yet
+	PendingInstances []string
+	// UnhealthyInstances - The instances found unhealthy after the last batch
+	UnhealthyInstances []string
+	// Error - Why the upgrade failed, if it did
+	Error error
+}
+
+// RollingUpgrade tracks a rolling upgrade started by StartRollingUpgrade or UpdateVirtualMachineProfile.
+// Pause and Resume take effect between batches; Cancel stops the batch in progress.
+type RollingUpgrade struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu        sync.Mutex
+	paused    bool
+	resume    chan struct{}
+	cancelled bool
+	status    RollingUpgradeStatus
+}
+
+// UpdateVirtualMachineProfile replaces the virtual machine profile of the scale set and upgrades the existing instances
+// following the upgrade policy of the scale set. It returns nil in Manual mode, which leaves the instances as they are.
+func (c *VirtualMachineScaleSetClient) UpdateVirtualMachineProfile(ctx context.Context, group, name string, profile *compute.VirtualMachineScaleSetVMProfile, options RollingUpgradeOptions) (*RollingUpgrade, error) {
+	if profile == nil {
+		return nil, errors.Wrapf(errors.InvalidInput, "Missing virtual machine profile")
+	}
+	vmss, err := c.getVirtualMachineScaleSet(ctx, group, name)
+	if err != nil {
+		return nil, err
+	}
+	if vmss.VirtualMachineScaleSetProperties == nil {
+		vmss.VirtualMachineScaleSetProperties = &compute.VirtualMachineScaleSetProperties{}
+	}
+	updated := *vmss
+	properties := *vmss.VirtualMachineScaleSetProperties
+	properties.VirtualMachineProfile = profile
+	updated.VirtualMachineScaleSetProperties = &properties
+	if _, err = c.CreateOrUpdate(ctx, group, name, &updated); err != nil {
+		return nil, err
+	}
+
+	switch getUpgradeMode(vmss) {
+	case compute.UpgradeModeManual:
+		return nil, nil
+	case compute.UpgradeModeAutomatic, compute.UpgradeModeRolling:
+		return c.StartRollingUpgrade(ctx, group, name, options)
+	default:
+		return nil, errors.Wrapf(errors.InvalidInput, "Unknown upgrade mode [%s]", getUpgradeMode(vmss))
+	}
+}
+
+// StartRollingUpgrade recreates the instances of the scale set from its current profile, batch by batch, and checks
+// that the instances are running and reported ready by their guest agent between batches.
+// The upgrade stops with RollingUpgradeFailed when more instances are unhealthy than the policy tolerates.
+func (c *VirtualMachineScaleSetClient) StartRollingUpgrade(ctx context.Context, group, name string, options RollingUpgradeOptions) (*RollingUpgrade, error) {
+	if c.vms == nil {
+		return nil, errors.Wrapf(errors.NotInitialized, "Rolling upgrade needs the virtual machine client")
+	}
+	vmss, err := c.getVirtualMachineScaleSet(ctx, group, name)
+	if err != nil {
+		return nil, err
+	}
+	batchPercent, unhealthyPercent, pause, err := getRollingUpgradePolicy(vmss, options.Policy)
+	if err != nil {
+		return nil, err
+	}
+	if options.HealthTimeout < 0 {
+		return nil, errors.Wrapf(errors.InvalidInput, "Health timeout cannot be negative")
+	}
+	if options.HealthTimeout == 0 {
+		options.HealthTimeout = DefaultHealthTimeout
+	}
+
+	instances, err := c.List(ctx, group, name)
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for i := range *instances {
+		ids = append(ids, getInstanceID(&(*instances)[i]))
+	}
+	batches := getBatches(ids, batchPercent)
+	maxUnhealthy := len(ids) * unhealthyPercent / 100
+
+	runCtx, cancel := context.WithCancel(ctx)
+	u := &RollingUpgrade{
+		cancel: cancel,
+		done:   make(chan struct{}),
+		status: RollingUpgradeStatus{
+			State:              RollingUpgradeRollingForward,
+			TotalBatches:       len(batches),
+			UpgradedInstances:  []string{},
+			PendingInstances:   ids,
+			UnhealthyInstances: []string{},
+		},
+	}
+	go u.run(runCtx, c, group, name, batches, maxUnhealthy, pause, options)
+	return u, nil
+}
+
+func (u *RollingUpgrade) run(ctx context.Context, c *VirtualMachineScaleSetClient, group, name string, batches [][]string, maxUnhealthy int, pause time.Duration, options RollingUpgradeOptions) {
+	defer close(u.done)
+	defer u.cancel()
+
+	for i, batch := range batches {
+		if err := u.waitIfPaused(ctx); err != nil {
+			u.finish(ctx, err)
+			return
+		}
+		instances, err := c.recreateInstances(ctx, group, name, batch, options.AdminPasswordReference)
+		created := getInstanceIDs(instances)
+		u.mu.Lock()
+		u.status.UpgradedInstances = append(u.status.UpgradedInstances, created...)
+		u.status.PendingInstances = u.status.PendingInstances[len(batch):]
+		u.mu.Unlock()
+		if err != nil {
+			u.finish(ctx, err)
+			return
+		}
+
+		unhealthy, err := c.waitForHealthyInstances(ctx, group, name, created, options)
+		u.mu.Lock()
+		u.status.UnhealthyInstances = unhealthy
+		u.mu.Unlock()
+		if err != nil {
+			u.finish(ctx, err)
+			return
+		}
+		if len(unhealthy) > maxUnhealthy {
+			u.finish(ctx, errors.Wrapf(errors.Failed, "%d instances are unhealthy after batch %d, at most %d are tolerated", len(unhealthy), i+1, maxUnhealthy))
+			return
+		}
+		u.mu.Lock()
+		u.status.CompletedBatches++
+		u.mu.Unlock()
+
+		if pause > 0 && i < len(batches)-1 {
+			select {
+			case <-ctx.Done():
+				u.finish(ctx, ctx.Err())
+				return
+			case <-time.After(pause):
+			}
+		}
+	}
+	u.finish(ctx, nil)
+}
+
+// finish records the final state of the upgrade
+func (u *RollingUpgrade) finish(ctx context.Context, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	switch {
+	case err == nil:
+		u.status.State = RollingUpgradeCompleted
+	case u.cancelled:
+		u.status.State = RollingUpgradeCancelled
+		u.status.Error = errors.Wrapf(errors.NoActionTaken, "Rolling upgrade was cancelled: %v", err)
+	default:
+		u.status.State = RollingUpgradeFailed
+		u.status.Error = err
+	}
+}
+
+// waitIfPaused blocks while the upgrade is paused
+func (u *RollingUpgrade) waitIfPaused(ctx context.Context) error {
+	u.mu.Lock()
+	if !u.paused {
+		u.mu.Unlock()
+		return ctx.Err()
+	}
+	u.status.State = RollingUpgradePaused
+	resume := u.resume
+	u.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-resume:
+		return nil
+	}
+}
+
+// Pause stops the upgrade once the batch in progress is done
+func (u *RollingUpgrade) Pause() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !u.paused {
+		u.paused = true
+		u.resume = make(chan struct{})
+	}
+}
+
+// Resume continues a paused upgrade
+func (u *RollingUpgrade) Resume() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.paused {
+		u.paused = false
+		close(u.resume)
+		if u.status.State == RollingUpgradePaused {
+			u.status.State = RollingUpgradeRollingForward
+		}
+	}
+}
+
+// Cancel stops the upgrade. Instances of the batch in progress may be left deleted and not yet recreated.
+func (u *RollingUpgrade) Cancel() {
+	u.mu.Lock()
+	u.cancelled = true
+	u.mu.Unlock()
+	u.cancel()
+}
+
+// Done is closed once the upgrade completed, failed or was cancelled
+func (u *RollingUpgrade) Done() <-chan struct{} {
+	return u.done
+}
+
+// Wait blocks until the upgrade is over and returns its error
+func (u *RollingUpgrade) Wait() error {
+	<-u.done
+	return u.Status().Error
+}
+
+// Status returns a copy of the progress of the upgrade
+func (u *RollingUpgrade) Status() RollingUpgradeStatus {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	status := u.status
+	status.UpgradedInstances = append([]string{}, u.status.UpgradedInstances...)
+	status.PendingInstances = append([]string{}, u.status.PendingInstances...)
+	status.UnhealthyInstances = append([]string{}, u.status.UnhealthyInstances...)
+	return status
+}
+
+// recreateInstances deletes the instances ids and sends the scale set back, so that the node agent recreates them from
+// the current profile. It waits until the replacements are running and returns them, with the last power state observed.
+// The administrator password of the profile is read from passwordReference, see getWritableScaleSet.
+func (c *VirtualMachineScaleSetClient) recreateInstances(ctx context.Context, group, name string, ids []string, passwordReference *compute.SecretReference) ([]InstanceResult, error) {
+	vmss, err := c.getVirtualMachineScaleSet(ctx, group, name)
+	if err != nil {
+		return nil, err
+	}
+	if vmss, err = c.getWritableScaleSet(ctx, group, vmss, passwordReference); err != nil {
+		return nil, err
+	}
+	before, err := c.List(ctx, group, name)
+	if err != nil {
+		return nil, err
+	}
+	existing := map[string]bool{}
+	for i := range *before {
+		existing[getInstanceID(&(*before)[i])] = true
+	}
+	removed := map[string]bool{}
+	for _, id := range ids {
+		if !existing[id] {
+			return nil, errors.Wrapf(errors.NotFound, "Instance [%s] is not part of Virtual Machine Scale Set [%s]", id, name)
+		}
+		removed[id] = true
+	}
+
+	c.markOwnOperation(group, name, ids, false)
+	for i, id := range ids {
+		if err := c.vms.Delete(ctx, group, id); err != nil && !errors.IsNotFound(err) {
+			for _, notDeleted := range ids[i:] {
+				c.unmarkOwnOperation(group, name, notDeleted)
+			}
+			return nil, errors.Wrapf(err, "Unable to delete instance [%s]", id)
+		}
+		c.markOwnOperation(group, name, []string{id}, false)
+	}
+	if _, err = c.CreateOrUpdate(ctx, group, name, vmss); err != nil {
+		return nil, errors.Wrapf(err, "Unable to recreate the instances of Virtual Machine Scale Set [%s]", name)
+	}
+
+	capacity := getCapacity(vmss)
+	created := []InstanceResult{}
+	ctx, cancel := withScaleTimeout(ctx, ScaleOptions{})
+	defer cancel()
+	err = c.waitForInstances(ctx, group, name, func(instances []compute.VirtualMachine) bool {
+		created = created[:0]
+		done := int64(len(instances)) == capacity
+		for i := range instances {
+			id := getInstanceID(&instances[i])
+			if removed[id] {
+				done = false
+				continue
+			}
+			if existing[id] {
+				continue
+			}
+			instance := InstanceResult{InstanceID: id, Action: InstanceCreated, PowerState: getPowerState(&instances[i])}
+			if isFailed, state := isProvisioningFailed(&instances[i]); isFailed {
+				instance.Error = errors.Wrapf(errors.Failed, "Instance [%s] provisioning state is [%s]", id, state)
+			} else if instance.PowerState != wssdcommonproto.PowerState_Running.String() {
+				done = false
+			}
+			created = append(created, instance)
+		}
+		return done
+	})
+	if err != nil {
+		return created, err
+	}
+	return created, getInstanceResultsError(created)
+}
+
+// waitForHealthyInstances waits until the instances ids are healthy or options.HealthTimeout expires, and returns
+// every unhealthy instance of the scale set
+func (c *VirtualMachineScaleSetClient) waitForHealthyInstances(ctx context.Context, group, name string, ids []string, options RollingUpgradeOptions) ([]string, error) {
+	wanted := map[string]bool{}
+	for _, id := range ids {
+		wanted[id] = true
+	}
+	unhealthy := []string{}
+	healthCtx, cancel := context.WithTimeout(ctx, options.HealthTimeout)
+	defer cancel()
+	err := c.waitForInstances(healthCtx, group, name, func(instances []compute.VirtualMachine) bool {
+		unhealthy = unhealthy[:0]
+		done := true
+		for i := range instances {
+			if isInstanceHealthy(&instances[i], options.SkipGuestAgentCheck) {
+				continue
+			}
+			id := getInstanceID(&instances[i])
+			unhealthy = append(unhealthy, id)
+			if wanted[id] {
+				done = false
+			}
+		}
+		return done
+	})
+	if err != nil && ctx.Err() != nil {
+		return unhealthy, ctx.Err()
+	}
+	// A batch that did not become healthy in time is judged by the number of unhealthy instances
+	return unhealthy, nil
+}
+
+// isInstanceHealthy returns true if the instance is running and, unless skipGuestAgent is set, its guest agent
+// reported at least one status and no error
+func isInstanceHealthy(vm *compute.VirtualMachine, skipGuestAgent bool) bool {
+	if getPowerState(vm) != wssdcommonproto.PowerState_Running.String() {
+		return false
+	}
+	if failed, _ := isProvisioningFailed(vm); failed {
+		return false
+	}
+	if skipGuestAgent {
+		return true
+	}
+	view := vm.GuestAgentInstanceView
+	if view == nil || len(view.Statuses) == 0 {
+		return false
+	}
+	for _, status := range view.Statuses {
+		if status != nil && status.Level == compute.StatusLevelError {
+			return false
+		}
+	}
+	return true
+}
+
+// getRollingUpgradePolicy returns the batch percent, the unhealthy percent and the pause of the upgrade
+func getRollingUpgradePolicy(vmss *compute.VirtualMachineScaleSet, policy *compute.RollingUpgradePolicy) (int, int, time.Duration, error) {
+	if policy == nil && vmss.VirtualMachineScaleSetProperties != nil && vmss.UpgradePolicy != nil {
+		if vmss.UpgradePolicy.Mode == compute.UpgradeModeAutomatic {
+			return 100, 100, 0, nil
+		}
+		policy = vmss.UpgradePolicy.RollingUpgradePolicy
+	}
+	batchPercent, unhealthyPercent := DefaultMaxBatchPercent, DefaultMaxUnhealthyPercent
+	var pause time.Duration
+	if policy != nil {
+		if policy.MaxBatchPercent != nil {
+			batchPercent = int(*policy.MaxBatchPercent)
+		}
+		if policy.MaxUnhealthyPercent != nil {
+			unhealthyPercent = int(*policy.MaxUnhealthyPercent)
+		}
+		if policy.PauseBetweenBatches != nil {
+			pause = *policy.PauseBetweenBatches
+		}
+	}
+	if batchPercent < 1 || batchPercent > 100 {
+		return 0, 0, 0, errors.Wrapf(errors.InvalidInput, "MaxBatchPercent must be between 1 and 100, got %d", batchPercent)
+	}
+	if unhealthyPercent < 0 || unhealthyPercent > 100 {
+		return 0, 0, 0, errors.Wrapf(errors.InvalidInput, "MaxUnhealthyPercent must be between 0 and 100, got %d", unhealthyPercent)
+	}
+	if pause < 0 {
+		return 0, 0, 0, errors.Wrapf(errors.InvalidInput, "PauseBetweenBatches cannot be negative")
+	}
+	return batchPercent, unhealthyPercent, pause, nil
+}
+
+// getBatches splits ids into batches of at most batchPercent of them, and at least one
+func getBatches(ids []string, batchPercent int) [][]string {
+	size := (len(ids)*batchPercent + 99) / 100
+	if size < 1 {
+		size = 1
+	}
+	batches := [][]string{}
+	for start := 0; start < len(ids); start += size {
+		end := start + size
+		if end > len(ids) {
+			end = len(ids)
+		}
+		batches = append(batches, ids[start:end])
+	}
+	return batches
+}
+
+func getUpgradeMode(vmss *compute.VirtualMachineScaleSet) compute.UpgradeMode {
+	if vmss.VirtualMachineScaleSetProperties == nil || vmss.UpgradePolicy == nil || vmss.UpgradePolicy.Mode == "" {
+		return compute.UpgradeModeManual
+	}
+	return vmss.UpgradePolicy.Mode
+}
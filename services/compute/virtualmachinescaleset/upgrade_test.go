@@ -0,0 +1,86 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package virtualmachinescaleset
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/microsoft/moc/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/microsoft/wssd-sdk-for-go/services/compute"
+)
+
+func int32Ptr(v int32) *int32 {
+	return &v
+}
+
+func Test_RollingUpgrade(t *testing.T) {
+	setFastInstancePolling(t)
+	c, service := newTestClient(4)
+	service.vmss.UpgradePolicy = &compute.UpgradePolicy{
+		Mode:                 compute.UpgradeModeRolling,
+		RollingUpgradePolicy: &compute.RollingUpgradePolicy{MaxBatchPercent: int32Ptr(50)},
+	}
+
+	upgrade, err := c.UpdateVirtualMachineProfile(context.Background(), "group", "vmss", &compute.VirtualMachineScaleSetVMProfile{}, RollingUpgradeOptions{SkipGuestAgentCheck: true})
+	assert.Nil(t, err)
+	assert.Nil(t, upgrade.Wait())
+
+	status := upgrade.Status()
+	assert.Equal(t, RollingUpgradeCompleted, status.State)
+	assert.Equal(t, 2, status.TotalBatches)
+	assert.Equal(t, 2, status.CompletedBatches)
+	assert.Equal(t, []string{"vmss-4", "vmss-5", "vmss-6", "vmss-7"}, status.UpgradedInstances)
+	assert.Empty(t, status.PendingInstances)
+	assert.Equal(t, []string{"vmss-4", "vmss-5", "vmss-6", "vmss-7"}, instanceNames(service))
+	assert.NotNil(t, service.vmss.VirtualMachineProfile)
+}
+
+func Test_RollingUpgradeUnhealthy(t *testing.T) {
+	setFastInstancePolling(t)
+	c, service := newTestClient(2)
+
+	// Instances without a guest agent report are unhealthy
+	upgrade, err := c.StartRollingUpgrade(context.Background(), "group", "vmss", RollingUpgradeOptions{
+		Policy:        &compute.RollingUpgradePolicy{MaxBatchPercent: int32Ptr(50), MaxUnhealthyPercent: int32Ptr(0)},
+		HealthTimeout: 10 * time.Millisecond,
+	})
+	assert.Nil(t, err)
+	assert.True(t, errors.IsFailed(upgrade.Wait()))
+
+	status := upgrade.Status()
+	assert.Equal(t, RollingUpgradeFailed, status.State)
+	assert.Equal(t, 0, status.CompletedBatches)
+	assert.Equal(t, []string{"vmss-1"}, status.PendingInstances)
+	assert.Equal(t, []string{"vmss-1", "vmss-2"}, instanceNames(service))
+}
+
+func Test_RollingUpgradeCancel(t *testing.T) {
+	setFastInstancePolling(t)
+	c, _ := newTestClient(2)
+	pause := time.Hour
+
+	upgrade, err := c.StartRollingUpgrade(context.Background(), "group", "vmss", RollingUpgradeOptions{
+		Policy:              &compute.RollingUpgradePolicy{MaxBatchPercent: int32Ptr(50), PauseBetweenBatches: &pause},
+		SkipGuestAgentCheck: true,
+	})
+	assert.Nil(t, err)
+	upgrade.Cancel()
+	assert.NotNil(t, upgrade.Wait())
+	assert.Equal(t, RollingUpgradeCancelled, upgrade.Status().State)
+
+	_, err = c.StartRollingUpgrade(context.Background(), "group", "vmss", RollingUpgradeOptions{
+		Policy: &compute.RollingUpgradePolicy{MaxBatchPercent: int32Ptr(0)},
+	})
+	assert.True(t, errors.IsInvalidInput(err))
+}
+
+func Test_getBatches(t *testing.T) {
+	assert.Equal(t, [][]string{{"a", "b"}, {"c", "d"}, {"e"}}, getBatches([]string{"a", "b", "c", "d", "e"}, 30))
+	assert.Equal(t, [][]string{{"a"}, {"b"}}, getBatches([]string{"a", "b"}, 1))
+	assert.Equal(t, [][]string{}, getBatches([]string{}, 20))
+}
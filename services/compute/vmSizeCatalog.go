@@ -0,0 +1,168 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package compute
+
+import (
+	"sort"
+	"strings"
+
+	wssdcommon "github.com/microsoft/moc/common"
+	"github.com/microsoft/moc/pkg/errors"
+	"github.com/microsoft/moc/rpc/common"
+)
+
+// VirtualMachineSize describes the shape of a virtual machine size
+type VirtualMachineSize struct {
+	// Name - The size type
+	Name VirtualMachineSizeTypes `json:"name,omitempty"`
+	// CpuCount - Number of virtual CPUs. Nil for custom sizes.
+	CpuCount *int32 `json:"cpucount,omitempty"`
+	// MemoryMB - Memory in MB. Nil for custom sizes.
+	MemoryMB *int32 `json:"memorymb,omitempty"`
+	// GpuCount - Number of GPUs assigned to the size. Nil for custom sizes.
+	GpuCount *int32 `json:"gpucount,omitempty"`
+	// GpuName - The GPU model assigned to the size, if any
+	GpuName *string `json:"gpuname,omitempty"`
+	// GpuAssignment - How GPUs are assigned to the size, if any
+	GpuAssignment *Assignment `json:"gpuassignment,omitempty"`
+	// IsCustom - Whether the shape is supplied through HardwareProfile.CustomSize
+	IsCustom *bool `json:"iscustom,omitempty"`
+}
+
+// HostCapacity describes the resources available on a host. Nil fields are not checked.
+type HostCapacity struct {
+	// CpuCount - Number of available logical processors
+	CpuCount *int32 `json:"cpucount,omitempty"`
+	// MemoryMB - Available memory in MB
+	MemoryMB *int32 `json:"memorymb,omitempty"`
+	// GpuCount - Number of available GPUs
+	GpuCount *int32 `json:"gpucount,omitempty"`
+}
+
+// ListSizes returns every size of the node agent size enumeration whose shape is in the size table of the moc common
+// package, plus the custom sizes, in enumeration order. The table is maintained by hand and may differ from the sizes a
+// given node agent accepts.
+func ListSizes() []VirtualMachineSize {
+	values := make([]int32, 0, len(common.VirtualMachineSizeType_name))
+	for value := range common.VirtualMachineSizeType_name {
+		values = append(values, value)
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+
+	sizes := []VirtualMachineSize{}
+	for _, value := range values {
+		if size, found := getVirtualMachineSize(common.VirtualMachineSizeType(value)); found {
+			sizes = append(sizes, *size)
+		}
+	}
+	return sizes
+}
+
+// GetSize returns the shape of a size
+func GetSize(size VirtualMachineSizeTypes) (*VirtualMachineSize, error) {
+	wssdSize, err := GetSupportedWssdVirtualMachineSize(size)
+	if err != nil {
+		return nil, err
+	}
+	vmSize, found := getVirtualMachineSize(wssdSize)
+	if !found {
+		return nil, errors.Wrapf(errors.NotFound, "The shape of virtual machine size [%s] is not known", size)
+	}
+	return vmSize, nil
+}
+
+// FitsOnHost reports whether a virtual machine of the given size fits in the host capacity.
+// Custom sizes must have CpuCount and MemoryMB filled in, e.g. from HardwareProfile.CustomSize.
+func FitsOnHost(size *VirtualMachineSize, host *HostCapacity) (bool, error) {
+	if size == nil {
+		return false, errors.Wrapf(errors.InvalidInput, "Size is nil")
+	}
+	if size.CpuCount == nil || size.MemoryMB == nil {
+		return false, errors.Wrapf(errors.InvalidInput, "The CPU and memory of size [%s] are not set", size.Name)
+	}
+	if host == nil {
+		return true, nil
+	}
+	if host.CpuCount != nil && *size.CpuCount > *host.CpuCount {
+		return false, nil
+	}
+	if host.MemoryMB != nil && *size.MemoryMB > *host.MemoryMB {
+		return false, nil
+	}
+	if host.GpuCount != nil && size.GpuCount != nil && *size.GpuCount > *host.GpuCount {
+		return false, nil
+	}
+	return true, nil
+}
+
+// SuggestSize returns the smallest predefined size with at least the requested CPUs, memory and GPUs.
+// Sizes with GPUs are only suggested when GPUs are requested.
+func SuggestSize(cpuCount, memoryMB, gpuCount int32) (*VirtualMachineSize, error) {
+	var best *VirtualMachineSize
+	for _, size := range ListSizes() {
+		if *size.IsCustom || size.Name == VirtualMachineSizeTypesDefault {
+			continue
+		}
+		if *size.CpuCount < cpuCount || *size.MemoryMB < memoryMB || *size.GpuCount < gpuCount {
+			continue
+		}
+		if gpuCount == 0 && *size.GpuCount > 0 {
+			continue
+		}
+		if best == nil || isSmallerSize(&size, best) {
+			best = &size
+		}
+	}
+	if best == nil {
+		return nil, errors.Wrapf(errors.NotFound, "No size has %d CPUs, %d MB of memory and %d GPUs", cpuCount, memoryMB, gpuCount)
+	}
+	return best, nil
+}
+
+func isSmallerSize(a, b *VirtualMachineSize) bool {
+	if *a.CpuCount != *b.CpuCount {
+		return *a.CpuCount < *b.CpuCount
+	}
+	if *a.MemoryMB != *b.MemoryMB {
+		return *a.MemoryMB < *b.MemoryMB
+	}
+	return *a.GpuCount < *b.GpuCount
+}
+
+func getVirtualMachineSize(wssdSize common.VirtualMachineSizeType) (*VirtualMachineSize, bool) {
+	name := common.VirtualMachineSizeType_name[int32(wssdSize)]
+	if wssdSize == common.VirtualMachineSizeType_Unsupported || name == "" {
+		return nil, false
+	}
+	if strings.HasPrefix(name, string(VirtualMachineSizeTypesCustom)) {
+		isCustom := true
+		return &VirtualMachineSize{Name: VirtualMachineSizeTypes(name), IsCustom: &isCustom}, true
+	}
+
+	shape, found := wssdcommon.VirtualMachineSize_value[wssdSize]
+	if !found {
+		return nil, false
+	}
+	cpuCount, memoryMB, gpuCount := int32(shape.CpuCount), int32(shape.MemoryMB), int32(shape.GpuCount)
+	isCustom := false
+	size := &VirtualMachineSize{
+		Name:     VirtualMachineSizeTypes(name),
+		CpuCount: &cpuCount,
+		MemoryMB: &memoryMB,
+		GpuCount: &gpuCount,
+		IsCustom: &isCustom,
+	}
+	if shape.GpuName != "" {
+		gpuName := shape.GpuName
+		size.GpuName = &gpuName
+	}
+	if shape.GpuAssignMode == wssdcommon.GpuAssignTypeDDA {
+		assignment := GpuDDA
+		size.GpuAssignment = &assignment
+	} else if shape.GpuAssignMode == wssdcommon.GpuAssignTypeGpuPv {
+		assignment := GpuPV
+		size.GpuAssignment = &assignment
+	}
+	return size, true
+}
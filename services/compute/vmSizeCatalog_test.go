@@ -0,0 +1,94 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package compute
+
+import (
+	"testing"
+
+	"github.com/microsoft/moc/pkg/errors"
+	"github.com/microsoft/moc/rpc/common"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+)
+
+func Test_GetSize(t *testing.T) {
+	size, err := GetSize(VirtualMachineSizeTypesStandardD4sV3)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(4), *size.CpuCount)
+	assert.Equal(t, int32(16384), *size.MemoryMB)
+	assert.Equal(t, int32(0), *size.GpuCount)
+	assert.False(t, *size.IsCustom)
+
+	size, err = GetSize(VirtualMachineSizeTypesStandardNK12)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), *size.GpuCount)
+	assert.Equal(t, GpuDDA, *size.GpuAssignment)
+
+	size, err = GetSize(VirtualMachineSizeTypesCustomNK)
+	assert.NoError(t, err)
+	assert.True(t, *size.IsCustom)
+	assert.Nil(t, size.CpuCount)
+
+	_, err = GetSize(VirtualMachineSizeTypesStandardA0)
+	assert.True(t, errors.IsNotSupported(err))
+}
+
+func Test_ListSizes(t *testing.T) {
+	sizes := ListSizes()
+	assert.Equal(t, VirtualMachineSizeTypesDefault, sizes[0].Name)
+	for _, size := range sizes {
+		_, err := GetSupportedWssdVirtualMachineSize(size.Name)
+		assert.NoError(t, err)
+	}
+}
+
+func Test_GetWssdVirtualMachineSizeFromVirtualMachineSize(t *testing.T) {
+	assert.Equal(t, common.VirtualMachineSizeType_Default, GetWssdVirtualMachineSizeFromVirtualMachineSize(VirtualMachineSizeTypesDefault))
+	assert.Equal(t, common.VirtualMachineSizeType_Unsupported, GetWssdVirtualMachineSizeFromVirtualMachineSize(""))
+	assert.Equal(t, common.VirtualMachineSizeType_Unsupported, GetWssdVirtualMachineSizeFromVirtualMachineSize("Standard_Bogus"))
+}
+
+func Test_GetSupportedWssdVirtualMachineSize(t *testing.T) {
+	size, err := GetSupportedWssdVirtualMachineSize(VirtualMachineSizeTypesDefault)
+	assert.NoError(t, err)
+	assert.Equal(t, common.VirtualMachineSizeType_Default, size)
+
+	_, err = GetSupportedWssdVirtualMachineSize("")
+	assert.True(t, errors.IsInvalidInput(err))
+	_, err = GetSupportedWssdVirtualMachineSize("Unsupported")
+	assert.True(t, errors.IsNotSupported(err))
+	_, err = GetSupportedWssdVirtualMachineSize("Standard_Bogus")
+	assert.True(t, errors.IsNotSupported(err))
+}
+
+func Test_FitsOnHost(t *testing.T) {
+	size, _ := GetSize(VirtualMachineSizeTypesStandardNK6)
+	fits, err := FitsOnHost(size, &HostCapacity{CpuCount: proto.Int32(8), MemoryMB: proto.Int32(16384), GpuCount: proto.Int32(1)})
+	assert.NoError(t, err)
+	assert.True(t, fits)
+
+	fits, _ = FitsOnHost(size, &HostCapacity{CpuCount: proto.Int32(8), GpuCount: proto.Int32(0)})
+	assert.False(t, fits)
+
+	custom, _ := GetSize(VirtualMachineSizeTypesCustom)
+	_, err = FitsOnHost(custom, &HostCapacity{})
+	assert.Error(t, err)
+}
+
+func Test_SuggestSize(t *testing.T) {
+	size, err := SuggestSize(3, 10000, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, VirtualMachineSizeTypesStandardD4sV3, size.Name)
+
+	size, err = SuggestSize(1, 1024, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, VirtualMachineSizeTypesStandardK8S5V1, size.Name)
+
+	size, err = SuggestSize(4, 4096, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), *size.GpuCount)
+
+	_, err = SuggestSize(1024, 1024, 0)
+	assert.True(t, errors.IsNotFound(err))
+}
@@ -4,6 +4,7 @@
 package compute
 
 import (
+	"github.com/microsoft/moc/pkg/errors"
 	"github.com/microsoft/moc/rpc/common"
 )
 
@@ -20,6 +21,20 @@ func GetWssdVirtualMachineSizeFromVirtualMachineSize(size VirtualMachineSizeType
 	return common.VirtualMachineSizeType(value)
 }
 
+// GetSupportedWssdVirtualMachineSize converts an sdk size to the node agent size like
+// GetWssdVirtualMachineSizeFromVirtualMachineSize, but fails with NotSupported instead of returning Unsupported,
+// and with InvalidInput for an empty size.
+func GetSupportedWssdVirtualMachineSize(size VirtualMachineSizeTypes) (common.VirtualMachineSizeType, error) {
+	if size == "" {
+		return common.VirtualMachineSizeType_Unsupported, errors.Wrapf(errors.InvalidInput, "Virtual machine size is missing")
+	}
+	value := GetWssdVirtualMachineSizeFromVirtualMachineSize(size)
+	if value == common.VirtualMachineSizeType_Unsupported {
+		return value, errors.Wrapf(errors.NotSupported, "Unsupported virtual machine size [%s]", size)
+	}
+	return value, nil
+}
+
 func GetVirtualMachineSizeFromWssdVirtualMachineSize(size common.VirtualMachineSizeType) VirtualMachineSizeTypes {
 	sizeInt := int32(size)
 	value, found := common.VirtualMachineSizeType_name[sizeInt]
@@ -35,6 +50,7 @@ type VirtualMachineSizeTypes string
 // For more information about virtual machine sizes, see 'Sizes for virtual machines':
 //  https://docs.microsoft.com/en-us/azure/virtual-machines/windows/sizes
 //  NOTE: Kubernetes requires 2 CPU cores. [ERROR NumCPU]: the number of available CPUs 1 is less than the required 2.
+//  NOTE: ListSizes and GetSize return the shapes below programmatically, from the size table of the moc common package.
 /*
 The following Size Types are supported:
 
@@ -0,0 +1,124 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package internal
+
+import (
+	"math/rand"
+	"testing"
+
+	wssdnetwork "github.com/microsoft/moc/rpc/nodeagent/network"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/microsoft/wssd-sdk-for-go/internal/roundtrip"
+	"github.com/microsoft/wssd-sdk-for-go/services/network"
+)
+
+func Test_VirtualNetworkInterfaceRoundTrip(t *testing.T) {
+	for seed := int64(0); seed < 500; seed++ {
+		checkVirtualNetworkInterfaceRoundTrip(t, seed, false)
+		checkVirtualNetworkInterfaceRoundTrip(t, seed, true)
+		checkWssdVirtualNetworkInterfaceRoundTrip(t, seed)
+	}
+}
+
+func FuzzVirtualNetworkInterfaceRoundTrip(f *testing.F) {
+	f.Add(int64(0), false)
+	f.Add(int64(1), true)
+	f.Fuzz(func(t *testing.T, seed int64, sparse bool) {
+		checkVirtualNetworkInterfaceRoundTrip(t, seed, sparse)
+		checkWssdVirtualNetworkInterfaceRoundTrip(t, seed)
+	})
+}
+
+// checkVirtualNetworkInterfaceRoundTrip converts a random spec to protobuf and back. A sparse spec may be rejected, a full one must not be.
+func checkVirtualNetworkInterfaceRoundTrip(t *testing.T, seed int64, sparse bool) {
+	r := rand.New(rand.NewSource(seed))
+	vnic := &network.VirtualNetworkInterface{}
+	if sparse {
+		roundtrip.FillSparse(vnic, r)
+	} else {
+		roundtrip.Fill(vnic, r)
+	}
+	canonicalizeVirtualNetworkInterface(vnic, r)
+
+	c := client{}
+	wssdvnic, err := c.getWssdVirtualNetworkInterface(vnic)
+	if sparse && err != nil {
+		return
+	}
+	if !assert.Nil(t, err, "seed %d", seed) {
+		return
+	}
+	got, err := c.getVirtualNetworkInterface("", "", wssdvnic)
+	assert.Nil(t, err, "seed %d", seed)
+	clearVirtualNetworkInterfaceOutputs(got)
+	assert.Nil(t, roundtrip.Diff(vnic, got), "seed %d", seed)
+}
+
+// checkWssdVirtualNetworkInterfaceRoundTrip converts a random node agent network interface to the SDK and back. The SDK view
+// must not change.
+func checkWssdVirtualNetworkInterfaceRoundTrip(t *testing.T, seed int64) {
+	r := rand.New(rand.NewSource(seed))
+	wssdvnic := &wssdnetwork.VirtualNetworkInterface{}
+	roundtrip.FillSparse(wssdvnic, r)
+
+	c := client{}
+	vnic, err := c.getVirtualNetworkInterface("", "", wssdvnic)
+	if !assert.Nil(t, err, "seed %d", seed) {
+		return
+	}
+	clearVirtualNetworkInterfaceOutputs(vnic)
+	wssdvnic, err = c.getWssdVirtualNetworkInterface(vnic)
+	if err != nil {
+		return
+	}
+	got, err := c.getVirtualNetworkInterface("", "", wssdvnic)
+	assert.Nil(t, err, "seed %d", seed)
+	clearVirtualNetworkInterfaceOutputs(got)
+	assert.Nil(t, roundtrip.Diff(vnic, got), "seed %d", seed)
+}
+
+// canonicalizeVirtualNetworkInterface replaces random values with valid ones and clears the fields the node agent does not carry
+func canonicalizeVirtualNetworkInterface(vnic *network.VirtualNetworkInterface, r *rand.Rand) {
+	clearVirtualNetworkInterfaceOutputs(vnic)
+	if vnic.VirtualNetworkInterfaceProperties == nil {
+		return
+	}
+	// Not carried: the virtual network and routes come from the subnet, and the guards are not configurable on the node
+	vnic.VirtualNetwork = nil
+	vnic.Routes = nil
+	vnic.EnableIPForwarding = nil
+	vnic.EnableMACSpoofing = nil
+	vnic.EnableDHCPGuard = nil
+	vnic.EnableRouterAdvertisementGuard = nil
+	if vnic.IPConfigurations == nil {
+		return
+	}
+	for i := range *vnic.IPConfigurations {
+		ipconfig := &(*vnic.IPConfigurations)[i]
+		// Not carried: IP configurations are not resources of their own, and load balancing is configured elsewhere
+		ipconfig.ID = nil
+		ipconfig.Name = nil
+		ipconfig.Type = nil
+		ipconfig.Tags = nil
+		if ipconfig.IPConfigurationProperties == nil {
+			continue
+		}
+		ipconfig.VirtualNetworkInterfaceID = nil
+		ipconfig.LoadBalancerBackendAddressPoolIDs = nil
+		ipconfig.LoadBalancerInboundNatPoolIDs = nil
+		ipconfig.NetworkType = []network.NetworkType{network.Virtual, network.Logical}[r.Intn(2)]
+		ipconfig.IPAllocationMethod = []network.IPAllocationMethod{network.Static, network.Dynamic}[r.Intn(2)]
+	}
+}
+
+func clearVirtualNetworkInterfaceOutputs(vnic *network.VirtualNetworkInterface) {
+	vnic.ID = nil
+	vnic.Type = nil
+	if vnic.VirtualNetworkInterfaceProperties == nil {
+		return
+	}
+	vnic.ProvisioningState = nil
+	vnic.Statuses = nil
+}
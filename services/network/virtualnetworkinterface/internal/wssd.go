@@ -195,17 +195,22 @@ func (c *client) getVirtualNetworkInterfacesFromResponse(group string, response
 
 // Conversion functions from network interface to wssd network interface
 func (cc *client) getWssdVirtualNetworkInterface(c *network.VirtualNetworkInterface) (*wssdnetwork.VirtualNetworkInterface, error) {
+	if c.Name == nil {
+		return nil, errors.Wrapf(errors.InvalidInput, "Network Interface name is missing")
+	}
 	if c.VirtualNetworkInterfaceProperties == nil {
 		return nil, errors.Wrapf(errors.InvalidInput, "Missing Network Interface Properties")
 	}
 
 	wssdipconfigs := []*wssdnetwork.IpConfiguration{}
-	for _, ipconfig := range *c.IPConfigurations {
-		wssdipconfig, err := cc.getWssdNetworkInterfaceIPConfig(&ipconfig)
-		if err != nil {
-			return nil, err
+	if c.IPConfigurations != nil {
+		for _, ipconfig := range *c.IPConfigurations {
+			wssdipconfig, err := cc.getWssdNetworkInterfaceIPConfig(&ipconfig)
+			if err != nil {
+				return nil, err
+			}
+			wssdipconfigs = append(wssdipconfigs, wssdipconfig)
 		}
-		wssdipconfigs = append(wssdipconfigs, wssdipconfig)
 	}
 
 	vnic := &wssdnetwork.VirtualNetworkInterface{
@@ -308,6 +313,9 @@ func (c *client) getWssdNetworkInterfaceIPConfig(ipconfig *network.IPConfigurati
 	if ipconfig.Gateway != nil {
 		wssdipconfig.Gateway = *ipconfig.Gateway
 	}
+	if ipconfig.Primary != nil {
+		wssdipconfig.Primary = *ipconfig.Primary
+	}
 	wssdipconfig.Allocation = ipAllocationMethodSdkToProtobuf(ipconfig.IPAllocationMethod)
 
 	return wssdipconfig, nil
@@ -345,9 +353,6 @@ func (cc *client) getDns(dnssetting *network.DNSSetting) *wssdcommonproto.Dns {
 	if dnssetting.Domain != nil {
 		dns.Domain = *dnssetting.Domain
 	}
-	if dnssetting.Domain != nil {
-		dns.Domain = *dnssetting.Domain
-	}
 	if dnssetting.Search != nil {
 		dns.Search = *dnssetting.Search
 	}
@@ -388,12 +393,16 @@ func (c *client) getNetworkIpConfigs(wssdipconfigs []*wssdnetwork.IpConfiguratio
 	ipconfigs := []network.IPConfiguration{}
 
 	for _, wssdipconfig := range wssdipconfigs {
+		if wssdipconfig == nil {
+			continue
+		}
 		ipconfigs = append(ipconfigs, network.IPConfiguration{
 			IPConfigurationProperties: &network.IPConfigurationProperties{
 				IPAddress:          &wssdipconfig.Ipaddress,
 				PrefixLength:       &wssdipconfig.Prefixlength,
 				SubnetID:           &wssdipconfig.Subnetid,
 				Gateway:            &wssdipconfig.Gateway,
+				Primary:            &wssdipconfig.Primary,
 				IPAllocationMethod: ipAllocationMethodProtobufToSdk(wssdipconfig.Allocation),
 				NetworkType:        networkTypeProtobufToSdk(wssdipconfig.NetworkType),
 			},
@@ -27,7 +27,7 @@ type Secret struct {
 	// Tags - Custom resource tags
 	Tags map[string]*string `json:"tags"`
 	// Value
-	Value *string `json:"value"`
+	Value *string `json:"value" sensitive:"true"`
 	// Properties
 	*SecretProperties `json:"properties,omitempty"`
 }
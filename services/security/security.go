@@ -13,7 +13,7 @@ const (
 
 // KeyVaultProperties defines the structure of a Security Item
 type KeyVaultProperties struct {
-	SecretMap map[string]*string `json:"secretmap"`
+	SecretMap map[string]*string `json:"secretmap" sensitive:"true"`
 	// State - State would container ProvisioningState-SubState
 	Statuses map[string]*string `json:"statuses"`
 	// ProvisioningState - READ-ONLY; The provisioning state, which only appears in the response.
@@ -55,11 +55,11 @@ type Identity struct {
 	// Tags - Custom resource tags
 	Tags map[string]*string `json:"tags"`
 	// Certificate string encoded in base64
-	Certificate *string `json:"certificate,omitempty"`
+	Certificate *string `json:"certificate,omitempty" sensitive:"true"`
 	// Token Expiry
 	TokenExpiry *int64 `json:"tokenexpiry,omitempty"`
 	// Token
-	Token *string `json:"token,omitempty"`
+	Token *string `json:"token,omitempty" sensitive:"true"`
 	// Properties
 	*IdentityProperties `json:"properties,omitempty"`
 }
@@ -115,9 +115,9 @@ type CertificateRequest struct {
 	// CaName - The ca certificate name to sign the certificate
 	CaName *string `json:"caname,omitempty"`
 	// PrivateKey Key contents of RSA Private Key string encoded in base64
-	PrivateKey *string `json:"privatekey,omitempty"`
+	PrivateKey *string `json:"privatekey,omitempty" sensitive:"true"`
 	// OldCertificate Certificate contents of x509 certificate string to be renewed encoded in base64
-	OldCertificate *string `json:"oldcert,omitempty"`
+	OldCertificate *string `json:"oldcert,omitempty" sensitive:"true"`
 	// ServerAuth - If the certificate to have ServerAuth for mTLS
 	ServerAuth *bool `json:"serverauth,omitempty"`
 	// Attributes - The certificate attributes.
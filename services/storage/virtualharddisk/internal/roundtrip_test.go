@@ -0,0 +1,116 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license
+
+package internal
+
+import (
+	"math/rand"
+	"testing"
+
+	wssdstorage "github.com/microsoft/moc/rpc/nodeagent/storage"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/microsoft/wssd-sdk-for-go/internal/roundtrip"
+	"github.com/microsoft/wssd-sdk-for-go/services/storage"
+)
+
+func Test_VirtualHardDiskRoundTrip(t *testing.T) {
+	for seed := int64(0); seed < 500; seed++ {
+		checkVirtualHardDiskRoundTrip(t, seed, false)
+		checkVirtualHardDiskRoundTrip(t, seed, true)
+		checkWssdVirtualHardDiskRoundTrip(t, seed)
+	}
+}
+
+func FuzzVirtualHardDiskRoundTrip(f *testing.F) {
+	f.Add(int64(0), false)
+	f.Add(int64(1), true)
+	f.Fuzz(func(t *testing.T, seed int64, sparse bool) {
+		checkVirtualHardDiskRoundTrip(t, seed, sparse)
+		checkWssdVirtualHardDiskRoundTrip(t, seed)
+	})
+}
+
+// checkVirtualHardDiskRoundTrip converts a random spec to protobuf and back. A sparse spec may be rejected, a full one must not be.
+func checkVirtualHardDiskRoundTrip(t *testing.T, seed int64, sparse bool) {
+	r := rand.New(rand.NewSource(seed))
+	vhd := &storage.VirtualHardDisk{}
+	if sparse {
+		roundtrip.FillSparse(vhd, r)
+	} else {
+		roundtrip.Fill(vhd, r)
+	}
+	canonicalizeVirtualHardDisk(vhd, r)
+
+	wssdvhd, err := getWssdVirtualHardDisk("", vhd)
+	if sparse && err != nil {
+		return
+	}
+	if !assert.Nil(t, err, "seed %d", seed) {
+		return
+	}
+	got := getVirtualHardDisk(wssdvhd)
+	clearVirtualHardDiskOutputs(got)
+	assert.Nil(t, roundtrip.Diff(vhd, got), "seed %d", seed)
+}
+
+// checkWssdVirtualHardDiskRoundTrip converts a random node agent virtual hard disk to the SDK and back. The SDK view must not change.
+func checkWssdVirtualHardDiskRoundTrip(t *testing.T, seed int64) {
+	r := rand.New(rand.NewSource(seed))
+	wssdvhd := &wssdstorage.VirtualHardDisk{}
+	roundtrip.FillSparse(wssdvhd, r)
+	wssdvhd.Virtualharddisktype = wssdstorage.VirtualHardDiskType(r.Intn(len(wssdstorage.VirtualHardDiskType_name)))
+
+	vhd := getVirtualHardDisk(wssdvhd)
+	clearVirtualHardDiskOutputs(vhd)
+	vhd.ContainerName = nil
+	clearUncarriedVirtualHardDiskFields(vhd)
+	wssdvhd, err := getWssdVirtualHardDisk("", vhd)
+	if err != nil {
+		return
+	}
+	got := getVirtualHardDisk(wssdvhd)
+	clearVirtualHardDiskOutputs(got)
+	assert.Nil(t, roundtrip.Diff(vhd, got), "seed %d", seed)
+}
+
+// canonicalizeVirtualHardDisk replaces random values with valid ones and clears the fields the node agent does not take
+func canonicalizeVirtualHardDisk(vhd *storage.VirtualHardDisk, r *rand.Rand) {
+	clearVirtualHardDiskOutputs(vhd)
+	if vhd.VirtualHardDiskProperties == nil {
+		vhd.VirtualHardDiskProperties = &storage.VirtualHardDiskProperties{}
+	}
+	vhd.Virtualharddisktype = wssdstorage.VirtualHardDiskType_name[int32(r.Intn(len(wssdstorage.VirtualHardDiskType_name)))]
+	// Not carried: the container comes from the client
+	vhd.ContainerName = nil
+	clearUncarriedVirtualHardDiskFields(vhd)
+}
+
+// clearUncarriedVirtualHardDiskFields clears the fields that are only sent for the other disk type
+func clearUncarriedVirtualHardDiskFields(vhd *storage.VirtualHardDisk) {
+	if vhd.Virtualharddisktype == wssdstorage.VirtualHardDiskType_OS_VIRTUALHARDDISK.String() {
+		// The size and format of an OS disk are taken from its source
+		vhd.DiskSizeBytes = nil
+		vhd.Dynamic = nil
+		vhd.Blocksizebytes = nil
+		vhd.Logicalsectorbytes = nil
+		vhd.Physicalsectorbytes = nil
+		vhd.VirtualMachineName = nil
+	} else {
+		vhd.CloudInitDataSource = 0
+	}
+}
+
+func clearVirtualHardDiskOutputs(vhd *storage.VirtualHardDisk) {
+	vhd.ID = nil
+	vhd.Type = nil
+	if vhd.VirtualHardDiskProperties == nil {
+		return
+	}
+	vhd.Controllernumber = nil
+	vhd.Controllerlocation = nil
+	vhd.Disknumber = nil
+	vhd.Scsipath = nil
+	vhd.ProvisioningState = nil
+	vhd.Statuses = nil
+}